@@ -10,9 +10,12 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/cookiejar"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/demisto/download/domain"
 )
@@ -37,23 +40,30 @@ type Client struct {
 	password    string
 	server      string
 	token       string
+	// apiKey is sent instead of the session cookie and XSRF token when set
+	apiKey string
 }
 
 // New client that does not do anything yet before the login
 func New(username, password, server string, insecure bool) (*Client, error) {
-	if username == "" || password == "" || server == "" {
+	if username == "" || password == "" {
 		return nil, errors.New("Please provide all the parameters")
 	}
-	if !strings.HasSuffix(server, "/") {
-		server += "/"
+	c, err := NewAnonymous(server, insecure)
+	if err != nil {
+		return nil, err
 	}
-	cookieJar, _ := cookiejar.New(nil)
-	c := &Client{Client: &http.Client{Jar: cookieJar}, credentials: &credentials{User: username, Password: password}, server: server}
-	if insecure {
-		c.Client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	c.credentials = &credentials{User: username, Password: password}
+	return c, nil
+}
+
+// NewAnonymous returns a client for the requests that do not need to login, like resetting a forgotten password
+func NewAnonymous(server string, insecure bool) (*Client, error) {
+	if server == "" {
+		return nil, errors.New("Please provide all the parameters")
 	}
-	c.Jar = cookieJar
-	req, err := http.NewRequest("GET", server, nil)
+	c := newClient(server, insecure)
+	req, err := http.NewRequest("GET", c.server, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -70,6 +80,28 @@ func New(username, password, server string, insecure bool) (*Client, error) {
 	return c, nil
 }
 
+// NewWithAPIKey returns a client that authenticates every request with the API key and does not need to login
+func NewWithAPIKey(apiKey, server string, insecure bool) (*Client, error) {
+	if apiKey == "" || server == "" {
+		return nil, errors.New("Please provide all the parameters")
+	}
+	c := newClient(server, insecure)
+	c.apiKey = apiKey
+	return c, nil
+}
+
+func newClient(server string, insecure bool) *Client {
+	if !strings.HasSuffix(server, "/") {
+		server += "/"
+	}
+	cookieJar, _ := cookiejar.New(nil)
+	c := &Client{Client: &http.Client{Jar: cookieJar}, server: server}
+	if insecure {
+		c.Client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	return c
+}
+
 // handleError will handle responses with status code different from success
 func (c *Client) handleError(resp *http.Response) error {
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
@@ -79,9 +111,18 @@ func (c *Client) handleError(resp *http.Response) error {
 }
 
 func (c *Client) req(method, path, contentType string, body io.Reader, result interface{}) error {
+	_, err := c.reqWithHeader(method, path, contentType, body, nil, result)
+	return err
+}
+
+// reqWithHeader sends the request with the additional header and returns the header of the response
+func (c *Client) reqWithHeader(method, path, contentType string, body io.Reader, header http.Header, result interface{}) (http.Header, error) {
 	req, err := http.NewRequest(method, c.server+path, body)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
 	}
 	req.Header.Add("Accept", "application/json")
 	if contentType == "" {
@@ -89,40 +130,127 @@ func (c *Client) req(method, path, contentType string, body io.Reader, result in
 	} else {
 		req.Header.Add("Content-type", contentType)
 	}
-	req.Header.Add(xsrfTokenKey, c.token)
+	if c.apiKey != "" {
+		req.Header.Add("Authorization", "Bearer "+c.apiKey)
+	} else {
+		req.Header.Add(xsrfTokenKey, c.token)
+	}
 	resp, err := c.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if err = c.handleError(resp); err != nil {
-		return err
+		// Some endpoints explain the failure in the body, like the import results
+		if w, ok := result.(io.Writer); ok && resp.StatusCode == http.StatusBadRequest && strings.Contains(resp.Header.Get("Content-Type"), "text/csv") {
+			io.Copy(w, resp.Body)
+		}
+		return resp.Header, err
 	}
 	if result != nil {
 		switch result := result.(type) {
 		// Should we just dump the response body
 		case io.Writer:
 			if _, err = io.Copy(result, resp.Body); err != nil {
-				return err
+				return resp.Header, err
 			}
 		default:
 			if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
-				return err
+				return resp.Header, err
 			}
 		}
 	}
-	return nil
+	return resp.Header, nil
 }
 
-// Login to the Demisto download server, and returns statues code
-func (c *Client) Login() (*domain.User, error) {
+// maxRetries is how many times idempotent requests are sent if the server cannot be reached
+const maxRetries = 3
+
+// idempotentPost sends the request with the idempotency key and retries it on network errors.
+// The server replays the original response if the first attempt got through.
+func (c *Client) idempotentPost(path, key string, v interface{}, result interface{}) (err error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Idempotency-Key": []string{key}}
+	for i := 0; i < maxRetries; i++ {
+		_, err = c.reqWithHeader("POST", path, "", bytes.NewReader(b), header, result)
+		if _, ok := err.(*url.Error); !ok {
+			return err
+		}
+		time.Sleep(time.Duration(i+1) * time.Second)
+	}
+	return err
+}
+
+// loginResponse is either the user or a request for the one time password
+type loginResponse struct {
+	domain.User
+	OTPRequired bool `json:"otpRequired"`
+}
+
+// Login to the Demisto download server. The one time password is only used if the user has two factor authentication.
+func (c *Client) Login(otp string) (*domain.User, error) {
 	creds, err := json.Marshal(c.credentials)
 	if err != nil {
 		return nil, err
 	}
-	u := &domain.User{}
-	err = c.req("POST", "login", "", bytes.NewBuffer(creds), u)
-	return u, err
+	res := &loginResponse{}
+	if err = c.req("POST", "login", "", bytes.NewBuffer(creds), res); err != nil {
+		return nil, err
+	}
+	if res.OTPRequired {
+		if otp == "" {
+			return nil, errors.New("Two factor authentication is enabled - please provide the code with -otp")
+		}
+		b, err := json.Marshal(map[string]string{"code": otp})
+		if err != nil {
+			return nil, err
+		}
+		res = &loginResponse{}
+		if err = c.req("POST", "login/otp", "", bytes.NewBuffer(b), res); err != nil {
+			return nil, err
+		}
+	}
+	return &res.User, nil
+}
+
+// EnrollTOTP generates a new secret for the logged in user and returns the secret and otpauth URI
+func (c *Client) EnrollTOTP() (res map[string]string, err error) {
+	err = c.req("POST", "user/totp", "", nil, &res)
+	return
+}
+
+// ConfirmTOTP enables two factor authentication with a code from the authenticator and returns the recovery codes
+func (c *Client) ConfirmTOTP(code string) ([]string, error) {
+	b, err := json.Marshal(map[string]string{"code": code})
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	err = c.req("POST", "user/totp/confirm", "", bytes.NewBuffer(b), &res)
+	return res.RecoveryCodes, err
+}
+
+// ForgotPassword asks for a code to reset the password by email
+func (c *Client) ForgotPassword(username string) error {
+	b, err := json.Marshal(map[string]string{"user": username})
+	if err != nil {
+		return err
+	}
+	return c.req("POST", "password/forgot", "", bytes.NewBuffer(b), nil)
+}
+
+// ResetPassword with the code from the email
+func (c *Client) ResetPassword(code, password string) error {
+	b, err := json.Marshal(map[string]string{"token": code, "password": password})
+	if err != nil {
+		return err
+	}
+	return c.req("POST", "password/reset", "", bytes.NewBuffer(b), nil)
 }
 
 // Logout from the Demisto server
@@ -130,11 +258,104 @@ func (c *Client) Logout() error {
 	return c.req("POST", "logout", "", nil, nil)
 }
 
-func (c *Client) Tokens() (tokens []domain.Token, err error) {
-	err = c.req("GET", "token", "", nil, &tokens)
+// Tokens returns the tokens with all the given labels and customer. If all is false, only open tokens are returned.
+func (c *Client) Tokens(labels []string, customer string, all bool) (tokens []domain.Token, err error) {
+	q := url.Values{}
+	for _, l := range labels {
+		q.Add("label", l)
+	}
+	if customer != "" {
+		q.Set("customer", customer)
+	}
+	if all {
+		q.Set("all", "true")
+	}
+	path := "token"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	err = c.req("GET", path, "", nil, &tokens)
 	return
 }
 
+// Users returns a page of the users matching the filter
+func (c *Client) Users(f *domain.UserFilter) (users []domain.User, err error) {
+	q := url.Values{}
+	if f.Username != "" {
+		q.Set("username", f.Username)
+	}
+	if f.Email != "" {
+		q.Set("email", f.Email)
+	}
+	if f.Type != nil {
+		q.Set("type", strconv.Itoa(int(*f.Type)))
+	}
+	if f.Organization != "" {
+		q.Set("organization", f.Organization)
+	}
+	if f.Offset > 0 {
+		q.Set("offset", strconv.Itoa(f.Offset))
+	}
+	if f.Limit > 0 {
+		q.Set("limit", strconv.Itoa(f.Limit))
+	}
+	path := "users"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	err = c.req("GET", path, "", nil, &users)
+	return
+}
+
+// UserDetails returns the user with its tokens, recent downloads and sessions
+func (c *Client) UserDetails(username string) (*domain.UserDetails, error) {
+	res := &domain.UserDetails{}
+	err := c.req("GET", "users/detail?"+url.Values{"username": {username}}.Encode(), "", nil, res)
+	return res, err
+}
+
+// Emails returns the most recent email deliveries matching the filter
+func (c *Client) Emails(f *domain.EmailFilter) (emails []domain.EmailDelivery, err error) {
+	q := url.Values{}
+	for param, v := range map[string]string{"username": f.Username, "recipient": f.Recipient, "status": f.Status} {
+		if v != "" {
+			q.Set(param, v)
+		}
+	}
+	if f.Limit > 0 {
+		q.Set("limit", strconv.Itoa(f.Limit))
+	}
+	err = c.req("GET", "emails?"+q.Encode(), "", nil, &emails)
+	return
+}
+
+// AuditLog returns a page of the audit entries matching the filter and the hash of the last entry in the log
+func (c *Client) AuditLog(f *domain.AuditFilter) (entries []domain.AuditEntry, head string, err error) {
+	q := url.Values{}
+	for param, v := range map[string]string{"actor": f.Actor, "action": f.Action, "target": f.Target} {
+		if v != "" {
+			q.Set(param, v)
+		}
+	}
+	if f.Since != nil {
+		q.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if f.Until != nil {
+		q.Set("until", f.Until.Format(time.RFC3339))
+	}
+	if f.AfterID > 0 {
+		q.Set("after", strconv.FormatInt(f.AfterID, 10))
+	}
+	if f.Limit > 0 {
+		q.Set("limit", strconv.Itoa(f.Limit))
+	}
+	h, err := c.reqWithHeader("GET", "audit?"+q.Encode(), "", nil, nil, &entries)
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, h.Get("X-Audit-Head"), nil
+}
+
 func (c *Client) DownloadLog() (l []domain.DownloadLog, err error) {
 	err = c.req("GET", "log", "", nil, &l)
 	return
@@ -145,13 +366,17 @@ func (c *Client) ListDownloads() (d []domain.Download, err error) {
 	return
 }
 
+// userDetails to create or update a user. Empty fields are not changed when updating.
 type userDetails struct {
-	Username string          `json:"username"`
-	Password string          `json:"password"`
-	Email    string          `json:"email"`
-	Name     string          `json:"name"`
-	Type     domain.UserType `json:"type"`
-	Token    string          `json:"token"`
+	Username            string           `json:"username,omitempty"`
+	Password            string           `json:"password,omitempty"`
+	Email               *string          `json:"email,omitempty"`
+	Name                *string          `json:"name,omitempty"`
+	Type                *domain.UserType `json:"type,omitempty"`
+	Token               string           `json:"token,omitempty"`
+	Organization        *string          `json:"organization,omitempty"`
+	ForcePasswordChange *bool            `json:"forcePasswordChange,omitempty"`
+	Disabled            *bool            `json:"disabled,omitempty"`
 }
 
 func (c *Client) SetUser(u *userDetails) (*domain.User, error) {
@@ -164,8 +389,22 @@ func (c *Client) SetUser(u *userDetails) (*domain.User, error) {
 	return res, err
 }
 
+type passwordChange struct {
+	Current  string `json:"current"`
+	Password string `json:"password"`
+}
+
+// ChangePassword of the logged in user
+func (c *Client) ChangePassword(current, password string) error {
+	b, err := json.Marshal(&passwordChange{Current: current, Password: password})
+	if err != nil {
+		return err
+	}
+	return c.req("POST", "user/password", "", bytes.NewBuffer(b), nil)
+}
+
 // Upload adds a version to the download server
-func (c *Client) Upload(name, filePath string) error {
+func (c *Client) Upload(name, filePath, version string) error {
 	b := &bytes.Buffer{}
 	writer := multipart.NewWriter(b)
 	part, err := writer.CreateFormFile("file", filepath.Base(filePath))
@@ -189,38 +428,141 @@ func (c *Client) Upload(name, filePath string) error {
 	if err != nil {
 		return err
 	}
+	if version != "" {
+		err = writer.WriteField("version", version)
+		if err != nil {
+			return err
+		}
+	}
 	writer.Close()
 	err = c.req("POST", "upload", writer.FormDataContentType(), b, nil)
 	return err
 }
 
+// tokenOptions are the optional restrictions of generated tokens
+type tokenOptions struct {
+	NotBefore *time.Time   `json:"notBefore,omitempty"`
+	ExpiresAt *time.Time   `json:"expiresAt,omitempty"`
+	Scope     domain.Scope `json:"scope,omitempty"`
+	Versions  string       `json:"versions,omitempty"`
+	Customer  string       `json:"customer,omitempty"`
+	Notes     string       `json:"notes,omitempty"`
+	Labels    []string     `json:"labels,omitempty"`
+	Reason    string       `json:"reason,omitempty"`
+}
+
 type newTokens struct {
 	Count     int `json:"count"`
 	Downloads int `json:"downloads"`
+	tokenOptions
+}
+
+// Generate tokens. Repeating the call with the same key returns the same tokens.
+func (c *Client) Generate(count, downloads int, key string, opts tokenOptions) (tokens []domain.Token, err error) {
+	nt := &newTokens{Count: count, Downloads: downloads, tokenOptions: opts}
+	err = c.idempotentPost("tokens/generate", key, nt, &tokens)
+	return
+}
+
+type newEmailToken struct {
+	Email        string `json:"email"`
+	Downloads    int    `json:"downloads"`
+	Organization string `json:"organization,omitempty"`
+	tokenOptions
+}
+
+// GenerateForEmail generates a token and user for the email. Repeating the call with the same key returns the same token.
+func (c *Client) GenerateForEmail(email string, downloads int, org, key string, opts tokenOptions) (token *domain.Token, err error) {
+	nt := &newEmailToken{Email: email, Downloads: downloads, Organization: org, tokenOptions: opts}
+	token = &domain.Token{}
+	err = c.idempotentPost("tokens/email", key, nt, token)
+	return
+}
+
+func (c *Client) Organizations() (o []domain.Organization, err error) {
+	err = c.req("GET", "organizations", "", nil, &o)
+	return
 }
 
-func (c *Client) Generate(count, downloads int) (tokens []domain.Token, err error) {
-	nt := &newTokens{Count: count, Downloads: downloads}
-	b, err := json.Marshal(nt)
+func (c *Client) SetOrganization(o *domain.Organization) (*domain.Organization, error) {
+	b, err := json.Marshal(o)
 	if err != nil {
 		return nil, err
 	}
-	err = c.req("POST", "tokens/generate", "", bytes.NewBuffer(b), &tokens)
+	res := &domain.Organization{}
+	err = c.req("POST", "organization", "", bytes.NewBuffer(b), res)
+	return res, err
+}
+
+func (c *Client) OrganizationsUsage() (u []domain.OrganizationUsage, err error) {
+	err = c.req("GET", "organizations/usage", "", nil, &u)
 	return
 }
 
-type newEmailToken struct {
-	Email     string `json:"email"`
-	Downloads int `json:"downloads"`
+// TokenHistory returns the ledger of the token with the given name (digest)
+func (c *Client) TokenHistory(name string) (h *domain.TokenHistory, err error) {
+	h = &domain.TokenHistory{}
+	err = c.req("GET", "token/history?name="+url.QueryEscape(name), "", nil, h)
+	return
 }
 
-func (c *Client) GenerateForEmail(email string, downloads int) (token *domain.Token, err error) {
-	nt := &newEmailToken{Email: email, Downloads: downloads}
-	b, err := json.Marshal(nt)
+type tokenAdjustment struct {
+	Name   string                `json:"name"`
+	Delta  int                   `json:"delta"`
+	Type   domain.TokenEventType `json:"type"`
+	Reason string                `json:"reason,omitempty"`
+}
+
+// AdjustToken adds delta downloads to the token with the given event type (topped_up or refunded)
+func (c *Client) AdjustToken(name string, delta int, eventType domain.TokenEventType, reason string) (*domain.Token, error) {
+	b, err := json.Marshal(&tokenAdjustment{Name: name, Delta: delta, Type: eventType, Reason: reason})
 	if err != nil {
 		return nil, err
 	}
-	token = &domain.Token{}
-	err = c.req("POST", "tokens/email", "", bytes.NewBuffer(b), &token)
+	res := &domain.Token{}
+	err = c.req("POST", "token/adjust", "", bytes.NewBuffer(b), res)
+	return res, err
+}
+
+// ImportTokens creates the tokens in the CSV and writes the results CSV to out.
+// If any row is invalid, nothing is created and the results explain what is wrong.
+func (c *Client) ImportTokens(in io.Reader, reason string, out io.Writer) error {
+	return c.req("POST", "tokens/import?reason="+url.QueryEscape(reason), "text/csv", in, out)
+}
+
+// ExportTokens writes the CSV of all the tokens with their usage to out
+func (c *Client) ExportTokens(out io.Writer) error {
+	return c.req("GET", "tokens/export", "", nil, out)
+}
+
+type newAPIKey struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// APIKeys returns all the API keys
+func (c *Client) APIKeys() (k []domain.APIKey, err error) {
+	err = c.req("GET", "apikeys", "", nil, &k)
 	return
 }
+
+// CreateAPIKey issues a new API key acting as the logged in user. The plain key is only returned here.
+func (c *Client) CreateAPIKey(name string, scopes []string, expiresAt *time.Time) (*domain.APIKey, error) {
+	b, err := json.Marshal(&newAPIKey{Name: name, Scopes: scopes, ExpiresAt: expiresAt})
+	if err != nil {
+		return nil, err
+	}
+	res := &domain.APIKey{}
+	err = c.req("POST", "apikeys", "", bytes.NewBuffer(b), res)
+	return res, err
+}
+
+// RevokeAPIKey revokes the API key with the given ID
+func (c *Client) RevokeAPIKey(id string) error {
+	b, err := json.Marshal(&domain.APIKey{ID: id})
+	if err != nil {
+		return err
+	}
+	return c.req("POST", "apikeys/revoke", "", bytes.NewBuffer(b), nil)
+}
@@ -4,10 +4,15 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/demisto/download/domain"
-	"strconv"
+	"github.com/demisto/download/util"
 )
 
 var (
@@ -15,6 +20,30 @@ var (
 	pass     = flag.String("p", "", "The password to set")
 	server   = flag.String("s", "https://download.demisto.com", "The location of the server")
 	insecure = flag.Bool("insecure", false, "Skip cetificate check")
+	nbf      = flag.String("nbf", "", "Generated tokens are not active before this time - date (2006-01-02), RFC3339 time or duration from now (72h, 30d)")
+	exp      = flag.String("exp", "", "Generated tokens expire at this time - date (2006-01-02), RFC3339 time or duration from now (72h, 30d)")
+	scope    = flag.String("scope", "", "Comma separated download names or glob patterns generated tokens are limited to")
+	versions = flag.String("versions", "", "Semver constraint generated tokens are limited to (for example \">= 4.0, < 5.0\")")
+	customer = flag.String("customer", "", "The customer of generated tokens or the customer to search tokens for")
+	notes    = flag.String("notes", "", "Notes for generated tokens")
+	labels   = flag.String("labels", "", "Comma separated labels for generated tokens or labels to search tokens with")
+	all      = flag.Bool("all", false, "List also used up and expired tokens")
+	org      = flag.String("org", "", "The organization to attach new users to")
+	reason   = flag.String("reason", "", "The reason recorded in the token ledger")
+	otp      = flag.String("otp", "", "The code from the authenticator app if two factor authentication is enabled")
+	email    = flag.String("email", "", "Part of the email to search users with or the recipient to list emails of")
+	userType = flag.Int("type", -1, "The type of users to search for - 0 for admins and 1 for customers")
+	offset   = flag.Int("offset", 0, "How many users to skip when searching")
+	limit    = flag.Int("limit", 0, "How many users (default 50), emails or audit entries (default 100) to return")
+	since    = flag.String("since", "", "List audit entries since this time - date (2006-01-02), RFC3339 time or negative duration from now (-24h, -7d)")
+	key      = flag.String("key", "", "Idempotency key for gen and email so repeating the command does not generate new tokens (random by default)")
+)
+
+const (
+	// apiKeyEnv is the environment variable with the API key to use instead of the username and password
+	apiKeyEnv = "DCLI_API_KEY"
+	// auditKeyEnv is the environment variable with the audit key of the server to verify the audit log
+	auditKeyEnv = "DCLI_AUDIT_KEY"
 )
 
 func stderr(format string, v ...interface{}) {
@@ -28,53 +57,206 @@ func check(e error) {
 	}
 }
 
-func main() {
-	flag.Parse()
-	if *user == "" {
-		stderr("Please provide the username")
+// parseTime parses the given value as a date, RFC3339 time or a duration from now where d can be used for days
+func parseTime(val string) (*time.Time, error) {
+	if val == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, val, time.Local); err == nil {
+			return &t, nil
+		}
 	}
-	if *pass == "" {
-		stderr("Please provide the password")
+	if strings.HasSuffix(val, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(val, "d"))
+		if err != nil {
+			return nil, err
+		}
+		t := time.Now().AddDate(0, 0, days)
+		return &t, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid time %s - %v", val, err)
+	}
+	t := time.Now().Add(d)
+	return &t, nil
+}
+
+// idempotencyKey returns the key from the flags or a random one
+func idempotencyKey() string {
+	if *key != "" {
+		return *key
+	}
+	return util.SecureRandomString(32, false)
+}
+
+// options returns the token options based on the flags
+func options() tokenOptions {
+	notBefore, err := parseTime(*nbf)
+	check(err)
+	expiresAt, err := parseTime(*exp)
+	check(err)
+	return tokenOptions{
+		NotBefore: notBefore,
+		ExpiresAt: expiresAt,
+		Scope:     util.SplitAndTrim(*scope),
+		Versions:  *versions,
+		Customer:  *customer,
+		Notes:     *notes,
+		Labels:    util.SplitAndTrim(*labels),
+		Reason:    *reason,
+	}
+}
+
+// formatTime for the token listing
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// formatScope for the token listing
+func formatScope(t *domain.Token) string {
+	res := strings.Join(t.Scope, ",")
+	if res == "" {
+		res = "*"
+	}
+	if t.Versions != "" {
+		res += " (" + t.Versions + ")"
+	}
+	return res
+}
+
+// printTokens in a table
+func printTokens(tokens []domain.Token) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Token\tDownloads\tNot Before\tExpires\tScope\tCustomer\tLabels\tCreated By\tCreated\tLast Used\tID")
+	for _, t := range tokens {
+		// The plain token is only available right after generation
+		plain := t.Plain
+		if plain == "" {
+			plain = t.Hint
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", plain, t.Downloads, formatTime(t.NotBefore), formatTime(t.ExpiresAt),
+			formatScope(&t), t.Customer, strings.Join(t.Labels, ","), t.CreatedBy, formatTime(&t.CreatedAt), formatTime(t.LastUsed), t.Name)
+	}
+	tw.Flush()
+}
+
+// printEmails lists the email deliveries
+func printEmails(emails []domain.EmailDelivery) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Emails\tRecipient\tSubject\tStatus\tCreated\tSent\tError")
+	for _, e := range emails {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Template, e.Recipient, e.Subject, e.Status, formatTime(&e.CreatedAt), formatTime(e.SentAt), e.Error)
 	}
+	tw.Flush()
+}
+
+func main() {
+	flag.Parse()
 	args := flag.Args()
 	if len(args) == 0 {
 		stderr("Please provide the action you want to perform")
 	}
-	c, err := New(*user, *pass, *server, *insecure)
-	u, err := c.Login()
-	check(err)
-	fmt.Printf("Logged in with user %s [%s]\n", u.Username, u.Name)
+	// Forgotten passwords are reset without logging in
 	switch args[0] {
-	case "tokens":
-		tokens, err := c.Tokens()
+	case "forgot":
+		c, err := NewAnonymous(*server, *insecure)
+		check(err)
+		check(c.ForgotPassword(*user))
+		fmt.Printf("If %s can reset the password, a code was sent to its email. Use it with: reset-password code newpassword\n", *user)
+		return
+	case "reset-password":
+		if len(args) < 3 {
+			stderr("Reset syntax is: reset-password code newpassword\n")
+		}
+		c, err := NewAnonymous(*server, *insecure)
+		check(err)
+		check(c.ResetPassword(args[1], args[2]))
+		fmt.Println("Password was reset. All the sessions were logged out.")
+		return
+	}
+	var c *Client
+	var err error
+	if apiKey := os.Getenv(apiKeyEnv); apiKey != "" {
+		c, err = NewWithAPIKey(apiKey, *server, *insecure)
 		check(err)
-		fmt.Println("Token\t\tDownloads")
-		for _, t := range tokens {
-			fmt.Printf("%s\t\t%d\n", t.Name, t.Downloads)
+	} else {
+		if *user == "" {
+			stderr("Please provide the username")
 		}
+		if *pass == "" {
+			stderr("Please provide the password or set %s", apiKeyEnv)
+		}
+		c, err = New(*user, *pass, *server, *insecure)
+		check(err)
+		u, err := c.Login(*otp)
+		check(err)
+		fmt.Printf("Logged in with user %s [%s]\n", u.Username, u.Name)
+	}
+	switch args[0] {
+	case "tokens":
+		tokens, err := c.Tokens(util.SplitAndTrim(*labels), *customer, *all)
+		check(err)
+		printTokens(tokens)
 	case "newu":
 		if len(args) < 4 {
 			stderr("User syntax is: 0 username password [name [email]] OR 1 token email [name]\n")
 		}
 		var u *userDetails
 		if args[1] == "0" {
-			u = &userDetails{Username: args[2], Password: args[3], Type: domain.UserTypeAdmin}
+			userType := domain.UserType(domain.UserTypeAdmin)
+			u = &userDetails{Username: args[2], Password: args[3], Type: &userType}
 			if len(args) > 4 {
-				u.Name = args[4]
+				u.Name = &args[4]
 			}
 			if len(args) > 5 {
-				u.Email = args[5]
+				u.Email = &args[5]
 			}
 		} else {
-			u = &userDetails{Username: args[2] + "*-*" + args[3], Token: args[2], Email: args[3]}
+			// The server names the user based on the token digest
+			userType := domain.UserType(domain.UserTypeUser)
+			u = &userDetails{Token: args[2], Email: &args[3], Type: &userType, Organization: org}
 			if len(args) > 4 {
-				u.Name = args[4]
+				u.Name = &args[4]
 			}
 		}
 		res, err := c.SetUser(u)
 		check(err)
 		b, _ := json.MarshalIndent(res, "", "  ")
 		fmt.Printf("Created user:\n%s\n", string(b))
+	case "totp":
+		res, err := c.EnrollTOTP()
+		check(err)
+		fmt.Printf("Add the secret %s to your authenticator app or use the URI:\n%s\n", res["secret"], res["uri"])
+		fmt.Println("Then enable two factor authentication with: totp-confirm code")
+	case "totp-confirm":
+		if len(args) < 2 {
+			stderr("Confirm syntax is: totp-confirm code\n")
+		}
+		codes, err := c.ConfirmTOTP(args[1])
+		check(err)
+		fmt.Println("Two factor authentication is enabled. Keep the recovery codes in a safe place, each can be used once instead of a code:")
+		for _, code := range codes {
+			fmt.Println(code)
+		}
+	case "passwd":
+		if len(args) < 2 {
+			stderr("Password syntax is: passwd newpassword (the current password is taken from -p)\n")
+		}
+		check(c.ChangePassword(*pass, args[1]))
+		fmt.Println("Password changed")
+	case "reset":
+		if len(args) < 3 {
+			stderr("Reset syntax is: reset username password - the user will have to change the password on the next login\n")
+		}
+		force := true
+		_, err := c.SetUser(&userDetails{Username: args[1], Password: args[2], ForcePasswordChange: &force})
+		check(err)
+		fmt.Printf("Password of %s was reset\n", args[1])
 	case "email":
 		if len(args) < 2 {
 			stderr("Email syntax is: email [downloads] where downloads default is 3\n")
@@ -85,15 +267,26 @@ func main() {
 		}
 		downloads, err := strconv.Atoi(d)
 		check(err)
-		res, err := c.GenerateForEmail(args[1], downloads)
+		res, err := c.GenerateForEmail(args[1], downloads, *org, idempotencyKey(), options())
 		check(err)
-		fmt.Printf("Generated token %s with %d downloads\n", res.Name, res.Downloads)
-		fmt.Printf("Link to download is https://download.demisto.com/download-params?token=%s&email=%s\n", res.Name, args[1])
+		fmt.Printf("Generated token %s with %d downloads\n", res.Plain, res.Downloads)
+		if res.NotBefore != nil || res.ExpiresAt != nil {
+			fmt.Printf("Token is valid from %s until %s\n", formatTime(res.NotBefore), formatTime(res.ExpiresAt))
+		}
+		if len(res.Scope) > 0 || res.Versions != "" {
+			fmt.Printf("Token is limited to %s\n", formatScope(res))
+		}
+		fmt.Printf("Link to download is https://download.demisto.com/download-link?token=%s&email=%s\n", res.Plain, url.QueryEscape(args[1]))
+		fmt.Printf("If emails are configured, the link is emailed to the customer. Check the delivery with: emails -email %s\n", args[1])
 	case "upload":
 		if len(args) < 3 {
-			stderr("Upload should receive 2 parameters - name and path\n")
+			stderr("Upload should receive 2 parameters - name and path and optionally the version\n")
 		}
-		err := c.Upload(args[1], args[2])
+		version := ""
+		if len(args) > 3 {
+			version = args[3]
+		}
+		err := c.Upload(args[1], args[2], version)
 		check(err)
 	case "gen":
 		if len(args) < 3 {
@@ -103,17 +296,234 @@ func main() {
 		check(err)
 		downloads, err := strconv.Atoi(args[2])
 		check(err)
-		tokens, err := c.Generate(count, downloads)
+		tokens, err := c.Generate(count, downloads, idempotencyKey(), options())
+		check(err)
+		printTokens(tokens)
+	case "history":
+		if len(args) < 2 {
+			stderr("History syntax is: history id\n")
+		}
+		h, err := c.TokenHistory(args[1])
+		check(err)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "Time\tEvent\tDelta\tBalance\tActor\tReason")
+		for _, e := range h.Events {
+			fmt.Fprintf(tw, "%s\t%s\t%+d\t%d\t%s\t%s\n", formatTime(&e.CreatedAt), e.Type, e.Delta, e.Balance, e.Actor, e.Reason)
+		}
+		tw.Flush()
+		if !h.Consistent {
+			fmt.Printf("Warning - token has %d downloads but the ledger balance is %d\n", h.Token.Downloads, h.LedgerBalance)
+		}
+	case "topup", "refund":
+		if len(args) < 3 {
+			stderr("Syntax is: %s id downloads (the reason is taken from -reason)\n", args[0])
+		}
+		delta, err := strconv.Atoi(args[2])
+		check(err)
+		eventType := domain.TokenEventToppedUp
+		if args[0] == "refund" {
+			eventType = domain.TokenEventRefunded
+		}
+		t, err := c.AdjustToken(args[1], delta, eventType, *reason)
+		check(err)
+		fmt.Printf("Token %s has %d downloads\n", t.Hint, t.Downloads)
+	case "import":
+		if len(args) < 2 {
+			stderr("Import syntax is: import tokens.csv [results.csv] where the CSV has the columns email,downloads,expires,scope,organization\n")
+		}
+		in, err := os.Open(args[1])
 		check(err)
-		fmt.Println("Token\t\tDownloads")
-		for _, t := range tokens {
-			fmt.Printf("%s\t\t%d\n", t.Name, t.Downloads)
+		defer in.Close()
+		out := os.Stdout
+		if len(args) > 2 {
+			out, err = os.Create(args[2])
+			check(err)
+			defer out.Close()
 		}
+		check(c.ImportTokens(in, *reason, out))
+	case "export":
+		out := os.Stdout
+		if len(args) > 1 {
+			out, err = os.Create(args[1])
+			check(err)
+			defer out.Close()
+		}
+		check(c.ExportTokens(out))
+	case "apikeys":
+		keys, err := c.APIKeys()
+		check(err)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "Key\tName\tScopes\tUser\tExpires\tCreated\tLast Used\tRevoked\tID")
+		for _, k := range keys {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", k.Hint, k.Name, strings.Join(k.Scopes, ","), k.Username,
+				formatTime(k.ExpiresAt), formatTime(&k.CreatedAt), formatTime(k.LastUsed), formatTime(k.RevokedAt), k.ID)
+		}
+		tw.Flush()
+	case "apikey":
+		if len(args) < 3 {
+			stderr("API key syntax is: apikey name scopes where scopes is a comma separated list of upload, token-issue and read-log (expiration is taken from -exp)\n")
+		}
+		expiresAt, err := parseTime(*exp)
+		check(err)
+		k, err := c.CreateAPIKey(args[1], util.SplitAndTrim(args[2]), expiresAt)
+		check(err)
+		fmt.Printf("Issued API key %s\nIt will not be shown again. Use it by setting %s.\n", k.Plain, apiKeyEnv)
+	case "apikey-revoke":
+		if len(args) < 2 {
+			stderr("Revoke syntax is: apikey-revoke id\n")
+		}
+		check(c.RevokeAPIKey(args[1]))
+		fmt.Println("API key revoked")
+	case "orgs":
+		orgs, err := c.Organizations()
+		check(err)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "Organization\tDownloads\tScope")
+		for _, o := range orgs {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", o.Name, o.Downloads, formatScope(&domain.Token{Scope: o.Scope, Versions: o.Versions}))
+		}
+		tw.Flush()
+	case "org":
+		if len(args) < 3 {
+			stderr("Organization syntax is: org name downloads (entitlements are taken from -scope and -versions)\n")
+		}
+		downloads, err := strconv.Atoi(args[2])
+		check(err)
+		o, err := c.SetOrganization(&domain.Organization{Name: args[1], Downloads: downloads, Scope: util.SplitAndTrim(*scope), Versions: *versions})
+		check(err)
+		fmt.Printf("Organization %s has %d downloads\n", o.Name, o.Downloads)
+	case "usage":
+		usage, err := c.OrganizationsUsage()
+		check(err)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "Organization\tLeft\tUsed\tUsers\tLast Download")
+		for _, u := range usage {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\n", u.Name, u.Downloads, u.Used, u.Users, formatTime(u.LastDownload))
+		}
+		tw.Flush()
 	case "log":
 		l, err := c.DownloadLog()
 		check(err)
 		b, _ := json.MarshalIndent(l, "", "  ")
 		fmt.Printf("%s\n", string(b))
+	case "users":
+		f := &domain.UserFilter{Email: *email, Organization: *org, Offset: *offset, Limit: *limit}
+		if len(args) > 1 {
+			f.Username = args[1]
+		}
+		if *userType >= 0 {
+			t := domain.UserType(*userType)
+			f.Type = &t
+		}
+		users, err := c.Users(f)
+		check(err)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "Username\tName\tEmail\tType\tOrganization\tRoles\tLast Login\tDisabled")
+		for _, u := range users {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%v\n", u.Username, u.Name, u.Email, u.Type, u.Organization,
+				strings.Join(u.RoleNames(), ","), formatTime(&u.LastLogin), u.Disabled)
+		}
+		tw.Flush()
+	case "user":
+		if len(args) < 2 {
+			stderr("User syntax is: user username\n")
+		}
+		d, err := c.UserDetails(args[1])
+		check(err)
+		b, _ := json.MarshalIndent(d.User, "", "  ")
+		fmt.Printf("%s\n", string(b))
+		if d.Token != nil {
+			fmt.Println("Download token:")
+			printTokens([]domain.Token{*d.Token})
+		}
+		if len(d.IssuedTokens) > 0 {
+			fmt.Println("Issued tokens:")
+			printTokens(d.IssuedTokens)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "Recent Downloads\tPath\tIP\tDate")
+		for _, l := range d.Downloads {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", l.Name, l.Path, l.IP, formatTime(&l.ModifyDate))
+		}
+		tw.Flush()
+		tw = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "Sessions\tIP\tUser Agent\tCreated\tLast Seen")
+		for _, s := range d.Sessions {
+			fmt.Fprintf(tw, "\t%s\t%s\t%s\t%s\n", s.IP, s.UserAgent, formatTime(&s.CreatedAt), formatTime(&s.LastSeen))
+		}
+		tw.Flush()
+		printEmails(d.Emails)
+	case "user-disable", "user-enable":
+		if len(args) < 2 {
+			stderr("Syntax is: %s username\n", args[0])
+		}
+		disabled := args[0] == "user-disable"
+		_, err := c.SetUser(&userDetails{Username: args[1], Disabled: &disabled})
+		check(err)
+		fmt.Printf("User %s is %sd\n", args[1], strings.TrimPrefix(args[0], "user-"))
+	case "emails":
+		f := &domain.EmailFilter{Recipient: *email, Limit: *limit}
+		if len(args) > 1 {
+			f.Username = args[1]
+		}
+		emails, err := c.Emails(f)
+		check(err)
+		printEmails(emails)
+	case "audit":
+		f := &domain.AuditFilter{Limit: *limit}
+		if len(args) > 1 {
+			f.Actor = args[1]
+		}
+		if len(args) > 2 {
+			f.Target = args[2]
+		}
+		f.Since, err = parseTime(*since)
+		check(err)
+		entries, _, err := c.AuditLog(f)
+		check(err)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTime\tActor\tAction\tTarget\tStatus\tIP\tChanges")
+		for _, e := range entries {
+			actor := e.Actor
+			if e.APIKey != "" {
+				actor += " (" + e.APIKey + ")"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", e.ID, formatTime(&e.CreatedAt), actor, e.Action, e.Target, e.Status, e.IP, e.Changes)
+		}
+		tw.Flush()
+	case "audit-verify":
+		key := os.Getenv(auditKeyEnv)
+		if key == "" {
+			stderr("Please set %s to the audit key of the server\n", auditKeyEnv)
+		}
+		// An optional hash printed by an earlier verification must still be in the chain
+		anchor, anchored := "", false
+		if len(args) > 1 {
+			anchor = args[1]
+		}
+		f := &domain.AuditFilter{Limit: domain.MaxAuditPageSize}
+		prev, count := "", 0
+		for {
+			entries, head, err := c.AuditLog(f)
+			check(err)
+			if len(entries) == 0 {
+				if head != prev {
+					stderr("The last entry %d does not match the head of the log - entries were removed from the end or added while verifying\n", f.AfterID)
+				}
+				break
+			}
+			prev, err = domain.VerifyAuditChain([]byte(key), prev, entries)
+			check(err)
+			for _, e := range entries {
+				anchored = anchored || e.Hash == anchor
+			}
+			count += len(entries)
+			f.AfterID = entries[len(entries)-1].ID
+		}
+		if anchor != "" && !anchored {
+			stderr("Hash %s is not in the audit log - the log was rewritten\n", anchor)
+		}
+		fmt.Printf("Verified %d audit entries. The head is %s\n", count, prev)
 	case "downloads":
 		d, err := c.ListDownloads()
 		check(err)
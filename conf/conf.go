@@ -19,12 +19,101 @@ var Options struct {
 	ExternalAddress string
 	// Security defintions
 	Security struct {
-		// The secret session key that is used to symmetrically encrypt sessions stored in cookies
+		// The secret session key that is used to encrypt cookies if SessionKeys is empty and to open cookies in the
+		// old format while LegacyCookies is set
 		SessionKey string
+		// SessionKeys encrypt the cookies with AES-GCM, newest first. The newest encrypts and all of them decrypt, so
+		// a key is rotated by adding the new one first and removing the old one after the session timeout.
+		// Keys can be of any length.
+		SessionKeys []string
+		// LegacyCookies accepts cookies encrypted with SessionKey in the old format during the migration.
+		// Disable it once all the sessions were renewed.
+		LegacyCookies bool
 		// Session timeout in minutes
 		Timeout int
 		// Database encryption key used to encrypt sensitive data
 		DBKey string
+		// TokenKey is used to hash tokens stored in the database. If empty, DBKey is used.
+		// Changing it invalidates all the existing tokens.
+		TokenKey string
+		// AuditKey keys the hashes of the audit log chain. If empty, DBKey is used. Auditors need it to verify the log.
+		// Changing it breaks the verification of the existing entries.
+		AuditKey string
+		// PasswordMinLength is the min length of passwords set by users and admins
+		PasswordMinLength int
+		// BreachedPasswords is an optional file with breached passwords (one per line) that cannot be used
+		BreachedPasswords string
+		// RequireTOTP forces admins to enable two factor authentication before doing anything else
+		RequireTOTP bool
+		// WebAuthnOrigin is the origin of the web UI for passkeys (for example https://download.demisto.com).
+		// If empty, ExternalAddress is used.
+		WebAuthnOrigin string
+		// Roles are custom roles with their permissions. A role with the name of a built in role replaces it.
+		Roles map[string][]string
+	}
+	// OIDC single sign-on. Disabled if the issuer is empty.
+	OIDC struct {
+		// Issuer URL of the IdP used for discovery
+		Issuer       string
+		ClientID     string
+		ClientSecret string
+		// RedirectURL registered at the IdP. If empty, ExternalAddress/login/oidc/callback is used.
+		RedirectURL string
+		// Scopes in addition to openid. Usually email, profile and the one for groups.
+		Scopes []string
+		// UsernameClaim is the ID token claim used as the username. Default is email.
+		UsernameClaim string
+		// GroupsClaim is the ID token claim with the groups of the user. Default is groups.
+		GroupsClaim string
+		// AdminGroups are the groups whose members sign in as admins
+		AdminGroups []string
+		// UserGroups are the groups whose members sign in as customers
+		UserGroups []string
+	}
+	// LDAP authentication of staff against the directory (for example Active Directory). Disabled if the URL is empty.
+	LDAP struct {
+		// URL of the server, ldap://host or ldaps://host
+		URL string
+		// StartTLS upgrades ldap:// connections before binding
+		StartTLS bool
+		// InsecureSkipVerify disables the verification of the server certificate. Only for testing.
+		InsecureSkipVerify bool
+		// BindDN and BindPassword of the service account used to find users
+		BindDN       string
+		BindPassword string
+		// BaseDN of the user search
+		BaseDN string
+		// UserFilter finds the user where %s is the username. Default is (sAMAccountName=%s).
+		UserFilter string
+		// GroupAttribute lists the group DNs of the user. Default is memberOf.
+		GroupAttribute string
+		// EmailAttribute default is mail
+		EmailAttribute string
+		// NameAttribute default is displayName
+		NameAttribute string
+		// AdminGroups are the DNs of the groups whose members sign in as admins
+		AdminGroups []string
+		// UserGroups are the DNs of the groups whose members sign in as customers
+		UserGroups []string
+	}
+	// Mail configures how emails such as sign-in links and issued tokens are delivered
+	Mail struct {
+		// Driver is smtp, file or log. The default is smtp if SMTP.Address is set. Emails are disabled without a driver.
+		Driver string
+		// Dir is where the file driver writes the emails
+		Dir string
+		// Templates is a directory with templates that replace the built in emails
+		Templates string
+	}
+	// SMTP server of the smtp mail driver
+	SMTP struct {
+		// Address of the server as host:port
+		Address string
+		// Username and Password for authentication. Authentication is skipped if the username is empty.
+		Username string
+		Password string
+		// From is the sender of the emails of all the drivers
+		From string
 	}
 	// SSL configuration
 	SSL struct {
@@ -48,6 +137,8 @@ var Options struct {
 		// ClientKey for TLS
 		ClientKey string
 	}
+	// IdempotencyWindow in minutes during which responses are replayed for requests repeating an Idempotency-Key
+	IdempotencyWindow int
 	// Dir where to place the files
 	Dir string
 	// Location of the static resources
@@ -84,10 +175,13 @@ func Default() {
 	Options.Address = ":9090"
 	Options.Security.SessionKey = "kukuKiki1234qawsed.Strazaaplokij"
 	Options.Security.DBKey = Options.Security.SessionKey
+	Options.Security.LegacyCookies = true
 	Options.Security.Timeout = 1440
+	Options.Security.PasswordMinLength = 10
 	Options.DB.Username = "download"
 	Options.DB.Password = "password"
 	Options.DB.ConnectString = "tcp/download?parseTime=true"
+	Options.IdempotencyWindow = 1440
 	Options.Dir = "."
 	Options.Static = "static"
 }
@@ -0,0 +1,111 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/demisto/download/util"
+)
+
+var (
+	// ErrAPIKeyRevoked is returned when the API key was revoked
+	ErrAPIKeyRevoked = errors.New("API key was revoked")
+	// ErrAPIKeyExpired is returned when the API key expiration time has passed
+	ErrAPIKeyExpired = errors.New("API key has expired")
+)
+
+// APIKeyScope is an area of the API that a key can access
+type APIKeyScope string
+
+// The API key scopes
+const (
+	// APIKeyScopeUpload allows uploading new versions and listing the downloads
+	APIKeyScopeUpload APIKeyScope = "upload"
+	// APIKeyScopeTokenIssue allows generating tokens
+	APIKeyScopeTokenIssue APIKeyScope = "token-issue"
+	// APIKeyScopeReadLog allows reading the download log
+	APIKeyScopeReadLog APIKeyScope = "read-log"
+)
+
+// APIKeyScopes are all the valid scopes
+var APIKeyScopes = []APIKeyScope{APIKeyScopeUpload, APIKeyScopeTokenIssue, APIKeyScopeReadLog}
+
+// APIKeyPrefix is the prefix of the plain API keys so secret scanners can tell them apart from tokens
+const APIKeyPrefix = "dmst_ak_"
+
+// APIKey allows automation to call the API on behalf of the admin that issued it without a session.
+// Like tokens, only the keyed digest of the key is stored and the plain key is only available when it is issued.
+type APIKey struct {
+	// ID is the digest of the key
+	ID string `json:"id"`
+	// Plain is the actual key. It is never stored.
+	Plain string `json:"key,omitempty" db:"-"`
+	// Hint is the beginning of the plain key so admins can recognize it
+	Hint string `json:"hint"`
+	// Name describes what the key is used for
+	Name string `json:"name"`
+	// Username of the admin the key acts as
+	Username string `json:"username"`
+	// Scopes the key is allowed to access
+	Scopes StringList `json:"scopes"`
+	// ExpiresAt is the time after which the key can no longer be used. Nil means never.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" db:"expires_at"`
+	CreatedAt time.Time  `json:"createdAt" db:"created_at"`
+	// LastUsed is the last time the key was used. Nil if it was never used.
+	LastUsed *time.Time `json:"lastUsed,omitempty" db:"last_used"`
+	// RevokedAt is when the key was revoked. Nil if the key is not revoked.
+	RevokedAt *time.Time `json:"revokedAt,omitempty" db:"revoked_at"`
+}
+
+// NewAPIKey for the user with the given scopes
+func NewAPIKey(name, username string, scopes []string, expiresAt *time.Time) (*APIKey, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, errors.New("API key name is required")
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("API key must have at least one scope")
+	}
+	for _, s := range scopes {
+		if !util.In(APIKeyScopes, APIKeyScope(s)) {
+			return nil, fmt.Errorf("Invalid API key scope [%s]", s)
+		}
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, errors.New("API key expiration must be in the future")
+	}
+	body := APIKeyPrefix + util.SecureRandomString(tokenRandomSize, false)
+	plain := body + tokenChecksum(body)
+	return &APIKey{
+		ID:        TokenDigest(plain),
+		Plain:     plain,
+		Hint:      plain[:len(APIKeyPrefix)+tokenHintSize] + "...",
+		Name:      name,
+		Username:  username,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// IsAPIKey checks if the value claims to be a plain API key
+func IsAPIKey(plain string) bool {
+	return strings.HasPrefix(plain, APIKeyPrefix)
+}
+
+// Valid checks if the key can be used at the given time
+func (k *APIKey) Valid(now time.Time) error {
+	if k.RevokedAt != nil {
+		return ErrAPIKeyRevoked
+	}
+	if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return ErrAPIKeyExpired
+	}
+	return nil
+}
+
+// Allows checks if the key has the given scope
+func (k *APIKey) Allows(scope APIKeyScope) bool {
+	return util.In(k.Scopes, string(scope))
+}
@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	if _, err := NewAPIKey("ci", "admin", nil, nil); err == nil {
+		t.Error("API key without scopes should fail")
+	}
+	if _, err := NewAPIKey("ci", "admin", []string{"upload", "admin"}, nil); err == nil {
+		t.Error("API key with an unknown scope should fail")
+	}
+	if _, err := NewAPIKey("ci", "admin", []string{"upload"}, &past); err == nil {
+		t.Error("API key that is already expired should fail")
+	}
+	k, err := NewAPIKey("ci", "admin", []string{"upload", "read-log"}, &future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsAPIKey(k.Plain) || IsFormattedToken(k.Plain) || k.ID != TokenDigest(k.Plain) {
+		t.Errorf("Unexpected key %s with ID %s", k.Plain, k.ID)
+	}
+	if !k.Allows(APIKeyScopeUpload) || k.Allows(APIKeyScopeTokenIssue) {
+		t.Errorf("Unexpected scopes %v", k.Scopes)
+	}
+}
+
+func TestAPIKeyValid(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	tests := []struct {
+		key *APIKey
+		err error
+	}{
+		{&APIKey{}, nil},
+		{&APIKey{ExpiresAt: &future}, nil},
+		{&APIKey{ExpiresAt: &past}, ErrAPIKeyExpired},
+		{&APIKey{RevokedAt: &past}, ErrAPIKeyRevoked},
+	}
+	for i, test := range tests {
+		if err := test.key.Valid(now); err != test.err {
+			t.Errorf("%d: expected %v but got %v", i, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package domain
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/util"
+)
+
+// MaxAuditPageSize is the maximum number of audit entries returned by a single query
+const MaxAuditPageSize = 1000
+
+// AuditEntry records a mutating administrative request. Each entry includes the hash of the previous one so
+// changing, removing or reordering entries breaks the chain. The hashes are keyed with the audit key so they cannot
+// be recomputed with write access to the database alone.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	// Actor is the user that made the request
+	Actor string `json:"actor"`
+	// APIKey is the hint of the API key the request was made with, if any
+	APIKey string `json:"apiKey,omitempty" db:"api_key"`
+	// Action is the method and path of the request
+	Action string `json:"action"`
+	// Target is what the request changed such as a username or a token
+	Target string `json:"target"`
+	// Changes are the changed fields as JSON, mapping each field to its value before and after with secrets removed
+	Changes   string `json:"changes,omitempty"`
+	Status    int    `json:"status"`
+	IP        string `json:"ip"`
+	RequestID string `json:"requestId" db:"request_id"`
+	PrevHash  string `json:"prevHash" db:"prev_hash"`
+	Hash      string `json:"hash"`
+}
+
+// AuditFilter is used to query the audit log. Empty fields are ignored.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  *time.Time
+	Until  *time.Time
+	// AfterID returns only entries after this one so the log can be paged in order
+	AfterID int64
+	Limit   int
+}
+
+// AuditChange is the value of a field before and after a change
+type AuditChange struct {
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// ErrAuditChain is returned when an entry does not match its hash or does not follow the previous entry
+type ErrAuditChain struct {
+	ID int64
+}
+
+func (e *ErrAuditChain) Error() string {
+	return fmt.Sprintf("Audit chain is broken at entry %d", e.ID)
+}
+
+// AuditRedacted replaces the values of secrets that changed
+const AuditRedacted = "[redacted]"
+
+// AuditChanges returns the fields that differ between before and after as JSON. Either can be nil for created
+// or deleted objects. The filters are removed as in util.MarshalWithFilter, but top level secrets that changed are
+// still listed with redacted values so it is visible that they changed.
+func AuditChanges(before, after interface{}, filters ...string) (string, error) {
+	b, err := auditFields(before, filters)
+	if err != nil {
+		return "", err
+	}
+	a, err := auditFields(after, filters)
+	if err != nil {
+		return "", err
+	}
+	changes := make(map[string]AuditChange)
+	for k, v := range b {
+		if !reflect.DeepEqual(v, a[k]) {
+			changes[k] = AuditChange{Before: v, After: a[k]}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok && v != nil {
+			changes[k] = AuditChange{After: v}
+		}
+	}
+	if len(filters) > 0 {
+		if b, err = auditFields(before, nil); err != nil {
+			return "", err
+		}
+		if a, err = auditFields(after, nil); err != nil {
+			return "", err
+		}
+		for _, f := range filters {
+			if !reflect.DeepEqual(b[f], a[f]) && (!isEmptyJSON(b[f]) || !isEmptyJSON(a[f])) {
+				changes[f] = AuditChange{After: AuditRedacted}
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return "", nil
+	}
+	res, err := json.Marshal(changes)
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
+
+func isEmptyJSON(v interface{}) bool {
+	return v == nil || v == "" || v == false || v == float64(0)
+}
+
+// auditFields returns the top level fields of the object without the filters
+func auditFields(v interface{}, filters []string) (map[string]interface{}, error) {
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return nil, nil
+	}
+	var b []byte
+	var err error
+	if len(filters) == 0 {
+		b, err = json.Marshal(v)
+	} else {
+		b, err = util.MarshalWithFilter(v, filters...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err = json.Unmarshal(b, &generic); err != nil {
+		return nil, err
+	}
+	if m, ok := generic.(map[string]interface{}); ok {
+		return m, nil
+	}
+	// Anything but an object is compared as a whole
+	return map[string]interface{}{"value": generic}, nil
+}
+
+// AuditKey returns the key of the audit chain from the configuration, never from the database
+func AuditKey() []byte {
+	key := conf.Options.Security.AuditKey
+	if key == "" {
+		key = conf.Options.Security.DBKey
+	}
+	return []byte(key)
+}
+
+// Seal links the entry to the previous hash and computes its hash with the key. The time is truncated to seconds
+// since that is what the repository keeps.
+func (e *AuditEntry) Seal(prevHash string, key []byte) {
+	e.CreatedAt = e.CreatedAt.UTC().Truncate(time.Second)
+	e.PrevHash = prevHash
+	e.Hash = e.ComputeHash(key)
+}
+
+// ComputeHash returns the HMAC-SHA256 of the previous hash and the recorded fields. The key is kept in the
+// configuration rather than the database, so someone who can change the database but not read the configuration
+// cannot rehash the chain and the head after changing an entry. The ID is not included since the repository assigns
+// it after the entry is sealed.
+func (e *AuditEntry) ComputeHash(key []byte) string {
+	fields := []string{e.PrevHash, e.CreatedAt.UTC().Format(time.RFC3339), e.Actor, e.APIKey, e.Action, e.Target,
+		e.Changes, strconv.Itoa(e.Status), e.IP, e.RequestID}
+	h := hmac.New(sha256.New, key)
+	for _, f := range fields {
+		// Length prefixes keep the fields apart so moving text from one field to another changes the hash
+		h.Write([]byte(strconv.Itoa(len(f)) + ":" + f))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyAuditChain checks that the entries follow each other starting after the entry with prevHash, which is empty
+// for the first entry, and were hashed with the key. It returns the hash of the last entry so the log can be
+// verified a page at a time.
+func VerifyAuditChain(key []byte, prevHash string, entries []AuditEntry) (string, error) {
+	for _, e := range entries {
+		if e.PrevHash != prevHash || !hmac.Equal([]byte(e.Hash), []byte(e.ComputeHash(key))) {
+			return prevHash, &ErrAuditChain{ID: e.ID}
+		}
+		prevHash = e.Hash
+	}
+	return prevHash, nil
+}
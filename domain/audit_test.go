@@ -0,0 +1,72 @@
+package domain
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAuditChanges(t *testing.T) {
+	before := &User{Username: "auditor", Name: "Old", Hash: "old-hash", Roles: []string{"support"}}
+	after := &User{Username: "auditor", Name: "New", Hash: "new-hash", Roles: []string{"support"}, Disabled: true}
+	s, err := AuditChanges(before, after, UserFilterFields...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes map[string]AuditChange
+	if err = json.Unmarshal([]byte(s), &changes); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || changes["name"].Before != "Old" || changes["name"].After != "New" || changes["disabled"].After != true {
+		t.Errorf("Unexpected changes %s", s)
+	}
+	if changes["hash"].Before != nil || changes["hash"].After != AuditRedacted {
+		t.Errorf("Secrets must be redacted but got %v", changes["hash"])
+	}
+	if s, err = AuditChanges(nil, &Organization{Name: "acme"}); err != nil || s == "" {
+		t.Errorf("Expected the created fields but got %s - %v", s, err)
+	}
+	if s, _ = AuditChanges(before, before, UserFilterFields...); s != "" {
+		t.Errorf("Expected no changes but got %s", s)
+	}
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	now := time.Now()
+	key := []byte("audit key")
+	var entries []AuditEntry
+	prev := ""
+	for i, action := range []string{"POST /user", "POST /tokens/generate", "POST /upload"} {
+		e := AuditEntry{ID: int64(i + 1), CreatedAt: now, Actor: "admin", Action: action, Status: 200}
+		e.Seal(prev, key)
+		prev = e.Hash
+		entries = append(entries, e)
+	}
+	if head, err := VerifyAuditChain(key, "", entries); err != nil || head != prev {
+		t.Errorf("Expected a valid chain ending with %s but got %s - %v", prev, head, err)
+	}
+	// Pages continue from the hash of the previous page
+	if _, err := VerifyAuditChain(key, entries[0].Hash, entries[1:]); err != nil {
+		t.Error(err)
+	}
+
+	// Without the key the chain cannot be verified, nor rehashed after a change
+	if _, err := VerifyAuditChain([]byte("another key"), "", entries); err == nil || err.(*ErrAuditChain).ID != 1 {
+		t.Errorf("Expected a break at entry 1 with another key but got %v", err)
+	}
+
+	tampered := append([]AuditEntry{}, entries...)
+	tampered[1].Actor = "someone-else"
+	if _, err := VerifyAuditChain(key, "", tampered); err == nil || err.(*ErrAuditChain).ID != 2 {
+		t.Errorf("Expected a break at entry 2 but got %v", err)
+	}
+	removed := []AuditEntry{entries[0], entries[2]}
+	if _, err := VerifyAuditChain(key, "", removed); err == nil || err.(*ErrAuditChain).ID != 3 {
+		t.Errorf("Expected a break at entry 3 but got %v", err)
+	}
+	// Rehashing a changed entry still breaks the link of the next one
+	tampered[1].Seal(tampered[1].PrevHash, key)
+	if _, err := VerifyAuditChain(key, "", tampered); err == nil || err.(*ErrAuditChain).ID != 3 {
+		t.Errorf("Expected a break at entry 3 but got %v", err)
+	}
+}
@@ -7,14 +7,16 @@ type Download struct {
 	Path       string    `json:"path"`
 	SHA256     string    `json:"sha256"`
 	GitHash    string    `json:"gitHash" db:"git_hash"`
+	Version    string    `json:"version"`
 	Username   string    `json:"username"`
 	ModifyDate time.Time `json:"modifyDate" db:"modify_date"`
 }
 
 type DownloadLog struct {
-	Username   string    `json:"username"`
-	Name       string    `json:"name"`
-	Path       string    `json:"path"`
-	IP         string    `json:"ip"`
-	ModifyDate time.Time `json:"modifyDate" db:"modify_date"`
+	Username     string    `json:"username"`
+	Organization string    `json:"organization"`
+	Name         string    `json:"name"`
+	Path         string    `json:"path"`
+	IP           string    `json:"ip"`
+	ModifyDate   time.Time `json:"modifyDate" db:"modify_date"`
 }
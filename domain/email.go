@@ -0,0 +1,38 @@
+package domain
+
+import "time"
+
+// The delivery statuses of emails
+const (
+	EmailQueued = "queued"
+	EmailSent   = "sent"
+	EmailFailed = "failed"
+)
+
+// MaxEmailPageSize is the maximum number of email deliveries returned by a single query
+const MaxEmailPageSize = 500
+
+// EmailDelivery records an email the server sent and whether it was delivered. The body is not kept since it
+// includes tokens, links and codes.
+type EmailDelivery struct {
+	ID int64 `json:"id"`
+	// Template the email was rendered from such as token or sign-in
+	Template string `json:"template"`
+	// Username of the user the email was sent to
+	Username  string `json:"username"`
+	Recipient string `json:"recipient"`
+	Subject   string `json:"subject"`
+	Status    string `json:"status"`
+	// Error is why the delivery failed
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"createdAt" db:"created_at"`
+	SentAt    *time.Time `json:"sentAt,omitempty" db:"sent_at"`
+}
+
+// EmailFilter is used to search email deliveries. Empty fields are ignored.
+type EmailFilter struct {
+	Username  string
+	Recipient string
+	Status    string
+	Limit     int
+}
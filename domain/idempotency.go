@@ -0,0 +1,23 @@
+package domain
+
+import "time"
+
+// IdempotentResponse is the response stored for a request with an idempotency key so it can be replayed
+// when the client retries the request
+type IdempotentResponse struct {
+	// Key is the idempotency key provided by the client. Keys are scoped to the user.
+	Key      string `db:"id_key"`
+	Username string
+	// Request is a fingerprint of the method, path and body so the key cannot be reused for a different request
+	Request string
+	// Status of the response. Zero while the original request is still in progress.
+	Status      int
+	ContentType string `db:"content_type"`
+	Body        []byte
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// Done checks if the original request has completed and the response can be replayed
+func (r *IdempotentResponse) Done() bool {
+	return r.Status != 0
+}
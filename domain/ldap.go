@@ -0,0 +1,130 @@
+package domain
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/demisto/download/util"
+)
+
+var (
+	// ErrLDAPCredentials is returned when the user is not in the directory or the password is wrong
+	ErrLDAPCredentials = errors.New("Invalid LDAP credentials")
+	// ErrLDAPNoRole is returned when the user is not in any of the groups mapped to a user type
+	ErrLDAPNoRole = errors.New("User is not in any group that is allowed to sign in")
+)
+
+// LDAPDirectory authenticates users against an LDAP server such as Active Directory. The user entry is found with
+// the service account and the password is checked by binding as the user.
+type LDAPDirectory struct {
+	// URL of the server, ldap://host or ldaps://host
+	URL string
+	// StartTLS upgrades ldap:// connections before sending any credentials
+	StartTLS  bool
+	TLSConfig *tls.Config
+	// BindDN and BindPassword of the service account that searches for users
+	BindDN       string
+	BindPassword string
+	// BaseDN of the user search
+	BaseDN string
+	// UserFilter finds the user entry where %s is the escaped username. Default is (sAMAccountName=%s).
+	UserFilter string
+	// GroupAttribute of the user entry with the DNs of its groups. Default is memberOf.
+	GroupAttribute string
+	// EmailAttribute default is mail
+	EmailAttribute string
+	// NameAttribute default is displayName
+	NameAttribute string
+	// AdminGroups are the DNs of the groups whose members are admins
+	AdminGroups []string
+	// UserGroups are the DNs of the groups whose members are customers
+	UserGroups []string
+	Timeout    time.Duration
+}
+
+func (d *LDAPDirectory) attribute(val, def string) string {
+	if val == "" {
+		return def
+	}
+	return val
+}
+
+// dial connects and upgrades the connection if needed
+func (d *LDAPDirectory) dial() (*util.LDAPConn, error) {
+	conn, err := util.DialLDAP(d.URL, d.TLSConfig, d.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if d.StartTLS {
+		if err = conn.StartTLS(d.TLSConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Authenticate checks the password of the user and returns the user with the type mapped from its groups.
+// The returned user is not saved.
+func (d *LDAPDirectory) Authenticate(username, password string) (*User, error) {
+	if username == "" || password == "" {
+		return nil, ErrLDAPCredentials
+	}
+	conn, err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.Bind(d.BindDN, d.BindPassword); err != nil {
+		return nil, err
+	}
+	groupAttr := d.attribute(d.GroupAttribute, "memberOf")
+	emailAttr := d.attribute(d.EmailAttribute, "mail")
+	nameAttr := d.attribute(d.NameAttribute, "displayName")
+	filter := strings.Replace(d.attribute(d.UserFilter, "(sAMAccountName=%s)"), "%s", util.EscapeLDAPFilter(username), -1)
+	entries, err := conn.Search(d.BaseDN, filter, []string{groupAttr, emailAttr, nameAttr})
+	if err != nil {
+		return nil, err
+	}
+	// An ambiguous filter must not let one user sign in as another
+	if len(entries) != 1 {
+		return nil, ErrLDAPCredentials
+	}
+	entry := entries[0]
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if util.IsLDAPError(err, util.LDAPInvalidCredentials) {
+			return nil, ErrLDAPCredentials
+		}
+		return nil, err
+	}
+	userType, err := d.UserType(entry.Attributes[strings.ToLower(groupAttr)])
+	if err != nil {
+		return nil, err
+	}
+	return &User{Username: username, Email: entry.Attr(emailAttr), Name: entry.Attr(nameAttr), Type: userType}, nil
+}
+
+// UserType maps the group DNs of the user to a type. Admin groups take precedence. DNs are compared case insensitively.
+func (d *LDAPDirectory) UserType(groups []string) (UserType, error) {
+	in := func(dns []string, g string) bool {
+		for _, dn := range dns {
+			if strings.EqualFold(dn, g) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, g := range groups {
+		if in(d.AdminGroups, g) {
+			return UserTypeAdmin, nil
+		}
+	}
+	for _, g := range groups {
+		if in(d.UserGroups, g) {
+			return UserTypeUser, nil
+		}
+	}
+	return 0, ErrLDAPNoRole
+}
@@ -0,0 +1,239 @@
+package domain
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/download/util"
+)
+
+type fakeLDAPEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// fakeLDAPServer is an in-process directory that supports simple bind, search and StartTLS
+type fakeLDAPServer struct {
+	t          *testing.T
+	l          net.Listener
+	tls        *tls.Config
+	entries    []*fakeLDAPEntry
+	requireTLS bool
+}
+
+func newFakeLDAPServer(t *testing.T) *fakeLDAPServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "localhost"}, DNSNames: []string{"localhost"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeLDAPServer{t: t, l: l, tls: &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}}
+	s.entries = []*fakeLDAPEntry{
+		{dn: "CN=svc,OU=Service,DC=corp,DC=com", password: "svc-secret"},
+		{dn: "CN=Jane Doe,OU=Staff,DC=corp,DC=com", password: "jane-secret", attrs: map[string][]string{
+			"sAMAccountName": {"jdoe"}, "mail": {"jdoe@corp.com"}, "displayName": {"Jane Doe"},
+			"memberOf": {"CN=Support,OU=Groups,DC=corp,DC=com", "CN=Everyone,OU=Groups,DC=corp,DC=com"}}},
+		{dn: "CN=Bob,OU=Staff,DC=corp,DC=com", password: "bob-secret", attrs: map[string][]string{
+			"sAMAccountName": {"bob"}, "memberOf": {"CN=Everyone,OU=Groups,DC=corp,DC=com"}}},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeLDAPServer) url() string {
+	_, port, _ := net.SplitHostPort(s.l.Addr().String())
+	return "ldap://localhost:" + port
+}
+
+func (s *fakeLDAPServer) rootCAs() *x509.CertPool {
+	cert, _ := x509.ParseCertificate(s.tls.Certificates[0].Certificate[0])
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}
+
+func (s *fakeLDAPServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func result(op byte, code int64) []byte {
+	return util.BERConstruct(util.BERApplication|op, util.BERInt(util.BEREnumerated, code), util.BER(util.BEROctetString, nil), util.BER(util.BEROctetString, nil))
+}
+
+func (s *fakeLDAPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := io.Reader(bufio.NewReader(conn))
+	secure := false
+	for {
+		msg, err := util.ReadBER(r)
+		if err != nil {
+			return
+		}
+		id, op := msg.Child(0), msg.Child(1)
+		reply := func(ops ...[]byte) {
+			for _, o := range ops {
+				conn.Write(util.BERConstruct(util.BERSequence, util.BERInt(util.BERInteger, id.Int()), o))
+			}
+		}
+		switch op.Tag &^ util.BERConstructed {
+		case util.BERApplication | 0:
+			if s.requireTLS && !secure {
+				reply(result(1, util.LDAPUnwillingToPerform))
+				continue
+			}
+			code := int64(util.LDAPInvalidCredentials)
+			for _, e := range s.entries {
+				if strings.EqualFold(e.dn, op.Child(1).String()) && e.password == op.Child(2).String() {
+					code = util.LDAPSuccess
+				}
+			}
+			reply(result(1, code))
+		case util.BERApplication | 2:
+			return
+		case util.BERApplication | 3:
+			var ops [][]byte
+			for _, e := range s.entries {
+				if e.attrs == nil || !strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(op.Child(0).String())) || !matchLDAPFilter(op.Child(6), e) {
+					continue
+				}
+				var attrs [][]byte
+				for _, name := range op.Child(7).Children {
+					var vals [][]byte
+					for _, v := range e.attrs[name.String()] {
+						vals = append(vals, util.BER(util.BEROctetString, []byte(v)))
+					}
+					attrs = append(attrs, util.BERConstruct(util.BERSequence, util.BER(util.BEROctetString, name.Value), util.BERConstruct(util.BERSet, vals...)))
+				}
+				ops = append(ops, util.BERConstruct(util.BERApplication|4, util.BER(util.BEROctetString, []byte(e.dn)), util.BERConstruct(util.BERSequence, attrs...)))
+			}
+			reply(append(ops, result(5, util.LDAPSuccess))...)
+		case util.BERApplication | 23:
+			reply(result(24, util.LDAPSuccess))
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, r, secure = tlsConn, tlsConn, true
+		}
+	}
+}
+
+// matchLDAPFilter evaluates and, or, not, equality and presence filters
+func matchLDAPFilter(f *util.BERElement, e *fakeLDAPEntry) bool {
+	switch f.Tag {
+	case util.BERContext | util.BERConstructed | 0:
+		for _, c := range f.Children {
+			if !matchLDAPFilter(c, e) {
+				return false
+			}
+		}
+		return true
+	case util.BERContext | util.BERConstructed | 1:
+		for _, c := range f.Children {
+			if matchLDAPFilter(c, e) {
+				return true
+			}
+		}
+		return false
+	case util.BERContext | util.BERConstructed | 2:
+		return !matchLDAPFilter(f.Child(0), e)
+	case util.BERContext | util.BERConstructed | 3:
+		for _, v := range e.attrs[f.Child(0).String()] {
+			if strings.EqualFold(v, f.Child(1).String()) {
+				return true
+			}
+		}
+		return false
+	case util.BERContext | 7:
+		return len(e.attrs[f.String()]) > 0
+	}
+	return false
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	s := newFakeLDAPServer(t)
+	defer s.l.Close()
+	// Binds fail unless the connection was upgraded
+	s.requireTLS = true
+	d := &LDAPDirectory{
+		URL:          s.url(),
+		StartTLS:     true,
+		TLSConfig:    &tls.Config{RootCAs: s.rootCAs()},
+		BindDN:       "CN=svc,OU=Service,DC=corp,DC=com",
+		BindPassword: "svc-secret",
+		BaseDN:       "DC=corp,DC=com",
+		UserFilter:   "(&(sAMAccountName=%s)(mail=*))",
+		AdminGroups:  []string{"cn=admins,ou=groups,dc=corp,dc=com"},
+		UserGroups:   []string{"cn=support,ou=groups,dc=corp,dc=com"},
+		Timeout:      5 * time.Second,
+	}
+	u, err := d.Authenticate("jdoe", "jane-secret")
+	if err != nil {
+		t.Fatalf("Unable to authenticate - %v", err)
+	}
+	if u.Username != "jdoe" || u.Email != "jdoe@corp.com" || u.Name != "Jane Doe" || u.Type != UserTypeUser {
+		t.Errorf("Unexpected user %#v", u)
+	}
+	if _, err = d.Authenticate("jdoe", "wrong"); err != ErrLDAPCredentials {
+		t.Errorf("Expected wrong password to fail, got %v", err)
+	}
+	if _, err = d.Authenticate("jdoe", ""); err != ErrLDAPCredentials {
+		t.Errorf("Expected empty password to fail, got %v", err)
+	}
+	if _, err = d.Authenticate("*", "jane-secret"); err != ErrLDAPCredentials {
+		t.Errorf("Expected the username to be escaped, got %v", err)
+	}
+	if _, err = d.Authenticate("nobody", "jane-secret"); err != ErrLDAPCredentials {
+		t.Errorf("Expected unknown user to fail, got %v", err)
+	}
+	d.UserFilter = "(sAMAccountName=%s)"
+	if _, err = d.Authenticate("bob", "bob-secret"); err != ErrLDAPNoRole {
+		t.Errorf("Expected user without a mapped group to fail, got %v", err)
+	}
+	d.StartTLS = false
+	if _, err = d.Authenticate("jdoe", "jane-secret"); !util.IsLDAPError(err, util.LDAPUnwillingToPerform) {
+		t.Errorf("Expected the server to require TLS, got %v", err)
+	}
+}
+
+func TestLDAPFilter(t *testing.T) {
+	for _, f := range []string{"(cn=a)", "(&(objectClass=user)(|(cn=a\\2a)(!(mail=*))))"} {
+		if _, err := util.CompileLDAPFilter(f); err != nil {
+			t.Errorf("Unable to compile %s - %v", f, err)
+		}
+	}
+	for _, f := range []string{"", "cn=a", "(cn=a", "(cn=a*)", "(!(cn=a)(cn=b))", "(cn=a))", "(cn=\\2)"} {
+		if _, err := util.CompileLDAPFilter(f); err == nil {
+			t.Errorf("Expected %s to be rejected", f)
+		}
+	}
+	if util.EscapeLDAPFilter("a*(b)\\") != "a\\2a\\28b\\29\\5c" {
+		t.Errorf("Unexpected escaping %s", util.EscapeLDAPFilter("a*(b)\\"))
+	}
+}
@@ -0,0 +1,46 @@
+package domain
+
+import "time"
+
+// TokenEventType is the kind of change recorded in the token ledger
+type TokenEventType string
+
+const (
+	// TokenEventIssued when the token is generated
+	TokenEventIssued TokenEventType = "issued"
+	// TokenEventToppedUp when an admin adds downloads to the token
+	TokenEventToppedUp TokenEventType = "topped_up"
+	// TokenEventSet when an admin overrides the downloads of the token
+	TokenEventSet TokenEventType = "set"
+	// TokenEventConsumed when the token is used for a download
+	TokenEventConsumed TokenEventType = "consumed"
+	// TokenEventRefunded when a download is given back to the token
+	TokenEventRefunded TokenEventType = "refunded"
+	// TokenEventRevoked when the token is revoked
+	TokenEventRevoked TokenEventType = "revoked"
+)
+
+// TokenEvent is a single entry in the append only ledger of a token.
+// The sum of the deltas of all the events of a token should be equal to its downloads.
+type TokenEvent struct {
+	ID    int64          `json:"id"`
+	Token string         `json:"token"`
+	Type  TokenEventType `json:"type"`
+	// Delta is the change in the downloads of the token
+	Delta int `json:"delta"`
+	// Balance is the downloads of the token after the event
+	Balance   int       `json:"balance"`
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+// TokenHistory is the ledger of a token along with the check against the current balance
+type TokenHistory struct {
+	Token  *Token       `json:"token"`
+	Events []TokenEvent `json:"events"`
+	// LedgerBalance is the sum of all the event deltas
+	LedgerBalance int `json:"ledgerBalance"`
+	// Consistent is true if the ledger balance matches the token downloads
+	Consistent bool `json:"consistent"`
+}
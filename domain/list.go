@@ -0,0 +1,32 @@
+package domain
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/demisto/download/util"
+)
+
+// StringList is a list of strings that is stored as a comma separated value
+type StringList []string
+
+// Value implements driver.Valuer
+func (l StringList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+// Scan implements sql.Scanner
+func (l *StringList) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case nil:
+		*l = nil
+	case []byte:
+		*l = util.SplitOrEmpty(string(src))
+	case string:
+		*l = util.SplitOrEmpty(src)
+	default:
+		return fmt.Errorf("Unable to scan %T into string list", src)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"errors"
+	"time"
+
+	"github.com/demisto/download/util"
+)
+
+// ErrLoginLinkInvalid is returned when a link is used after it expired or for another kind
+var ErrLoginLinkInvalid = errors.New("Link is invalid or has expired")
+
+// The kinds of emailed links. A link can only be used for its kind.
+const (
+	LoginLinkSignIn        = "sign-in"
+	LoginLinkPasswordReset = "password-reset"
+)
+
+const (
+	// LoginLinkTimeout is how long an emailed link can be used
+	LoginLinkTimeout = 15 * time.Minute
+	// loginLinkRandomSize is the length of the random ID in the link
+	loginLinkRandomSize = 32
+)
+
+// LoginLink is a one time link emailed to a user to sign in or reset the password. Like sessions, only the digest of
+// the ID is stored and the link is deleted when used.
+type LoginLink struct {
+	// ID is the digest of the plain ID
+	ID string `json:"id"`
+	// Plain is the ID in the link. It is never stored.
+	Plain     string    `json:"-" db:"-"`
+	Username  string    `json:"username"`
+	Kind      string    `json:"kind"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	ExpiresAt time.Time `json:"expiresAt" db:"expires_at"`
+}
+
+// NewLoginLink of the given kind for the user
+func NewLoginLink(username, kind string) *LoginLink {
+	plain := util.SecureRandomString(loginLinkRandomSize, false)
+	now := time.Now()
+	return &LoginLink{ID: TokenDigest(plain), Plain: plain, Username: username, Kind: kind, CreatedAt: now, ExpiresAt: now.Add(LoginLinkTimeout)}
+}
+
+// Valid checks that the link is of the given kind and did not expire
+func (l *LoginLink) Valid(kind string, now time.Time) error {
+	if l.Kind != kind || !now.Before(l.ExpiresAt) {
+		return ErrLoginLinkInvalid
+	}
+	return nil
+}
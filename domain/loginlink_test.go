@@ -0,0 +1,22 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewLoginLink(t *testing.T) {
+	l := NewLoginLink("customer", LoginLinkSignIn)
+	if l.ID != TokenDigest(l.Plain) || l.Plain == NewLoginLink("customer", LoginLinkSignIn).Plain || l.ExpiresAt.Sub(l.CreatedAt) != LoginLinkTimeout {
+		t.Errorf("Unexpected link %#v", l)
+	}
+	if err := l.Valid(LoginLinkSignIn, l.CreatedAt.Add(time.Minute)); err != nil {
+		t.Errorf("Expected valid link - %v", err)
+	}
+	if err := l.Valid(LoginLinkPasswordReset, l.CreatedAt.Add(time.Minute)); err != ErrLoginLinkInvalid {
+		t.Errorf("Expected a sign-in link to be invalid for password reset but got %v", err)
+	}
+	if err := l.Valid(LoginLinkSignIn, l.ExpiresAt); err != ErrLoginLinkInvalid {
+		t.Errorf("Expected expired link but got %v", err)
+	}
+}
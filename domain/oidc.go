@@ -0,0 +1,432 @@
+package domain
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/demisto/download/util"
+)
+
+var (
+	// ErrOIDCInvalidToken is returned when the ID token does not verify
+	ErrOIDCInvalidToken = errors.New("Invalid OIDC ID token")
+	// ErrOIDCNoRole is returned when the user is not in any of the groups mapped to a user type
+	ErrOIDCNoRole = errors.New("User is not in any group that is allowed to sign in")
+)
+
+const (
+	// oidcClockSkew is the allowed difference between our clock and the IdP clock
+	oidcClockSkew = 2 * time.Minute
+	// oidcKeysRefresh is the minimum time between fetching the IdP keys when a token is signed with an unknown key
+	oidcKeysRefresh = time.Minute
+)
+
+// OIDCProvider is an OpenID Connect relying party using the authorization code flow with PKCE.
+// The IdP endpoints are discovered on first use.
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Scopes in addition to openid
+	Scopes []string
+	// UsernameClaim is the claim used as the username. Default is email.
+	UsernameClaim string
+	// GroupsClaim is the claim with the groups of the user. Default is groups.
+	GroupsClaim string
+	// AdminGroups are the groups whose members are admins
+	AdminGroups []string
+	// UserGroups are the groups whose members are customers
+	UserGroups []string
+	Client     *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+// OIDCClaims are the claims of a verified ID token we use
+type OIDCClaims struct {
+	Subject  string
+	Username string
+	Email    string
+	Name     string
+	Groups   []string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewOIDCSecret returns a random value for the state, nonce and PKCE verifier
+func NewOIDCSecret() string {
+	return util.SecureRandomString(43, false)
+}
+
+// pkceChallenge is the S256 code challenge of the verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *OIDCProvider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return http.DefaultClient
+}
+
+func (p *OIDCProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client().Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d from %s", resp.StatusCode, u)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover the IdP endpoints once
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	d := &oidcDiscovery{}
+	if err := p.getJSON(strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("OIDC issuer %s does not match the configured %s", d.Issuer, p.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document is missing endpoints")
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// AuthCodeURL returns the IdP URL the user is redirected to
+func (p *OIDCProvider) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange the authorization code for the ID token and verify it
+func (p *OIDCProvider) Exchange(code, verifier, nonce string) (*OIDCClaims, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || res.Error != "" {
+		return nil, fmt.Errorf("OIDC token request failed with status %d - %s %s", resp.StatusCode, res.Error, res.ErrorDescription)
+	}
+	if res.IDToken == "" {
+		return nil, errors.New("OIDC token response has no ID token")
+	}
+	return p.VerifyIDToken(res.IDToken, nonce, time.Now())
+}
+
+// key returns the IdP key with the given ID, fetching the keys again if it is unknown
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetchedAt) < oidcKeysRefresh {
+		return nil, ErrOIDCInvalidToken
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err = p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keysFetchedAt = time.Now()
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if k, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = k
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, ErrOIDCInvalidToken
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrOIDCInvalidToken
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil || k.Crv != "P-256" {
+			return nil, ErrOIDCInvalidToken
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, ErrOIDCInvalidToken
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", k.Kty)
+}
+
+// verifyJWT checks the signature of a compact JWT and returns its claims
+func (p *OIDCProvider) verifyJWT(raw string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrOIDCInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil {
+		return nil, ErrOIDCInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrOIDCInvalidToken
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	ok := false
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		ok = header.Alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS uses the raw R and S concatenation and not ASN.1
+		ok = header.Alg == "ES256" && len(signature) == 64 &&
+			ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+	}
+	if !ok {
+		return nil, ErrOIDCInvalidToken
+	}
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrOIDCInvalidToken
+	}
+	claims := make(map[string]interface{})
+	decoder := json.NewDecoder(strings.NewReader(string(b)))
+	decoder.UseNumber()
+	if err = decoder.Decode(&claims); err != nil {
+		return nil, ErrOIDCInvalidToken
+	}
+	return claims, nil
+}
+
+// claimTime returns the numeric date claim
+func claimTime(claims map[string]interface{}, name string) (time.Time, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, err := n.Int64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// claimStrings returns a claim that can be a string or a list of strings
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		res := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// VerifyIDToken verifies the signature, issuer, audience, expiration and nonce of the ID token
+func (p *OIDCProvider) VerifyIDToken(raw, nonce string, now time.Time) (*OIDCClaims, error) {
+	claims, err := p.verifyJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return nil, ErrOIDCInvalidToken
+	}
+	aud := claimStrings(claims, "aud")
+	if !util.In(aud, p.ClientID) {
+		return nil, ErrOIDCInvalidToken
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.ClientID || !ok && len(aud) > 1 {
+		return nil, ErrOIDCInvalidToken
+	}
+	exp, ok := claimTime(claims, "exp")
+	if !ok || !now.Before(exp.Add(oidcClockSkew)) {
+		return nil, ErrOIDCInvalidToken
+	}
+	if iat, ok := claimTime(claims, "iat"); ok && iat.After(now.Add(oidcClockSkew)) {
+		return nil, ErrOIDCInvalidToken
+	}
+	if n, _ := claims["nonce"].(string); nonce == "" || n != nonce {
+		return nil, ErrOIDCInvalidToken
+	}
+	c := &OIDCClaims{Groups: claimStrings(claims, p.groupsClaim())}
+	c.Subject, _ = claims["sub"].(string)
+	c.Email, _ = claims["email"].(string)
+	c.Name, _ = claims["name"].(string)
+	c.Username, _ = claims[p.usernameClaim()].(string)
+	if c.Subject == "" || c.Username == "" {
+		return nil, ErrOIDCInvalidToken
+	}
+	// Do not trust an email the IdP did not verify, either as the username or as where we send links and tokens
+	if !emailVerified(claims) {
+		if p.usernameClaim() == "email" {
+			return nil, ErrOIDCInvalidToken
+		}
+		c.Email = ""
+	}
+	return c, nil
+}
+
+// emailVerified checks the email_verified claim is true. Some IdPs send it as a string.
+func emailVerified(claims map[string]interface{}) bool {
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// ExternalID identifies the user of the claims across sign-ins. The subject is only unique for the issuer.
+func (p *OIDCProvider) ExternalID(c *OIDCClaims) string {
+	return p.Issuer + "#" + c.Subject
+}
+
+func (p *OIDCProvider) usernameClaim() string {
+	if p.UsernameClaim == "" {
+		return "email"
+	}
+	return p.UsernameClaim
+}
+
+func (p *OIDCProvider) groupsClaim() string {
+	if p.GroupsClaim == "" {
+		return "groups"
+	}
+	return p.GroupsClaim
+}
+
+// UserType maps the groups of the user to the user type. Admin groups take precedence.
+func (p *OIDCProvider) UserType(c *OIDCClaims) (UserType, error) {
+	for _, g := range c.Groups {
+		if util.In(p.AdminGroups, g) {
+			return UserTypeAdmin, nil
+		}
+	}
+	for _, g := range c.Groups {
+		if util.In(p.UserGroups, g) {
+			return UserTypeUser, nil
+		}
+	}
+	return 0, ErrOIDCNoRole
+}
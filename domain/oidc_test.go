@@ -0,0 +1,171 @@
+package domain
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIdP is an in-process OIDC provider that issues a code for the next login
+type fakeIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// claims of the next ID token
+	claims map[string]interface{}
+	// challenge is the PKCE challenge of the pending code
+	challenge string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{t: t, key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.FormValue("code") != "the-code" || id != "download" || secret != "s3cret" || pkceChallenge(r.FormValue("code_verifier")) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(idp.claims), "token_type": "Bearer"})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *fakeIdP) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (idp *fakeIdP) idToken(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss": idp.server.URL, "aud": "download", "sub": "1234", "nonce": nonce,
+		"email": "jane@demisto.com", "email_verified": true, "name": "Jane",
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+		"groups": []string{"staff", "download-admins"},
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.server.Close()
+	p := &OIDCProvider{Issuer: idp.server.URL, ClientID: "download", ClientSecret: "s3cret", RedirectURL: "https://download.demisto.com/login/oidc/callback",
+		AdminGroups: []string{"download-admins"}, UserGroups: []string{"staff"}}
+	state, nonce, verifier := NewOIDCSecret(), NewOIDCSecret(), NewOIDCSecret()
+	authURL, err := p.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil || !strings.HasPrefix(authURL, idp.server.URL+"/authorize?") {
+		t.Fatalf("Unexpected authorization URL %s", authURL)
+	}
+	q := u.Query()
+	if q.Get("state") != state || q.Get("nonce") != nonce || q.Get("code_challenge_method") != "S256" || q.Get("scope") != "openid" {
+		t.Fatalf("Unexpected authorization parameters %v", q)
+	}
+	idp.challenge, idp.claims = q.Get("code_challenge"), idp.idToken(nonce)
+
+	if _, err = p.Exchange("the-code", NewOIDCSecret(), nonce); err == nil {
+		t.Error("Exchange with the wrong PKCE verifier should fail")
+	}
+	if _, err = p.Exchange("the-code", verifier, NewOIDCSecret()); err != ErrOIDCInvalidToken {
+		t.Errorf("Exchange with the wrong nonce should fail but got %v", err)
+	}
+	c, err := p.Exchange("the-code", verifier, nonce)
+	if err != nil {
+		t.Fatalf("Unable to exchange code - %v", err)
+	}
+	if c.Username != "jane@demisto.com" || c.Subject != "1234" || c.Name != "Jane" {
+		t.Errorf("Unexpected claims %#v", c)
+	}
+	if userType, err := p.UserType(c); err != nil || userType != UserTypeAdmin {
+		t.Errorf("Expected admin but got %v %v", userType, err)
+	}
+	if userType, err := p.UserType(&OIDCClaims{Groups: []string{"staff"}}); err != nil || userType != UserTypeUser {
+		t.Errorf("Expected customer but got %v %v", userType, err)
+	}
+	if _, err := p.UserType(&OIDCClaims{Groups: []string{"sales"}}); err != ErrOIDCNoRole {
+		t.Errorf("Expected no role but got %v", err)
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.server.Close()
+	p := &OIDCProvider{Issuer: idp.server.URL, ClientID: "download"}
+	now := time.Now()
+	tests := []struct {
+		name   string
+		modify func(map[string]interface{})
+		valid  bool
+	}{
+		{"valid", func(c map[string]interface{}) {}, true},
+		{"issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.com" }, false},
+		{"audience", func(c map[string]interface{}) { c["aud"] = "other" }, false},
+		{"audiences", func(c map[string]interface{}) { c["aud"] = []string{"other", "download"} }, false},
+		{"authorized party", func(c map[string]interface{}) { c["aud"], c["azp"] = []string{"other", "download"}, "download" }, true},
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() }, false},
+		{"unverified email", func(c map[string]interface{}) { c["email_verified"] = false }, false},
+		{"email not known to be verified", func(c map[string]interface{}) { delete(c, "email_verified") }, false},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }, false},
+	}
+	for _, test := range tests {
+		claims := idp.idToken("nonce")
+		test.modify(claims)
+		_, err := p.VerifyIDToken(idp.sign(claims), "nonce", now)
+		if test.valid && err != nil || !test.valid && err == nil {
+			t.Errorf("%s: expected valid %v but got %v", test.name, test.valid, err)
+		}
+	}
+	// An unverified email is dropped when it is not the username
+	bySubject := &OIDCProvider{Issuer: idp.server.URL, ClientID: "download", UsernameClaim: "sub"}
+	claims := idp.idToken("nonce")
+	delete(claims, "email_verified")
+	if c, err := bySubject.VerifyIDToken(idp.sign(claims), "nonce", now); err != nil || c.Username != "1234" || c.Email != "" {
+		t.Errorf("Expected the unverified email to be dropped but got %#v %v", c, err)
+	}
+	token := idp.sign(idp.idToken("nonce"))
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(map[string]interface{}{"iss": idp.server.URL, "aud": "download", "sub": "1", "email": "admin@demisto.com", "nonce": "nonce", "exp": now.Add(time.Hour).Unix()})
+	if _, err := p.VerifyIDToken(parts[0]+"."+base64.RawURLEncoding.EncodeToString(forged)+"."+parts[2], "nonce", now); err == nil {
+		t.Error("Token with a forged payload should fail")
+	}
+}
@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrPoolUsed is returned when the organization has no downloads left in its pool
+var ErrPoolUsed = errors.New("Organization download pool is fully used")
+
+// Organization is a customer that owns a shared pool of downloads and entitlements.
+// Users attached to the organization draw their downloads from the pool.
+type Organization struct {
+	Name string `json:"name"`
+	// Downloads left in the shared pool
+	Downloads int `json:"downloads"`
+	// Scope limits the downloads of the organization users. Empty means any unrestricted download.
+	Scope Scope `json:"scope,omitempty"`
+	// Versions is an optional semver constraint the download version must satisfy
+	Versions   string    `json:"versions,omitempty"`
+	ModifyDate time.Time `json:"modifyDate" db:"modify_date"`
+}
+
+// Valid checks that the pool still has downloads
+func (o *Organization) Valid() error {
+	if o.Downloads < 1 {
+		return ErrPoolUsed
+	}
+	return nil
+}
+
+// Allows checks if the organization entitlements allow the given download
+func (o *Organization) Allows(d *Download) error {
+	return allows(o.Scope, o.Versions, d)
+}
+
+// OrganizationUsage summarizes the downloads of an organization
+type OrganizationUsage struct {
+	Name string `json:"name"`
+	// Downloads left in the pool
+	Downloads int `json:"downloads"`
+	// Used is the number of downloads by the organization users
+	Used int `json:"used"`
+	// Users attached to the organization
+	Users int `json:"users"`
+	// LastDownload is the last time one of the users downloaded. Nil if never.
+	LastDownload *time.Time `json:"lastDownload,omitempty" db:"last_download"`
+}
@@ -0,0 +1,65 @@
+package domain
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrPasswordBreached is returned when the password appears in the breached passwords list
+	ErrPasswordBreached = errors.New("Password appears in a list of breached passwords")
+	// ErrPasswordPersonal is returned when the password is the username or email of the user
+	ErrPasswordPersonal = errors.New("Password must not be the username or email")
+)
+
+// maxPasswordLength is the longest password bcrypt can hash
+const maxPasswordLength = 72
+
+// PasswordPolicy is what a password must satisfy when it is set
+type PasswordPolicy struct {
+	MinLength int
+	// breached are the lower cased breached passwords
+	breached map[string]bool
+}
+
+// NewPasswordPolicy with the given min length and the breached passwords file (one password per line).
+// The breached passwords file is optional.
+func NewPasswordPolicy(minLength int, breachedFile string) (*PasswordPolicy, error) {
+	p := &PasswordPolicy{MinLength: minLength, breached: make(map[string]bool)}
+	if breachedFile == "" {
+		return p, nil
+	}
+	f, err := os.Open(breachedFile)
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			p.breached[strings.ToLower(line)] = true
+		}
+	}
+	return p, scanner.Err()
+}
+
+// Validate checks the password the user wants to set against the policy
+func (p *PasswordPolicy) Validate(password string, u *User) error {
+	if len(password) < p.MinLength {
+		return fmt.Errorf("Password must be at least %d characters long", p.MinLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("Password must be at most %d characters long", maxPasswordLength)
+	}
+	lower := strings.ToLower(password)
+	if u != nil && (lower == strings.ToLower(u.Username) || u.Email != "" && lower == strings.ToLower(u.Email)) {
+		return ErrPasswordPersonal
+	}
+	if p.breached[lower] {
+		return ErrPasswordBreached
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package domain
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	f, err := ioutil.TempFile("", "breached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("123456\nCorrectHorseBattery\n\n")
+	f.Close()
+	p, err := NewPasswordPolicy(8, f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &User{Username: "admin1234", Email: "admin@acme.com"}
+	tests := []struct {
+		password string
+		valid    bool
+	}{
+		{"short", false},
+		{"correcthorsebattery", false},
+		{"Admin1234", false},
+		{"admin@acme.com", false},
+		{"long enough and unique", true},
+	}
+	for _, test := range tests {
+		if err := p.Validate(test.password, u); (err == nil) != test.valid {
+			t.Errorf("Password [%s] expected valid %v but got %v", test.password, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"fmt"
+
+	"github.com/demisto/download/util"
+)
+
+// Permission is an action that routes require
+type Permission string
+
+// The permissions
+const (
+	// PermissionDownload allows downloading content
+	PermissionDownload Permission = "download"
+	// PermissionUpload allows uploading new versions and listing the downloads
+	PermissionUpload Permission = "upload"
+	// PermissionPublish is kept for releasing builds to customers. Organizations and their SAML providers grant
+	// downloads and sign-ins so they require PermissionIssueTokens and PermissionManageUsers instead.
+	PermissionPublish Permission = "publish"
+	// PermissionIssueTokens allows generating, changing, importing and exporting tokens
+	PermissionIssueTokens Permission = "issue-tokens"
+	// PermissionReadLog allows reading the download log and the usage of organizations
+	PermissionReadLog Permission = "read-log"
+	// PermissionManageUsers allows creating and changing users, their roles and sessions, and API keys.
+	// Since users with it can assign any role, it should only be granted to admins.
+	PermissionManageUsers Permission = "manage-users"
+	// PermissionReadAudit allows reading and verifying the audit log of administrative actions
+	PermissionReadAudit Permission = "read-audit"
+)
+
+// Permissions are all the valid permissions
+var Permissions = []Permission{PermissionDownload, PermissionUpload, PermissionPublish, PermissionIssueTokens, PermissionReadLog, PermissionManageUsers, PermissionReadAudit}
+
+// The built in roles. Users without roles get the default role of their type.
+const (
+	RoleAdmin           = "admin"
+	RoleCustomer        = "customer"
+	RoleReleaseEngineer = "release-engineer"
+	RoleSupport         = "support"
+)
+
+// Roles maps role names to their permissions
+type Roles map[string][]Permission
+
+// NewRoles returns the built in roles with the custom roles added. A custom role with the name of a built in
+// role replaces it.
+func NewRoles(custom map[string][]string) (Roles, error) {
+	roles := Roles{
+		RoleAdmin:           Permissions,
+		RoleCustomer:        {PermissionDownload},
+		RoleReleaseEngineer: {PermissionUpload, PermissionPublish, PermissionDownload},
+		RoleSupport:         {PermissionIssueTokens, PermissionReadLog, PermissionDownload},
+	}
+	for name, permissions := range custom {
+		roles[name] = nil
+		for _, p := range permissions {
+			if !util.In(Permissions, Permission(p)) {
+				return nil, fmt.Errorf("Invalid permission [%s] in role %s", p, name)
+			}
+			roles[name] = append(roles[name], Permission(p))
+		}
+	}
+	return roles, nil
+}
+
+// Validate checks that all the roles exist
+func (r Roles) Validate(names []string) error {
+	for _, name := range names {
+		if _, ok := r[name]; !ok {
+			return fmt.Errorf("Unknown role [%s]", name)
+		}
+	}
+	return nil
+}
+
+// Allows checks if any of the roles of the user has the permission
+func (r Roles) Allows(u *User, p Permission) bool {
+	for _, name := range u.RoleNames() {
+		if util.In(r[name], p) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleNames returns the roles of the user or the default role of the user type if none were assigned
+func (u *User) RoleNames() []string {
+	if len(u.Roles) > 0 {
+		return u.Roles
+	}
+	if u.Type == UserTypeAdmin {
+		return []string{RoleAdmin}
+	}
+	return []string{RoleCustomer}
+}
@@ -0,0 +1,39 @@
+package domain
+
+import "testing"
+
+func TestRoles(t *testing.T) {
+	roles, err := NewRoles(map[string][]string{"auditor": {"read-log"}, RoleSupport: {"issue-tokens"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user    *User
+		allowed []Permission
+		denied  []Permission
+	}{
+		{&User{Type: UserTypeAdmin}, Permissions, nil},
+		{&User{Type: UserTypeUser}, []Permission{PermissionDownload}, []Permission{PermissionUpload, PermissionReadLog}},
+		{&User{Type: UserTypeAdmin, Roles: StringList{RoleReleaseEngineer}}, []Permission{PermissionUpload, PermissionPublish}, []Permission{PermissionIssueTokens, PermissionReadLog, PermissionManageUsers}},
+		{&User{Type: UserTypeAdmin, Roles: StringList{"auditor", RoleSupport}}, []Permission{PermissionReadLog, PermissionIssueTokens}, []Permission{PermissionDownload, PermissionUpload}},
+		{&User{Type: UserTypeAdmin, Roles: StringList{"removed"}}, nil, Permissions},
+	}
+	for _, test := range tests {
+		for _, p := range test.allowed {
+			if !roles.Allows(test.user, p) {
+				t.Errorf("Expected roles %v to allow %s", test.user.RoleNames(), p)
+			}
+		}
+		for _, p := range test.denied {
+			if roles.Allows(test.user, p) {
+				t.Errorf("Expected roles %v to deny %s", test.user.RoleNames(), p)
+			}
+		}
+	}
+	if roles.Validate([]string{RoleAdmin, "auditor"}) != nil || roles.Validate([]string{"removed"}) == nil {
+		t.Error("Unexpected role validation")
+	}
+	if _, err = NewRoles(map[string][]string{"bad": {"everything"}}); err == nil {
+		t.Error("Expected an unknown permission to fail")
+	}
+}
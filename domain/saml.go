@@ -0,0 +1,335 @@
+package domain
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/demisto/download/util"
+)
+
+// SAML namespaces and values
+const (
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlProtocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlMetadataNS  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlRedirect    = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlPost        = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlSuccess     = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	// samlClockSkew is the allowed difference between our clock and the IdP clock
+	samlClockSkew = 2 * time.Minute
+)
+
+// ErrSAMLInvalid is returned when the SAML response is not valid for us
+var ErrSAMLInvalid = errors.New("Invalid SAML response")
+
+// SAMLProvider is the SAML IdP of a customer organization. Users that sign in through it become users of the organization.
+type SAMLProvider struct {
+	Organization string `json:"organization"`
+	// EntityID of the IdP which must be the issuer of the assertions
+	EntityID string `json:"entityId" db:"entity_id"`
+	// SSOURL is where authentication requests are sent with the HTTP-Redirect binding
+	SSOURL string `json:"ssoUrl" db:"sso_url"`
+	// Certificate is the PEM encoded certificate the IdP signs assertions with
+	Certificate string `json:"certificate"`
+	// EmailAttribute is the attribute with the user email. If empty, the NameID is used.
+	EmailAttribute string `json:"emailAttribute" db:"email_attribute"`
+	// NameAttribute is the attribute with the user display name
+	NameAttribute string    `json:"nameAttribute" db:"name_attribute"`
+	ModifyDate    time.Time `json:"modifyDate" db:"modify_date"`
+}
+
+// SAMLAssertion is the verified content of an assertion
+type SAMLAssertion struct {
+	ID     string
+	NameID string
+	Email  string
+	Name   string
+	// NotOnOrAfter is when the assertion can no longer be used
+	NotOnOrAfter time.Time
+	Attributes   map[string][]string
+}
+
+// ServiceProvider is our side of SAML
+type ServiceProvider struct {
+	// EntityID identifies us to the IdPs and is the audience of the assertions
+	EntityID string
+	// ACSURL is the assertion consumer service where the IdPs post the responses
+	ACSURL string
+}
+
+// ParseCertificate parses the PEM certificate of the provider
+func (p *SAMLProvider) ParseCertificate() (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(p.Certificate))
+	if block == nil {
+		// Metadata has the base64 DER without the PEM armor
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(p.Certificate), ""))
+		if err != nil {
+			return nil, errors.New("Invalid SAML certificate")
+		}
+		return x509.ParseCertificate(der)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Validate the provider configuration
+func (p *SAMLProvider) Validate() error {
+	if p.Organization == "" || p.EntityID == "" {
+		return errors.New("Organization and entity ID are required")
+	}
+	if u, err := url.Parse(p.SSOURL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("Invalid SSO URL [%s]", p.SSOURL)
+	}
+	if _, err := p.ParseCertificate(); err != nil {
+		return fmt.Errorf("Invalid certificate - %v", err)
+	}
+	return nil
+}
+
+// ParseSAMLMetadata reads the entity ID, SSO URL and signing certificate from the IdP metadata
+func ParseSAMLMetadata(data []byte) (*SAMLProvider, error) {
+	root, err := util.ParseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	if !root.Is(samlMetadataNS, "EntityDescriptor") {
+		return nil, errors.New("Metadata must be an EntityDescriptor")
+	}
+	idp := root.Element(samlMetadataNS, "IDPSSODescriptor")
+	if idp == nil {
+		return nil, errors.New("Metadata has no IDPSSODescriptor")
+	}
+	p := &SAMLProvider{EntityID: root.Attr("entityID")}
+	for _, sso := range idp.Elements(samlMetadataNS, "SingleSignOnService") {
+		if sso.Attr("Binding") == samlRedirect {
+			p.SSOURL = sso.Attr("Location")
+		}
+	}
+	for _, kd := range idp.Elements(samlMetadataNS, "KeyDescriptor") {
+		if use := kd.Attr("use"); use != "" && use != "signing" {
+			continue
+		}
+		if ki := kd.Element(util.XMLDSigNamespace, "KeyInfo"); ki != nil {
+			if data := ki.Element(util.XMLDSigNamespace, "X509Data"); data != nil {
+				if cert := data.Element(util.XMLDSigNamespace, "X509Certificate"); cert != nil {
+					p.Certificate = strings.TrimSpace(cert.Text())
+					break
+				}
+			}
+		}
+	}
+	if p.SSOURL == "" || p.Certificate == "" {
+		return nil, errors.New("Metadata must have an HTTP-Redirect SSO service and a signing certificate")
+	}
+	return p, nil
+}
+
+// xmlEscaper escapes text and attribute values
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;")
+
+func xmlEscape(s string) string {
+	return xmlEscaper.Replace(s)
+}
+
+// Metadata returns the metadata customers configure their IdP with
+func (sp *ServiceProvider) Metadata() []byte {
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="` + samlMetadataNS + `" entityID="` + xmlEscape(sp.EntityID) + `">
+  <md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="` + samlProtocolNS + `">
+    <md:NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress</md:NameIDFormat>
+    <md:AssertionConsumerService Binding="` + samlPost + `" Location="` + xmlEscape(sp.ACSURL) + `" index="0" isDefault="true"/>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>
+`)
+}
+
+// NewSAMLRequestID returns a random ID for an authentication request. IDs must not start with a digit.
+func NewSAMLRequestID() string {
+	return "id-" + util.SecureRandomString(32, false)
+}
+
+// AuthnRequestURL returns the IdP URL with the authentication request using the HTTP-Redirect binding
+func (sp *ServiceProvider) AuthnRequestURL(p *SAMLProvider, id, relayState string, now time.Time) (string, error) {
+	req := `<samlp:AuthnRequest xmlns:samlp="` + samlProtocolNS + `" xmlns:saml="` + samlAssertionNS + `" ID="` + xmlEscape(id) +
+		`" Version="2.0" IssueInstant="` + now.UTC().Format(time.RFC3339) + `" Destination="` + xmlEscape(p.SSOURL) +
+		`" AssertionConsumerServiceURL="` + xmlEscape(sp.ACSURL) + `" ProtocolBinding="` + samlPost + `"><saml:Issuer>` +
+		xmlEscape(sp.EntityID) + `</saml:Issuer><samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	w.Write([]byte(req))
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(p.SSOURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(b.Bytes()))
+	q.Set("RelayState", relayState)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// samlTime parses an optional SAML time attribute
+func samlTime(e *util.XMLElement, name string) (time.Time, bool, error) {
+	v := e.Attr(name)
+	if v == "" {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, false, ErrSAMLInvalid
+	}
+	return t, true, nil
+}
+
+// ParseResponse verifies the base64 encoded response posted by the IdP for the request with the given ID and
+// returns the assertion. The assertion itself must be signed and only its signed content is used.
+func (sp *ServiceProvider) ParseResponse(p *SAMLProvider, encoded, requestID string, now time.Time) (*SAMLAssertion, error) {
+	cert, err := p.ParseCertificate()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return nil, ErrSAMLInvalid
+	}
+	resp, err := util.ParseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Is(samlProtocolNS, "Response") {
+		return nil, ErrSAMLInvalid
+	}
+	if d := resp.Attr("Destination"); d != "" && d != sp.ACSURL {
+		return nil, fmt.Errorf("SAML response destination %s does not match %s", d, sp.ACSURL)
+	}
+	if irt := resp.Attr("InResponseTo"); irt != "" && irt != requestID {
+		return nil, ErrSAMLInvalid
+	}
+	status := resp.Element(samlProtocolNS, "Status")
+	if status == nil {
+		return nil, ErrSAMLInvalid
+	}
+	if code := status.Element(samlProtocolNS, "StatusCode"); code == nil || code.Attr("Value") != samlSuccess {
+		return nil, errors.New("SAML sign-in was not successful")
+	}
+	assertions := resp.Elements(samlAssertionNS, "Assertion")
+	if len(assertions) != 1 {
+		return nil, ErrSAMLInvalid
+	}
+	signed, err := util.VerifyEnvelopedSignature(assertions[0], cert)
+	if err != nil {
+		return nil, err
+	}
+	// Everything below comes from the signed content only so nothing can be injected around it
+	a, err := util.ParseXML(signed)
+	if err != nil {
+		return nil, err
+	}
+	if issuer := a.Element(samlAssertionNS, "Issuer"); issuer == nil || strings.TrimSpace(issuer.Text()) != p.EntityID {
+		return nil, ErrSAMLInvalid
+	}
+	res := &SAMLAssertion{ID: a.Attr("ID"), Attributes: make(map[string][]string)}
+	if err = sp.checkConditions(a, now, res); err != nil {
+		return nil, err
+	}
+	if err = sp.checkSubject(a, requestID, now, res); err != nil {
+		return nil, err
+	}
+	if stmt := a.Element(samlAssertionNS, "AttributeStatement"); stmt != nil {
+		for _, attr := range stmt.Elements(samlAssertionNS, "Attribute") {
+			name := attr.Attr("Name")
+			for _, v := range attr.Elements(samlAssertionNS, "AttributeValue") {
+				res.Attributes[name] = append(res.Attributes[name], strings.TrimSpace(v.Text()))
+			}
+		}
+	}
+	res.Email = res.NameID
+	if p.EmailAttribute != "" {
+		if v := res.Attributes[p.EmailAttribute]; len(v) > 0 {
+			res.Email = v[0]
+		}
+	}
+	if v := res.Attributes[p.NameAttribute]; p.NameAttribute != "" && len(v) > 0 {
+		res.Name = v[0]
+	}
+	return res, nil
+}
+
+// checkConditions checks the validity window and that we are the audience
+func (sp *ServiceProvider) checkConditions(a *util.XMLElement, now time.Time, res *SAMLAssertion) error {
+	cond := a.Element(samlAssertionNS, "Conditions")
+	if cond == nil {
+		return ErrSAMLInvalid
+	}
+	notBefore, ok, err := samlTime(cond, "NotBefore")
+	if err != nil || ok && now.Add(samlClockSkew).Before(notBefore) {
+		return ErrSAMLInvalid
+	}
+	notOnOrAfter, ok, err := samlTime(cond, "NotOnOrAfter")
+	if err != nil || !ok || !now.Add(-samlClockSkew).Before(notOnOrAfter) {
+		return ErrSAMLInvalid
+	}
+	res.NotOnOrAfter = notOnOrAfter
+	restrictions := cond.Elements(samlAssertionNS, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return ErrSAMLInvalid
+	}
+	// Each restriction must include us
+	for _, r := range restrictions {
+		found := false
+		for _, aud := range r.Elements(samlAssertionNS, "Audience") {
+			found = found || strings.TrimSpace(aud.Text()) == sp.EntityID
+		}
+		if !found {
+			return ErrSAMLInvalid
+		}
+	}
+	return nil
+}
+
+// checkSubject checks the bearer confirmation is for our request and returns the NameID
+func (sp *ServiceProvider) checkSubject(a *util.XMLElement, requestID string, now time.Time, res *SAMLAssertion) error {
+	subject := a.Element(samlAssertionNS, "Subject")
+	if subject == nil {
+		return ErrSAMLInvalid
+	}
+	nameID := subject.Element(samlAssertionNS, "NameID")
+	if nameID == nil || strings.TrimSpace(nameID.Text()) == "" {
+		return ErrSAMLInvalid
+	}
+	res.NameID = strings.TrimSpace(nameID.Text())
+	for _, sc := range subject.Elements(samlAssertionNS, "SubjectConfirmation") {
+		data := sc.Element(samlAssertionNS, "SubjectConfirmationData")
+		if sc.Attr("Method") != samlBearer || data == nil {
+			continue
+		}
+		notOnOrAfter, ok, err := samlTime(data, "NotOnOrAfter")
+		if err != nil || !ok || !now.Add(-samlClockSkew).Before(notOnOrAfter) {
+			continue
+		}
+		if data.Attr("Recipient") == sp.ACSURL && data.Attr("InResponseTo") == requestID {
+			return nil
+		}
+	}
+	return ErrSAMLInvalid
+}
+
+// SAMLUsername returns the username of the user of the organization with the NameID.
+// Usernames are namespaced so a customer IdP cannot sign in as a local user.
+func SAMLUsername(organization, nameID string) string {
+	return "saml*-*" + organization + "*-*" + nameID
+}
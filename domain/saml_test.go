@@ -0,0 +1,181 @@
+package domain
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/download/util"
+)
+
+// fakeSAMLIdP issues signed assertions with a locally generated certificate
+type fakeSAMLIdP struct {
+	t        *testing.T
+	entityID string
+	key      *rsa.PrivateKey
+	certDER  []byte
+}
+
+func newFakeSAMLIdP(t *testing.T) *fakeSAMLIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "idp.acme.com"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeSAMLIdP{t: t, entityID: "https://idp.acme.com/saml", key: key, certDER: der}
+}
+
+func (idp *fakeSAMLIdP) metadata() []byte {
+	return []byte(`<?xml version="1.0"?>
+<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" entityID="` + idp.entityID + `">
+  <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <KeyDescriptor use="signing"><ds:KeyInfo><ds:X509Data><ds:X509Certificate>
+      ` + base64.StdEncoding.EncodeToString(idp.certDER) + `
+    </ds:X509Certificate></ds:X509Data></ds:KeyInfo></KeyDescriptor>
+    <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.acme.com/sso/post"/>
+    <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.acme.com/sso?app=download"/>
+  </IDPSSODescriptor>
+</EntityDescriptor>`)
+}
+
+func (idp *fakeSAMLIdP) assertion(id, requestID, nameID string, sp *ServiceProvider, now time.Time) string {
+	exp := now.Add(5 * time.Minute).UTC().Format(time.RFC3339)
+	return `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="` + id + `" Version="2.0" IssueInstant="` + now.UTC().Format(time.RFC3339) + `">` +
+		`<saml:Issuer>` + idp.entityID + `</saml:Issuer>` +
+		`<saml:Subject><saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">` + nameID + `</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer"><saml:SubjectConfirmationData InResponseTo="` + requestID +
+		`" NotOnOrAfter="` + exp + `" Recipient="` + sp.ACSURL + `"/></saml:SubjectConfirmation></saml:Subject>` +
+		`<saml:Conditions NotBefore="` + now.Add(-time.Minute).UTC().Format(time.RFC3339) + `" NotOnOrAfter="` + exp + `">` +
+		`<saml:AudienceRestriction><saml:Audience>` + sp.EntityID + `</saml:Audience></saml:AudienceRestriction></saml:Conditions>` +
+		`<saml:AttributeStatement>` +
+		`<saml:Attribute Name="mail"><saml:AttributeValue>jane@acme.com</saml:AttributeValue></saml:Attribute>` +
+		`<saml:Attribute Name="displayName"><saml:AttributeValue>Jane &amp; Co</saml:AttributeValue></saml:Attribute>` +
+		`</saml:AttributeStatement></saml:Assertion>`
+}
+
+// sign inserts an enveloped signature after the issuer of the assertion
+func (idp *fakeSAMLIdP) sign(assertion string, key *rsa.PrivateKey) string {
+	e, err := util.ParseXML([]byte(assertion))
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	digest := sha256.Sum256(e.Canonicalize(nil, nil))
+	sig := `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo>` +
+		`<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+		`<ds:Reference URI="#` + e.Attr("ID") + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"/>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/></ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue></ds:Reference></ds:SignedInfo>` +
+		`<ds:SignatureValue>SIGNATURE</ds:SignatureValue></ds:Signature>`
+	s, err := util.ParseXML([]byte(sig))
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	infoDigest := sha256.Sum256(s.Element(util.XMLDSigNamespace, "SignedInfo").Canonicalize(nil, nil))
+	value, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, infoDigest[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	sig = strings.Replace(sig, "SIGNATURE", base64.StdEncoding.EncodeToString(value), 1)
+	return strings.Replace(assertion, "</saml:Issuer>", "</saml:Issuer>"+sig, 1)
+}
+
+func (idp *fakeSAMLIdP) response(requestID string, sp *ServiceProvider, assertions ...string) string {
+	return base64.StdEncoding.EncodeToString([]byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ` +
+		`xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="resp-1" Version="2.0" InResponseTo="` + requestID + `" Destination="` + sp.ACSURL + `">` +
+		`<saml:Issuer>` + idp.entityID + `</saml:Issuer><samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>` +
+		strings.Join(assertions, "") + `</samlp:Response>`))
+}
+
+func TestSAMLMetadata(t *testing.T) {
+	idp := newFakeSAMLIdP(t)
+	p, err := ParseSAMLMetadata(idp.metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Organization = "acme"
+	if p.EntityID != idp.entityID || p.SSOURL != "https://idp.acme.com/sso?app=download" || p.Validate() != nil {
+		t.Errorf("Unexpected provider %#v - %v", p, p.Validate())
+	}
+	sp := &ServiceProvider{EntityID: "https://download.demisto.com/saml/metadata", ACSURL: "https://download.demisto.com/saml"}
+	if _, err = util.ParseXML(sp.Metadata()); err != nil {
+		t.Errorf("Invalid SP metadata - %v", err)
+	}
+	authURL, err := sp.AuthnRequestURL(p, "id-123", "state", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	if u.Query().Get("app") != "download" || u.Query().Get("RelayState") != "state" {
+		t.Errorf("Unexpected request URL %s", authURL)
+	}
+	deflated, _ := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+	req, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	if err != nil || !strings.Contains(string(req), `ID="id-123"`) {
+		t.Errorf("Unexpected request %s - %v", req, err)
+	}
+}
+
+func TestSAMLResponse(t *testing.T) {
+	idp := newFakeSAMLIdP(t)
+	p, err := ParseSAMLMetadata(idp.metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Organization, p.EmailAttribute, p.NameAttribute = "acme", "mail", "displayName"
+	sp := &ServiceProvider{EntityID: "https://download.demisto.com/saml/metadata", ACSURL: "https://download.demisto.com/saml"}
+	now := time.Now()
+	signed := idp.sign(idp.assertion("a-1", "req-1", "jane", sp, now), idp.key)
+
+	a, err := sp.ParseResponse(p, idp.response("req-1", sp, signed), "req-1", now)
+	if err != nil {
+		t.Fatalf("Unable to parse response - %v", err)
+	}
+	if a.ID != "a-1" || a.NameID != "jane" || a.Email != "jane@acme.com" || a.Name != "Jane & Co" {
+		t.Errorf("Unexpected assertion %#v", a)
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	evil := idp.assertion("a-1", "req-1", "admin", sp, now)
+	tests := []struct {
+		name      string
+		response  string
+		requestID string
+		now       time.Time
+		sp        *ServiceProvider
+	}{
+		{"tampered", idp.response("req-1", sp, strings.Replace(signed, ">jane<", ">admin<", 1)), "req-1", now, sp},
+		{"unsigned", idp.response("req-1", sp, idp.assertion("a-1", "req-1", "jane", sp, now)), "req-1", now, sp},
+		{"other key", idp.response("req-1", sp, idp.sign(idp.assertion("a-1", "req-1", "jane", sp, now), other)), "req-1", now, sp},
+		{"other request", idp.response("req-1", sp, signed), "req-2", now, sp},
+		{"expired", idp.response("req-1", sp, signed), "req-1", now.Add(time.Hour), sp},
+		{"other audience", idp.response("req-1", sp, signed), "req-1", now, &ServiceProvider{EntityID: "https://other.com", ACSURL: sp.ACSURL}},
+		{"two assertions", idp.response("req-1", sp, evil, signed), "req-1", now, sp},
+		// The signature of the original assertion is copied into an assertion with the same ID
+		{"wrapped", idp.response("req-1", sp, strings.Replace(evil, "</saml:Issuer>", "</saml:Issuer>"+signed[strings.Index(signed, "<ds:Signature"):strings.Index(signed, "</ds:Signature>")+15], 1)), "req-1", now, sp},
+	}
+	for _, test := range tests {
+		if _, err := test.sp.ParseResponse(p, test.response, test.requestID, test.now); err == nil {
+			t.Errorf("%s: expected the response to be rejected", test.name)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"errors"
+	"time"
+
+	"github.com/demisto/download/util"
+)
+
+// ErrSessionExpired is returned when the session was not used within the timeout
+var ErrSessionExpired = errors.New("Session has expired")
+
+// sessionRandomSize is the length of the random session ID in the cookie
+const sessionRandomSize = 32
+
+// Session is a login of a user. The cookie only holds the plain ID so a session can be revoked on the server
+// by deleting it. Like tokens, only the keyed digest of the ID is stored.
+type Session struct {
+	// ID is the digest of the plain ID
+	ID string `json:"id"`
+	// Plain is the ID in the cookie. It is never stored.
+	Plain     string    `json:"-" db:"-"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	LastSeen  time.Time `json:"lastSeen" db:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent" db:"user_agent"`
+	// Current is set when listing the sessions of the user making the request
+	Current bool `json:"current" db:"-"`
+}
+
+// NewSession for the user logging in from the given address and user agent
+func NewSession(username, ip, userAgent string) *Session {
+	plain := util.SecureRandomString(sessionRandomSize, false)
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	now := time.Now()
+	return &Session{ID: TokenDigest(plain), Plain: plain, Username: username, CreatedAt: now, LastSeen: now, IP: ip, UserAgent: userAgent}
+}
+
+// Valid checks that the session was seen within the timeout
+func (s *Session) Valid(now time.Time, timeout time.Duration) error {
+	if !now.Before(s.LastSeen.Add(timeout)) {
+		return ErrSessionExpired
+	}
+	return nil
+}
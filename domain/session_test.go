@@ -0,0 +1,20 @@
+package domain
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSession(t *testing.T) {
+	s := NewSession("admin", "10.0.0.1", strings.Repeat("a", 300))
+	if s.ID != TokenDigest(s.Plain) || s.Plain == NewSession("admin", "", "").Plain || len(s.UserAgent) != 255 {
+		t.Errorf("Unexpected session %#v", s)
+	}
+	if err := s.Valid(s.LastSeen.Add(time.Minute), time.Hour); err != nil {
+		t.Errorf("Expected valid session - %v", err)
+	}
+	if err := s.Valid(s.LastSeen.Add(time.Hour), time.Hour); err != ErrSessionExpired {
+		t.Errorf("Expected expired session but got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package domain
+
+import "time"
+
+// Throttle limits the failed attempts (passwords, codes, guessed tokens) of a key such as an address or an account
+type Throttle struct {
+	// MaxFailures within the window lock the key
+	MaxFailures int
+	// Window in which failures are counted. It starts with the first failure.
+	Window time.Duration
+	// Lockout is how long the key is locked once it reaches MaxFailures. Each additional failure doubles it.
+	Lockout time.Duration
+	// MaxLockout caps the doubling of the lockout
+	MaxLockout time.Duration
+}
+
+// Attempts are the failures of a throttled key. They are stored so lockouts hold across instances and restarts.
+type Attempts struct {
+	Key         string     `json:"key" db:"attempt_key"`
+	Failures    int        `json:"failures"`
+	WindowStart time.Time  `json:"windowStart" db:"window_start"`
+	LockedUntil *time.Time `json:"lockedUntil" db:"locked_until"`
+}
+
+// Fail records a failure at the given time and locks the key if it has too many failures in the window
+func (t *Throttle) Fail(a *Attempts, now time.Time) {
+	if a.RetryAfter(now) == 0 && !now.Before(a.WindowStart.Add(t.Window)) {
+		a.Failures = 0
+		a.WindowStart = now
+	}
+	a.Failures++
+	if a.Failures < t.MaxFailures {
+		return
+	}
+	lockout := t.Lockout
+	for i := t.MaxFailures; i < a.Failures && lockout < t.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > t.MaxLockout {
+		lockout = t.MaxLockout
+	}
+	until := now.Add(lockout)
+	a.LockedUntil = &until
+}
+
+// RetryAfter returns how long the key is still locked or zero if it is not locked
+func (a *Attempts) RetryAfter(now time.Time) time.Duration {
+	if a.LockedUntil == nil || !now.Before(*a.LockedUntil) {
+		return 0
+	}
+	return a.LockedUntil.Sub(now)
+}
@@ -0,0 +1,38 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	th := &Throttle{MaxFailures: 3, Window: 10 * time.Minute, Lockout: time.Minute, MaxLockout: 3 * time.Minute}
+	now := time.Now()
+	a := &Attempts{Key: "ip:10.0.0.1"}
+	th.Fail(a, now)
+	th.Fail(a, now.Add(time.Minute))
+	if a.Failures != 2 || a.RetryAfter(now.Add(time.Minute)) != 0 || !a.WindowStart.Equal(now) {
+		t.Errorf("Unexpected lock after 2 failures %#v", a)
+	}
+	th.Fail(a, now.Add(2*time.Minute))
+	if d := a.RetryAfter(now.Add(2 * time.Minute)); d != time.Minute {
+		t.Errorf("Expected a lock of a minute but got %v", d)
+	}
+	if d := a.RetryAfter(now.Add(3 * time.Minute)); d != 0 {
+		t.Errorf("Expected the lock to end but got %v", d)
+	}
+	// Failures in the window double the lockout up to the max
+	th.Fail(a, now.Add(3*time.Minute))
+	if d := a.RetryAfter(now.Add(3 * time.Minute)); d != 2*time.Minute {
+		t.Errorf("Expected a lock of 2 minutes but got %v", d)
+	}
+	th.Fail(a, now.Add(5*time.Minute))
+	if d := a.RetryAfter(now.Add(5 * time.Minute)); d != 3*time.Minute {
+		t.Errorf("Expected the max lock but got %v", d)
+	}
+	// A new window starts once the window and the lock are over
+	th.Fail(a, now.Add(20*time.Minute))
+	if a.Failures != 1 || a.RetryAfter(now.Add(20*time.Minute)) != 0 || !a.WindowStart.Equal(now.Add(20*time.Minute)) {
+		t.Errorf("Expected a new window %#v", a)
+	}
+}
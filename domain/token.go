@@ -1,13 +1,247 @@
 package domain
 
-import "github.com/demisto/download/util"
+import (
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
 
+	"github.com/Masterminds/semver"
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/util"
+)
+
+var (
+	// ErrTokenUsed is returned when the token has no downloads left
+	ErrTokenUsed = errors.New("Token is fully used and no longer allowed to download")
+	// ErrTokenNotActive is returned when the token activation time has not arrived yet
+	ErrTokenNotActive = errors.New("Token is not active yet")
+	// ErrTokenExpired is returned when the token expiration time has passed
+	ErrTokenExpired = errors.New("Token has expired")
+	// ErrDownloadNotInScope is returned when the token is not allowed to download the requested download
+	ErrDownloadNotInScope = errors.New("Token is not allowed to download the requested download")
+	// ErrVersionNotInScope is returned when the requested download version does not satisfy the token constraint
+	ErrVersionNotInScope = errors.New("Token is not allowed to download the requested version")
+	// ErrTokenRevoked is returned when the token was revoked
+	ErrTokenRevoked = errors.New("Token was revoked and is no longer allowed to download")
+)
+
+// Scope is a list of download names or glob patterns (as in path.Match) a token is allowed to download.
+// It is stored as a comma separated list.
+type Scope []string
+
+// Value implements driver.Valuer
+func (s Scope) Value() (driver.Value, error) {
+	return StringList(s).Value()
+}
+
+// Scan implements sql.Scanner
+func (s *Scope) Scan(src interface{}) error {
+	return (*StringList)(s).Scan(src)
+}
+
+// Validate that all the patterns are well formed
+func (s Scope) Validate() error {
+	for _, pattern := range s {
+		if pattern == "" || strings.Contains(pattern, ",") {
+			return fmt.Errorf("Invalid scope pattern [%s]", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid scope pattern [%s] - %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Allows checks if the download name matches one of the patterns. An empty scope allows everything.
+func (s Scope) Allows(name string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, pattern := range s {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateVersions checks that the versions constraint is a valid semver range
+func ValidateVersions(versions string) error {
+	if versions == "" {
+		return nil
+	}
+	_, err := semver.NewConstraint(versions)
+	return err
+}
+
+// Token allows customers to download. Only the keyed digest of the token is stored and used as its name.
+// The plain token is only available when the token is generated.
 type Token struct {
-	Name      string `json:"name"`
+	// Name is the digest of the token
+	Name string `json:"name"`
+	// Plain is the actual token handed to the customer. It is never stored.
+	Plain string `json:"token,omitempty" db:"-"`
+	// Hint is the beginning of the plain token so admins can recognize it
+	Hint      string `json:"hint"`
 	Downloads int    `json:"downloads"`
+	// NotBefore is the time from which the token can be used. Nil means immediately.
+	NotBefore *time.Time `json:"notBefore,omitempty" db:"not_before"`
+	// ExpiresAt is the time after which the token can no longer be used. Nil means never.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" db:"expires_at"`
+	// Expired is set by the expiration job once ExpiresAt has passed
+	Expired bool `json:"expired"`
+	// Scope limits the downloads the token can be used for. Empty means any unrestricted download.
+	Scope Scope `json:"scope,omitempty"`
+	// Versions is an optional semver constraint (for example ">= 4.0, < 5.0" or "~4.1") the download version must satisfy
+	Versions string `json:"versions,omitempty"`
+	// Customer or organization the token was issued to
+	Customer string `json:"customer"`
+	// Notes are free form text for the admins
+	Notes string `json:"notes"`
+	// Labels are free form tags that can be used to search tokens
+	Labels StringList `json:"labels"`
+	// CreatedBy is the admin that issued the token
+	CreatedBy string `json:"createdBy" db:"created_by"`
+	// CreatedAt is when the token was issued
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	// LastUsed is the last time the token was used for a download. Nil if it was never used.
+	LastUsed *time.Time `json:"lastUsed,omitempty" db:"last_used"`
+	// RevokedAt is when the token was revoked. Nil if the token is not revoked.
+	RevokedAt *time.Time `json:"revokedAt,omitempty" db:"revoked_at"`
+}
+
+// TokenFilter is used to search tokens. Empty fields are ignored.
+type TokenFilter struct {
+	// Labels that the token must all have
+	Labels []string
+	// Customer is matched as a substring of the token customer
+	Customer string
+	// CreatedBy is the admin that created the token
+	CreatedBy string
+	// All includes tokens that are used up, expired or revoked
+	All bool
 }
 
+// ValidateLabels makes sure that labels can be stored and searched
+func ValidateLabels(labels []string) error {
+	for _, label := range labels {
+		if strings.TrimSpace(label) == "" || strings.Contains(label, ",") {
+			return fmt.Errorf("Invalid label [%s]", label)
+		}
+	}
+	return nil
+}
+
+// tokenHintSize is how many characters of the plain token (after the prefix) are kept as hint
+const tokenHintSize = 4
+
 // NewToken with the given number of downloads
 func NewToken(downloads int) *Token {
-	return &Token{Name: util.SecureRandomString(12, true), Downloads: downloads}
-}
\ No newline at end of file
+	plain := NewPlainToken()
+	return &Token{Name: TokenDigest(plain), Plain: plain, Hint: TokenHint(plain), Downloads: downloads, CreatedAt: time.Now()}
+}
+
+// TokenDigest returns the keyed digest of the plain token which is used to store and look up the token
+func TokenDigest(plain string) string {
+	key := conf.Options.Security.TokenKey
+	if key == "" {
+		key = conf.Options.Security.DBKey
+	}
+	return util.KeyedHash(plain, []byte(key))
+}
+
+// IsTokenDigest checks if the given value looks like a token digest and not a plain token
+func IsTokenDigest(val string) bool {
+	if len(val) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(val)
+	return err == nil
+}
+
+// TokenHint returns the part of the plain token that can be shown to admins
+func TokenHint(plain string) string {
+	size := tokenHintSize
+	if IsFormattedToken(plain) {
+		size += len(TokenPrefix)
+	}
+	if len(plain) <= size {
+		return ""
+	}
+	return plain[:size] + "..."
+}
+
+// TokenUsername returns the username of the customer user created for the token digest and email
+func TokenUsername(digest, email string) string {
+	return digest + "*-*" + email
+}
+
+// Valid checks if the token can be used for a download at the given time
+func (t *Token) Valid(now time.Time) error {
+	if err := t.Active(now); err != nil {
+		return err
+	}
+	if t.Downloads < 1 {
+		return ErrTokenUsed
+	}
+	return nil
+}
+
+// Active checks that the token is not revoked and within its activation window regardless of the
+// downloads left. It is used when the downloads are drawn from an organization pool.
+func (t *Token) Active(now time.Time) error {
+	if t.RevokedAt != nil {
+		return ErrTokenRevoked
+	}
+	if t.NotBefore != nil && now.Before(*t.NotBefore) {
+		return ErrTokenNotActive
+	}
+	if t.Expired || t.ExpiresAt != nil && !now.Before(*t.ExpiresAt) {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// Allows checks if the token scope allows the given download
+func (t *Token) Allows(d *Download) error {
+	return allows(t.Scope, t.Versions, d)
+}
+
+// allows checks the download against the scope and versions constraint
+func allows(scope Scope, versions string, d *Download) error {
+	if !scope.Allows(d.Name) {
+		return ErrDownloadNotInScope
+	}
+	if versions == "" {
+		return nil
+	}
+	c, err := semver.NewConstraint(versions)
+	if err != nil {
+		return ErrVersionNotInScope
+	}
+	v, err := semver.NewVersion(d.Version)
+	if err != nil || !c.Check(v) {
+		return ErrVersionNotInScope
+	}
+	return nil
+}
+
+// TokenGrant is a token issued to a customer user as part of a bulk import
+type TokenGrant struct {
+	Token *Token
+	User  *User
+}
+
+// TokenUsage is a token along with the customer user it was issued to and its downloads, used for exports
+type TokenUsage struct {
+	Token
+	// Email of the customer user. Empty if the token was not issued to an email.
+	Email        string `json:"email"`
+	Organization string `json:"organization"`
+	// Used is the number of downloads the customer user made
+	Used int `json:"used"`
+}
@@ -0,0 +1,131 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenValid(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	tests := []struct {
+		token *Token
+		err   error
+	}{
+		{&Token{Downloads: 1}, nil},
+		{&Token{Downloads: 0}, ErrTokenUsed},
+		{&Token{Downloads: 1, NotBefore: &past, ExpiresAt: &future}, nil},
+		{&Token{Downloads: 1, NotBefore: &future}, ErrTokenNotActive},
+		{&Token{Downloads: 1, ExpiresAt: &past}, ErrTokenExpired},
+		{&Token{Downloads: 1, ExpiresAt: &now}, ErrTokenExpired},
+		{&Token{Downloads: 1, Expired: true}, ErrTokenExpired},
+		{&Token{Downloads: 1, RevokedAt: &past}, ErrTokenRevoked},
+	}
+	for i, test := range tests {
+		if err := test.token.Valid(now); err != test.err {
+			t.Errorf("%d: expected %v but got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestTokenAllows(t *testing.T) {
+	tests := []struct {
+		token *Token
+		d     *Download
+		err   error
+	}{
+		{&Token{}, &Download{Name: "free"}, nil},
+		{&Token{Scope: Scope{"free"}}, &Download{Name: "free"}, nil},
+		{&Token{Scope: Scope{"free"}}, &Download{Name: "ova"}, ErrDownloadNotInScope},
+		{&Token{Scope: Scope{"ov?", "server-*"}}, &Download{Name: "server-rhel"}, nil},
+		{&Token{Scope: Scope{"ov?", "server-*"}}, &Download{Name: "agent-rhel"}, ErrDownloadNotInScope},
+		{&Token{Versions: ">= 4.0, < 5.0"}, &Download{Name: "free", Version: "4.1.2"}, nil},
+		{&Token{Versions: ">= 4.0, < 5.0"}, &Download{Name: "free", Version: "5.0.0"}, ErrVersionNotInScope},
+		{&Token{Versions: "~4.1"}, &Download{Name: "free"}, ErrVersionNotInScope},
+	}
+	for i, test := range tests {
+		if err := test.token.Allows(test.d); err != test.err {
+			t.Errorf("%d: expected %v but got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	var s Scope
+	if err := s.Scan([]byte("free,ova*")); err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 2 || s[1] != "ova*" {
+		t.Fatalf("Unexpected scope %v", s)
+	}
+	v, _ := s.Value()
+	if v != "free,ova*" {
+		t.Errorf("Unexpected value %v", v)
+	}
+	if err := s.Scan([]byte("")); err != nil || len(s) != 0 {
+		t.Errorf("Expected empty scope but got %v - %v", s, err)
+	}
+	if err := (Scope{"[a-"}).Validate(); err == nil {
+		t.Error("Expected invalid pattern")
+	}
+}
+
+func TestNewToken(t *testing.T) {
+	token := NewToken(3)
+	if !IsTokenDigest(token.Name) {
+		t.Fatalf("Token name should be a digest - %s", token.Name)
+	}
+	if token.Name != TokenDigest(token.Plain) {
+		t.Error("Token name should be the digest of the plain token")
+	}
+	if IsTokenDigest(token.Plain) {
+		t.Error("Plain token should not look like a digest")
+	}
+	if !ValidTokenFormat(token.Plain) || !TokenRegexp.MatchString(token.Plain) {
+		t.Errorf("Token is not in the expected format - %s", token.Plain)
+	}
+	if token.Hint != token.Plain[:12]+"..." {
+		t.Errorf("Unexpected hint %s", token.Hint)
+	}
+}
+
+func TestValidTokenFormat(t *testing.T) {
+	plain := NewPlainToken()
+	if !ValidTokenFormat(plain) {
+		t.Fatalf("Expected valid token - %s", plain)
+	}
+	// Change a single character in the random part
+	c := byte('a')
+	if plain[10] == c {
+		c = 'b'
+	}
+	typo := plain[:10] + string(c) + plain[11:]
+	if ValidTokenFormat(typo) {
+		t.Errorf("Checksum should catch the typo - %s", typo)
+	}
+	for _, invalid := range []string{"", "abcdefghijkl", plain[:len(plain)-1], "dmst_xx_" + plain[8:], plain[:20] + "-" + plain[21:]} {
+		if ValidTokenFormat(invalid) {
+			t.Errorf("Expected invalid token - %s", invalid)
+		}
+	}
+	if TokenHint("abcdefghijkl") != "abcd..." {
+		t.Errorf("Unexpected hint for legacy token - %s", TokenHint("abcdefghijkl"))
+	}
+}
+
+func TestOrganizationAllows(t *testing.T) {
+	o := &Organization{Name: "acme", Downloads: 1, Scope: Scope{"server-*"}, Versions: "^4"}
+	if err := o.Valid(); err != nil {
+		t.Errorf("Expected valid organization - %v", err)
+	}
+	if err := o.Allows(&Download{Name: "server-rhel", Version: "4.5.0"}); err != nil {
+		t.Errorf("Expected download to be allowed - %v", err)
+	}
+	if err := o.Allows(&Download{Name: "agent", Version: "4.5.0"}); err != ErrDownloadNotInScope {
+		t.Errorf("Expected download not in scope but got %v", err)
+	}
+	o.Downloads = 0
+	if err := o.Valid(); err != ErrPoolUsed {
+		t.Errorf("Expected pool used but got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package domain
+
+import (
+	"hash/crc32"
+	"regexp"
+	"strings"
+
+	"github.com/demisto/download/util"
+)
+
+// Tokens are generated in a recognizable format so leaked tokens can be detected by secret scanners:
+//
+//	dmst_dl_<30 random base62 characters><6 base62 characters of CRC32 checksum>
+//
+// The prefix identifies the format version. A new format must use a new prefix.
+// Tokens generated before the format was introduced are 12 letters and are still accepted.
+const (
+	// TokenPrefix is the prefix of all the tokens in the current format
+	TokenPrefix = "dmst_dl_"
+	// TokenPattern is the regular expression secret scanners should use to find tokens
+	TokenPattern = `\bdmst_dl_[0-9A-Za-z]{36}\b`
+	// tokenRandomSize is the number of random characters - about 178 bits of entropy
+	tokenRandomSize = 30
+	// tokenChecksumSize is the number of characters of the encoded checksum
+	tokenChecksumSize = 6
+	// base62 is the alphabet used for the checksum
+	base62 = `0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz`
+)
+
+// TokenRegexp is the compiled TokenPattern
+var TokenRegexp = regexp.MustCompile(TokenPattern)
+
+// tokenChecksum returns the base62 encoded CRC32 of the value padded to tokenChecksumSize
+func tokenChecksum(val string) string {
+	crc := crc32.ChecksumIEEE([]byte(val))
+	res := make([]byte, tokenChecksumSize)
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i] = base62[crc%62]
+		crc /= 62
+	}
+	return string(res)
+}
+
+// NewPlainToken returns a new random token in the current format
+func NewPlainToken() string {
+	body := TokenPrefix + util.SecureRandomString(tokenRandomSize, false)
+	return body + tokenChecksum(body)
+}
+
+// IsFormattedToken checks if the token claims to be in the current format
+func IsFormattedToken(plain string) bool {
+	return strings.HasPrefix(plain, TokenPrefix)
+}
+
+// ValidTokenFormat checks the shape and checksum of a token in the current format without looking it up
+func ValidTokenFormat(plain string) bool {
+	if len(plain) != len(TokenPrefix)+tokenRandomSize+tokenChecksumSize || !IsFormattedToken(plain) {
+		return false
+	}
+	for _, c := range plain[len(TokenPrefix):] {
+		if !strings.ContainsRune(base62, c) {
+			return false
+		}
+	}
+	split := len(plain) - tokenChecksumSize
+	return tokenChecksum(plain[:split]) == plain[split:]
+}
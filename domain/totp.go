@@ -0,0 +1,120 @@
+package domain
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/util"
+)
+
+const (
+	// TOTPIssuer is shown in authenticator apps
+	TOTPIssuer = "Demisto Download"
+	// totpSecretSize in bytes as recommended by RFC 4226
+	totpSecretSize = 20
+	// totpSkew is the number of steps before and after now that are accepted for clock drift
+	totpSkew = 1
+	// recoveryCodesCount is how many recovery codes are generated when enabling TOTP
+	recoveryCodesCount = 10
+	// recoveryCodeSize is the length of each recovery code
+	recoveryCodeSize = 10
+)
+
+var (
+	// ErrInvalidOTP is returned when the one time password or recovery code is wrong or was already used
+	ErrInvalidOTP = errors.New("Invalid one time password")
+)
+
+// NewTOTPSecret generates a secret and sets it on the user encrypted. TOTP is only enabled once the user
+// proves the secret was added to the authenticator. Returns the base32 secret for the authenticator.
+func (u *User) NewTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	encoded := util.EncodeTOTPSecret(secret)
+	encrypted, err := util.Encrypt(encoded, []byte(conf.Options.Security.DBKey))
+	if err != nil {
+		return "", err
+	}
+	u.TOTPSecret = encrypted
+	u.TOTPEnabled = false
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+	return encoded, nil
+}
+
+// TOTPURI returns the otpauth URI authenticator apps use to add the secret
+func (u *User) TOTPURI(secret string) string {
+	label := url.PathEscape(TOTPIssuer + ":" + u.Username)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", TOTPIssuer)
+	q.Set("digits", "6")
+	q.Set("period", "30")
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// CheckTOTP checks the code against the user secret. A code can only be used once so on success
+// the step is set on the user and must be stored before the code is accepted.
+func (u *User) CheckTOTP(code string, now time.Time) error {
+	if u.TOTPSecret == "" {
+		return ErrInvalidOTP
+	}
+	encoded, err := util.Decrypt(u.TOTPSecret, []byte(conf.Options.Security.DBKey))
+	if err != nil {
+		return err
+	}
+	secret, err := util.DecodeTOTPSecret(encoded)
+	if err != nil {
+		return err
+	}
+	step, ok := util.ValidateTOTP(secret, code, now, totpSkew)
+	if !ok || step <= u.TOTPLastStep {
+		return ErrInvalidOTP
+	}
+	u.TOTPLastStep = step
+	return nil
+}
+
+// recoveryCodeDigest is what we keep for recovery codes
+func recoveryCodeDigest(code string) string {
+	return util.KeyedHash(strings.ToUpper(strings.Replace(code, "-", "", -1)), []byte(conf.Options.Security.DBKey))
+}
+
+// NewRecoveryCodes replaces the recovery codes of the user and returns the plain codes to show once
+func (u *User) NewRecoveryCodes() []string {
+	codes := make([]string, recoveryCodesCount)
+	u.RecoveryCodes = make(StringList, recoveryCodesCount)
+	for i := range codes {
+		code := strings.ToUpper(util.SecureRandomString(recoveryCodeSize, false))
+		codes[i] = code[:recoveryCodeSize/2] + "-" + code[recoveryCodeSize/2:]
+		u.RecoveryCodes[i] = recoveryCodeDigest(code)
+	}
+	return codes
+}
+
+// UseRecoveryCode removes the recovery code from the user if it exists. The remaining codes must be stored
+// before the code is accepted.
+func (u *User) UseRecoveryCode(code string) error {
+	digest := recoveryCodeDigest(code)
+	for i, c := range u.RecoveryCodes {
+		if c == digest {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrInvalidOTP
+}
+
+// DisableTOTP removes the secret and recovery codes
+func (u *User) DisableTOTP() {
+	u.TOTPSecret = ""
+	u.TOTPEnabled = false
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+}
@@ -0,0 +1,46 @@
+package domain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/util"
+)
+
+func TestUserTOTP(t *testing.T) {
+	conf.Default()
+	u := &User{Username: "admin"}
+	secret, err := u.NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.TOTPSecret == "" || u.TOTPSecret == secret {
+		t.Fatal("Secret should be stored encrypted")
+	}
+	raw, err := util.DecodeTOTPSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code := util.HOTP(raw, util.TOTPStep(now))
+	if err = u.CheckTOTP(code, now); err != nil {
+		t.Fatalf("Valid code was rejected - %v", err)
+	}
+	if err = u.CheckTOTP(code, now); err != ErrInvalidOTP {
+		t.Error("Code should not be accepted twice")
+	}
+	codes := u.NewRecoveryCodes()
+	if len(codes) != recoveryCodesCount {
+		t.Fatalf("Expected %d recovery codes but got %d", recoveryCodesCount, len(codes))
+	}
+	if err = u.UseRecoveryCode(codes[3]); err != nil {
+		t.Fatalf("Recovery code was rejected - %v", err)
+	}
+	if err = u.UseRecoveryCode(codes[3]); err != ErrInvalidOTP {
+		t.Error("Recovery code should not be accepted twice")
+	}
+	if len(u.RecoveryCodes) != recoveryCodesCount-1 {
+		t.Errorf("Expected %d recovery codes left but got %d", recoveryCodesCount-1, len(u.RecoveryCodes))
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/base64"
 	"time"
 
-	"fmt"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -17,6 +16,13 @@ const (
 	UserTypeUser
 )
 
+// The sources of users created by an identity provider on their first sign-in
+const (
+	UserSourceOIDC = "oidc"
+	UserSourceSAML = "saml"
+	UserSourceLDAP = "ldap"
+)
+
 // Stringer implementation
 func (s UserType) String() string {
 	switch s {
@@ -31,15 +37,35 @@ func (s UserType) String() string {
 
 // User holds information about a user within the system.
 // A user has a role for each project.
+// Users that belong to an organization draw their downloads from the organization pool.
 type User struct {
-	Username   string    `json:"username"`
-	Hash       string    `json:"hash"`
-	Email      string    `json:"email"`
-	Name       string    `json:"name"`
-	Type       UserType  `json:"type"`
-	LastLogin  time.Time `json:"lastLogin" db:"last_login"`
-	Token      string    `json:"token"`
-	ModifyDate time.Time `json:"modifyDate" db:"modify_date"`
+	Username     string    `json:"username"`
+	Hash         string    `json:"hash"`
+	Email        string    `json:"email"`
+	Name         string    `json:"name"`
+	Type         UserType  `json:"type"`
+	LastLogin    time.Time `json:"lastLogin" db:"last_login"`
+	Token        string    `json:"token"`
+	Organization string    `json:"organization"`
+	ModifyDate   time.Time `json:"modifyDate" db:"modify_date"`
+	// ForcePasswordChange requires the user to change the password before doing anything else
+	ForcePasswordChange bool `json:"forcePasswordChange" db:"force_password_change"`
+	// TOTPSecret is the encrypted base32 secret for two factor authentication
+	TOTPSecret string `json:"totpSecret" db:"totp_secret"`
+	// TOTPEnabled is set once the user confirmed the secret with a valid code
+	TOTPEnabled bool `json:"totpEnabled" db:"totp_enabled"`
+	// TOTPLastStep is the time step of the last accepted code so codes cannot be replayed
+	TOTPLastStep int64 `json:"totpLastStep" db:"totp_last_step"`
+	// RecoveryCodes are the digests of the one time codes that can be used instead of TOTP
+	RecoveryCodes StringList `json:"recoveryCodes" db:"recovery_codes"`
+	// Roles grant the permissions of the user. If empty, the default role of the type is used.
+	Roles StringList `json:"roles"`
+	// Disabled users cannot log in, use their API keys or download with their token
+	Disabled bool `json:"disabled"`
+	// Source is the identity provider that created the user. Empty for local users.
+	Source string `json:"source"`
+	// ExternalID identifies the user at the source so users are never matched by a username the IdP controls
+	ExternalID string `json:"externalId" db:"external_id"`
 }
 
 // GetHashFromPassword returns the hash based on bcrypt
@@ -53,9 +79,58 @@ func (u *User) SetPassword(password string) {
 	u.Hash = GetHashFromPassword(password)
 }
 
+// SingleSignOn users sign in at their IdP, which is responsible for their second factor. Directory (LDAP) users
+// sign in with a password here so they are not.
+func (u *User) SingleSignOn() bool {
+	return u.Source == UserSourceOIDC || u.Source == UserSourceSAML
+}
+
+// CheckPassword checks the password against the user hash. Users without a password cannot log in with one.
+func (u *User) CheckPassword(password string) bool {
+	if u.Hash == "" || password == "" {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(u.Hash)
+	if err != nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// UsernameForToken returns the username of a customer user based on the token digest and email
 func (u *User) UsernameForToken() string {
-	return fmt.Sprintf("%d-%s", u.Token, u.Email)
+	return TokenUsername(u.Token, u.Email)
 }
 
 // UserFilterFields is the list of fields we should filter when sending to clients
-var UserFilterFields = []string{"hash"}
+var UserFilterFields = []string{"hash", "totpSecret", "totpLastStep", "recoveryCodes"}
+
+// MaxUserPageSize is the maximum number of users returned by a single search
+const MaxUserPageSize = 500
+
+// UserFilter is used to search users. Empty fields are ignored.
+type UserFilter struct {
+	// Username is matched as a substring of the username
+	Username string
+	// Email is matched as a substring of the email
+	Email        string
+	Type         *UserType
+	Organization string
+	Offset       int
+	// Limit is the page size, up to MaxUserPageSize
+	Limit int
+}
+
+// UserDetails is what admins see when inspecting a user
+type UserDetails struct {
+	User *User `json:"user"`
+	// Token the customer downloads with
+	Token *Token `json:"token,omitempty"`
+	// IssuedTokens are the tokens the user generated
+	IssuedTokens []Token `json:"issuedTokens"`
+	// Downloads are the most recent downloads of the user
+	Downloads []DownloadLog `json:"downloads"`
+	Sessions  []Session     `json:"sessions"`
+	// Emails are the most recent emails sent to the user
+	Emails []EmailDelivery `json:"emails"`
+}
@@ -0,0 +1,294 @@
+package domain
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/demisto/download/util"
+)
+
+var (
+	// ErrWebAuthnInvalid is returned when a registration or assertion does not verify
+	ErrWebAuthnInvalid = errors.New("Invalid WebAuthn response")
+	// ErrWebAuthnCloned is returned when the signature counter went backwards which means the authenticator may be cloned
+	ErrWebAuthnCloned = errors.New("WebAuthn signature counter did not increase")
+	// ErrWebAuthnUnverified is returned when the authenticator did not verify the user with a PIN or biometrics.
+	// Passkey logins skip the password and TOTP so presence alone is not enough.
+	ErrWebAuthnUnverified = errors.New("WebAuthn user was not verified")
+)
+
+// COSE algorithms we support
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// WebAuthnAlgorithms are the COSE algorithms offered to authenticators in order of preference
+var WebAuthnAlgorithms = []int{coseES256, coseEdDSA, coseRS256}
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// WebAuthnCredential is a public key credential (passkey or security key) registered by a user
+type WebAuthnCredential struct {
+	// ID is the base64url credential ID chosen by the authenticator
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	// Name helps the user recognize the authenticator
+	Name string `json:"name"`
+	// PublicKey is the COSE encoded public key
+	PublicKey []byte `json:"-" db:"public_key"`
+	// SignCount is the last signature counter reported by the authenticator
+	SignCount uint32     `json:"signCount" db:"sign_count"`
+	CreatedAt time.Time  `json:"createdAt" db:"created_at"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty" db:"last_used"`
+}
+
+// RelyingParty is the server side of the WebAuthn ceremonies
+type RelyingParty struct {
+	// ID is the domain the credentials are scoped to
+	ID string
+	// Origin is the exact origin (scheme, host and port) of the web UI
+	Origin string
+	// Name is shown by the authenticator
+	Name string
+}
+
+// clientData is the part of the client data JSON we verify
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is the parsed authenticator data
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// NewWebAuthnChallenge returns a random challenge for a ceremony
+func NewWebAuthnChallenge() string {
+	return util.SecureRandomString(43, false)
+}
+
+// webAuthnCeremonyIDSize is the length of the random ID the browser gets for a ceremony
+const webAuthnCeremonyIDSize = 32
+
+// WebAuthnCeremony is a registration or login in progress. It is stored until it is finished so its challenge can
+// only be used once and the browser only gets its ID.
+type WebAuthnCeremony struct {
+	ID string
+	// Username is empty for logins with discoverable credentials
+	Username  string
+	Type      string
+	Challenge string
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// NewWebAuthnCeremony of the given type for the user with a new challenge that must be answered within the timeout
+func NewWebAuthnCeremony(username, ceremonyType string, timeout time.Duration) *WebAuthnCeremony {
+	return &WebAuthnCeremony{ID: util.SecureRandomString(webAuthnCeremonyIDSize, false), Username: username, Type: ceremonyType,
+		Challenge: NewWebAuthnChallenge(), ExpiresAt: time.Now().Add(timeout)}
+}
+
+// verifyClientData checks the ceremony type, challenge and origin
+func (rp *RelyingParty) verifyClientData(raw []byte, ceremony, challenge string) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return ErrWebAuthnInvalid
+	}
+	expected := base64.RawURLEncoding.EncodeToString([]byte(challenge))
+	if cd.Type != ceremony || subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(expected)) != 1 {
+		return ErrWebAuthnInvalid
+	}
+	if cd.Origin != rp.Origin {
+		return fmt.Errorf("WebAuthn origin %s does not match %s", cd.Origin, rp.Origin)
+	}
+	return nil
+}
+
+// parseAuthenticatorData parses the authenticator data and checks it is for us and the user was present and verified
+func (rp *RelyingParty) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, ErrWebAuthnInvalid
+	}
+	ad := &authenticatorData{rpIDHash: data[:32], flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) || ad.flags&flagUserPresent == 0 {
+		return nil, ErrWebAuthnInvalid
+	}
+	if ad.flags&flagUserVerified == 0 {
+		return nil, ErrWebAuthnUnverified
+	}
+	if ad.flags&flagAttested == 0 {
+		return ad, nil
+	}
+	// AAGUID (16) and credential ID length (2)
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, ErrWebAuthnInvalid
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || len(rest) < idLen {
+		return nil, ErrWebAuthnInvalid
+	}
+	ad.credentialID, rest = rest[:idLen], rest[idLen:]
+	_, n, err := util.UnmarshalCBOR(rest)
+	if err != nil {
+		return nil, ErrWebAuthnInvalid
+	}
+	ad.publicKey = rest[:n]
+	return ad, nil
+}
+
+// VerifyRegistration verifies the response of navigator.credentials.create() and returns the new credential.
+// Attestation is not requested so the attestation statement is not verified.
+func (rp *RelyingParty) VerifyRegistration(challenge string, clientDataJSON, attestationObject []byte) (*WebAuthnCredential, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+	obj, _, err := util.UnmarshalCBOR(attestationObject)
+	if err != nil {
+		return nil, ErrWebAuthnInvalid
+	}
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebAuthnInvalid
+	}
+	raw, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, ErrWebAuthnInvalid
+	}
+	ad, err := rp.parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, ErrWebAuthnInvalid
+	}
+	if _, err = parseCOSEKey(ad.publicKey); err != nil {
+		return nil, err
+	}
+	return &WebAuthnCredential{
+		ID:        base64.RawURLEncoding.EncodeToString(ad.credentialID),
+		PublicKey: ad.publicKey,
+		SignCount: ad.signCount,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// VerifyAssertion verifies the response of navigator.credentials.get() for the credential and updates its counter
+func (rp *RelyingParty) VerifyAssertion(cred *WebAuthnCredential, challenge string, clientDataJSON, authData, signature []byte) error {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return err
+	}
+	ad, err := rp.parseAuthenticatorData(authData)
+	if err != nil {
+		return err
+	}
+	key, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	if err = key.verify(signed, signature); err != nil {
+		return err
+	}
+	// Authenticators that do not implement the counter always send zero
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return ErrWebAuthnCloned
+	}
+	cred.SignCount = ad.signCount
+	now := time.Now()
+	cred.LastUsed = &now
+	return nil
+}
+
+// coseKey is a parsed public key
+type coseKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+func (k *coseKey) verify(signed, signature []byte) error {
+	var ok bool
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		ok = ecdsa.VerifyASN1(key, digest[:], signature)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, signed, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	}
+	if !ok {
+		return ErrWebAuthnInvalid
+	}
+	return nil
+}
+
+// parseCOSEKey parses a COSE_Key (RFC 8152) for the algorithms we support
+func parseCOSEKey(data []byte) (*coseKey, error) {
+	v, _, err := util.UnmarshalCBOR(data)
+	if err != nil {
+		return nil, ErrWebAuthnInvalid
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebAuthnInvalid
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == coseES256:
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv, _ := m[int64(-1)].(int64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, ErrWebAuthnInvalid
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, ErrWebAuthnInvalid
+		}
+		return &coseKey{alg: alg, key: key}, nil
+	case kty == 1 && alg == coseEdDSA:
+		x, _ := m[int64(-2)].([]byte)
+		if crv, _ := m[int64(-1)].(int64); crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, ErrWebAuthnInvalid
+		}
+		return &coseKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case kty == 3 && alg == coseRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrWebAuthnInvalid
+		}
+		return &coseKey{alg: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}}, nil
+	}
+	return nil, fmt.Errorf("Unsupported WebAuthn key type %d with algorithm %d", kty, alg)
+}
@@ -0,0 +1,126 @@
+package domain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/demisto/download/util"
+)
+
+// softAuthenticator is a software ES256 authenticator implementing the parts of the ceremonies the server verifies
+type softAuthenticator struct {
+	t         *testing.T
+	rp        *RelyingParty
+	id        []byte
+	key       *ecdsa.PrivateKey
+	signCount uint32
+}
+
+func newSoftAuthenticator(t *testing.T, rp *RelyingParty) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{t: t, rp: rp, id: id, key: key}
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": base64.RawURLEncoding.EncodeToString([]byte(challenge)), "origin": a.rp.Origin})
+	return b
+}
+
+func (a *softAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rp.ID))
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	return data
+}
+
+func (a *softAuthenticator) register(challenge string) (clientDataJSON, attestationObject []byte) {
+	cose, err := util.MarshalCBOR(util.CBORMap{{1, 2}, {3, coseES256}, {-1, 1}, {-2, a.key.X.FillBytes(make([]byte, 32))}, {-3, a.key.Y.FillBytes(make([]byte, 32))}})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	authData := a.authData(flagUserPresent | flagUserVerified | flagAttested)
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, byte(len(a.id)>>8), byte(len(a.id)))
+	authData = append(append(authData, a.id...), cose...)
+	attestationObject, err = util.MarshalCBOR(util.CBORMap{{"fmt", "none"}, {"attStmt", util.CBORMap{}}, {"authData", authData}})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return a.clientData("webauthn.create", challenge), attestationObject
+}
+
+func (a *softAuthenticator) assert(challenge string) (clientDataJSON, authData, signature []byte) {
+	return a.assertWithFlags(challenge, flagUserPresent|flagUserVerified)
+}
+
+func (a *softAuthenticator) assertWithFlags(challenge string, flags byte) (clientDataJSON, authData, signature []byte) {
+	a.signCount++
+	clientDataJSON = a.clientData("webauthn.get", challenge)
+	authData = a.authData(flags)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return
+}
+
+func TestWebAuthn(t *testing.T) {
+	rp := &RelyingParty{ID: "download.demisto.com", Origin: "https://download.demisto.com", Name: "Demisto Download"}
+	a := newSoftAuthenticator(t, rp)
+	challenge := NewWebAuthnChallenge()
+	clientDataJSON, attestationObject := a.register(challenge)
+	if _, err := rp.VerifyRegistration(NewWebAuthnChallenge(), clientDataJSON, attestationObject); err == nil {
+		t.Error("Registration with the wrong challenge should fail")
+	}
+	cred, err := rp.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		t.Fatalf("Unable to verify registration - %v", err)
+	}
+	if cred.ID != base64.RawURLEncoding.EncodeToString(a.id) {
+		t.Errorf("Unexpected credential ID %s", cred.ID)
+	}
+
+	challenge = NewWebAuthnChallenge()
+	clientDataJSON, authData, signature := a.assert(challenge)
+	if err = rp.VerifyAssertion(cred, challenge, clientDataJSON, authData, signature); err != nil {
+		t.Fatalf("Unable to verify assertion - %v", err)
+	}
+	if cred.SignCount != 1 || cred.LastUsed == nil {
+		t.Errorf("Credential was not updated - %#v", cred)
+	}
+	// Replaying the same assertion fails on the counter
+	if err = rp.VerifyAssertion(cred, challenge, clientDataJSON, authData, signature); err != ErrWebAuthnCloned {
+		t.Errorf("Expected replay to fail on the counter but got %v", err)
+	}
+	challenge = NewWebAuthnChallenge()
+	clientDataJSON, authData, signature = a.assert(challenge)
+	signature[len(signature)-1] ^= 0xff
+	if err = rp.VerifyAssertion(cred, challenge, clientDataJSON, authData, signature); err == nil {
+		t.Error("Assertion with a bad signature should fail")
+	}
+	// Touching the authenticator without a PIN or biometrics is not enough
+	challenge = NewWebAuthnChallenge()
+	clientDataJSON, authData, signature = a.assertWithFlags(challenge, flagUserPresent)
+	if err = rp.VerifyAssertion(cred, challenge, clientDataJSON, authData, signature); err != ErrWebAuthnUnverified {
+		t.Errorf("Expected assertion without user verification to fail but got %v", err)
+	}
+	phishing := &RelyingParty{ID: rp.ID, Origin: "https://download-demisto.com"}
+	challenge = NewWebAuthnChallenge()
+	clientDataJSON, authData, signature = a.assert(challenge)
+	if err = phishing.VerifyAssertion(cred, challenge, clientDataJSON, authData, signature); err == nil {
+		t.Error("Assertion from another origin should fail")
+	}
+}
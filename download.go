@@ -35,7 +35,10 @@ func run(signalCh chan os.Signal) {
 	serviceChannel := make(chan bool)
 	var closers []closer
 	closers = append(closers, r)
-	appC := web.NewContext(r)
+	appC, err := web.NewContext(r)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 	router := web.New(appC, conf.Options.Static)
 	go func() {
 		router.Serve()
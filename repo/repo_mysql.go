@@ -12,13 +12,14 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/demisto/download/conf"
 	"github.com/demisto/download/domain"
+	"github.com/demisto/download/util"
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 )
 
 const schema = `
 CREATE TABLE IF NOT EXISTS users (
-	username VARCHAR(128) NOT NULL,
+	username VARCHAR(255) NOT NULL,
 	hash VARCHAR(128),
 	email VARCHAR(128),
 	name VARCHAR(128),
@@ -26,32 +27,247 @@ CREATE TABLE IF NOT EXISTS users (
 	modify_date TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	last_login TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	token VARCHAR(128),
-	CONSTRAINT users_pk PRIMARY KEY (username)
+	organization VARCHAR(128) NOT NULL DEFAULT '',
+	force_password_change BOOLEAN NOT NULL DEFAULT FALSE,
+	totp_secret VARCHAR(255) NOT NULL DEFAULT '',
+	totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+	totp_last_step BIGINT NOT NULL DEFAULT 0,
+	recovery_codes VARCHAR(1024) NOT NULL DEFAULT '',
+	roles VARCHAR(255) NOT NULL DEFAULT '',
+	disabled BOOLEAN NOT NULL DEFAULT FALSE,
+	source VARCHAR(16) NOT NULL DEFAULT '',
+	external_id VARCHAR(512) NOT NULL DEFAULT '',
+	CONSTRAINT users_pk PRIMARY KEY (username),
+	INDEX users_external_idx (source, external_id(191))
 );
 CREATE TABLE IF NOT EXISTS tokens (
-	name VARCHAR(30) NOT NULL,
+	name VARCHAR(64) NOT NULL,
+	hint VARCHAR(16) NOT NULL DEFAULT '',
 	downloads INT NOT NULL,
+	not_before DATETIME NULL,
+	expires_at DATETIME NULL,
+	expired BOOLEAN NOT NULL DEFAULT FALSE,
+	scope VARCHAR(1024) NOT NULL DEFAULT '',
+	versions VARCHAR(128) NOT NULL DEFAULT '',
+	customer VARCHAR(128) NOT NULL DEFAULT '',
+	notes VARCHAR(1024) NOT NULL DEFAULT '',
+	labels VARCHAR(1024) NOT NULL DEFAULT '',
+	created_by VARCHAR(128) NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_used DATETIME NULL,
+	revoked_at DATETIME NULL,
 	CONSTRAINT tokens_pk PRIMARY KEY (name)
 );
 CREATE TABLE IF NOT EXISTS downloads (
 	name VARCHAR(30) NOT NULL,
 	path VARCHAR(1024) NOT NULL,
 	sha256 VARCHAR(128),
+	git_hash VARCHAR(128),
+	version VARCHAR(64) NOT NULL DEFAULT '',
 	username VARCHAR(128) NOT NULL DEFAULT '',
 	modify_date TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	CONSTRAINT download_pk PRIMARY KEY (name)
 );
+CREATE TABLE IF NOT EXISTS organizations (
+	name VARCHAR(128) NOT NULL,
+	downloads INT NOT NULL,
+	scope VARCHAR(1024) NOT NULL DEFAULT '',
+	versions VARCHAR(128) NOT NULL DEFAULT '',
+	modify_date TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	CONSTRAINT organizations_pk PRIMARY KEY (name)
+);
+CREATE TABLE IF NOT EXISTS saml_providers (
+	organization VARCHAR(128) NOT NULL,
+	entity_id VARCHAR(512) NOT NULL,
+	sso_url VARCHAR(1024) NOT NULL,
+	certificate TEXT NOT NULL,
+	email_attribute VARCHAR(255) NOT NULL DEFAULT '',
+	name_attribute VARCHAR(255) NOT NULL DEFAULT '',
+	modify_date TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	CONSTRAINT saml_providers_pk PRIMARY KEY (organization)
+);
+CREATE TABLE IF NOT EXISTS saml_assertions (
+	id VARCHAR(255) NOT NULL,
+	expires_at DATETIME NOT NULL,
+	CONSTRAINT saml_assertions_pk PRIMARY KEY (id),
+	INDEX saml_assertions_expires_idx (expires_at)
+);
+CREATE TABLE IF NOT EXISTS webauthn_ceremonies (
+	id VARCHAR(64) NOT NULL,
+	username VARCHAR(255) NOT NULL DEFAULT '',
+	type VARCHAR(16) NOT NULL,
+	challenge VARCHAR(64) NOT NULL,
+	expires_at DATETIME NOT NULL,
+	CONSTRAINT webauthn_ceremonies_pk PRIMARY KEY (id),
+	INDEX webauthn_ceremonies_expires_idx (expires_at)
+);
+CREATE TABLE IF NOT EXISTS token_events (
+	id BIGINT NOT NULL AUTO_INCREMENT,
+	token VARCHAR(64) NOT NULL,
+	type VARCHAR(16) NOT NULL,
+	delta INT NOT NULL,
+	balance INT NOT NULL,
+	actor VARCHAR(255) NOT NULL DEFAULT '',
+	reason VARCHAR(1024) NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	CONSTRAINT token_events_pk PRIMARY KEY (id),
+	INDEX token_events_token_idx (token)
+);
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	id_key VARCHAR(255) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	request VARCHAR(64) NOT NULL,
+	status INT NOT NULL DEFAULT 0,
+	content_type VARCHAR(128) NOT NULL DEFAULT '',
+	body MEDIUMTEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	CONSTRAINT idempotency_keys_pk PRIMARY KEY (username, id_key),
+	INDEX idempotency_keys_created_idx (created_at)
+);
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+	id VARCHAR(255) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	name VARCHAR(128) NOT NULL DEFAULT '',
+	public_key BLOB NOT NULL,
+	sign_count BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_used DATETIME NULL,
+	CONSTRAINT webauthn_credentials_pk PRIMARY KEY (id),
+	INDEX webauthn_credentials_username_idx (username)
+);
+CREATE TABLE IF NOT EXISTS api_keys (
+	id VARCHAR(64) NOT NULL,
+	hint VARCHAR(20) NOT NULL DEFAULT '',
+	name VARCHAR(128) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	scopes VARCHAR(255) NOT NULL DEFAULT '',
+	expires_at DATETIME NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_used DATETIME NULL,
+	revoked_at DATETIME NULL,
+	CONSTRAINT api_keys_pk PRIMARY KEY (id)
+);
+CREATE TABLE IF NOT EXISTS sessions (
+	id VARCHAR(64) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_seen DATETIME NOT NULL,
+	ip VARCHAR(45) NOT NULL DEFAULT '',
+	user_agent VARCHAR(255) NOT NULL DEFAULT '',
+	CONSTRAINT sessions_pk PRIMARY KEY (id),
+	INDEX sessions_username_idx (username)
+);
+CREATE TABLE IF NOT EXISTS login_links (
+	id VARCHAR(64) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	kind VARCHAR(32) NOT NULL DEFAULT 'sign-in',
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME NOT NULL,
+	CONSTRAINT login_links_pk PRIMARY KEY (id)
+);
+CREATE TABLE IF NOT EXISTS attempts (
+	attempt_key VARCHAR(255) NOT NULL,
+	failures INT NOT NULL DEFAULT 0,
+	window_start DATETIME NOT NULL,
+	locked_until DATETIME NULL,
+	CONSTRAINT attempts_pk PRIMARY KEY (attempt_key)
+);
+CREATE TABLE IF NOT EXISTS emails (
+	id BIGINT NOT NULL AUTO_INCREMENT,
+	template VARCHAR(64) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	recipient VARCHAR(255) NOT NULL,
+	subject VARCHAR(255) NOT NULL DEFAULT '',
+	status VARCHAR(16) NOT NULL,
+	error VARCHAR(1024) NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL,
+	sent_at DATETIME NULL,
+	CONSTRAINT emails_pk PRIMARY KEY (id),
+	INDEX emails_username_idx (username),
+	INDEX emails_recipient_idx (recipient)
+);
+CREATE TABLE IF NOT EXISTS audit_log (
+	id BIGINT NOT NULL AUTO_INCREMENT,
+	created_at DATETIME NOT NULL,
+	actor VARCHAR(255) NOT NULL,
+	api_key VARCHAR(16) NOT NULL DEFAULT '',
+	action VARCHAR(255) NOT NULL,
+	target VARCHAR(255) NOT NULL DEFAULT '',
+	changes MEDIUMTEXT NOT NULL,
+	status INT NOT NULL,
+	ip VARCHAR(45) NOT NULL DEFAULT '',
+	request_id VARCHAR(64) NOT NULL DEFAULT '',
+	prev_hash VARCHAR(64) NOT NULL,
+	hash VARCHAR(64) NOT NULL,
+	CONSTRAINT audit_log_pk PRIMARY KEY (id),
+	INDEX audit_log_actor_idx (actor),
+	INDEX audit_log_target_idx (target)
+);
+CREATE TABLE IF NOT EXISTS audit_head (
+	id INT NOT NULL,
+	hash VARCHAR(64) NOT NULL,
+	CONSTRAINT audit_head_pk PRIMARY KEY (id)
+);
 CREATE TABLE IF NOT EXISTS download_log (
-	username VARCHAR(128) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	organization VARCHAR(128) NOT NULL DEFAULT '',
 	name VARCHAR(30) NOT NULL,
 	path VARCHAR(1024) NOT NULL,
 	ip VARCHAR(30),
 	modify_date TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 )`
 
+// migrations are applied after the schema creation to bring tables created by older versions up to date.
+// Statements that fail because they were already applied are ignored.
+const migrations = `
+ALTER TABLE tokens ADD COLUMN not_before DATETIME NULL;
+ALTER TABLE tokens ADD COLUMN expires_at DATETIME NULL;
+ALTER TABLE tokens ADD COLUMN expired BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE tokens ADD COLUMN scope VARCHAR(1024) NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN versions VARCHAR(128) NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN customer VARCHAR(128) NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN notes VARCHAR(1024) NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN labels VARCHAR(1024) NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN created_by VARCHAR(128) NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE tokens ADD COLUMN last_used DATETIME NULL;
+ALTER TABLE tokens MODIFY COLUMN name VARCHAR(64) NOT NULL;
+ALTER TABLE tokens ADD COLUMN hint VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN revoked_at DATETIME NULL;
+ALTER TABLE users MODIFY COLUMN username VARCHAR(255) NOT NULL;
+ALTER TABLE download_log MODIFY COLUMN username VARCHAR(255) NOT NULL;
+ALTER TABLE users ADD COLUMN organization VARCHAR(128) NOT NULL DEFAULT '';
+ALTER TABLE download_log ADD COLUMN organization VARCHAR(128) NOT NULL DEFAULT '';
+ALTER TABLE downloads ADD COLUMN git_hash VARCHAR(128);
+ALTER TABLE downloads ADD COLUMN version VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN force_password_change BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN recovery_codes VARCHAR(1024) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN roles VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE login_links ADD COLUMN kind VARCHAR(32) NOT NULL DEFAULT 'sign-in';
+ALTER TABLE users ADD COLUMN source VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN external_id VARCHAR(512) NOT NULL DEFAULT '';
+CREATE INDEX users_external_idx ON users (source, external_id(191))`
+
+const (
+	// mysqlDuplicateColumn is returned when adding a column that already exists
+	mysqlDuplicateColumn = 1060
+	// mysqlDuplicateKey is returned when adding an index that already exists
+	mysqlDuplicateKey = 1061
+	// mysqlDuplicateEntry is returned when inserting a row with an existing primary key
+	mysqlDuplicateEntry = 1062
+	// cleanupInterval is how often we look for tokens that have expired and idempotency keys to forget
+	cleanupInterval = 10 * time.Minute
+)
+
 var (
 	// ErrNotFound is a not found error if Get does not retrieve a value
 	ErrNotFound = errors.New("not_found")
+	// ErrAlreadyUsed is returned when a one time value was already used
+	ErrAlreadyUsed = errors.New("already_used")
 )
 
 type Repo struct {
@@ -117,18 +333,170 @@ func New() (*Repo, error) {
 		return nil, err
 	}
 	logrus.Info("Schema creation is done")
+	err = migrate(db)
+	if err != nil {
+		return nil, err
+	}
 	r := &Repo{
 		db:   db,
-		stop: make(chan bool, 1),
+		stop: make(chan bool),
 	}
+	util.GoAndRespawn(r.cleanupJob, util.RecoverRoutineForever, nil)
 	return r, nil
 }
 
+// migrate applies the migrations ignoring the ones that were already applied
+func migrate(db *sqlx.DB) error {
+	for _, m := range strings.Split(migrations, ";") {
+		if strings.TrimSpace(m) == "" {
+			continue
+		}
+		_, err := db.Exec(m)
+		if err != nil {
+			if myErr, ok := err.(*mysql.MySQLError); ok && (myErr.Number == mysqlDuplicateColumn || myErr.Number == mysqlDuplicateKey) {
+				continue
+			}
+			return err
+		}
+	}
+	logrus.Info("Schema migration is done")
+	if err := migrateTokenDigests(db); err != nil {
+		return err
+	}
+	return openTokenLedgers(db)
+}
+
+// openTokenLedgers records the current balance of tokens created before the ledger existed
+func openTokenLedgers(db *sqlx.DB) error {
+	res, err := db.Exec(`INSERT INTO token_events (token, type, delta, balance, actor, reason, created_at)
+SELECT t.name, ?, t.downloads, t.downloads, t.created_by, 'Opening balance', t.created_at FROM tokens t
+WHERE NOT EXISTS (SELECT 1 FROM token_events e WHERE e.token = t.name)`, domain.TokenEventIssued)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		logrus.Infof("Opened the ledger of %d tokens", n)
+	}
+	return nil
+}
+
+// migrateTokenDigests replaces plain tokens stored by older versions with their digest.
+// The users derived from the tokens and their download log are renamed as well so existing links keep working.
+func migrateTokenDigests(db *sqlx.DB) error {
+	var plains []string
+	err := db.Select(&plains, "SELECT name FROM tokens WHERE LENGTH(name) <> 64")
+	if err != nil || len(plains) == 0 {
+		return err
+	}
+	logrus.Infof("Migrating %d plain tokens to digests", len(plains))
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, plain := range plains {
+		digest := domain.TokenDigest(plain)
+		prefix := plain + "*-*"
+		stmts := []struct {
+			q    string
+			args []interface{}
+		}{
+			{"UPDATE tokens SET name = ?, hint = ? WHERE name = ?", []interface{}{digest, domain.TokenHint(plain), plain}},
+			{"UPDATE users SET username = CONCAT(?, SUBSTRING(username, ?)) WHERE username LIKE ?", []interface{}{digest + "*-*", len(prefix) + 1, prefix + "%"}},
+			{"UPDATE users SET token = ? WHERE token = ?", []interface{}{digest, plain}},
+			{"UPDATE token_events SET token = ? WHERE token = ?", []interface{}{digest, plain}},
+			{"UPDATE download_log SET username = CONCAT(?, SUBSTRING(username, ?)) WHERE username LIKE ?", []interface{}{digest + "*-*", len(prefix) + 1, prefix + "%"}},
+		}
+		for _, stmt := range stmts {
+			if _, err = tx.Exec(stmt.q, stmt.args...); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
 func (r *Repo) Close() error {
-	r.stop <- true
+	close(r.stop)
 	return r.db.Close()
 }
 
+// cleanupJob periodically marks tokens that passed their expiration time and deletes idempotency keys
+// that are older than the idempotency window and expired SAML assertions until the repo is closed
+func (r *Repo) cleanupJob() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.ExpireTokens(time.Now()); err != nil {
+			logrus.WithError(err).Warn("Unable to mark expired tokens")
+		}
+		if err := r.DeleteIdempotentResponses(idempotencyCutoff()); err != nil {
+			logrus.WithError(err).Warn("Unable to delete old idempotency keys")
+		}
+		if err := r.DeleteExpiredSAMLAssertions(time.Now()); err != nil {
+			logrus.WithError(err).Warn("Unable to delete expired SAML assertions")
+		}
+		if err := r.DeleteExpiredWebAuthnCeremonies(time.Now()); err != nil {
+			logrus.WithError(err).Warn("Unable to delete expired WebAuthn ceremonies")
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// idempotencyCutoff is the creation time before which idempotency keys are forgotten
+func idempotencyCutoff() time.Time {
+	return time.Now().Add(-time.Duration(conf.Options.IdempotencyWindow) * time.Minute)
+}
+
+// ReserveIdempotencyKey stores the key with an empty response before the request is handled.
+// If the key was already used within the idempotency window, the stored response is returned instead
+// and the caller should not handle the request.
+func (r *Repo) ReserveIdempotencyKey(resp *domain.IdempotentResponse) (*domain.IdempotentResponse, error) {
+	if resp.CreatedAt.IsZero() {
+		resp.CreatedAt = time.Now()
+	}
+	// Keys outside the window can be reused even if the cleanup job did not get to them yet
+	_, err := r.db.Exec("DELETE FROM idempotency_keys WHERE username = ? AND id_key = ? AND created_at < ?", resp.Username, resp.Key, idempotencyCutoff())
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.db.Exec("INSERT INTO idempotency_keys (id_key, username, request, status, content_type, body, created_at) VALUES (?, ?, ?, 0, '', NULL, ?)",
+		resp.Key, resp.Username, resp.Request, resp.CreatedAt)
+	if myErr, ok := err.(*mysql.MySQLError); ok && myErr.Number == mysqlDuplicateEntry {
+		existing := &domain.IdempotentResponse{}
+		err = r.db.Get(existing, "SELECT * FROM idempotency_keys WHERE username = ? AND id_key = ?", resp.Username, resp.Key)
+		if err != nil {
+			return nil, err
+		}
+		return existing, nil
+	}
+	return nil, err
+}
+
+// SetIdempotentResponse stores the response of a reserved key. The body is stored as given so callers must
+// seal it if it includes secrets such as plain tokens.
+func (r *Repo) SetIdempotentResponse(resp *domain.IdempotentResponse) error {
+	_, err := r.db.Exec("UPDATE idempotency_keys SET status = ?, content_type = ?, body = ? WHERE username = ? AND id_key = ?",
+		resp.Status, resp.ContentType, resp.Body, resp.Username, resp.Key)
+	return err
+}
+
+// DeleteIdempotencyKey releases a reserved key so the request can be retried
+func (r *Repo) DeleteIdempotencyKey(username, key string) error {
+	_, err := r.db.Exec("DELETE FROM idempotency_keys WHERE username = ? AND id_key = ?", username, key)
+	return err
+}
+
+// DeleteIdempotentResponses deletes the keys created before the given time
+func (r *Repo) DeleteIdempotentResponses(before time.Time) error {
+	_, err := r.db.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", before)
+	return err
+}
+
 func (r *Repo) get(tableName, field, id string, data interface{}) error {
 	err := r.db.Get(data, "SELECT * FROM "+tableName+" WHERE "+field+" = ?", id)
 	if err == sql.ErrNoRows {
@@ -152,13 +520,18 @@ func (r *Repo) User(username string) (*domain.User, error) {
 }
 
 func (r *Repo) SetUser(u *domain.User) error {
+	return setUser(r.db, u)
+}
+
+func setUser(db sqlx.Execer, u *domain.User) error {
 	logrus.Infof("Saving user - %s", u.Username)
 	if u.ModifyDate.IsZero() {
 		u.ModifyDate = time.Now()
 	}
-	_, err := r.db.Exec(`INSERT INTO users (
-username, hash, email, name, type, modify_date, last_login, token)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	_, err := db.Exec(`INSERT INTO users (
+username, hash, email, name, type, modify_date, last_login, token, organization, force_password_change,
+totp_secret, totp_enabled, totp_last_step, recovery_codes, roles, disabled, source, external_id)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 ON DUPLICATE KEY UPDATE
 hash = ?,
 email = ?,
@@ -166,12 +539,508 @@ name = ?,
 type = ?,
 modify_date = ?,
 last_login = ?,
-token = ?`,
-		u.Username, u.Hash, u.Email, u.Name, u.Type, u.ModifyDate, u.LastLogin, u.Token,
-		u.Hash, u.Email, u.Name, u.Type, u.ModifyDate, u.LastLogin, u.Token)
+token = ?,
+organization = ?,
+force_password_change = ?,
+totp_secret = ?,
+totp_enabled = ?,
+totp_last_step = ?,
+recovery_codes = ?,
+roles = ?,
+disabled = ?,
+source = ?,
+external_id = ?`,
+		u.Username, u.Hash, u.Email, u.Name, u.Type, u.ModifyDate, u.LastLogin, u.Token, u.Organization, u.ForcePasswordChange,
+		u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep, u.RecoveryCodes, u.Roles, u.Disabled, u.Source, u.ExternalID,
+		u.Hash, u.Email, u.Name, u.Type, u.ModifyDate, u.LastLogin, u.Token, u.Organization, u.ForcePasswordChange,
+		u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep, u.RecoveryCodes, u.Roles, u.Disabled, u.Source, u.ExternalID)
+	return err
+}
+
+// SetLastLogin records the login time of the user without saving anything else
+func (r *Repo) SetLastLogin(username string, at time.Time) error {
+	_, err := r.db.Exec("UPDATE users SET last_login = ? WHERE username = ?", at, username)
+	return err
+}
+
+// UseTOTPStep records the time step of an accepted one time password. Returns ErrAlreadyUsed if the same or a later
+// step was already used, even by a concurrent request.
+func (r *Repo) UseTOTPStep(username string, step int64) error {
+	res, err := r.db.Exec("UPDATE users SET totp_last_step = ? WHERE username = ? AND totp_last_step < ?", step, username, step)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAlreadyUsed
+	}
+	return nil
+}
+
+// UseRecoveryCode replaces the recovery codes of the user with the remaining ones if they were not changed since
+// they were loaded. Returns ErrAlreadyUsed if they were, for example by a concurrent request using the same code.
+func (r *Repo) UseRecoveryCode(username string, loaded, remaining domain.StringList) error {
+	res, err := r.db.Exec("UPDATE users SET recovery_codes = ? WHERE username = ? AND recovery_codes = ?", remaining, username, loaded)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAlreadyUsed
+	}
+	return nil
+}
+
+// UserByExternalID returns the user the identity provider of the source created for the external ID
+func (r *Repo) UserByExternalID(source, id string) (*domain.User, error) {
+	u := &domain.User{}
+	err := r.db.Get(u, "SELECT * FROM users WHERE source = ? AND external_id = ?", source, id)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// CustomerByEmail returns the enabled local customer with the email that logged in most recently. Customers have
+// a user per token so several can share an email. Users of an identity provider or directory are never returned
+// since they must sign in there.
+func (r *Repo) CustomerByEmail(email string) (*domain.User, error) {
+	u := &domain.User{}
+	err := r.db.Get(u, "SELECT * FROM users WHERE email = ? AND type = ? AND source = '' AND disabled = FALSE ORDER BY last_login DESC LIMIT 1",
+		email, domain.UserTypeUser)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// SearchUsers returns a page of the users matching the filter ordered by username and the total number of matches
+func (r *Repo) SearchUsers(f *domain.UserFilter) (u []domain.User, total int, err error) {
+	var where []string
+	var args []interface{}
+	if f.Username != "" {
+		where = append(where, "username LIKE ?")
+		args = append(args, "%"+f.Username+"%")
+	}
+	if f.Email != "" {
+		where = append(where, "email LIKE ?")
+		args = append(args, "%"+f.Email+"%")
+	}
+	if f.Type != nil {
+		where = append(where, "type = ?")
+		args = append(args, *f.Type)
+	}
+	if f.Organization != "" {
+		where = append(where, "organization = ?")
+		args = append(args, f.Organization)
+	}
+	q := ""
+	if len(where) > 0 {
+		q = " WHERE " + strings.Join(where, " AND ")
+	}
+	if err = r.db.Get(&total, "SELECT COUNT(*) FROM users"+q, args...); err != nil {
+		return
+	}
+	limit := f.Limit
+	if limit <= 0 || limit > domain.MaxUserPageSize {
+		limit = domain.MaxUserPageSize
+	}
+	err = r.db.Select(&u, "SELECT * FROM users"+q+" ORDER BY username LIMIT ? OFFSET ?", append(args, limit, f.Offset)...)
+	return
+}
+
+// AddWebAuthnCredential registers a new credential. Returns an error if the credential is already registered.
+func (r *Repo) AddWebAuthnCredential(c *domain.WebAuthnCredential) error {
+	_, err := r.db.Exec("INSERT INTO webauthn_credentials (id, username, name, public_key, sign_count, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		c.ID, c.Username, c.Name, c.PublicKey, c.SignCount, c.CreatedAt)
+	return err
+}
+
+// UpdateWebAuthnCredential saves the counter and last use of the credential after a login. The counter must be higher
+// than the stored one, otherwise domain.ErrWebAuthnCloned is returned, so of two logins with the same assertion only
+// one succeeds. Authenticators that do not implement the counter always send zero and are not checked, their replays
+// are stopped by UseWebAuthnCeremony.
+func (r *Repo) UpdateWebAuthnCredential(c *domain.WebAuthnCredential) error {
+	if c.SignCount == 0 {
+		_, err := r.db.Exec("UPDATE webauthn_credentials SET last_used = ? WHERE id = ?", c.LastUsed, c.ID)
+		return err
+	}
+	res, err := r.db.Exec("UPDATE webauthn_credentials SET sign_count = ?, last_used = ? WHERE id = ? AND sign_count < ?", c.SignCount, c.LastUsed, c.ID, c.SignCount)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return domain.ErrWebAuthnCloned
+	}
+	return nil
+}
+
+// WebAuthnCredential returns the credential with the given ID
+func (r *Repo) WebAuthnCredential(id string) (*domain.WebAuthnCredential, error) {
+	c := &domain.WebAuthnCredential{}
+	if err := r.get("webauthn_credentials", "id", id, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// WebAuthnCredentials returns the credentials registered by the user
+func (r *Repo) WebAuthnCredentials(username string) (c []domain.WebAuthnCredential, err error) {
+	err = r.db.Select(&c, "SELECT * FROM webauthn_credentials WHERE username = ? ORDER BY created_at", username)
+	return
+}
+
+// DeleteWebAuthnCredential removes a credential of the user
+func (r *Repo) DeleteWebAuthnCredential(username, id string) error {
+	_, err := r.db.Exec("DELETE FROM webauthn_credentials WHERE username = ? AND id = ?", username, id)
+	return err
+}
+
+// AddWebAuthnCeremony stores the ceremony until it is finished
+func (r *Repo) AddWebAuthnCeremony(c *domain.WebAuthnCeremony) error {
+	_, err := r.db.Exec("INSERT INTO webauthn_ceremonies (id, username, type, challenge, expires_at) VALUES (?, ?, ?, ?, ?)",
+		c.ID, c.Username, c.Type, c.Challenge, c.ExpiresAt)
+	return err
+}
+
+// UseWebAuthnCeremony returns the ceremony with the given ID and deletes it so its challenge cannot be used again.
+// Returns ErrNotFound if the ceremony does not exist or was already used, even by a concurrent request.
+func (r *Repo) UseWebAuthnCeremony(id string) (*domain.WebAuthnCeremony, error) {
+	c := &domain.WebAuthnCeremony{}
+	if err := r.get("webauthn_ceremonies", "id", id, c); err != nil {
+		return nil, err
+	}
+	res, err := r.db.Exec("DELETE FROM webauthn_ceremonies WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrNotFound
+	}
+	return c, nil
+}
+
+// DeleteExpiredWebAuthnCeremonies removes the ceremonies that were not finished in time
+func (r *Repo) DeleteExpiredWebAuthnCeremonies(now time.Time) error {
+	_, err := r.db.Exec("DELETE FROM webauthn_ceremonies WHERE expires_at < ?", now)
+	return err
+}
+
+// AddAPIKey stores a new API key
+func (r *Repo) AddAPIKey(k *domain.APIKey) error {
+	_, err := r.db.Exec("INSERT INTO api_keys (id, hint, name, username, scopes, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		k.ID, k.Hint, k.Name, k.Username, k.Scopes, k.ExpiresAt, k.CreatedAt)
+	return err
+}
+
+// APIKey returns the API key with the given ID (digest)
+func (r *Repo) APIKey(id string) (*domain.APIKey, error) {
+	k := &domain.APIKey{}
+	if err := r.get("api_keys", "id", id, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// APIKeys returns all the API keys including revoked ones
+func (r *Repo) APIKeys() (k []domain.APIKey, err error) {
+	err = r.db.Select(&k, "SELECT * FROM api_keys ORDER BY created_at")
+	return
+}
+
+// SetAPIKeyUsed records the last use of the API key
+func (r *Repo) SetAPIKeyUsed(id string, at time.Time) error {
+	_, err := r.db.Exec("UPDATE api_keys SET last_used = ? WHERE id = ?", at, id)
+	return err
+}
+
+// RevokeAPIKey revokes the API key if it is not revoked yet. Returns ErrNotFound if the key does not exist.
+func (r *Repo) RevokeAPIKey(id string, at time.Time) error {
+	logrus.Infof("Revoking API key - %s", id)
+	res, err := r.db.Exec("UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?", at, id)
+	if err != nil {
+		return err
+	}
+	// Affected rows count changed rows only so check existence separately
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		if _, err = r.APIKey(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddSession stores a new login session
+func (r *Repo) AddSession(s *domain.Session) error {
+	_, err := r.db.Exec("INSERT INTO sessions (id, username, created_at, last_seen, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?)",
+		s.ID, s.Username, s.CreatedAt, s.LastSeen, s.IP, s.UserAgent)
+	return err
+}
+
+// Session returns the session with the given ID (digest)
+func (r *Repo) Session(id string) (*domain.Session, error) {
+	s := &domain.Session{}
+	if err := r.get("sessions", "id", id, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Sessions returns the sessions of the user, most recently seen first
+func (r *Repo) Sessions(username string) (s []domain.Session, err error) {
+	err = r.db.Select(&s, "SELECT * FROM sessions WHERE username = ? ORDER BY last_seen DESC", username)
+	return
+}
+
+// SetSessionSeen records the last request of the session
+func (r *Repo) SetSessionSeen(id string, at time.Time) error {
+	_, err := r.db.Exec("UPDATE sessions SET last_seen = ? WHERE id = ?", at, id)
+	return err
+}
+
+// DeleteSession revokes the session. Returns ErrNotFound if the session does not exist.
+func (r *Repo) DeleteSession(id string) error {
+	res, err := r.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteUserSessions revokes all the sessions of the user and returns how many were revoked
+func (r *Repo) DeleteUserSessions(username string) (int64, error) {
+	logrus.Infof("Revoking all sessions of %s", username)
+	res, err := r.db.Exec("DELETE FROM sessions WHERE username = ?", username)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteExpiredSessions removes the sessions that were not seen since the given time
+func (r *Repo) DeleteExpiredSessions(before time.Time) error {
+	_, err := r.db.Exec("DELETE FROM sessions WHERE last_seen < ?", before)
+	return err
+}
+
+// AddLoginLink stores a new emailed link
+func (r *Repo) AddLoginLink(l *domain.LoginLink) error {
+	_, err := r.db.Exec("INSERT INTO login_links (id, username, kind, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		l.ID, l.Username, l.Kind, l.CreatedAt, l.ExpiresAt)
+	return err
+}
+
+// LoginLink returns the link with the given ID (digest) without using it
+func (r *Repo) LoginLink(id string) (*domain.LoginLink, error) {
+	l := &domain.LoginLink{}
+	if err := r.get("login_links", "id", id, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// UseLoginLink deletes the link with the given ID (digest) so it cannot be used again. Returns ErrNotFound if the
+// link does not exist or was already used, even by a concurrent request.
+func (r *Repo) UseLoginLink(id string) error {
+	res, err := r.db.Exec("DELETE FROM login_links WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteExpiredLoginLinks removes the links that expired before the given time
+func (r *Repo) DeleteExpiredLoginLinks(before time.Time) error {
+	_, err := r.db.Exec("DELETE FROM login_links WHERE expires_at < ?", before)
+	return err
+}
+
+// Attempts returns the failed attempts of the key. Returns ErrNotFound if there are none.
+func (r *Repo) Attempts(key string) (*domain.Attempts, error) {
+	a := &domain.Attempts{}
+	if err := r.get("attempts", "attempt_key", key, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// FailAttempt records a failed attempt of the key based on the throttle. The row is locked so concurrent failures
+// on all instances are counted.
+func (r *Repo) FailAttempt(key string, t *domain.Throttle, now time.Time) (*domain.Attempts, error) {
+	a := &domain.Attempts{}
+	err := r.withTx(func(tx *sqlx.Tx) error {
+		if _, err := tx.Exec("INSERT IGNORE INTO attempts (attempt_key, window_start) VALUES (?, ?)", key, now); err != nil {
+			return err
+		}
+		if err := tx.Get(a, "SELECT * FROM attempts WHERE attempt_key = ? FOR UPDATE", key); err != nil {
+			return err
+		}
+		t.Fail(a, now)
+		_, err := tx.Exec("UPDATE attempts SET failures = ?, window_start = ?, locked_until = ? WHERE attempt_key = ?",
+			a.Failures, a.WindowStart, a.LockedUntil, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// DeleteAttempts forgets the failed attempts of the key
+func (r *Repo) DeleteAttempts(key string) error {
+	_, err := r.db.Exec("DELETE FROM attempts WHERE attempt_key = ?", key)
 	return err
 }
 
+// DeleteExpiredAttempts removes the attempts that are not locked and whose window started before the given time
+func (r *Repo) DeleteExpiredAttempts(before, now time.Time) error {
+	_, err := r.db.Exec("DELETE FROM attempts WHERE window_start < ? AND (locked_until IS NULL OR locked_until < ?)", before, now)
+	return err
+}
+
+// AddEmailDelivery records an email that is about to be sent
+func (r *Repo) AddEmailDelivery(d *domain.EmailDelivery) error {
+	res, err := r.db.Exec("INSERT INTO emails (template, username, recipient, subject, status, error, created_at, sent_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		d.Template, d.Username, d.Recipient, d.Subject, d.Status, d.Error, d.CreatedAt, d.SentAt)
+	if err != nil {
+		return err
+	}
+	d.ID, err = res.LastInsertId()
+	return err
+}
+
+// SetEmailDeliveryStatus saves the status, error and sent time of the delivery
+func (r *Repo) SetEmailDeliveryStatus(d *domain.EmailDelivery) error {
+	_, err := r.db.Exec("UPDATE emails SET status = ?, error = ?, sent_at = ? WHERE id = ?", d.Status, d.Error, d.SentAt, d.ID)
+	return err
+}
+
+// EmailDeliveries returns the deliveries matching the filter, newest first
+func (r *Repo) EmailDeliveries(f *domain.EmailFilter) (d []domain.EmailDelivery, err error) {
+	var where []string
+	var args []interface{}
+	if f.Username != "" {
+		where = append(where, "username = ?")
+		args = append(args, f.Username)
+	}
+	if f.Recipient != "" {
+		where = append(where, "recipient = ?")
+		args = append(args, f.Recipient)
+	}
+	if f.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	q := "SELECT * FROM emails"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	limit := f.Limit
+	if limit <= 0 || limit > domain.MaxEmailPageSize {
+		limit = domain.MaxEmailPageSize
+	}
+	err = r.db.Select(&d, q+" ORDER BY id DESC LIMIT ?", append(args, limit)...)
+	return
+}
+
+// AddAuditEntry seals the entry with the hash of the last one and appends it. The single row of audit_head is locked
+// so entries from all instances form one chain.
+func (r *Repo) AddAuditEntry(e *domain.AuditEntry) error {
+	return r.withTx(func(tx *sqlx.Tx) error {
+		if _, err := tx.Exec("INSERT IGNORE INTO audit_head (id, hash) VALUES (1, '')"); err != nil {
+			return err
+		}
+		var prev string
+		if err := tx.Get(&prev, "SELECT hash FROM audit_head WHERE id = 1 FOR UPDATE"); err != nil {
+			return err
+		}
+		e.Seal(prev, domain.AuditKey())
+		res, err := tx.Exec(`INSERT INTO audit_log (created_at, actor, api_key, action, target, changes, status, ip, request_id, prev_hash, hash)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.CreatedAt, e.Actor, e.APIKey, e.Action, e.Target, e.Changes, e.Status, e.IP, e.RequestID, e.PrevHash, e.Hash)
+		if err != nil {
+			return err
+		}
+		if e.ID, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE audit_head SET hash = ? WHERE id = 1", e.Hash)
+		return err
+	})
+}
+
+// AuditLog returns the audit entries matching the filter ordered by ID
+func (r *Repo) AuditLog(f *domain.AuditFilter) (e []domain.AuditEntry, err error) {
+	var where []string
+	var args []interface{}
+	if f.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		where = append(where, "action LIKE ?")
+		args = append(args, "%"+f.Action+"%")
+	}
+	if f.Target != "" {
+		where = append(where, "target = ?")
+		args = append(args, f.Target)
+	}
+	if f.Since != nil {
+		where = append(where, "created_at >= ?")
+		args = append(args, *f.Since)
+	}
+	if f.Until != nil {
+		where = append(where, "created_at < ?")
+		args = append(args, *f.Until)
+	}
+	if f.AfterID > 0 {
+		where = append(where, "id > ?")
+		args = append(args, f.AfterID)
+	}
+	q := "SELECT * FROM audit_log"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	limit := f.Limit
+	if limit <= 0 || limit > domain.MaxAuditPageSize {
+		limit = domain.MaxAuditPageSize
+	}
+	err = r.db.Select(&e, q+" ORDER BY id LIMIT ?", append(args, limit)...)
+	return
+}
+
+// AuditHead returns the hash of the last audit entry or empty if there are none
+func (r *Repo) AuditHead() (string, error) {
+	var hash string
+	err := r.db.Get(&hash, "SELECT hash FROM audit_head WHERE id = 1")
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
 func (r *Repo) Token(name string) (*domain.Token, error) {
 	token := &domain.Token{}
 	err := r.get("tokens", "name", name, token)
@@ -187,17 +1056,246 @@ func (r *Repo) Tokens() (t []domain.Token, err error) {
 }
 
 func (r *Repo) OpenTokens() (t []domain.Token, err error) {
-	err = r.db.Select(&t, "SELECT * FROM tokens WHERE downloads > 0")
+	err = r.db.Select(&t, "SELECT * FROM tokens WHERE downloads > 0 AND expired = FALSE AND revoked_at IS NULL")
 	return
 }
 
+// SetToken creates or updates the token. The creation details are only set when the token is created,
+// the last used time is only updated if it is set and a revoked token stays revoked.
+// Changes to the downloads should go through SetTokenWithEvent or AdjustToken so they are recorded in the ledger.
 func (r *Repo) SetToken(t *domain.Token) error {
+	return setToken(r.db, t)
+}
+
+func setToken(db sqlx.Execer, t *domain.Token) error {
 	logrus.Infof("Saving token - %s", t.Name)
-	_, err := r.db.Exec(`INSERT INTO tokens (name, downloads) VALUES (?, ?) ON DUPLICATE KEY UPDATE downloads = ?`,
-		t.Name, t.Downloads, t.Downloads)
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	_, err := db.Exec(`INSERT INTO tokens (name, hint, downloads, not_before, expires_at, expired, scope, versions, customer, notes, labels, created_by, created_at, last_used, revoked_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE downloads = ?, not_before = ?, expires_at = ?, expired = ?, scope = ?, versions = ?, customer = ?, notes = ?, labels = ?,
+last_used = COALESCE(?, last_used), revoked_at = COALESCE(revoked_at, ?)`,
+		t.Name, t.Hint, t.Downloads, t.NotBefore, t.ExpiresAt, t.Expired, t.Scope, t.Versions, t.Customer, t.Notes, t.Labels, t.CreatedBy, t.CreatedAt, t.LastUsed, t.RevokedAt,
+		t.Downloads, t.NotBefore, t.ExpiresAt, t.Expired, t.Scope, t.Versions, t.Customer, t.Notes, t.Labels, t.LastUsed, t.RevokedAt)
 	return err
 }
 
+// withTx runs f in a transaction that is committed if f succeeds and rolled back otherwise
+func (r *Repo) withTx(f func(tx *sqlx.Tx) error) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// addTokenEvent appends the event to the ledger. Events are never updated or deleted.
+func addTokenEvent(db sqlx.Execer, e *domain.TokenEvent) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	res, err := db.Exec(`INSERT INTO token_events (token, type, delta, balance, actor, reason, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		e.Token, e.Type, e.Delta, e.Balance, e.Actor, e.Reason, e.CreatedAt)
+	if err != nil {
+		return err
+	}
+	e.ID, err = res.LastInsertId()
+	return err
+}
+
+// SetTokenWithEvent saves the token and records the event with the new balance in the same transaction
+func (r *Repo) SetTokenWithEvent(t *domain.Token, e *domain.TokenEvent) error {
+	return r.withTx(func(tx *sqlx.Tx) error {
+		if err := setToken(tx, t); err != nil {
+			return err
+		}
+		e.Token = t.Name
+		e.Balance = t.Downloads
+		return addTokenEvent(tx, e)
+	})
+}
+
+// UpdateToken applies update to the existing token and saves it, recording the difference in downloads as a set event.
+// The token is locked while it is read, updated and written so concurrent updates and adjustments add up in the ledger.
+// An error returned by update is returned as is. Returns the token as it was before and after the update and
+// ErrNotFound if it does not exist.
+func (r *Repo) UpdateToken(name string, update func(t *domain.Token) error, actor, reason string) (old, t *domain.Token, err error) {
+	err = r.withTx(func(tx *sqlx.Tx) error {
+		old = &domain.Token{}
+		err := tx.Get(old, "SELECT * FROM tokens WHERE name = ? FOR UPDATE", name)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		updated := *old
+		t = &updated
+		if err = update(t); err != nil {
+			return err
+		}
+		if err = setToken(tx, t); err != nil {
+			return err
+		}
+		if t.Downloads == old.Downloads {
+			return nil
+		}
+		return addTokenEvent(tx, &domain.TokenEvent{Token: name, Type: domain.TokenEventSet, Delta: t.Downloads - old.Downloads,
+			Balance: t.Downloads, Actor: actor, Reason: reason})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return old, t, nil
+}
+
+// TouchToken sets the last used time of the token without changing anything else
+func (r *Repo) TouchToken(name string, at time.Time) error {
+	_, err := r.db.Exec("UPDATE tokens SET last_used = ? WHERE name = ?", at, name)
+	return err
+}
+
+// ImportTokens creates all the tokens, their opening ledger events and their users in a single transaction
+// so either all of them are created or none
+func (r *Repo) ImportTokens(grants []domain.TokenGrant, reason string) error {
+	return r.withTx(func(tx *sqlx.Tx) error {
+		for _, g := range grants {
+			if err := setToken(tx, g.Token); err != nil {
+				return err
+			}
+			e := &domain.TokenEvent{Token: g.Token.Name, Type: domain.TokenEventIssued, Delta: g.Token.Downloads, Balance: g.Token.Downloads, Actor: g.Token.CreatedBy, Reason: reason}
+			if err := addTokenEvent(tx, e); err != nil {
+				return err
+			}
+			if err := setUser(tx, g.User); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TokensUsage returns all the tokens with the users they were issued to and the number of downloads each user made.
+// A token with several users is returned once for each user.
+func (r *Repo) TokensUsage() (u []domain.TokenUsage, err error) {
+	err = r.db.Select(&u, `SELECT t.*, COALESCE(u.email, '') AS email, COALESCE(u.organization, '') AS organization,
+(SELECT COUNT(*) FROM download_log l WHERE l.username = u.username) AS used
+FROM tokens t LEFT JOIN users u ON u.token = t.name ORDER BY t.created_at, u.email`)
+	return
+}
+
+// AdjustToken atomically adds the event delta to the token downloads and records the event.
+// Consumption also updates the last used time of the token.
+// Returns ErrNotFound if the token does not exist and domain.ErrTokenUsed if the downloads would go below zero.
+func (r *Repo) AdjustToken(e *domain.TokenEvent) (t *domain.Token, err error) {
+	err = r.withTx(func(tx *sqlx.Tx) error {
+		t = &domain.Token{}
+		err := tx.Get(t, "SELECT * FROM tokens WHERE name = ? FOR UPDATE", e.Token)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if t.Downloads+e.Delta < 0 {
+			return domain.ErrTokenUsed
+		}
+		if e.CreatedAt.IsZero() {
+			e.CreatedAt = time.Now()
+		}
+		t.Downloads += e.Delta
+		if e.Type == domain.TokenEventConsumed {
+			t.LastUsed = &e.CreatedAt
+		}
+		if _, err = tx.Exec("UPDATE tokens SET downloads = ?, last_used = ? WHERE name = ?", t.Downloads, t.LastUsed, t.Name); err != nil {
+			return err
+		}
+		e.Balance = t.Downloads
+		return addTokenEvent(tx, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// TokenEvents returns the ledger of the token ordered by time
+func (r *Repo) TokenEvents(name string) (e []domain.TokenEvent, err error) {
+	err = r.db.Select(&e, "SELECT * FROM token_events WHERE token = ? ORDER BY id", name)
+	return
+}
+
+// TokenLedgerBalance returns the sum of all the deltas recorded for the token
+func (r *Repo) TokenLedgerBalance(name string) (balance int, err error) {
+	err = r.db.Get(&balance, "SELECT COALESCE(SUM(delta), 0) FROM token_events WHERE token = ?", name)
+	return
+}
+
+// SearchTokens returns the tokens matching the filter ordered by creation time
+func (r *Repo) SearchTokens(f *domain.TokenFilter) (t []domain.Token, err error) {
+	var where []string
+	var args []interface{}
+	if !f.All {
+		where = append(where, "downloads > 0 AND expired = FALSE AND revoked_at IS NULL")
+	}
+	for _, label := range f.Labels {
+		where = append(where, "FIND_IN_SET(?, labels) > 0")
+		args = append(args, label)
+	}
+	if f.Customer != "" {
+		where = append(where, "customer LIKE ?")
+		args = append(args, "%"+f.Customer+"%")
+	}
+	if f.CreatedBy != "" {
+		where = append(where, "created_by = ?")
+		args = append(args, f.CreatedBy)
+	}
+	q := "SELECT * FROM tokens"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	err = r.db.Select(&t, q+" ORDER BY created_at", args...)
+	return
+}
+
+// RevokeToken revokes the token with the given name (digest) if it exists and is not revoked yet.
+// The revocation is recorded in the ledger. Returns ErrNotFound if the token does not exist.
+func (r *Repo) RevokeToken(name, actor, reason string, at time.Time) error {
+	logrus.Infof("Revoking token - %s", name)
+	return r.withTx(func(tx *sqlx.Tx) error {
+		t := &domain.Token{}
+		err := tx.Get(t, "SELECT * FROM tokens WHERE name = ? FOR UPDATE", name)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if t.RevokedAt != nil {
+			return nil
+		}
+		if _, err = tx.Exec("UPDATE tokens SET revoked_at = ? WHERE name = ?", at, name); err != nil {
+			return err
+		}
+		return addTokenEvent(tx, &domain.TokenEvent{Token: name, Type: domain.TokenEventRevoked, Balance: t.Downloads, Actor: actor, Reason: reason, CreatedAt: at})
+	})
+}
+
+// ExpireTokens marks all the tokens that expired before now and returns how many were marked
+func (r *Repo) ExpireTokens(now time.Time) (int64, error) {
+	res, err := r.db.Exec("UPDATE tokens SET expired = TRUE WHERE expired = FALSE AND expires_at IS NOT NULL AND expires_at <= ?", now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n > 0 {
+		logrus.Infof("Marked %d tokens as expired", n)
+	}
+	return n, err
+}
+
 func (r *Repo) Download(name string) (*domain.Download, error) {
 	d := &domain.Download{}
 	err := r.get("downloads", "name", name, d)
@@ -212,17 +1310,23 @@ func (r *Repo) SetDownload(d *domain.Download) error {
 	if d.ModifyDate.IsZero() {
 		d.ModifyDate = time.Now()
 	}
-	_, err := r.db.Exec(`INSERT INTO downloads (name, path, sha256, git_hash, username, modify_date) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE path = ?, sha256 = ?, git_hash = ?, username = ?, modify_date = ?`,
-		d.Name, d.Path, d.SHA256, d.GitHash, d.Username, d.ModifyDate, d.Path, d.SHA256, d.GitHash, d.Username, d.ModifyDate)
+	_, err := r.db.Exec(`INSERT INTO downloads (name, path, sha256, git_hash, version, username, modify_date) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE path = ?, sha256 = ?, git_hash = ?, version = ?, username = ?, modify_date = ?`,
+		d.Name, d.Path, d.SHA256, d.GitHash, d.Version, d.Username, d.ModifyDate, d.Path, d.SHA256, d.GitHash, d.Version, d.Username, d.ModifyDate)
 	return err
 }
 
 func (r *Repo) LogDownload(u *domain.User, d *domain.Download, ip string) error {
-	_, err := r.db.Exec(`INSERT INTO download_log (username, name, path, ip, modify_date) VALUES (?, ?, ?, ?, ?)`,
-		u.Username, d.Name, d.Path, ip, time.Now())
+	_, err := r.db.Exec(`INSERT INTO download_log (username, organization, name, path, ip, modify_date) VALUES (?, ?, ?, ?, ?, ?)`,
+		u.Username, u.Organization, d.Name, d.Path, ip, time.Now())
 	return err
 }
 
+// UserDownloadLog returns the most recent downloads of the user
+func (r *Repo) UserDownloadLog(username string, limit int) (l []domain.DownloadLog, err error) {
+	err = r.db.Select(&l, "SELECT * FROM download_log WHERE username = ? ORDER BY modify_date DESC LIMIT ?", username, limit)
+	return
+}
+
 func (r *Repo) ListDownloadLog() (l []domain.DownloadLog, err error) {
 	err = r.db.Select(&l, "SELECT * FROM download_log")
 	return
@@ -232,3 +1336,102 @@ func (r *Repo) Downloads() (d []domain.Download, err error) {
 	err = r.db.Select(&d, "SELECT * FROM downloads")
 	return
 }
+
+func (r *Repo) Organization(name string) (*domain.Organization, error) {
+	o := &domain.Organization{}
+	err := r.get("organizations", "name", name, o)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (r *Repo) Organizations() (o []domain.Organization, err error) {
+	err = r.db.Select(&o, "SELECT * FROM organizations ORDER BY name")
+	return
+}
+
+func (r *Repo) SetOrganization(o *domain.Organization) error {
+	logrus.Infof("Saving organization - %s", o.Name)
+	o.ModifyDate = time.Now()
+	_, err := r.db.Exec(`INSERT INTO organizations (name, downloads, scope, versions, modify_date) VALUES (?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE downloads = ?, scope = ?, versions = ?, modify_date = ?`,
+		o.Name, o.Downloads, o.Scope, o.Versions, o.ModifyDate, o.Downloads, o.Scope, o.Versions, o.ModifyDate)
+	return err
+}
+
+// SAMLProvider returns the SAML IdP of the organization
+func (r *Repo) SAMLProvider(organization string) (*domain.SAMLProvider, error) {
+	p := &domain.SAMLProvider{}
+	if err := r.get("saml_providers", "organization", organization, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SAMLProviders returns the SAML IdPs of all the organizations
+func (r *Repo) SAMLProviders() (p []domain.SAMLProvider, err error) {
+	err = r.db.Select(&p, "SELECT * FROM saml_providers ORDER BY organization")
+	return
+}
+
+// SetSAMLProvider creates or updates the SAML IdP of the organization
+func (r *Repo) SetSAMLProvider(p *domain.SAMLProvider) error {
+	logrus.Infof("Saving SAML provider of organization - %s", p.Organization)
+	p.ModifyDate = time.Now()
+	_, err := r.db.Exec(`INSERT INTO saml_providers (organization, entity_id, sso_url, certificate, email_attribute, name_attribute, modify_date) VALUES (?, ?, ?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE entity_id = ?, sso_url = ?, certificate = ?, email_attribute = ?, name_attribute = ?, modify_date = ?`,
+		p.Organization, p.EntityID, p.SSOURL, p.Certificate, p.EmailAttribute, p.NameAttribute, p.ModifyDate,
+		p.EntityID, p.SSOURL, p.Certificate, p.EmailAttribute, p.NameAttribute, p.ModifyDate)
+	return err
+}
+
+// DeleteSAMLProvider removes the SAML IdP of the organization
+func (r *Repo) DeleteSAMLProvider(organization string) error {
+	_, err := r.db.Exec("DELETE FROM saml_providers WHERE organization = ?", organization)
+	return err
+}
+
+// UseSAMLAssertion records the assertion ID until it expires. Returns ErrAlreadyUsed if it was used before so it
+// cannot be replayed, even on another server.
+func (r *Repo) UseSAMLAssertion(id string, expiresAt time.Time) error {
+	_, err := r.db.Exec("INSERT INTO saml_assertions (id, expires_at) VALUES (?, ?)", id, expiresAt)
+	if myErr, ok := err.(*mysql.MySQLError); ok && myErr.Number == mysqlDuplicateEntry {
+		return ErrAlreadyUsed
+	}
+	return err
+}
+
+// DeleteExpiredSAMLAssertions forgets the assertions that can no longer be used anyway
+func (r *Repo) DeleteExpiredSAMLAssertions(now time.Time) error {
+	_, err := r.db.Exec("DELETE FROM saml_assertions WHERE expires_at < ?", now)
+	return err
+}
+
+// ConsumeOrganizationDownload takes a single download from the organization pool.
+// Unlike tokens, the pool is shared between users so it is decremented atomically.
+// Returns domain.ErrPoolUsed if the pool is empty.
+func (r *Repo) ConsumeOrganizationDownload(name string) error {
+	res, err := r.db.Exec("UPDATE organizations SET downloads = downloads - 1 WHERE name = ? AND downloads > 0", name)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return domain.ErrPoolUsed
+	}
+	return nil
+}
+
+// OrganizationsUsage returns the usage summary of all the organizations
+func (r *Repo) OrganizationsUsage() (u []domain.OrganizationUsage, err error) {
+	err = r.db.Select(&u, `SELECT o.name, o.downloads,
+(SELECT COUNT(*) FROM download_log l WHERE l.organization = o.name) AS used,
+(SELECT COUNT(*) FROM users u WHERE u.organization = o.name) AS users,
+(SELECT MAX(l.modify_date) FROM download_log l WHERE l.organization = o.name) AS last_download
+FROM organizations o ORDER BY o.name`)
+	return
+}
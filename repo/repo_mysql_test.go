@@ -3,7 +3,9 @@
 package repo
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/demisto/download/conf"
 	"github.com/demisto/download/domain"
@@ -47,9 +49,58 @@ func TestUser(t *testing.T) {
 	if u.Email != u1.Email {
 		t.Fatal("Email not updated")
 	}
+	if _, err = r.UserByExternalID(domain.UserSourceOIDC, "https://idp#test"); err != ErrNotFound {
+		t.Errorf("Local user must not match an external ID - %v", err)
+	}
+	u.Source, u.ExternalID = domain.UserSourceOIDC, "https://idp#test"
+	r.SetUser(u)
+	if u1, err = r.UserByExternalID(domain.UserSourceOIDC, "https://idp#test"); err != nil || u1.Username != "test" {
+		t.Errorf("Unable to load user by external ID - %v", err)
+	}
 	r.Close()
 }
 
+func TestSearchUsers(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	for _, u := range []*domain.User{
+		{Username: "admin", Email: "admin@demisto.com", Type: domain.UserTypeAdmin},
+		{Username: "jane", Email: "jane@acme.com", Type: domain.UserTypeUser, Organization: "acme"},
+		{Username: "joe", Email: "joe@acme.com", Type: domain.UserTypeUser, Organization: "acme", Disabled: true},
+	} {
+		if err := r.SetUser(u); err != nil {
+			t.Fatalf("Unable to create user - %v", err)
+		}
+	}
+	customer := domain.UserType(domain.UserTypeUser)
+	tests := []struct {
+		filter   domain.UserFilter
+		expected []string
+		total    int
+	}{
+		{domain.UserFilter{}, []string{"admin", "jane", "joe"}, 3},
+		{domain.UserFilter{Email: "acme"}, []string{"jane", "joe"}, 2},
+		{domain.UserFilter{Type: &customer, Username: "j", Organization: "acme", Limit: 1, Offset: 1}, []string{"joe"}, 2},
+		{domain.UserFilter{Organization: "other"}, nil, 0},
+	}
+	for _, test := range tests {
+		users, total, err := r.SearchUsers(&test.filter)
+		if err != nil {
+			t.Fatalf("Unable to search users - %v", err)
+		}
+		var names []string
+		for _, u := range users {
+			names = append(names, u.Username)
+		}
+		if total != test.total || strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Search %#v returned %v of %d", test.filter, names, total)
+		}
+	}
+	if u, err := r.User("joe"); err != nil || !u.Disabled {
+		t.Errorf("Expected disabled user - %v %#v", err, u)
+	}
+}
+
 func TestToken(t *testing.T) {
 	r := getTestDB(t)
 	token := &domain.Token{Name: "t", Downloads: 10}
@@ -84,3 +135,569 @@ func TestToken(t *testing.T) {
 		t.Errorf("Expecting no open tokens - %v", tokens)
 	}
 }
+
+func TestExpireTokens(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM tokens")
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	if err := r.SetToken(&domain.Token{Name: "expired", Downloads: 10, ExpiresAt: &past}); err != nil {
+		t.Fatalf("Unable to create token - %v", err)
+	}
+	if err := r.SetToken(&domain.Token{Name: "valid", Downloads: 10, ExpiresAt: &future}); err != nil {
+		t.Fatalf("Unable to create token - %v", err)
+	}
+	n, err := r.ExpireTokens(time.Now())
+	if err != nil {
+		t.Fatalf("Unable to expire tokens - %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expecting a single expired token but got %d", n)
+	}
+	token, err := r.Token("expired")
+	if err != nil {
+		t.Fatalf("Unable to load token - %v", err)
+	}
+	if !token.Expired {
+		t.Error("Token should be marked as expired")
+	}
+	tokens, err := r.OpenTokens()
+	if err != nil {
+		t.Fatalf("Unable to retrieve open tokens - %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].Name != "valid" {
+		t.Errorf("Expecting only the valid token to be open - %v", tokens)
+	}
+}
+
+func TestSearchTokens(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM tokens")
+	tokens := []*domain.Token{
+		{Name: "t1", Downloads: 1, Customer: "Acme Inc", Labels: domain.StringList{"trial", "eu"}, CreatedBy: "admin"},
+		{Name: "t2", Downloads: 1, Customer: "Other", Labels: domain.StringList{"trial"}, CreatedBy: "sales"},
+		{Name: "t3", Downloads: 0, Customer: "Acme Inc", Labels: domain.StringList{"eu"}, CreatedBy: "admin"},
+	}
+	for _, token := range tokens {
+		if err := r.SetToken(token); err != nil {
+			t.Fatalf("Unable to create token - %v", err)
+		}
+	}
+	tests := []struct {
+		f     domain.TokenFilter
+		count int
+	}{
+		{domain.TokenFilter{}, 2},
+		{domain.TokenFilter{All: true}, 3},
+		{domain.TokenFilter{Labels: []string{"trial"}}, 2},
+		{domain.TokenFilter{Labels: []string{"trial", "eu"}}, 1},
+		{domain.TokenFilter{Labels: []string{"eu"}, All: true}, 2},
+		{domain.TokenFilter{Customer: "acme", All: true}, 2},
+		{domain.TokenFilter{CreatedBy: "sales"}, 1},
+	}
+	for i, test := range tests {
+		res, err := r.SearchTokens(&test.f)
+		if err != nil {
+			t.Fatalf("Unable to search tokens - %v", err)
+		}
+		if len(res) != test.count {
+			t.Errorf("%d: expected %d tokens but got %v", i, test.count, res)
+		}
+	}
+}
+
+func TestMigrateTokenDigests(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM tokens")
+	r.db.Exec("INSERT INTO tokens (name, downloads) VALUES ('abcdefghijkl', 3)")
+	r.db.Exec("INSERT INTO users (username, email, type, token) VALUES ('abcdefghijkl*-*kuku@kiki', 'kuku@kiki', 1, 'abcdefghijkl')")
+	if err := migrateTokenDigests(r.db); err != nil {
+		t.Fatalf("Unable to migrate tokens - %v", err)
+	}
+	digest := domain.TokenDigest("abcdefghijkl")
+	token, err := r.Token(digest)
+	if err != nil {
+		t.Fatalf("Unable to load migrated token - %v", err)
+	}
+	if token.Downloads != 3 || token.Hint != "abcd..." {
+		t.Errorf("Unexpected migrated token - %#v", token)
+	}
+	u, err := r.User(domain.TokenUsername(digest, "kuku@kiki"))
+	if err != nil {
+		t.Fatalf("Unable to load migrated user - %v", err)
+	}
+	if u.Token != digest {
+		t.Errorf("User token was not migrated - %s", u.Token)
+	}
+}
+
+func TestOrganizationPool(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM organizations")
+	r.db.Exec("DELETE FROM download_log")
+	o := &domain.Organization{Name: "acme", Downloads: 1}
+	if err := r.SetOrganization(o); err != nil {
+		t.Fatalf("Unable to create organization - %v", err)
+	}
+	u := &domain.User{Username: "engineer", Organization: "acme", Type: domain.UserTypeUser}
+	if err := r.SetUser(u); err != nil {
+		t.Fatalf("Unable to create user - %v", err)
+	}
+	if err := r.ConsumeOrganizationDownload("acme"); err != nil {
+		t.Fatalf("Unable to consume download - %v", err)
+	}
+	if err := r.ConsumeOrganizationDownload("acme"); err != domain.ErrPoolUsed {
+		t.Fatalf("Expected pool to be used but got %v", err)
+	}
+	if err := r.LogDownload(u, &domain.Download{Name: "free", Path: "/tmp/free"}, "127.0.0.1"); err != nil {
+		t.Fatalf("Unable to log download - %v", err)
+	}
+	usage, err := r.OrganizationsUsage()
+	if err != nil {
+		t.Fatalf("Unable to retrieve usage - %v", err)
+	}
+	if len(usage) != 1 || usage[0].Downloads != 0 || usage[0].Used != 1 || usage[0].Users != 1 || usage[0].LastDownload == nil {
+		t.Errorf("Unexpected usage - %#v", usage)
+	}
+}
+
+func TestTokenLedger(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM tokens")
+	r.db.Exec("DELETE FROM token_events")
+	token := &domain.Token{Name: "ledger", Downloads: 1}
+	if err := r.SetTokenWithEvent(token, &domain.TokenEvent{Type: domain.TokenEventIssued, Delta: 1, Actor: "admin"}); err != nil {
+		t.Fatalf("Unable to create token - %v", err)
+	}
+	if _, err := r.AdjustToken(&domain.TokenEvent{Token: "ledger", Type: domain.TokenEventConsumed, Delta: -1, Actor: "user"}); err != nil {
+		t.Fatalf("Unable to consume token - %v", err)
+	}
+	if _, err := r.AdjustToken(&domain.TokenEvent{Token: "ledger", Type: domain.TokenEventConsumed, Delta: -1, Actor: "user"}); err != domain.ErrTokenUsed {
+		t.Fatalf("Expected token to be used but got %v", err)
+	}
+	res, err := r.AdjustToken(&domain.TokenEvent{Token: "ledger", Type: domain.TokenEventToppedUp, Delta: 5, Actor: "admin", Reason: "renewal"})
+	if err != nil {
+		t.Fatalf("Unable to top up token - %v", err)
+	}
+	if res.Downloads != 5 || res.LastUsed == nil {
+		t.Errorf("Unexpected token after top up - %#v", res)
+	}
+	setDownloads := func(tok *domain.Token) error {
+		tok.Downloads = 8
+		return nil
+	}
+	old, updated, err := r.UpdateToken("ledger", setDownloads, "admin", "correction")
+	if err != nil || old.Downloads != 5 || updated.Downloads != 8 {
+		t.Fatalf("Unable to update token - %#v %#v %v", old, updated, err)
+	}
+	if _, _, err = r.UpdateToken("missing", setDownloads, "admin", ""); err != ErrNotFound {
+		t.Errorf("Expected not found updating a missing token but got %v", err)
+	}
+	if err = r.RevokeToken("ledger", "admin", "leaked", time.Now()); err != nil {
+		t.Fatalf("Unable to revoke token - %v", err)
+	}
+	events, err := r.TokenEvents("ledger")
+	if err != nil {
+		t.Fatalf("Unable to load events - %v", err)
+	}
+	if len(events) != 5 || events[1].Type != domain.TokenEventConsumed || events[2].Balance != 5 || events[3].Delta != 3 || events[4].Type != domain.TokenEventRevoked {
+		t.Errorf("Unexpected events - %#v", events)
+	}
+	balance, err := r.TokenLedgerBalance("ledger")
+	if err != nil || balance != 8 {
+		t.Errorf("Expected ledger balance 8 but got %d - %v", balance, err)
+	}
+}
+
+func TestImportTokens(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM tokens")
+	r.db.Exec("DELETE FROM token_events")
+	r.db.Exec("DELETE FROM download_log")
+	var grants []domain.TokenGrant
+	for _, email := range []string{"a@acme.com", "b@acme.com"} {
+		token := domain.NewToken(2)
+		token.CreatedBy = "admin"
+		u := &domain.User{Username: domain.TokenUsername(token.Name, email), Email: email, Token: token.Name, Type: domain.UserTypeUser}
+		grants = append(grants, domain.TokenGrant{Token: token, User: u})
+	}
+	if err := r.ImportTokens(grants, "batch"); err != nil {
+		t.Fatalf("Unable to import tokens - %v", err)
+	}
+	if err := r.LogDownload(grants[0].User, &domain.Download{Name: "free", Path: "/tmp/free"}, "127.0.0.1"); err != nil {
+		t.Fatalf("Unable to log download - %v", err)
+	}
+	usage, err := r.TokensUsage()
+	if err != nil {
+		t.Fatalf("Unable to retrieve usage - %v", err)
+	}
+	if len(usage) != 2 {
+		t.Fatalf("Expected 2 tokens but got %d", len(usage))
+	}
+	if usage[0].Email != "a@acme.com" || usage[0].Used != 1 || usage[1].Used != 0 {
+		t.Errorf("Unexpected usage - %#v", usage)
+	}
+	balance, err := r.TokenLedgerBalance(grants[1].Token.Name)
+	if err != nil || balance != 2 {
+		t.Errorf("Expected ledger balance 2 but got %d - %v", balance, err)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM idempotency_keys")
+	resp := &domain.IdempotentResponse{Key: "retry", Username: "admin", Request: "fingerprint"}
+	existing, err := r.ReserveIdempotencyKey(resp)
+	if err != nil || existing != nil {
+		t.Fatalf("Unable to reserve key - %v %#v", err, existing)
+	}
+	existing, err = r.ReserveIdempotencyKey(&domain.IdempotentResponse{Key: "retry", Username: "admin", Request: "fingerprint"})
+	if err != nil || existing == nil || existing.Done() {
+		t.Fatalf("Expected key in progress - %v %#v", err, existing)
+	}
+	resp.Status, resp.ContentType, resp.Body = 200, "application/json", []byte(`{"token":"secret"}`)
+	if err = r.SetIdempotentResponse(resp); err != nil {
+		t.Fatalf("Unable to save response - %v", err)
+	}
+	existing, err = r.ReserveIdempotencyKey(&domain.IdempotentResponse{Key: "retry", Username: "admin", Request: "fingerprint"})
+	if err != nil || existing == nil || existing.Status != 200 || string(existing.Body) != `{"token":"secret"}` {
+		t.Fatalf("Expected stored response - %v %#v", err, existing)
+	}
+	existing, err = r.ReserveIdempotencyKey(&domain.IdempotentResponse{Key: "retry", Username: "other", Request: "fingerprint"})
+	if err != nil || existing != nil {
+		t.Fatalf("Keys should be scoped to the user - %v %#v", err, existing)
+	}
+	if err = r.DeleteIdempotentResponses(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Unable to delete keys - %v", err)
+	}
+	existing, err = r.ReserveIdempotencyKey(&domain.IdempotentResponse{Key: "retry", Username: "admin", Request: "other"})
+	if err != nil || existing != nil {
+		t.Fatalf("Expected deleted key to be reusable - %v %#v", err, existing)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM api_keys")
+	k, err := domain.NewAPIKey("ci", "admin", []string{"upload"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.AddAPIKey(k); err != nil {
+		t.Fatalf("Unable to add API key - %v", err)
+	}
+	now := time.Now()
+	if err = r.SetAPIKeyUsed(k.ID, now); err != nil {
+		t.Fatalf("Unable to set API key use - %v", err)
+	}
+	k1, err := r.APIKey(domain.TokenDigest(k.Plain))
+	if err != nil || k1.LastUsed == nil || !k1.Allows(domain.APIKeyScopeUpload) || k1.Valid(now) != nil {
+		t.Fatalf("Unexpected API key - %v %#v", err, k1)
+	}
+	if err = r.RevokeAPIKey(k.ID, now); err != nil {
+		t.Fatalf("Unable to revoke API key - %v", err)
+	}
+	if err = r.RevokeAPIKey(k.ID, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Revoking twice should succeed - %v", err)
+	}
+	if k1, err = r.APIKey(k.ID); err != nil || k1.Valid(now) != domain.ErrAPIKeyRevoked {
+		t.Fatalf("Expected revoked API key - %v %#v", err, k1)
+	}
+	if err = r.RevokeAPIKey("missing", now); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM sessions")
+	s1, s2 := domain.NewSession("admin", "10.0.0.1", "curl"), domain.NewSession("admin", "10.0.0.2", "firefox")
+	for _, s := range []*domain.Session{s1, s2, domain.NewSession("other", "", "")} {
+		if err := r.AddSession(s); err != nil {
+			t.Fatalf("Unable to add session - %v", err)
+		}
+	}
+	if err := r.SetSessionSeen(s2.ID, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Unable to set session seen - %v", err)
+	}
+	s, err := r.Session(domain.TokenDigest(s2.Plain))
+	if err != nil || s.Username != "admin" || s.UserAgent != "firefox" {
+		t.Fatalf("Unexpected session - %v %#v", err, s)
+	}
+	sessions, err := r.Sessions("admin")
+	if err != nil || len(sessions) != 2 || sessions[0].ID != s2.ID {
+		t.Fatalf("Unexpected sessions - %v %#v", err, sessions)
+	}
+	if err = r.DeleteSession(s1.ID); err != nil {
+		t.Fatalf("Unable to delete session - %v", err)
+	}
+	if err = r.DeleteSession(s1.ID); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+	if n, err := r.DeleteUserSessions("admin"); err != nil || n != 1 {
+		t.Fatalf("Unexpected revoke of all sessions - %v %d", err, n)
+	}
+	if err = r.DeleteExpiredSessions(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Unable to delete expired sessions - %v", err)
+	}
+	if sessions, err = r.Sessions("other"); err != nil || len(sessions) != 0 {
+		t.Fatalf("Expected expired sessions to be deleted - %v %#v", err, sessions)
+	}
+}
+
+func TestLoginLinks(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM login_links")
+	u := &domain.User{Username: "customer@example.com", Email: "customer@example.com", Type: domain.UserTypeUser}
+	if err := r.SetUser(u); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := r.CustomerByEmail("customer@example.com"); err != nil || c.Username != u.Username {
+		t.Fatalf("Unexpected customer - %v %#v", err, c)
+	}
+	if _, err := r.CustomerByEmail("other@example.com"); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+	sso := &domain.User{Username: "acme/sso@example.com", Email: "sso@example.com", Type: domain.UserTypeUser, Source: domain.UserSourceSAML}
+	if err := r.SetUser(sso); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.CustomerByEmail("sso@example.com"); err != ErrNotFound {
+		t.Fatalf("Expected identity provider users to be skipped but got %v", err)
+	}
+	l := domain.NewLoginLink(u.Username, domain.LoginLinkPasswordReset)
+	if err := r.AddLoginLink(l); err != nil {
+		t.Fatalf("Unable to add link - %v", err)
+	}
+	stored, err := r.LoginLink(domain.TokenDigest(l.Plain))
+	if err != nil || stored.Username != u.Username || stored.Kind != domain.LoginLinkPasswordReset {
+		t.Fatalf("Unexpected link - %v %#v", err, stored)
+	}
+	if err = r.UseLoginLink(l.ID); err != nil {
+		t.Fatalf("Unable to use link - %v", err)
+	}
+	if err = r.UseLoginLink(l.ID); err != ErrNotFound {
+		t.Fatalf("Expected the link to be single use but got %v", err)
+	}
+	expired := domain.NewLoginLink(u.Username, domain.LoginLinkSignIn)
+	if err = r.AddLoginLink(expired); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.DeleteExpiredLoginLinks(expired.ExpiresAt.Add(time.Minute)); err != nil {
+		t.Fatalf("Unable to delete expired links - %v", err)
+	}
+	if _, err = r.LoginLink(expired.ID); err != ErrNotFound {
+		t.Fatalf("Expected expired link to be deleted but got %v", err)
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM attempts")
+	th := &domain.Throttle{MaxFailures: 2, Window: time.Hour, Lockout: time.Minute, MaxLockout: time.Hour}
+	now := time.Now().Truncate(time.Second)
+	if _, err := r.Attempts("ip:10.0.0.1"); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+	a, err := r.FailAttempt("ip:10.0.0.1", th, now)
+	if err != nil || a.Failures != 1 || a.LockedUntil != nil {
+		t.Fatalf("Unexpected first failure - %v %#v", err, a)
+	}
+	if a, err = r.FailAttempt("ip:10.0.0.1", th, now); err != nil || a.RetryAfter(now) != time.Minute {
+		t.Fatalf("Expected a lock - %v %#v", err, a)
+	}
+	if a, err = r.Attempts("ip:10.0.0.1"); err != nil || a.Failures != 2 || a.RetryAfter(now) == 0 {
+		t.Fatalf("Expected the lock to be stored - %v %#v", err, a)
+	}
+	if _, err = r.FailAttempt("account:admin", th, now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.DeleteExpiredAttempts(now.Add(-time.Hour), now); err != nil {
+		t.Fatalf("Unable to delete expired attempts - %v", err)
+	}
+	if _, err = r.Attempts("account:admin"); err != ErrNotFound {
+		t.Fatalf("Expected expired attempts to be deleted but got %v", err)
+	}
+	if err = r.DeleteAttempts("ip:10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Attempts("ip:10.0.0.1"); err != ErrNotFound {
+		t.Fatalf("Expected attempts to be deleted but got %v", err)
+	}
+}
+
+func TestEmailDeliveries(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM emails")
+	d := &domain.EmailDelivery{Template: "token", Username: "bob", Recipient: "bob@example.com", Subject: "Your token", Status: domain.EmailQueued, CreatedAt: time.Now()}
+	if err := r.AddEmailDelivery(d); err != nil || d.ID == 0 {
+		t.Fatalf("Unable to add email delivery - %v", err)
+	}
+	r.AddEmailDelivery(&domain.EmailDelivery{Template: "sign-in", Username: "alice", Recipient: "alice@example.com", Status: domain.EmailQueued, CreatedAt: time.Now()})
+	now := time.Now()
+	d.Status, d.SentAt = domain.EmailSent, &now
+	if err := r.SetEmailDeliveryStatus(d); err != nil {
+		t.Fatal(err)
+	}
+	res, err := r.EmailDeliveries(&domain.EmailFilter{Username: "bob"})
+	if err != nil || len(res) != 1 || res[0].Status != domain.EmailSent || res[0].SentAt == nil {
+		t.Fatalf("Expected the sent delivery - %v %v", err, res)
+	}
+	if res, err = r.EmailDeliveries(&domain.EmailFilter{Status: domain.EmailQueued}); err != nil || len(res) != 1 || res[0].Username != "alice" {
+		t.Errorf("Expected the queued delivery - %v %v", err, res)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM audit_log")
+	r.db.Exec("DELETE FROM audit_head")
+	for _, action := range []string{"POST /user", "POST /tokens/generate", "POST /user"} {
+		if err := r.AddAuditEntry(&domain.AuditEntry{CreatedAt: time.Now(), Actor: "admin", Action: action, Target: "bob", Status: 200}); err != nil {
+			t.Fatalf("Unable to add audit entry - %v", err)
+		}
+	}
+	entries, err := r.AuditLog(&domain.AuditFilter{})
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("Expected 3 entries - %v %v", err, entries)
+	}
+	head, err := domain.VerifyAuditChain(domain.AuditKey(), "", entries)
+	if err != nil {
+		t.Fatalf("Stored entries must verify - %v", err)
+	}
+	if stored, err := r.AuditHead(); err != nil || stored != head {
+		t.Errorf("Expected head %s but got %s - %v", head, stored, err)
+	}
+	if entries, err = r.AuditLog(&domain.AuditFilter{Action: "/user", AfterID: entries[0].ID}); err != nil || len(entries) != 1 {
+		t.Errorf("Expected the last entry only - %v %v", err, entries)
+	}
+	r.db.Exec("UPDATE audit_log SET actor = 'someone-else' WHERE id = ?", entries[0].ID)
+	entries, _ = r.AuditLog(&domain.AuditFilter{})
+	if _, err = domain.VerifyAuditChain(domain.AuditKey(), "", entries); err == nil {
+		t.Error("Expected tampering to break the chain")
+	}
+}
+
+func TestSAMLProviders(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM saml_providers")
+	p := &domain.SAMLProvider{Organization: "acme", EntityID: "https://idp.acme.com", SSOURL: "https://idp.acme.com/sso", Certificate: "cert"}
+	if err := r.SetSAMLProvider(p); err != nil {
+		t.Fatalf("Unable to save SAML provider - %v", err)
+	}
+	p.EmailAttribute = "mail"
+	if err := r.SetSAMLProvider(p); err != nil {
+		t.Fatalf("Unable to update SAML provider - %v", err)
+	}
+	p1, err := r.SAMLProvider("acme")
+	if err != nil || p1.EntityID != p.EntityID || p1.EmailAttribute != "mail" {
+		t.Fatalf("Unexpected SAML provider - %v %#v", err, p1)
+	}
+	if err = r.DeleteSAMLProvider("acme"); err != nil {
+		t.Fatalf("Unable to delete SAML provider - %v", err)
+	}
+	if _, err = r.SAMLProvider("acme"); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+}
+
+func TestOneTimeCodes(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	u := &domain.User{Username: "otp", TOTPLastStep: 10, RecoveryCodes: domain.StringList{"a", "b"}}
+	if err := r.SetUser(u); err != nil {
+		t.Fatalf("Unable to create user - %v", err)
+	}
+	if err := r.UseTOTPStep("otp", 11); err != nil {
+		t.Fatalf("Unable to use step - %v", err)
+	}
+	// A concurrent request with the same code checked it against the old step
+	if err := r.UseTOTPStep("otp", 11); err != ErrAlreadyUsed {
+		t.Errorf("Expected the step to be used but got %v", err)
+	}
+	if err := r.UseRecoveryCode("otp", u.RecoveryCodes, domain.StringList{"b"}); err != nil {
+		t.Fatalf("Unable to use recovery code - %v", err)
+	}
+	if err := r.UseRecoveryCode("otp", u.RecoveryCodes, domain.StringList{"b"}); err != ErrAlreadyUsed {
+		t.Errorf("Expected the recovery code to be used but got %v", err)
+	}
+	u1, err := r.User("otp")
+	if err != nil || u1.TOTPLastStep != 11 || len(u1.RecoveryCodes) != 1 {
+		t.Errorf("Unexpected user after using codes - %#v %v", u1, err)
+	}
+}
+
+func TestSAMLAssertions(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM saml_assertions")
+	now := time.Now()
+	if err := r.UseSAMLAssertion("acme/id-1", now.Add(time.Minute)); err != nil {
+		t.Fatalf("Unable to use assertion - %v", err)
+	}
+	if err := r.UseSAMLAssertion("acme/id-1", now.Add(time.Minute)); err != ErrAlreadyUsed {
+		t.Errorf("Expected replayed assertion to fail but got %v", err)
+	}
+	if err := r.DeleteExpiredSAMLAssertions(now.Add(time.Hour)); err != nil {
+		t.Fatalf("Unable to delete expired assertions - %v", err)
+	}
+	if err := r.UseSAMLAssertion("acme/id-1", now.Add(time.Minute)); err != nil {
+		t.Errorf("Expired assertion was not deleted - %v", err)
+	}
+}
+
+func TestWebAuthnCeremonies(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	c := domain.NewWebAuthnCeremony("slavik", "webauthn.get", time.Minute)
+	if err := r.AddWebAuthnCeremony(c); err != nil {
+		t.Fatalf("Unable to add ceremony - %v", err)
+	}
+	used, err := r.UseWebAuthnCeremony(c.ID)
+	if err != nil || used.Challenge != c.Challenge || used.Username != "slavik" {
+		t.Fatalf("Unable to use ceremony - %#v %v", used, err)
+	}
+	if _, err = r.UseWebAuthnCeremony(c.ID); err != ErrNotFound {
+		t.Errorf("Expected the ceremony to be used but got %v", err)
+	}
+	expired := domain.NewWebAuthnCeremony("", "webauthn.get", -time.Minute)
+	r.AddWebAuthnCeremony(expired)
+	if err = r.DeleteExpiredWebAuthnCeremonies(time.Now()); err != nil {
+		t.Fatalf("Unable to delete expired ceremonies - %v", err)
+	}
+	if _, err = r.UseWebAuthnCeremony(expired.ID); err != ErrNotFound {
+		t.Errorf("Expired ceremony was not deleted - %v", err)
+	}
+}
+
+func TestWebAuthnSignCount(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	r.db.Exec("DELETE FROM webauthn_credentials")
+	c := &domain.WebAuthnCredential{ID: "counted", Username: "slavik", PublicKey: []byte{1}, SignCount: 1}
+	if err := r.AddWebAuthnCredential(c); err != nil {
+		t.Fatalf("Unable to add credential - %v", err)
+	}
+	now := time.Now()
+	c.SignCount, c.LastUsed = 2, &now
+	if err := r.UpdateWebAuthnCredential(c); err != nil {
+		t.Fatalf("Unable to update credential - %v", err)
+	}
+	// A replay racing the login above read the old counter and tries to save the same one
+	if err := r.UpdateWebAuthnCredential(c); err != domain.ErrWebAuthnCloned {
+		t.Errorf("Expected the replay to fail but got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package util
+
+import (
+	"errors"
+	"io"
+)
+
+// BER tags of the universal types LDAP uses
+const (
+	BERBoolean     byte = 0x01
+	BERInteger     byte = 0x02
+	BEROctetString byte = 0x04
+	BERNull        byte = 0x05
+	BEREnumerated  byte = 0x0a
+	BERSequence    byte = 0x30
+	BERSet         byte = 0x31
+	// BERConstructed is the bit of constructed tags
+	BERConstructed byte = 0x20
+	// BERApplication is the class of application tags
+	BERApplication byte = 0x40
+	// BERContext is the class of context specific tags
+	BERContext byte = 0x80
+)
+
+// maxBERSize limits the size of a single element so a peer cannot make us allocate unbounded memory
+const maxBERSize = 4 << 20
+
+// ErrInvalidBER is returned when the data is not well formed or uses unsupported BER features
+var ErrInvalidBER = errors.New("Invalid BER data")
+
+// BERElement is a decoded BER (X.690) element. Only single byte tags and definite lengths are supported,
+// which is what LDAP uses.
+type BERElement struct {
+	Tag   byte
+	Value []byte
+	// Children of constructed elements
+	Children []*BERElement
+}
+
+// ReadBER reads a single element from the reader
+func ReadBER(r io.Reader) (*BERElement, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[0]&0x1f == 0x1f {
+		return nil, ErrInvalidBER
+	}
+	length := int(head[1])
+	if head[1]&0x80 != 0 {
+		n := int(head[1] & 0x7f)
+		if n == 0 || n > 4 {
+			return nil, ErrInvalidBER
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, c := range b {
+			length = length<<8 | int(c)
+		}
+	}
+	if length > maxBERSize {
+		return nil, ErrInvalidBER
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	return newBERElement(head[0], value, 0)
+}
+
+func newBERElement(tag byte, value []byte, depth int) (*BERElement, error) {
+	e := &BERElement{Tag: tag, Value: value}
+	if tag&BERConstructed == 0 {
+		return e, nil
+	}
+	if depth > 32 {
+		return nil, ErrInvalidBER
+	}
+	for len(value) > 0 {
+		r := &byteReader{data: value}
+		child, err := ReadBER(r)
+		if err != nil {
+			return nil, ErrInvalidBER
+		}
+		if child, err = newBERElement(child.Tag, child.Value, depth+1); err != nil {
+			return nil, err
+		}
+		e.Children = append(e.Children, child)
+		value = value[r.pos:]
+	}
+	return e, nil
+}
+
+type byteReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if r.pos >= len(r.data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+// Int returns the value of an integer or enumerated element
+func (e *BERElement) Int() int64 {
+	var v int64
+	for i, c := range e.Value {
+		if i == 0 && c&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(c)
+	}
+	return v
+}
+
+// String returns the value of a primitive element as a string
+func (e *BERElement) String() string {
+	return string(e.Value)
+}
+
+// Child returns the child at the index or nil if there is none
+func (e *BERElement) Child(i int) *BERElement {
+	if i < 0 || i >= len(e.Children) {
+		return nil
+	}
+	return e.Children[i]
+}
+
+// BER encodes an element with the given tag and value
+func BER(tag byte, value []byte) []byte {
+	var head []byte
+	switch n := len(value); {
+	case n < 0x80:
+		head = []byte{tag, byte(n)}
+	case n <= 0xff:
+		head = []byte{tag, 0x81, byte(n)}
+	case n <= 0xffff:
+		head = []byte{tag, 0x82, byte(n >> 8), byte(n)}
+	default:
+		head = []byte{tag, 0x84, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	return append(head, value...)
+}
+
+// BERConstruct encodes a constructed element with the given encoded children
+func BERConstruct(tag byte, children ...[]byte) []byte {
+	var value []byte
+	for _, c := range children {
+		value = append(value, c...)
+	}
+	return BER(tag|BERConstructed, value)
+}
+
+// BERInt encodes an integer with the given tag (BERInteger or BEREnumerated)
+func BERInt(tag byte, v int64) []byte {
+	b := []byte{byte(v)}
+	for v > 0x7f || v < -0x80 {
+		v >>= 8
+		b = append([]byte{byte(v)}, b...)
+	}
+	return BER(tag, b)
+}
+
+// BERBool encodes a boolean
+func BERBool(v bool) []byte {
+	if v {
+		return BER(BERBoolean, []byte{0xff})
+	}
+	return BER(BERBoolean, []byte{0})
+}
@@ -0,0 +1,231 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// ErrInvalidCBOR is returned when the data is not well formed or uses unsupported CBOR features
+var ErrInvalidCBOR = errors.New("Invalid CBOR data")
+
+// maxCBORDepth limits nesting so malicious input cannot exhaust the stack
+const maxCBORDepth = 16
+
+// UnmarshalCBOR decodes the first CBOR (RFC 7049) item in data and returns it along with the number of bytes it used.
+// Integers are returned as int64, byte strings as []byte, text as string, arrays as []interface{} and maps as
+// map[interface{}]interface{}. Tags are ignored and indefinite lengths are not supported.
+// It covers what WebAuthn authenticators send and nothing more.
+func UnmarshalCBOR(data []byte) (interface{}, int, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.decode(0)
+	return v, d.pos, err
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, ErrInvalidCBOR
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// head reads the major type and argument of the next item
+func (d *cborDecoder) head() (byte, uint64, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, ErrInvalidCBOR
+	}
+	arg, err := d.next(size)
+	if err != nil {
+		return 0, 0, err
+	}
+	var val uint64
+	for _, c := range arg {
+		val = val<<8 | uint64(c)
+	}
+	return major, val, nil
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxCBORDepth {
+		return nil, ErrInvalidCBOR
+	}
+	start := d.pos
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, ErrInvalidCBOR
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, ErrInvalidCBOR
+		}
+		return -1 - int64(arg), nil
+	case 2, 3:
+		if arg > uint64(len(d.data)) {
+			return nil, ErrInvalidCBOR
+		}
+		b, err := d.next(int(arg))
+		if err != nil {
+			return nil, err
+		}
+		if major == 3 {
+			return string(b), nil
+		}
+		return append([]byte(nil), b...), nil
+	case 4:
+		if arg > uint64(len(d.data)) {
+			return nil, ErrInvalidCBOR
+		}
+		arr := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case 5:
+		if arg > uint64(len(d.data)) {
+			return nil, ErrInvalidCBOR
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, ErrInvalidCBOR
+			}
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		return m, nil
+	case 6:
+		return d.decode(depth + 1)
+	default:
+		switch d.data[start] & 0x1f {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			return nil, ErrInvalidCBOR
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), nil
+		case 27:
+			return math.Float64frombits(arg), nil
+		}
+		return nil, ErrInvalidCBOR
+	}
+}
+
+// cborHead encodes the major type and argument
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= math.MaxUint8:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= math.MaxUint16:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(arg))
+		return b
+	case arg <= math.MaxUint32:
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(arg))
+		return b
+	default:
+		b := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(b[1:], arg)
+		return b
+	}
+}
+
+// MarshalCBOR encodes integers, byte strings, text, booleans, arrays and CBORMap values.
+// Maps are written in the order of their pairs so the output is deterministic.
+func MarshalCBOR(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case int:
+		return MarshalCBOR(int64(v))
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v)), nil
+		}
+		return cborHead(0, uint64(v)), nil
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...), nil
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...), nil
+	case bool:
+		if v {
+			return []byte{0xf5}, nil
+		}
+		return []byte{0xf4}, nil
+	case []interface{}:
+		res := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			b, err := MarshalCBOR(item)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, b...)
+		}
+		return res, nil
+	case CBORMap:
+		res := cborHead(5, uint64(len(v)))
+		for _, kv := range v {
+			k, err := MarshalCBOR(kv[0])
+			if err != nil {
+				return nil, err
+			}
+			val, err := MarshalCBOR(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			res = append(append(res, k...), val...)
+		}
+		return res, nil
+	}
+	return nil, ErrInvalidCBOR
+}
+
+// CBORMap is an ordered CBOR map of key and value pairs for encoding
+type CBORMap [][2]interface{}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestCBOR(t *testing.T) {
+	v := CBORMap{{1, 2}, {3, -7}, {-1, 1}, {-2, []byte{1, 2, 3}}, {"fmt", "none"}, {"list", []interface{}{int64(1000), true}}}
+	b, err := MarshalCBOR(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Trailing data is not part of the item
+	decoded, n, err := UnmarshalCBOR(append(b, 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) {
+		t.Errorf("Expected %d bytes to be used but got %d", len(b), n)
+	}
+	m := decoded.(map[interface{}]interface{})
+	if m[int64(1)] != int64(2) || m[int64(3)] != int64(-7) || m["fmt"] != "none" || !bytes.Equal(m[int64(-2)].([]byte), []byte{1, 2, 3}) {
+		t.Errorf("Unexpected decoded map - %#v", m)
+	}
+	if list := m["list"].([]interface{}); list[0] != int64(1000) || list[1] != true {
+		t.Errorf("Unexpected decoded list - %#v", list)
+	}
+	// {"a": 1, "b": [2, 3]} from RFC 7049 appendix A
+	rfc, _ := hex.DecodeString("a26161016162820203")
+	if decoded, _, err = UnmarshalCBOR(rfc); err != nil || len(decoded.(map[interface{}]interface{})) != 2 {
+		t.Errorf("Unable to decode RFC example - %v %#v", err, decoded)
+	}
+	for _, bad := range []string{"", "5f", "a1", "9a ffffffff", "1c"} {
+		data, _ := hex.DecodeString(bad)
+		if _, _, err = UnmarshalCBOR(data); err == nil {
+			t.Errorf("Expected error for %s", bad)
+		}
+	}
+}
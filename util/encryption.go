@@ -8,6 +8,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/big"
@@ -57,6 +58,10 @@ func Decrypt(ciphertext string, key []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	// IV, at least one block and whole blocks
+	if len(cipherbytes) < 2*ciph.BlockSize() || len(cipherbytes)%ciph.BlockSize() != 0 {
+		return "", fmt.Errorf("Encrypted text is too short or not in blocks - %d", len(cipherbytes))
+	}
 	// IV is in the beginning
 	mode := cipher.NewCBCDecrypter(ciph, cipherbytes[:ciph.BlockSize()])
 	plainbytes := make([]byte, len(cipherbytes)-ciph.BlockSize())
@@ -64,7 +69,7 @@ func Decrypt(ciphertext string, key []byte) (string, error) {
 	// After decrypting, let's check padding
 	padding := int(plainbytes[len(plainbytes)-1])
 	// If decryption is wrong and padding is weird
-	if padding < 0 || padding > ciph.BlockSize() {
+	if padding <= 0 || padding > ciph.BlockSize() || len(plainbytes) < sha256.Size+padding {
 		return "", fmt.Errorf("Encryption key is wrong - %v", key)
 	}
 	// Let's make sure that checksum is correct
@@ -99,6 +104,13 @@ func DecryptJSON(ciphertext, pass string, v interface{}) error {
 	return decoder.Decode(v)
 }
 
+// KeyedHash returns the hex encoded HMAC-SHA256 of the value with the given key
+func KeyedHash(value string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 const (
 	alphanum = `0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz`
 	alpha    = `ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz`
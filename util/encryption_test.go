@@ -76,3 +76,16 @@ func TestSecureRandomStringAlphaNumeric(t *testing.T) {
 		t.Fatal("Expected random string to contains both alpha and numeric charcters")
 	}
 }
+
+func TestKeyedHash(t *testing.T) {
+	h := KeyedHash("token", []byte("key"))
+	if len(h) != 64 {
+		t.Fatalf("Unexpected hash length - %s", h)
+	}
+	if h != KeyedHash("token", []byte("key")) {
+		t.Error("Hash should be deterministic")
+	}
+	if h == KeyedHash("token", []byte("other")) {
+		t.Error("Hash should depend on the key")
+	}
+}
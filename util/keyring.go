@@ -0,0 +1,156 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrNoKey is returned when a keyring is created without keys
+var ErrNoKey = errors.New("At least one key is required")
+
+// ErrSealed is returned when a sealed value is malformed, was sealed with an unknown key or was tampered with
+var ErrSealed = errors.New("Unable to open sealed value")
+
+const (
+	// envelopeV1 prefixes values sealed with AES-256-GCM. The rest is base64url of key ID, nonce and ciphertext.
+	envelopeV1 = "v1."
+	// keyIDSize identifies the key that sealed a value so rotated keys do not have to be tried one by one
+	keyIDSize = 4
+)
+
+// HKDF derives a key of the given length from the secret as defined in RFC 5869 with SHA256
+func HKDF(secret, salt, info []byte, length int) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+	var res, prev []byte
+	for i := byte(1); len(res) < length; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(prev)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		prev = expand.Sum(nil)
+		res = append(res, prev...)
+	}
+	return res[:length]
+}
+
+type keyringKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// Keyring seals values with authenticated encryption using the newest key and opens values sealed with any of its
+// keys, so keys can be rotated without breaking existing values
+type Keyring struct {
+	keys []keyringKey
+	// legacy opens values encrypted with Encrypt before the envelope format existed. Nil disables it.
+	legacy []byte
+}
+
+// NewKeyring derives the keys from the secrets, newest first. The secrets can be of any length.
+// If legacy is not empty, values encrypted with Encrypt and that key are also opened.
+func NewKeyring(legacy string, secrets ...string) (*Keyring, error) {
+	if len(secrets) == 0 {
+		return nil, ErrNoKey
+	}
+	k := &Keyring{}
+	if legacy != "" {
+		k.legacy = []byte(legacy)
+	}
+	for _, secret := range secrets {
+		if secret == "" {
+			return nil, ErrNoKey
+		}
+		block, err := aes.NewCipher(HKDF([]byte(secret), nil, []byte("download envelope key"), 32))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys = append(k.keys, keyringKey{id: HKDF([]byte(secret), nil, []byte("download envelope key id"), keyIDSize), aead: aead})
+	}
+	return k, nil
+}
+
+// Seal encrypts and authenticates the plaintext with the newest key
+func (k *Keyring) Seal(plaintext []byte) (string, error) {
+	key := k.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := append(append([]byte{}, key.id...), nonce...)
+	out = key.aead.Seal(out, nonce, plaintext, envelopeAD(key.id))
+	return envelopeV1 + base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// Open returns the plaintext of a value sealed with any of the keys
+func (k *Keyring) Open(sealed string) ([]byte, error) {
+	if !strings.HasPrefix(sealed, envelopeV1) {
+		if k.legacy == nil {
+			return nil, ErrSealed
+		}
+		plaintext, err := Decrypt(sealed, k.legacy)
+		if err != nil {
+			return nil, ErrSealed
+		}
+		return []byte(plaintext), nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(sealed[len(envelopeV1):])
+	if err != nil || len(b) < keyIDSize {
+		return nil, ErrSealed
+	}
+	id := b[:keyIDSize]
+	for _, key := range k.keys {
+		if !hmac.Equal(key.id, id) {
+			continue
+		}
+		if len(b) < keyIDSize+key.aead.NonceSize() {
+			return nil, ErrSealed
+		}
+		nonce := b[keyIDSize : keyIDSize+key.aead.NonceSize()]
+		plaintext, err := key.aead.Open(nil, nonce, b[keyIDSize+key.aead.NonceSize():], envelopeAD(id))
+		if err != nil {
+			return nil, ErrSealed
+		}
+		return plaintext, nil
+	}
+	return nil, ErrSealed
+}
+
+// SealJSON seals the object serialized to JSON
+func (k *Keyring) SealJSON(v interface{}) (string, error) {
+	b := new(bytes.Buffer)
+	if err := json.NewEncoder(b).Encode(v); err != nil {
+		return "", err
+	}
+	return k.Seal(b.Bytes())
+}
+
+// OpenJSON opens the value into the object. Legacy values from EncryptJSON are opened as well.
+func (k *Keyring) OpenJSON(sealed string, v interface{}) error {
+	plaintext, err := k.Open(sealed)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+// envelopeAD binds the version and key ID to the ciphertext
+func envelopeAD(id []byte) []byte {
+	return append([]byte(envelopeV1), id...)
+}
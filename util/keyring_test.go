@@ -0,0 +1,79 @@
+package util
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestHKDF(t *testing.T) {
+	// RFC 5869 test case 1
+	ikm, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	okm := hex.EncodeToString(HKDF(ikm, salt, info, 42))
+	if okm != "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865" {
+		t.Errorf("Unexpected HKDF output %s", okm)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	old, err := NewKeyring("", "the old key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := old.SealJSON(map[string]string{"user": "admin"})
+	if err != nil || !strings.HasPrefix(sealed, envelopeV1) {
+		t.Fatalf("Unexpected sealed value %s - %v", sealed, err)
+	}
+	var v map[string]string
+	if err = old.OpenJSON(sealed, &v); err != nil || v["user"] != "admin" {
+		t.Fatalf("Unable to open sealed value - %v %v", err, v)
+	}
+	// After rotation the new key seals and the old one still opens
+	rotated, err := NewKeyring("", "a new key of any length", "the old key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rotated.OpenJSON(sealed, &v); err != nil {
+		t.Errorf("Rotated keyring must open values of the old key - %v", err)
+	}
+	newer, _ := rotated.Seal([]byte("secret"))
+	if _, err = old.Open(newer); err != ErrSealed {
+		t.Errorf("Old keyring must not open values of the new key - %v", err)
+	}
+	retired, _ := NewKeyring("", "a new key of any length")
+	if _, err = retired.Open(sealed); err != ErrSealed {
+		t.Errorf("Retired keys must not open values - %v", err)
+	}
+	tampered := []byte(newer)
+	tampered[len(tampered)-2] ^= 1
+	if _, err = rotated.Open(string(tampered)); err != ErrSealed {
+		t.Errorf("Tampered values must not open - %v", err)
+	}
+	if _, err = NewKeyring(""); err != ErrNoKey {
+		t.Errorf("Expected no key error but got %v", err)
+	}
+}
+
+func TestKeyringLegacy(t *testing.T) {
+	legacyKey := "kukuKiki1234qawsed.Strazaaplokij"
+	legacy, err := EncryptJSON(map[string]string{"user": "admin"}, legacyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _ := NewKeyring(legacyKey, "a new key")
+	var v map[string]string
+	if err = k.OpenJSON(legacy, &v); err != nil || v["user"] != "admin" {
+		t.Errorf("Unable to open legacy value - %v %v", err, v)
+	}
+	for _, garbage := range []string{"", "AAAA", legacy[:24]} {
+		if _, err = k.Open(garbage); err != ErrSealed {
+			t.Errorf("Expected garbage %q to fail but got %v", garbage, err)
+		}
+	}
+	k, _ = NewKeyring("", "a new key")
+	if _, err = k.Open(legacy); err != ErrSealed {
+		t.Errorf("Legacy values must not open once the migration is over - %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+package util
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LDAP protocol operations (RFC 4511)
+const (
+	ldapBindRequest      byte = 0
+	ldapBindResponse     byte = 1
+	ldapUnbindRequest    byte = 2
+	ldapSearchRequest    byte = 3
+	ldapSearchEntry      byte = 4
+	ldapSearchDone       byte = 5
+	ldapExtendedRequest  byte = 23
+	ldapExtendedResponse byte = 24
+	ldapStartTLSOID           = "1.3.6.1.4.1.1466.20037"
+)
+
+// LDAP result codes we care about
+const (
+	LDAPSuccess            = 0
+	LDAPSizeLimitExceeded  = 4
+	LDAPNoSuchObject       = 32
+	LDAPInvalidCredentials = 49
+	LDAPUnavailable        = 52
+	LDAPUnwillingToPerform = 53
+)
+
+const (
+	ldapProtocolVersion   = 3
+	ldapScopeWholeSubtree = 2
+	ldapDerefNever        = 0
+	// ldapMaxSearchEntries limits the entries of a search response we keep in memory
+	ldapMaxSearchEntries = 1000
+	ldapFilterMaxNesting = 16
+	ldapDefaultTimeout   = 10 * time.Second
+	ldapDefaultPort      = "389"
+	ldapDefaultTLSPort   = "636"
+)
+
+var (
+	// ErrLDAPProtocol is returned when the server response cannot be understood
+	ErrLDAPProtocol = errors.New("Invalid LDAP response")
+	// ErrLDAPFilter is returned for filters that cannot be parsed. Substring filters are not supported.
+	ErrLDAPFilter = errors.New("Invalid LDAP filter")
+)
+
+// LDAPError is a non successful LDAP result
+type LDAPError struct {
+	ResultCode int
+	Message    string
+}
+
+func (e *LDAPError) Error() string {
+	return fmt.Sprintf("LDAP result %d: %s", e.ResultCode, e.Message)
+}
+
+// IsLDAPError checks if the error is an LDAP result with the given code
+func IsLDAPError(err error, code int) bool {
+	e, ok := err.(*LDAPError)
+	return ok && e.ResultCode == code
+}
+
+// LDAPEntry is a search result. Attribute names are lower case since LDAP attribute names are case insensitive.
+type LDAPEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Attr returns the first value of the attribute
+func (e *LDAPEntry) Attr(name string) string {
+	if v := e.Attributes[strings.ToLower(name)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// LDAPConn is a minimal LDAPv3 client connection that supports simple bind, search and StartTLS.
+// It is not safe for concurrent use.
+type LDAPConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// host is the name of the server the certificate is verified for
+	host    string
+	msgID   int64
+	timeout time.Duration
+}
+
+// DialLDAP connects to an ldap:// or ldaps:// URL. The TLS configuration is used for ldaps and may be nil.
+func DialLDAP(rawurl string, tlsConfig *tls.Config, timeout time.Duration) (*LDAPConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = ldapDefaultTimeout
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := ldapDefaultPort
+		if u.Scheme == "ldaps" {
+			port = ldapDefaultTLSPort
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, ldapTLSConfig(tlsConfig, u.Hostname()))
+	default:
+		return nil, fmt.Errorf("Unsupported LDAP scheme %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &LDAPConn{conn: conn, r: bufio.NewReader(conn), host: u.Hostname(), timeout: timeout}, nil
+}
+
+func ldapTLSConfig(c *tls.Config, host string) *tls.Config {
+	if c == nil {
+		c = &tls.Config{}
+	} else {
+		c = c.Clone()
+	}
+	if c.ServerName == "" {
+		c.ServerName = host
+	}
+	return c
+}
+
+// Close sends an unbind request and closes the connection
+func (c *LDAPConn) Close() error {
+	c.msgID++
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	c.conn.Write(BERConstruct(BERSequence, BERInt(BERInteger, c.msgID), BER(BERApplication|ldapUnbindRequest, nil)))
+	return c.conn.Close()
+}
+
+// roundTrip sends the operation and returns the protocol operations of the responses until one with the done tag
+func (c *LDAPConn) roundTrip(op []byte, done byte) ([]*BERElement, error) {
+	c.msgID++
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(BERConstruct(BERSequence, BERInt(BERInteger, c.msgID), op)); err != nil {
+		return nil, err
+	}
+	var res []*BERElement
+	for {
+		msg, err := ReadBER(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Tag != BERSequence || len(msg.Children) < 2 || msg.Children[0].Int() != c.msgID {
+			return nil, ErrLDAPProtocol
+		}
+		resp := msg.Children[1]
+		res = append(res, resp)
+		if resp.Tag == BERApplication|BERConstructed|done {
+			return res, ldapResult(resp)
+		}
+		if len(res) > ldapMaxSearchEntries {
+			return nil, &LDAPError{ResultCode: LDAPSizeLimitExceeded, Message: "Too many entries"}
+		}
+	}
+}
+
+// ldapResult returns the error of an LDAPResult or nil on success
+func ldapResult(e *BERElement) error {
+	if len(e.Children) < 3 {
+		return ErrLDAPProtocol
+	}
+	if code := int(e.Children[0].Int()); code != LDAPSuccess {
+		return &LDAPError{ResultCode: code, Message: e.Children[2].String()}
+	}
+	return nil
+}
+
+// StartTLS upgrades the connection to TLS
+func (c *LDAPConn) StartTLS(tlsConfig *tls.Config) error {
+	req := BERConstruct(BERApplication|ldapExtendedRequest, BER(BERContext|0, []byte(ldapStartTLSOID)))
+	if _, err := c.roundTrip(req, ldapExtendedResponse); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, ldapTLSConfig(tlsConfig, c.host))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	return nil
+}
+
+// Bind authenticates with a simple bind. An empty password is rejected because servers treat it as an
+// unauthenticated bind that always succeeds.
+func (c *LDAPConn) Bind(dn, password string) error {
+	if password == "" {
+		return &LDAPError{ResultCode: LDAPInvalidCredentials, Message: "Empty password"}
+	}
+	req := BERConstruct(BERApplication|ldapBindRequest,
+		BERInt(BERInteger, ldapProtocolVersion),
+		BER(BEROctetString, []byte(dn)),
+		BER(BERContext|0, []byte(password)))
+	_, err := c.roundTrip(req, ldapBindResponse)
+	return err
+}
+
+// Search the subtree of the base DN with the filter and return the requested attributes
+func (c *LDAPConn) Search(baseDN, filter string, attributes []string) ([]*LDAPEntry, error) {
+	f, err := CompileLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrs [][]byte
+	for _, a := range attributes {
+		attrs = append(attrs, BER(BEROctetString, []byte(a)))
+	}
+	req := BERConstruct(BERApplication|ldapSearchRequest,
+		BER(BEROctetString, []byte(baseDN)),
+		BERInt(BEREnumerated, ldapScopeWholeSubtree),
+		BERInt(BEREnumerated, ldapDerefNever),
+		BERInt(BERInteger, 0),
+		BERInt(BERInteger, 0),
+		BERBool(false),
+		f,
+		BERConstruct(BERSequence, attrs...))
+	res, err := c.roundTrip(req, ldapSearchDone)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*LDAPEntry
+	for _, r := range res {
+		if r.Tag != BERApplication|BERConstructed|ldapSearchEntry {
+			continue
+		}
+		if len(r.Children) < 2 {
+			return nil, ErrLDAPProtocol
+		}
+		entry := &LDAPEntry{DN: r.Children[0].String(), Attributes: make(map[string][]string)}
+		for _, a := range r.Children[1].Children {
+			if len(a.Children) < 2 {
+				return nil, ErrLDAPProtocol
+			}
+			name := strings.ToLower(a.Children[0].String())
+			for _, v := range a.Children[1].Children {
+				entry.Attributes[name] = append(entry.Attributes[name], v.String())
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// EscapeLDAPFilter escapes a value so it can be safely used inside a filter
+func EscapeLDAPFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			b.WriteString(`\` + hex.EncodeToString([]byte{c}))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// CompileLDAPFilter encodes a string filter (RFC 4515). And, or, not, equality and presence filters are supported.
+func CompileLDAPFilter(s string) ([]byte, error) {
+	f, rest, err := compileLDAPFilter(strings.TrimSpace(s), 0)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, ErrLDAPFilter
+	}
+	return f, nil
+}
+
+func compileLDAPFilter(s string, depth int) ([]byte, string, error) {
+	if depth > ldapFilterMaxNesting || len(s) < 2 || s[0] != '(' {
+		return nil, "", ErrLDAPFilter
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|', '!':
+		tag := map[byte]byte{'&': 0, '|': 1, '!': 2}[s[0]]
+		s = s[1:]
+		var children [][]byte
+		for len(s) > 0 && s[0] == '(' {
+			child, rest, err := compileLDAPFilter(s, depth+1)
+			if err != nil {
+				return nil, "", err
+			}
+			children, s = append(children, child), rest
+		}
+		if len(s) == 0 || s[0] != ')' || len(children) == 0 || tag == 2 && len(children) != 1 {
+			return nil, "", ErrLDAPFilter
+		}
+		return BERConstruct(BERContext|tag, children...), s[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", ErrLDAPFilter
+	}
+	item, rest := s[:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", ErrLDAPFilter
+	}
+	attr, value := item[:eq], item[eq+1:]
+	if strings.ContainsAny(attr, "<>~:") {
+		return nil, "", ErrLDAPFilter
+	}
+	if value == "*" {
+		return BER(BERContext|7, []byte(attr)), rest, nil
+	}
+	if strings.IndexByte(value, '*') >= 0 {
+		return nil, "", ErrLDAPFilter
+	}
+	v, err := unescapeLDAPFilter(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return BERConstruct(BERContext|3, BER(BEROctetString, []byte(attr)), BER(BEROctetString, v)), rest, nil
+}
+
+func unescapeLDAPFilter(s string) ([]byte, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return nil, ErrLDAPFilter
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return nil, ErrLDAPFilter
+		}
+		b = append(b, c[0])
+		i += 2
+	}
+	return b, nil
+}
@@ -0,0 +1,214 @@
+package util
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ErrMailHeader is returned when the subject contains line breaks
+var ErrMailHeader = errors.New("Invalid mail header")
+
+// Mailer sends emails through an SMTP server. STARTTLS is used if the server supports it.
+type Mailer struct {
+	// Address of the server as host:port
+	Address string
+	// Username and Password for PLAIN authentication. Authentication is skipped if the username is empty.
+	Username string
+	Password string
+	// From is the sender of the emails
+	From string
+	// TLSConfig for STARTTLS. If nil, the certificate is verified against the host of the address.
+	TLSConfig *tls.Config
+	// Timeout of the whole exchange with the server
+	Timeout time.Duration
+}
+
+// Email is a message with a plain text body and an optional HTML alternative
+type Email struct {
+	To      []string
+	Subject string
+	Text    string
+	// HTML is sent as an alternative to the text if it is not empty
+	HTML string
+}
+
+// ComposeEmail builds the email with its headers from the given sender
+func ComposeEmail(sender string, e *Email) ([]byte, error) {
+	from, err := mail.ParseAddress(sender)
+	if err != nil {
+		return nil, err
+	}
+	var rcpts []string
+	for _, t := range e.To {
+		a, err := mail.ParseAddress(t)
+		if err != nil {
+			return nil, err
+		}
+		rcpts = append(rcpts, a.String())
+	}
+	if strings.ContainsAny(e.Subject, "\r\n") {
+		return nil, ErrMailHeader
+	}
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(rcpts, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%s@%s>\r\n", SecureRandomString(16, false), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	if e.HTML == "" {
+		buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err = writeQuotedPrintable(buf, e.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	mw := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	// Clients show the last part they support so the HTML goes last
+	for _, part := range []struct{ contentType, body string }{{"text/plain", e.Text}, {"text/html", e.HTML}} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=UTF-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1))); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// Message builds the plain text email with its headers
+func (m *Mailer) Message(to []string, subject, body string) ([]byte, error) {
+	return ComposeEmail(m.From, &Email{To: to, Subject: subject, Text: body})
+}
+
+// Send the plain text email to the recipients
+func (m *Mailer) Send(to []string, subject, body string) error {
+	return m.SendEmail(&Email{To: to, Subject: subject, Text: body})
+}
+
+// SendEmail sends the email to its recipients
+func (m *Mailer) SendEmail(e *Email) error {
+	msg, err := ComposeEmail(m.From, e)
+	if err != nil {
+		return err
+	}
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", m.Address, timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	host, _, err := net.SplitHostPort(m.Address)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		cfg := m.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{ServerName: host}
+		}
+		if err = c.StartTLS(cfg); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(m.From)
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, t := range e.To {
+		a, _ := mail.ParseAddress(t)
+		if err = c.Rcpt(a.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// FileMailer writes each email to a file in Dir instead of sending it. It is meant for development and for
+// handing emails to another system.
+type FileMailer struct {
+	Dir string
+	// From is the sender of the emails
+	From string
+}
+
+// SendEmail writes the email as an .eml file
+func (m *FileMailer) SendEmail(e *Email) error {
+	msg, err := ComposeEmail(m.From, e)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), SecureRandomString(8, false))
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), msg, 0600)
+}
+
+// LogMailer logs emails instead of sending them. The text is logged with any links and codes in it, so it is only
+// meant for development.
+type LogMailer struct{}
+
+// SendEmail logs the recipients, the subject and the text of the email
+func (LogMailer) SendEmail(e *Email) error {
+	if strings.ContainsAny(e.Subject, "\r\n") {
+		return ErrMailHeader
+	}
+	log.WithFields(log.Fields{"to": e.To, "subject": e.Subject}).Info(e.Text)
+	return nil
+}
@@ -0,0 +1,180 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// smtpStandIn is a local SMTP server that accepts any message and records it
+type smtpStandIn struct {
+	l        net.Listener
+	auth     string
+	rcpts    []string
+	messages chan string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{l: l, messages: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(cmd, "AUTH"):
+			s.auth = strings.TrimSpace(line)
+			reply("235 Authenticated")
+		case strings.HasPrefix(cmd, "RCPT"):
+			s.rcpts = append(s.rcpts, strings.TrimSpace(line))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 Go ahead")
+			var msg []string
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg = append(msg, l)
+			}
+			s.messages <- strings.Join(msg, "")
+			reply("250 Queued")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestMailerSend(t *testing.T) {
+	s := newSMTPStandIn(t)
+	defer s.l.Close()
+	m := &Mailer{Address: s.l.Addr().String(), Username: "mailer", Password: "secret", From: "Demisto <noreply@demisto.com>"}
+	body := "Sign in with the link:\nhttps://download.demisto.com/login/link?token=" + strings.Repeat("a", 80)
+	if err := m.Send([]string{"customer@example.com"}, "Sign in to Demisto – downloads", body); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(<-s.messages))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("To") != "<customer@example.com>" || msg.Header.Get("From") != `"Demisto" <noreply@demisto.com>` {
+		t.Errorf("Unexpected headers %v", msg.Header)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != "Sign in to Demisto – downloads" {
+		t.Errorf("Unexpected subject %s", subject)
+	}
+	b, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil || strings.TrimRight(strings.Replace(string(b), "\r\n", "\n", -1), "\n") != body {
+		t.Errorf("Unexpected body %s - %v", string(b), err)
+	}
+	if len(s.rcpts) != 1 || !strings.Contains(s.rcpts[0], "<customer@example.com>") || !strings.HasPrefix(s.auth, "AUTH PLAIN") {
+		t.Errorf("Unexpected exchange %v %s", s.rcpts, s.auth)
+	}
+}
+
+func TestMailerHeaderInjection(t *testing.T) {
+	m := &Mailer{From: "noreply@demisto.com"}
+	if _, err := m.Message([]string{"customer@example.com"}, "Hi\r\nBcc: victim@example.com", ""); err != ErrMailHeader {
+		t.Errorf("Expected header error but got %v", err)
+	}
+	if _, err := m.Message([]string{"customer@example.com\r\nBcc: victim@example.com"}, "Hi", ""); err == nil {
+		t.Error("Expected invalid recipient")
+	}
+}
+
+func TestComposeEmailAlternatives(t *testing.T) {
+	b, err := ComposeEmail("noreply@demisto.com", &Email{To: []string{"customer@example.com"}, Subject: "Your token",
+		Text: "Download with the link", HTML: "<p>Download with the <a href=\"https://download.demisto.com\">link</a></p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Expected alternatives but got %s - %v", mediaType, err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(quotedprintable.NewReader(p))
+		types = append(types, p.Header.Get("Content-Type"))
+		if strings.HasPrefix(p.Header.Get("Content-Type"), "text/html") && !strings.Contains(string(body), `<a href="https://download.demisto.com">`) {
+			t.Errorf("Unexpected HTML %s", body)
+		}
+	}
+	if len(types) != 2 || !strings.HasPrefix(types[0], "text/plain") || !strings.HasPrefix(types[1], "text/html") {
+		t.Errorf("Unexpected parts %v", types)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &FileMailer{Dir: dir, From: "noreply@demisto.com"}
+	if err = m.SendEmail(&Email{To: []string{"customer@example.com"}, Subject: "Your token", Text: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected a single email but got %v", files)
+	}
+	f, _ := os.Open(files[0])
+	defer f.Close()
+	if msg, err := mail.ReadMessage(f); err != nil || msg.Header.Get("To") != "<customer@example.com>" {
+		t.Errorf("Unexpected email - %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// TOTPPeriod is the time step of the codes as recommended by RFC 6238
+	TOTPPeriod = 30
+	// TOTPDigits is the number of digits in a code
+	TOTPDigits = 6
+)
+
+// TOTPStep returns the time step of the given time
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / TOTPPeriod
+}
+
+// HOTP returns the RFC 4226 code of the secret for the given counter
+func HOTP(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPDigits, code%1000000)
+}
+
+// ValidateTOTP checks the code against the steps around the given time allowing skew steps of clock drift
+// and returns the matching step so callers can reject codes that were already used
+func ValidateTOTP(secret []byte, code string, t time.Time, skew int64) (int64, bool) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+	step := TOTPStep(t)
+	for s := step - skew; s <= step+skew; s++ {
+		if subtle.ConstantTimeCompare([]byte(HOTP(secret, s)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// EncodeTOTPSecret returns the base32 encoding authenticator apps expect
+func EncodeTOTPSecret(secret []byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+}
+
+// DecodeTOTPSecret decodes a base32 secret
+func DecodeTOTPSecret(secret string) ([]byte, error) {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// Test vectors from RFC 6238 (SHA1) truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		if code := HOTP(secret, TOTPStep(time.Unix(test.unix, 0))); code != test.code {
+			t.Errorf("Expected %s at %d but got %s", test.code, test.unix, code)
+		}
+	}
+	now := time.Unix(1111111109, 0)
+	if step, ok := ValidateTOTP(secret, "081804", now.Add(TOTPPeriod*time.Second), 1); !ok || step != TOTPStep(now) {
+		t.Error("Code of the previous step should be accepted")
+	}
+	if _, ok := ValidateTOTP(secret, "081804", now.Add(3*TOTPPeriod*time.Second), 1); ok {
+		t.Error("Old code should be rejected")
+	}
+	encoded := EncodeTOTPSecret(secret)
+	if decoded, err := DecodeTOTPSecret(encoded); err != nil || string(decoded) != string(secret) {
+		t.Errorf("Secret did not survive encoding - %s %v", encoded, err)
+	}
+}
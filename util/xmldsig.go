@@ -0,0 +1,346 @@
+package util
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+// XML namespaces and algorithms used by XML signatures
+const (
+	XMLDSigNamespace = "http://www.w3.org/2000/09/xmldsig#"
+	xmlNamespace     = "http://www.w3.org/XML/1998/namespace"
+	excC14N          = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSig     = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	rsaSHA256        = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	digestSHA256     = "http://www.w3.org/2001/04/xmlenc#sha256"
+	maxXMLDepth      = 64
+	maxXMLSize       = 1 << 20
+)
+
+var (
+	// ErrInvalidXML is returned when the document cannot be parsed or uses unsupported XML features
+	ErrInvalidXML = errors.New("Invalid XML document")
+	// ErrInvalidSignature is returned when the XML signature is missing, unsupported or does not verify
+	ErrInvalidSignature = errors.New("Invalid XML signature")
+)
+
+// XMLElement is an element of a parsed document. Unlike encoding/xml unmarshaling, it keeps the namespace
+// prefixes and declarations that are needed for canonicalization.
+type XMLElement struct {
+	Prefix string
+	Local  string
+	// Attrs are the raw attributes, Name.Space is the prefix. Namespace declarations are included.
+	Attrs []xml.Attr
+	// Children are *XMLElement or string for text
+	Children []interface{}
+	Parent   *XMLElement
+}
+
+// ParseXML parses the document and returns its root element. DTDs are rejected.
+func ParseXML(data []byte) (*XMLElement, error) {
+	if len(data) > maxXMLSize {
+		return nil, ErrInvalidXML
+	}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, cur *XMLElement
+	depth := 0
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, ErrInvalidXML
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if depth++; depth > maxXMLDepth || root != nil && cur == nil {
+				return nil, ErrInvalidXML
+			}
+			e := &XMLElement{Prefix: t.Name.Space, Local: t.Name.Local, Attrs: append([]xml.Attr(nil), t.Attr...), Parent: cur}
+			if cur == nil {
+				root = e
+			} else {
+				cur.Children = append(cur.Children, e)
+			}
+			cur = e
+		case xml.EndElement:
+			if cur == nil || t.Name.Space != cur.Prefix || t.Name.Local != cur.Local {
+				return nil, ErrInvalidXML
+			}
+			depth--
+			cur = cur.Parent
+		case xml.CharData:
+			if cur != nil {
+				cur.Children = append(cur.Children, string(t))
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return nil, ErrInvalidXML
+			}
+		case xml.Directive:
+			return nil, ErrInvalidXML
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, ErrInvalidXML
+	}
+	return root, nil
+}
+
+// Namespace returns the namespace URI the prefix is bound to in the scope of the element
+func (e *XMLElement) Namespace(prefix string) string {
+	if prefix == "xml" {
+		return xmlNamespace
+	}
+	for el := e; el != nil; el = el.Parent {
+		for _, a := range el.Attrs {
+			if prefix == "" && a.Name.Space == "" && a.Name.Local == "xmlns" || a.Name.Space == "xmlns" && a.Name.Local == prefix {
+				return a.Value
+			}
+		}
+	}
+	return ""
+}
+
+// Space returns the namespace URI of the element
+func (e *XMLElement) Space() string {
+	return e.Namespace(e.Prefix)
+}
+
+// Is checks the namespace and local name of the element
+func (e *XMLElement) Is(space, local string) bool {
+	return e.Local == local && e.Space() == space
+}
+
+// Attr returns the value of the attribute without a prefix
+func (e *XMLElement) Attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Elements returns the child elements with the given namespace and local name
+func (e *XMLElement) Elements(space, local string) []*XMLElement {
+	var res []*XMLElement
+	for _, c := range e.Children {
+		if c, ok := c.(*XMLElement); ok && c.Is(space, local) {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// Element returns the first child element with the given namespace and local name or nil
+func (e *XMLElement) Element(space, local string) *XMLElement {
+	if res := e.Elements(space, local); len(res) > 0 {
+		return res[0]
+	}
+	return nil
+}
+
+// Text returns the text content of the element and its descendants
+func (e *XMLElement) Text() string {
+	var b strings.Builder
+	for _, c := range e.Children {
+		switch c := c.(type) {
+		case string:
+			b.WriteString(c)
+		case *XMLElement:
+			b.WriteString(c.Text())
+		}
+	}
+	return b.String()
+}
+
+// Canonicalize returns the exclusive canonical form (without comments) of the element. The excluded element
+// is left out, which implements the enveloped signature transform. Inclusive are the prefixes of the
+// InclusiveNamespaces PrefixList where #default is the default namespace.
+func (e *XMLElement) Canonicalize(exclude *XMLElement, inclusive []string) []byte {
+	var b bytes.Buffer
+	e.canonicalize(&b, map[string]string{}, exclude, inclusive)
+	return b.Bytes()
+}
+
+func qname(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+var (
+	c14nText = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	c14nAttr = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func (e *XMLElement) canonicalize(b *bytes.Buffer, rendered map[string]string, exclude *XMLElement, inclusive []string) {
+	// Exclusive canonicalization only renders the namespaces that are visibly utilized
+	used := []string{e.Prefix}
+	var attrs []xml.Attr
+	for _, a := range e.Attrs {
+		if a.Name.Space == "xmlns" || a.Name.Space == "" && a.Name.Local == "xmlns" {
+			continue
+		}
+		attrs = append(attrs, a)
+		if a.Name.Space != "" {
+			used = append(used, a.Name.Space)
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		if e.Namespace(p) != "" {
+			used = append(used, p)
+		}
+	}
+	decls := make(map[string]string)
+	for _, p := range used {
+		if p == "xml" {
+			continue
+		}
+		uri := e.Namespace(p)
+		if r, ok := rendered[p]; ok && r == uri || !ok && uri == "" {
+			continue
+		}
+		decls[p] = uri
+	}
+	prefixes := make([]string, 0, len(decls))
+	scope := make(map[string]string, len(rendered)+len(decls))
+	for p, uri := range rendered {
+		scope[p] = uri
+	}
+	for p, uri := range decls {
+		prefixes = append(prefixes, p)
+		scope[p] = uri
+	}
+	sort.Strings(prefixes)
+	sort.SliceStable(attrs, func(i, j int) bool {
+		si, sj := "", ""
+		if attrs[i].Name.Space != "" {
+			si = e.Namespace(attrs[i].Name.Space)
+		}
+		if attrs[j].Name.Space != "" {
+			sj = e.Namespace(attrs[j].Name.Space)
+		}
+		if si != sj {
+			return si < sj
+		}
+		return attrs[i].Name.Local < attrs[j].Name.Local
+	})
+
+	name := qname(e.Prefix, e.Local)
+	b.WriteString("<" + name)
+	for _, p := range prefixes {
+		if p == "" {
+			b.WriteString(` xmlns="` + c14nAttr.Replace(decls[p]) + `"`)
+		} else {
+			b.WriteString(` xmlns:` + p + `="` + c14nAttr.Replace(decls[p]) + `"`)
+		}
+	}
+	for _, a := range attrs {
+		b.WriteString(" " + qname(a.Name.Space, a.Name.Local) + `="` + c14nAttr.Replace(a.Value) + `"`)
+	}
+	b.WriteString(">")
+	for _, c := range e.Children {
+		switch c := c.(type) {
+		case string:
+			b.WriteString(c14nText.Replace(c))
+		case *XMLElement:
+			if c != exclude {
+				c.canonicalize(b, scope, exclude, inclusive)
+			}
+		}
+	}
+	b.WriteString("</" + name + ">")
+}
+
+// inclusivePrefixes returns the InclusiveNamespaces PrefixList of an exclusive canonicalization method or transform
+func inclusivePrefixes(method *XMLElement) []string {
+	for _, c := range method.Children {
+		if c, ok := c.(*XMLElement); ok && c.Local == "InclusiveNamespaces" && c.Space() == excC14N {
+			return strings.Fields(c.Attr("PrefixList"))
+		}
+	}
+	return nil
+}
+
+// VerifyEnvelopedSignature verifies the enveloped signature of the element with the certificate and returns the
+// canonical form of the element without the signature. Only what was signed is returned, so callers must use the
+// returned document and not the original element. Only exclusive canonicalization with RSA-SHA256 is supported.
+func VerifyEnvelopedSignature(e *XMLElement, cert *x509.Certificate) ([]byte, error) {
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrInvalidSignature
+	}
+	sigs := e.Elements(XMLDSigNamespace, "Signature")
+	if len(sigs) != 1 {
+		return nil, ErrInvalidSignature
+	}
+	sig := sigs[0]
+	signedInfo := sig.Element(XMLDSigNamespace, "SignedInfo")
+	sigValue := sig.Element(XMLDSigNamespace, "SignatureValue")
+	if signedInfo == nil || sigValue == nil {
+		return nil, ErrInvalidSignature
+	}
+	c14nMethod := signedInfo.Element(XMLDSigNamespace, "CanonicalizationMethod")
+	sigMethod := signedInfo.Element(XMLDSigNamespace, "SignatureMethod")
+	refs := signedInfo.Elements(XMLDSigNamespace, "Reference")
+	if c14nMethod == nil || c14nMethod.Attr("Algorithm") != excC14N || sigMethod == nil || sigMethod.Attr("Algorithm") != rsaSHA256 || len(refs) != 1 {
+		return nil, ErrInvalidSignature
+	}
+	ref := refs[0]
+	if id := e.Attr("ID"); id == "" || ref.Attr("URI") != "#"+id {
+		return nil, ErrInvalidSignature
+	}
+	var inclusive []string
+	transforms := ref.Element(XMLDSigNamespace, "Transforms")
+	if transforms == nil {
+		return nil, ErrInvalidSignature
+	}
+	enveloped := false
+	for _, t := range transforms.Elements(XMLDSigNamespace, "Transform") {
+		switch t.Attr("Algorithm") {
+		case envelopedSig:
+			enveloped = true
+		case excC14N:
+			inclusive = inclusivePrefixes(t)
+		default:
+			return nil, ErrInvalidSignature
+		}
+	}
+	digestMethod := ref.Element(XMLDSigNamespace, "DigestMethod")
+	digestValue := ref.Element(XMLDSigNamespace, "DigestValue")
+	if !enveloped || digestMethod == nil || digestMethod.Attr("Algorithm") != digestSHA256 || digestValue == nil {
+		return nil, ErrInvalidSignature
+	}
+	expected, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(digestValue.Text()), ""))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	signed := e.Canonicalize(sig, inclusive)
+	digest := sha256.Sum256(signed)
+	if subtle.ConstantTimeCompare(digest[:], expected) != 1 {
+		return nil, ErrInvalidSignature
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(sigValue.Text()), ""))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	infoDigest := sha256.Sum256(signedInfo.Canonicalize(nil, inclusivePrefixes(c14nMethod)))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, infoDigest[:], signature) != nil {
+		return nil, ErrInvalidSignature
+	}
+	return signed, nil
+}
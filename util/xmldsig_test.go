@@ -0,0 +1,47 @@
+package util
+
+import "testing"
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		doc      string
+		path     []int
+		expected string
+	}{
+		// Example from section 2.2 of the Exclusive XML Canonicalization spec
+		{`<n0:local xmlns:n0="foo:bar" xmlns:n3="ftp://example.org"><n1:elem2 xmlns:n1="http://example.net" xml:lang="en"><n3:stuff xmlns:n3="ftp://example.org"/></n1:elem2></n0:local>`,
+			[]int{0}, `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en"><n3:stuff xmlns:n3="ftp://example.org"></n3:stuff></n1:elem2>`},
+		{`<a xmlns="urn:x" xmlns:p="urn:p" b="2" p:c="3" a="1&amp;&lt;"><b xmlns="urn:x">t&gt;&#xD;</b><c xmlns=""/></a>`,
+			nil, `<a xmlns="urn:x" xmlns:p="urn:p" a="1&amp;&lt;" b="2" p:c="3"><b>t&gt;&#xD;</b><c xmlns=""></c></a>`},
+		// Unused namespaces are not rendered and the inherited ones are rendered on the apex
+		{`<r xmlns:u="urn:unused" xmlns:s="urn:s"><s:e><s:f>text</s:f></s:e></r>`,
+			[]int{0}, `<s:e xmlns:s="urn:s"><s:f>text</s:f></s:e>`},
+	}
+	for i, test := range tests {
+		e, err := ParseXML([]byte(test.doc))
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		for _, p := range test.path {
+			var children []*XMLElement
+			for _, c := range e.Children {
+				if c, ok := c.(*XMLElement); ok {
+					children = append(children, c)
+				}
+			}
+			e = children[p]
+		}
+		if res := string(e.Canonicalize(nil, nil)); res != test.expected {
+			t.Errorf("%d: expected\n%s\nbut got\n%s", i, test.expected, res)
+		}
+	}
+}
+
+func TestParseXMLRejectsDTD(t *testing.T) {
+	if _, err := ParseXML([]byte(`<!DOCTYPE r [<!ENTITY x "y">]><r>&x;</r>`)); err == nil {
+		t.Error("Documents with a DTD should be rejected")
+	}
+	if _, err := ParseXML([]byte(`<a/><b/>`)); err == nil {
+		t.Error("Documents with two roots should be rejected")
+	}
+}
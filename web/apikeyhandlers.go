@@ -0,0 +1,124 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+	"github.com/gorilla/context"
+)
+
+// apiKeyUseInterval limits how often the last use of an API key is written
+const apiKeyUseInterval = time.Minute
+
+// apiKeyRoutes are the routes API keys can access and the scope each requires. Any other route is session only.
+var apiKeyRoutes = map[string]domain.APIKeyScope{
+	"POST /upload":          domain.APIKeyScopeUpload,
+	"GET /list-downloads":   domain.APIKeyScopeUpload,
+	"POST /tokens/generate": domain.APIKeyScopeTokenIssue,
+	"POST /tokens/email":    domain.APIKeyScopeTokenIssue,
+	"POST /tokens/import":   domain.APIKeyScopeTokenIssue,
+	"GET /log":              domain.APIKeyScopeReadLog,
+}
+
+type newAPIKey struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// bearerToken returns the API key from the Authorization header or empty if there is none
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// apiKeyUser authenticates the plain API key and returns the key along with the admin it acts as
+func (ac *AppContext) apiKeyUser(plain string) (*domain.APIKey, *domain.User, error) {
+	if !domain.IsAPIKey(plain) {
+		return nil, nil, ErrAuth
+	}
+	k, err := ac.r.APIKey(domain.TokenDigest(plain))
+	if err == repo.ErrNotFound {
+		log.Warn("Unknown API key used")
+		return nil, nil, ErrAuth
+	} else if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if err = k.Valid(now); err != nil {
+		log.WithError(err).Warnf("API key %s [%s] rejected", k.Hint, k.Name)
+		return nil, nil, ErrAuth
+	}
+	u, err := ac.r.User(k.Username)
+	if err == repo.ErrNotFound {
+		log.Warnf("User %s of API key %s [%s] no longer exists", k.Username, k.Hint, k.Name)
+		return nil, nil, ErrAuth
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if u.Disabled {
+		log.Warnf("Disabled user %s used API key %s [%s]", k.Username, k.Hint, k.Name)
+		return nil, nil, ErrAuth
+	}
+	if k.LastUsed == nil || now.Sub(*k.LastUsed) > apiKeyUseInterval {
+		k.LastUsed = &now
+		if err = ac.r.SetAPIKeyUsed(k.ID, now); err != nil {
+			log.WithError(err).Warnf("Unable to record use of API key %s", k.Hint)
+		}
+	}
+	return k, u, nil
+}
+
+// apiKeysHandler lists all the API keys
+func (ac *AppContext) apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := ac.r.APIKeys()
+	if err != nil {
+		log.WithError(err).Error("Unable to load API keys")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	writeJSON(w, keys)
+}
+
+// createAPIKeyHandler issues a new API key acting as the current user. The plain key is only returned here.
+func (ac *AppContext) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	req := context.Get(r, "body").(*newAPIKey)
+	u := context.Get(r, "user").(*domain.User)
+	k, err := domain.NewAPIKey(req.Name, u.Username, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid API Key", Detail: err.Error()})
+		return
+	}
+	if err = ac.r.AddAPIKey(k); err != nil {
+		log.WithError(err).Error("Unable to save API key")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	log.Infof("User %s issued API key %s [%s] with scopes %v", u.Username, k.Hint, k.Name, k.Scopes)
+	auditChange(r, k.ID, nil, k, "key")
+	writeJSON(w, k)
+}
+
+// revokeAPIKeyHandler revokes the API key with the given ID
+func (ac *AppContext) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	k := context.Get(r, "body").(*domain.APIKey)
+	u := context.Get(r, "user").(*domain.User)
+	switch err := ac.r.RevokeAPIKey(k.ID, time.Now()); err {
+	case nil:
+		log.Infof("User %s revoked API key %s", u.Username, k.ID)
+		auditChange(r, k.ID, nil, nil)
+		w.WriteHeader(http.StatusNoContent)
+	case repo.ErrNotFound:
+		WriteError(w, ErrNotFound)
+	default:
+		log.WithError(err).Errorf("Unable to revoke API key %s", k.ID)
+		WriteError(w, ErrInternalServer)
+	}
+}
@@ -0,0 +1,119 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/domain"
+	"github.com/gorilla/context"
+)
+
+const (
+	// defaultAuditPageSize is the page size when the limit parameter is not given
+	defaultAuditPageSize = 100
+	// auditHeadHeader returns the hash of the last entry so a client can tell if entries were cut off the end
+	auditHeadHeader = "X-Audit-Head"
+	// maxAuditTarget is the size of the target column
+	maxAuditTarget = 255
+)
+
+// audit serves the request and records it in the audit log with the target and changes the handler added with
+// auditChange. The response is already written at that point so failing to record it is only logged.
+func (ac *AppContext) audit(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	e := &domain.AuditEntry{
+		Actor:     context.Get(r, "user").(*domain.User).Username,
+		Action:    r.Method + " " + r.URL.Path,
+		IP:        remoteIP(r),
+		RequestID: requestID(r),
+	}
+	if k, ok := context.Get(r, "apiKey").(*domain.APIKey); ok {
+		e.APIKey = k.Hint
+	}
+	context.Set(r, "audit", e)
+	lw := &loggingResponseWriter{w, http.StatusOK}
+	defer func() {
+		if err := recover(); err != nil {
+			e.Status = http.StatusInternalServerError
+			ac.recordAudit(e)
+			panic(err)
+		}
+	}()
+	next.ServeHTTP(lw, r)
+	e.Status = lw.status
+	ac.recordAudit(e)
+}
+
+func (ac *AppContext) recordAudit(e *domain.AuditEntry) {
+	e.CreatedAt = time.Now()
+	if err := ac.r.AddAuditEntry(e); err != nil {
+		log.WithError(err).Errorf("Unable to record audit entry of %s by %s on %s", e.Action, e.Actor, e.Target)
+	}
+}
+
+// auditChange sets the target of the audited request and the changes between before and after, which can be nil
+// when the target is created or deleted. The filters remove secrets as in writeWithFilter.
+func auditChange(r *http.Request, target string, before, after interface{}, filters ...string) {
+	e, ok := context.Get(r, "audit").(*domain.AuditEntry)
+	if !ok {
+		return
+	}
+	if len(target) > maxAuditTarget {
+		target = target[:maxAuditTarget]
+	}
+	e.Target = target
+	changes, err := domain.AuditChanges(before, after, filters...)
+	if err != nil {
+		log.WithError(err).Warnf("Unable to compute the audited changes of %s", target)
+		return
+	}
+	e.Changes = changes
+}
+
+// auditLogHandler returns the audit entries matching the actor, action, target, since and until parameters in order.
+// Pages continue with the after parameter set to the ID of the last entry.
+func (ac *AppContext) auditLogHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := &domain.AuditFilter{Actor: q.Get("actor"), Action: q.Get("action"), Target: q.Get("target"), Limit: defaultAuditPageSize}
+	var err error
+	for param, dest := range map[string]**time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := q.Get(param); v != "" {
+			t, pErr := time.Parse(time.RFC3339, v)
+			if pErr != nil {
+				WriteError(w, ErrBadRequest)
+				return
+			}
+			*dest = &t
+		}
+	}
+	if v := q.Get("after"); v != "" {
+		if f.AfterID, err = strconv.ParseInt(v, 10, 64); err != nil || f.AfterID < 0 {
+			WriteError(w, ErrBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > domain.MaxAuditPageSize {
+			WriteError(w, ErrBadRequest)
+			return
+		}
+	}
+	entries, err := ac.r.AuditLog(f)
+	if err != nil {
+		log.WithError(err).Error("Unable to load the audit log")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	head, err := ac.r.AuditHead()
+	if err != nil {
+		log.WithError(err).Error("Unable to load the audit head")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if entries == nil {
+		entries = []domain.AuditEntry{}
+	}
+	w.Header().Set(auditHeadHeader, head)
+	writeJSON(w, entries)
+}
@@ -0,0 +1,55 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/demisto/download/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+	sessionValue := loginWithUserAndPassword(t, f, "slavik", "password", true)
+
+	for _, body := range []string{`{"username":"audited","type":1,"name":"Before"}`, `{"username":"audited","name":"After","password":"a long enough password"}`} {
+		req, _ := http.NewRequest("POST", "http://demisto.com/user", bytes.NewBufferString(body))
+		req.Header.Set(requestIDHeader, "audit-test")
+		f.sendRequest(req, true, sessionValue)
+		if f.response.Code != http.StatusOK {
+			t.Fatalf("Unable to update user - %v %v", f.response.Code, f.response.Body)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://demisto.com/audit?target=audited", nil)
+	f.sendRequest(req, true, sessionValue)
+	if f.response.Code != http.StatusOK {
+		t.Fatalf("Unable to read the audit log - %v %v", f.response.Code, f.response.Body)
+	}
+	var entries []domain.AuditEntry
+	if err := json.NewDecoder(f.response.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if assert.True(t, len(entries) >= 2) {
+		e := entries[len(entries)-1]
+		assert.Equal(t, "slavik", e.Actor)
+		assert.Equal(t, "POST /user", e.Action)
+		assert.Equal(t, http.StatusOK, e.Status)
+		assert.Equal(t, "audit-test", e.RequestID)
+		assert.Contains(t, e.Changes, `"name":{"before":"Before","after":"After"}`)
+		assert.Contains(t, e.Changes, `"hash":{"after":"`+domain.AuditRedacted+`"}`)
+		assert.False(t, strings.Contains(e.Changes, "$2"), "password hashes must not be audited")
+	}
+
+	all, err := f.r.AuditLog(&domain.AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := domain.VerifyAuditChain(domain.AuditKey(), "", all)
+	assert.NoError(t, err)
+	assert.Equal(t, head, f.response.Header().Get(auditHeadHeader))
+}
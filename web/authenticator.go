@@ -0,0 +1,104 @@
+package web
+
+import (
+	"crypto/tls"
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+)
+
+// errInvalidCredentials is returned by authenticators for unknown users and wrong passwords so the next one can be tried
+var errInvalidCredentials = errors.New("Invalid credentials")
+
+// Authenticator checks the password of a user and returns the saved user
+type Authenticator interface {
+	Authenticate(username, password string) (*domain.User, error)
+}
+
+// passwordAuthenticator checks the bcrypt hash of local users
+type passwordAuthenticator struct {
+	r *repo.Repo
+}
+
+func (a *passwordAuthenticator) Authenticate(username, password string) (*domain.User, error) {
+	u, err := a.r.User(username)
+	if err == repo.ErrNotFound {
+		return nil, errInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	if !u.CheckPassword(password) {
+		return nil, errInvalidCredentials
+	}
+	return u, nil
+}
+
+// ldapAuthenticator checks the password with the directory and provisions the user on the first login
+type ldapAuthenticator struct {
+	r   *repo.Repo
+	dir *domain.LDAPDirectory
+}
+
+func (a *ldapAuthenticator) Authenticate(username, password string) (*domain.User, error) {
+	u, err := a.r.User(username)
+	provision := err == repo.ErrNotFound
+	if provision {
+		u = &domain.User{Username: username, Source: domain.UserSourceLDAP}
+	} else if err != nil {
+		return nil, err
+	} else if u.Hash != "" {
+		// Local users, like the initial admin, cannot be taken over by a directory account with the same name
+		return nil, errInvalidCredentials
+	}
+	du, err := a.dir.Authenticate(username, password)
+	if err == domain.ErrLDAPCredentials {
+		return nil, errInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	if provision {
+		log.Infof("Provisioning LDAP user %s as %v", username, du.Type)
+	}
+	// The directory is the source of truth for the role and profile of its users
+	u.Type = du.Type
+	if du.Email != "" {
+		u.Email = du.Email
+	}
+	if du.Name != "" {
+		u.Name = du.Name
+	}
+	u.ModifyDate = time.Now()
+	if err = a.r.SetUser(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// newAuthenticators returns the authenticators tried in order on login. Local passwords come first so the
+// initial admin can always log in, even if the directory is down.
+func newAuthenticators(r *repo.Repo) []Authenticator {
+	auth := []Authenticator{&passwordAuthenticator{r: r}}
+	c := conf.Options.LDAP
+	if c.URL != "" {
+		auth = append(auth, &ldapAuthenticator{r: r, dir: &domain.LDAPDirectory{
+			URL:            c.URL,
+			StartTLS:       c.StartTLS,
+			TLSConfig:      &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify},
+			BindDN:         c.BindDN,
+			BindPassword:   c.BindPassword,
+			BaseDN:         c.BaseDN,
+			UserFilter:     c.UserFilter,
+			GroupAttribute: c.GroupAttribute,
+			EmailAttribute: c.EmailAttribute,
+			NameAttribute:  c.NameAttribute,
+			AdminGroups:    c.AdminGroups,
+			UserGroups:     c.UserGroups,
+			Timeout:        10 * time.Second,
+		}})
+	}
+	return auth
+}
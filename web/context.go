@@ -1,21 +1,45 @@
 package web
 
 import (
+	"fmt"
+
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
 	"github.com/demisto/download/repo"
 )
 
 // AppContext holds the web context for the handlers
 type AppContext struct {
-	r *repo.Repo
+	r         *repo.Repo
+	passwords *domain.PasswordPolicy
+	// oidc is nil if single sign-on is not configured
+	oidc *domain.OIDCProvider
+	// authenticators check passwords on login in order
+	authenticators []Authenticator
+	// roles grant the permissions routes require
+	roles domain.Roles
+	// mailer is nil if emails are not configured
+	mailer Mailer
 }
 
-// NewContext creates a new context
-func NewContext(r *repo.Repo) *AppContext {
-	ac := &AppContext{r: r}
-	return ac
+// NewContext creates a new context. Fails if the configured breached passwords or roles cannot be loaded instead of
+// running without the breach check or with permissions that were not configured.
+func NewContext(r *repo.Repo) (*AppContext, error) {
+	passwords, err := domain.NewPasswordPolicy(conf.Options.Security.PasswordMinLength, conf.Options.Security.BreachedPasswords)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load breached passwords from %s - %v", conf.Options.Security.BreachedPasswords, err)
+	}
+	roles, err := domain.NewRoles(conf.Options.Security.Roles)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid custom roles - %v", err)
+	}
+	ac := &AppContext{r: r, passwords: passwords, oidc: newOIDCProvider(), authenticators: newAuthenticators(r), roles: roles, mailer: newMailer()}
+	return ac, nil
 }
 
 type session struct {
+	// ID is the plain ID of the server side session
+	ID   string `json:"id"`
 	User string `json:"user"`
 	When int64  `json:"when"`
 }
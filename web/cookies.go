@@ -0,0 +1,83 @@
+package web
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/util"
+)
+
+// cookieKeys caches the keyring until the configured keys change
+var cookieKeys struct {
+	sync.Mutex
+	config  string
+	keyring *util.Keyring
+}
+
+// cookieKeyring returns the keyring of the configured cookie keys
+func cookieKeyring() (*util.Keyring, error) {
+	secrets := conf.Options.Security.SessionKeys
+	if len(secrets) == 0 {
+		secrets = []string{conf.Options.Security.SessionKey}
+	}
+	legacy := ""
+	if conf.Options.Security.LegacyCookies {
+		legacy = conf.Options.Security.SessionKey
+	}
+	config := legacy + "\x00" + strings.Join(secrets, "\x00")
+	cookieKeys.Lock()
+	defer cookieKeys.Unlock()
+	if cookieKeys.keyring == nil || cookieKeys.config != config {
+		k, err := util.NewKeyring(legacy, secrets...)
+		if err != nil {
+			return nil, err
+		}
+		cookieKeys.config, cookieKeys.keyring = config, k
+	}
+	return cookieKeys.keyring, nil
+}
+
+// newCSRFToken returns the encrypted value of the CSRF cookie and header
+func newCSRFToken() (string, error) {
+	k, err := cookieKeyring()
+	if err != nil {
+		return "", err
+	}
+	return k.Seal([]byte(noXSRFAllowed + time.Now().String()))
+}
+
+// validCSRFToken checks that the token was created by newCSRFToken
+func validCSRFToken(token string) error {
+	k, err := cookieKeyring()
+	if err != nil {
+		return err
+	}
+	val, err := k.Open(token)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(val), noXSRFAllowed) {
+		return util.ErrSealed
+	}
+	return nil
+}
+
+// sealCookie encrypts the object for a cookie with the newest key
+func sealCookie(v interface{}) (string, error) {
+	k, err := cookieKeyring()
+	if err != nil {
+		return "", err
+	}
+	return k.SealJSON(v)
+}
+
+// openCookie decrypts the cookie value sealed with any of the keys into the object
+func openCookie(value string, v interface{}) error {
+	k, err := cookieKeyring()
+	if err != nil {
+		return err
+	}
+	return k.OpenJSON(value, v)
+}
@@ -3,31 +3,180 @@ package web
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"fmt"
+	"html/template"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/Masterminds/semver"
 	log "github.com/Sirupsen/logrus"
 	"github.com/demisto/download/conf"
 	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
 	"github.com/gorilla/context"
 )
 
-// doCheckDownload is the common function between the cookie and parameters check
-func (ac *AppContext) doCheckDownload(u *domain.User, w http.ResponseWriter, r *http.Request) {
-	if u.Type == domain.UserTypeUser {
+const (
+	// downloadLinkPath is where emailed download links point to
+	downloadLinkPath = "/download-link"
+	// downloadParamsPath downloads with the token and email parameters
+	downloadParamsPath = "/download-params"
+)
+
+// downloadLinkPage asks the customer to confirm the download. Mail scanners and browsers prefetch links with GET so
+// the download is only taken when the form is posted.
+var downloadLinkPage = template.Must(template.New("download-link").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="referrer" content="no-referrer">
+<title>Demisto downloads</title>
+<link rel="stylesheet" href="/style.css">
+</head>
+<body>
+<form method="POST" action="{{.Action}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="hidden" name="email" value="{{.Email}}">
+{{if .Download}}<input type="hidden" name="downloadName" value="{{.Download}}">
+{{end}}<input type="hidden" name="` + xsrfField + `" value="{{.CSRF}}">
+<p>Download {{if .Download}}{{.Download}}{{else}}Demisto{{end}} as {{.Email}}?</p>
+<button type="submit">Download</button>
+</form>
+</body>
+</html>
+`))
+
+// entitlement is what allows a customer user to download - a token, an organization pool or both.
+// If the user belongs to an organization, the downloads are drawn from the organization pool and the
+// token is only used for its activation window and scope.
+type entitlement struct {
+	token *domain.Token
+	org   *domain.Organization
+}
+
+// scoped checks if the entitlement depends on the actual download
+func (e *entitlement) scoped() bool {
+	return e.token != nil && (len(e.token.Scope) > 0 || e.token.Versions != "") ||
+		e.org != nil && (len(e.org.Scope) > 0 || e.org.Versions != "")
+}
+
+// allows checks that both the token and the organization allow the download
+func (e *entitlement) allows(d *domain.Download) error {
+	if e.token != nil {
+		if err := e.token.Allows(d); err != nil {
+			return err
+		}
+	}
+	if e.org != nil {
+		return e.org.Allows(d)
+	}
+	return nil
+}
+
+// userEntitlement loads the token and organization of the user and makes sure they can be used right now.
+// If not, the relevant error is written and nil is returned.
+func (ac *AppContext) userEntitlement(u *domain.User, w http.ResponseWriter) *entitlement {
+	e := &entitlement{}
+	now := time.Now()
+	if u.Token != "" {
 		token, err := ac.r.Token(u.Token)
 		if err != nil {
 			log.WithError(err).Errorf("Something is really weird - no token for %#v", u)
 			WriteError(w, ErrInternalServer)
-			return
+			return nil
 		}
-		// Token all used up
-		if token.Downloads < 1 {
-			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid Token", Detail: "Token is fully used and no longer allowed to download"})
+		if u.Organization == "" {
+			err = token.Valid(now)
+		} else {
+			err = token.Active(now)
+		}
+		if err != nil {
+			WriteError(w, tokenError(token, err))
+			return nil
+		}
+		e.token = token
+	}
+	if u.Organization != "" {
+		org, err := ac.r.Organization(u.Organization)
+		if err != nil {
+			log.WithError(err).Errorf("Unable to load organization of %#v", u)
+			WriteError(w, ErrInternalServer)
+			return nil
+		}
+		if err = org.Valid(); err != nil {
+			WriteError(w, tokenError(e.token, err))
+			return nil
+		}
+		e.org = org
+	}
+	// Single sign-on and directory users are created without a token until an admin assigns one
+	if e.token == nil && e.org == nil {
+		log.Infof("User %s has no token or organization to download with", u.Username)
+		WriteError(w, ErrNoEntitlement)
+		return nil
+	}
+	return e
+}
+
+// tokenError translates token validation errors to the relevant web error
+func tokenError(token *domain.Token, err error) *Error {
+	switch err {
+	case domain.ErrTokenNotActive:
+		return &Error{ID: "token_not_active", Status: 403, Title: "Token Not Active", Detail: fmt.Sprintf("Token is not active until %s", token.NotBefore.UTC().Format(time.RFC3339))}
+	case domain.ErrTokenExpired:
+		detail := "Token has expired and is no longer allowed to download"
+		if token.ExpiresAt != nil {
+			detail = fmt.Sprintf("Token expired at %s and is no longer allowed to download", token.ExpiresAt.UTC().Format(time.RFC3339))
+		}
+		return &Error{ID: "token_expired", Status: 403, Title: "Token Expired", Detail: detail}
+	case domain.ErrTokenRevoked:
+		return &Error{ID: "token_revoked", Status: 403, Title: "Token Revoked", Detail: err.Error()}
+	case domain.ErrPoolUsed:
+		return &Error{ID: "bad_request", Status: 400, Title: "Download Pool Used", Detail: err.Error()}
+	case domain.ErrDownloadNotInScope, domain.ErrVersionNotInScope:
+		return &Error{ID: "not_in_scope", Status: 403, Title: "Download Not Allowed", Detail: err.Error()}
+	default:
+		return &Error{ID: "bad_request", Status: 400, Title: "Invalid Token", Detail: err.Error()}
+	}
+}
+
+// requestedDownload returns the name of the download requested by the parameters
+func requestedDownload(r *http.Request) string {
+	downloadName := "free"
+	if r.FormValue("ova") != "" {
+		downloadName = "ova"
+	} else if r.FormValue("ovf") != "" {
+		downloadName = "ovf"
+	} else if r.FormValue("downloadName") != "" {
+		downloadName = r.FormValue("downloadName")
+	}
+	return downloadName
+}
+
+// doCheckDownload is the common function between the cookie and parameters check
+func (ac *AppContext) doCheckDownload(u *domain.User, w http.ResponseWriter, r *http.Request) {
+	if u.Type == domain.UserTypeUser {
+		e := ac.userEntitlement(u, w)
+		if e == nil {
 			return
 		}
+		// Only scoped entitlements care about the actual download
+		if e.scoped() {
+			downloadName := requestedDownload(r)
+			d, err := ac.r.Download(downloadName)
+			if err != nil {
+				log.WithError(err).Errorf("Unable to load download %s", downloadName)
+				WriteError(w, ErrInternalServer)
+				return
+			}
+			if err = e.allows(d); err != nil {
+				WriteError(w, tokenError(e.token, err))
+				return
+			}
+		}
 	}
 	writeJSON(w, map[string]bool{"result": true})
 }
@@ -38,60 +187,85 @@ func (ac *AppContext) checkDownloadHandler(w http.ResponseWriter, r *http.Reques
 	ac.doCheckDownload(u, w, r)
 }
 
-// checkDownloadParamsHandler checks if the download parameters are valid
-func (ac *AppContext) checkDownloadParamsHandler(w http.ResponseWriter, r *http.Request) {
+// paramsUser loads the customer user based on the token and email parameters.
+// If the user does not exist, the relevant error is written and nil is returned.
+func (ac *AppContext) paramsUser(w http.ResponseWriter, r *http.Request) *domain.User {
 	email := r.FormValue("email")
 	token := r.FormValue("token")
 	if email == "" || token == "" {
 		WriteError(w, ErrMissingPartRequest)
-		return
+		return nil
+	}
+	// Catch typos and garbage without hitting the DB
+	if domain.IsFormattedToken(token) && !domain.ValidTokenFormat(token) {
+		WriteError(w, ErrMalformedToken)
+		return nil
 	}
-	u, err := ac.r.User(token + "*-*" + email)
+	if ac.throttled(w, addressKey(r)) {
+		return nil
+	}
+	u, err := ac.r.User(domain.TokenUsername(domain.TokenDigest(token), email))
 	if err != nil {
-		log.WithError(err).Errorf("Trying to load user that does not exist for download [%s %s]", token, email)
+		log.WithError(err).Errorf("Trying to load user that does not exist for download [%s %s]", domain.TokenHint(token), email)
+		if err == repo.ErrNotFound {
+			ac.attemptFailed(addressThrottle, addressKey(r))
+		}
 		WriteError(w, ErrAuth)
-		return
+		return nil
+	}
+	if u.Disabled {
+		WriteError(w, ErrUserDisabled)
+		return nil
+	}
+	return u
+}
+
+// checkDownloadParamsHandler checks if the download parameters are valid
+func (ac *AppContext) checkDownloadParamsHandler(w http.ResponseWriter, r *http.Request) {
+	if u := ac.paramsUser(w, r); u != nil {
+		ac.doCheckDownload(u, w, r)
 	}
-	ac.doCheckDownload(u, w, r)
 }
 
 // doDownload handles the actual download with either cookie or params
 func (ac *AppContext) doDownload(u *domain.User, w http.ResponseWriter, r *http.Request) {
-	var token *domain.Token
+	var e *entitlement
 	if u.Type == domain.UserTypeUser {
-		var err error
-		token, err = ac.r.Token(u.Token)
-		if err != nil {
-			log.WithError(err).Errorf("Something is really weird - no token for %#v", u)
-			WriteError(w, ErrInternalServer)
-			return
-		}
-		// Token all used up
-		if token.Downloads < 1 {
-			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid Token", Detail: "Token is fully used and no longer allowed to download"})
+		if e = ac.userEntitlement(u, w); e == nil {
 			return
 		}
 	}
-	downloadName := "free"
-	if r.FormValue("ova") != "" {
-		downloadName = "ova"
-	} else if r.FormValue("ovf") != "" {
-		downloadName = "ovf"
-	} else if r.FormValue("downloadName") != "" {
-		downloadName = r.FormValue("downloadName")
-	}
-
+	downloadName := requestedDownload(r)
 	d, err := ac.r.Download(downloadName)
 	if err != nil {
 		log.WithError(err).Errorf("Unable to load download %s", downloadName)
 		WriteError(w, ErrInternalServer)
 		return
 	}
+	if e != nil {
+		if err = e.allows(d); err != nil {
+			log.Warnf("User [%s] is not allowed to download [%s %s]", u.Username, d.Name, d.Version)
+			WriteError(w, tokenError(e.token, err))
+			return
+		}
+	}
 	if d.Username != "" && u.Username != d.Username {
 		log.Errorf("download [%s] is restricted to user [%s] but user [%s] tried to download", downloadName, d.Username, u.Username)
 		WriteError(w, ErrBadRequest)
 		return
 	}
+	// The downloads are taken before serving to avoid going over the token or the shared organization pool
+	if e != nil {
+		err = ac.consume(u, e)
+		if err == domain.ErrPoolUsed || err == domain.ErrTokenUsed {
+			WriteError(w, tokenError(e.token, err))
+			return
+		} else if err != nil {
+			log.WithError(err).Errorf("Unable to take download for %s", u.Username)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+	}
 	absFile, err := filepath.Abs(d.Path)
 	if err != nil {
 		log.WithError(err).Errorf("Something wrong with the file path - %#v", d)
@@ -104,13 +278,6 @@ func (ac *AppContext) doDownload(u *domain.User, w http.ResponseWriter, r *http.
 	w.Header().Set("Content-Disposition", "attachment; filename="+name)
 	fileServer := http.FileServer(http.Dir(dir))
 	fileServer.ServeHTTP(w, r)
-	if token != nil {
-		token.Downloads--
-		err = ac.r.SetToken(token)
-		if err != nil {
-			log.WithError(err).Errorf("Could not update token in the database - %#v", token)
-		}
-	}
 	// Just log the download
 	err = ac.r.LogDownload(u, d, r.RemoteAddr)
 	if err != nil {
@@ -118,27 +285,50 @@ func (ac *AppContext) doDownload(u *domain.User, w http.ResponseWriter, r *http.
 	}
 }
 
+// consume takes a download from the organization pool if the user belongs to one or from the token otherwise.
+// Token downloads go through the ledger.
+func (ac *AppContext) consume(u *domain.User, e *entitlement) error {
+	now := time.Now()
+	if e.org != nil {
+		if err := ac.r.ConsumeOrganizationDownload(e.org.Name); err != nil {
+			return err
+		}
+		if e.token == nil {
+			return nil
+		}
+		e.token.LastUsed = &now
+		return ac.r.TouchToken(e.token.Name, now)
+	}
+	_, err := ac.r.AdjustToken(&domain.TokenEvent{Token: e.token.Name, Type: domain.TokenEventConsumed, Delta: -1, Actor: u.Username, CreatedAt: now})
+	return err
+}
+
 // downloadHandler returns the install file
 func (ac *AppContext) downloadHandler(w http.ResponseWriter, r *http.Request) {
 	u := context.Get(r, "user").(*domain.User)
 	ac.doDownload(u, w, r)
 }
 
-// downloadParamsHandler returns the install file using parameters
-func (ac *AppContext) downloadParamsHandler(w http.ResponseWriter, r *http.Request) {
-	email := r.FormValue("email")
-	token := r.FormValue("token")
-	if email == "" || token == "" {
-		WriteError(w, ErrMissingPartRequest)
+// downloadLinkHandler shows the page that confirms the download of an emailed link. Nothing is downloaded yet.
+func (ac *AppContext) downloadLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if ac.paramsUser(w, r) == nil {
 		return
 	}
-	u, err := ac.r.User(token + "*-*" + email)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	err := downloadLinkPage.Execute(w, map[string]string{"Action": downloadParamsPath, "Token": r.FormValue("token"),
+		"Email": r.FormValue("email"), "Download": r.FormValue("downloadName"), "CSRF": csrfToken(r)})
 	if err != nil {
-		log.WithError(err).Errorf("Trying to load user that does not exist for download [%s %s]", token, email)
-		WriteError(w, ErrAuth)
-		return
+		log.WithError(err).Error("Unable to render the download page")
+	}
+}
+
+// downloadParamsHandler returns the install file using parameters. It is also the target of the download page.
+func (ac *AppContext) downloadParamsHandler(w http.ResponseWriter, r *http.Request) {
+	if u := ac.paramsUser(w, r); u != nil {
+		ac.doDownload(u, w, r)
 	}
-	ac.doDownload(u, w, r)
 }
 
 // uploadHandler allows an admin to upload a new file
@@ -160,6 +350,14 @@ func (ac *AppContext) uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if gitHash == "" {
 		gitHash = "N/A"
 	}
+	version := r.FormValue("version")
+	if version != "" {
+		if _, err = semver.NewVersion(version); err != nil {
+			log.WithError(err).Errorf("Received invalid version - %s", version)
+			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid Version", Detail: "Version must be a valid semantic version"})
+			return
+		}
+	}
 	username := r.FormValue("username")
 	// Just to be on the safe side
 	finalFileName := filepath.Base(filename)
@@ -184,17 +382,22 @@ func (ac *AppContext) uploadHandler(w http.ResponseWriter, r *http.Request) {
 		WriteError(w, ErrInternalServer)
 		return
 	}
-	err = ac.r.SetDownload(&domain.Download{
+	// The previous version is only needed for the audit log so failing to load it does not fail the upload
+	before, _ := ac.r.Download(downloadName)
+	d := &domain.Download{
 		Name: downloadName,
 		Path: finalPath,
 		SHA256: base64.StdEncoding.EncodeToString(h.Sum(nil)),
 		GitHash: gitHash,
+		Version: version,
 		Username: username,
-	})
+	}
+	err = ac.r.SetDownload(d)
 	if err != nil {
 		log.WithError(err).Error("Error saving download to DB")
 		WriteError(w, ErrInternalServer)
 		return
 	}
+	auditChange(r, downloadName, before, d)
 	writeJSON(w, map[string]bool{"result": true})
 }
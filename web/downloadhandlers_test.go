@@ -0,0 +1,20 @@
+package web
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/demisto/download/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserEntitlementWithoutTokenOrOrganization(t *testing.T) {
+	ac := &AppContext{}
+	for _, source := range []string{domain.UserSourceOIDC, domain.UserSourceLDAP} {
+		rec := httptest.NewRecorder()
+		e := ac.userEntitlement(&domain.User{Username: "sso", Type: domain.UserTypeUser, Source: source}, rec)
+		assert.Nil(t, e)
+		assert.Equal(t, ErrNoEntitlement.Status, rec.Code, source)
+		assert.Contains(t, rec.Body.String(), ErrNoEntitlement.ID)
+	}
+}
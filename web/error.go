@@ -38,14 +38,42 @@ var (
 	ErrAuth = &Error{"unauthorized", 401, "Unauthorized", "The request requires authorization"}
 	// ErrPermission if not authenticated
 	ErrPermission = &Error{"forbidden", 403, "Forbidden", "The request requires the right permissions"}
+	// ErrNoEntitlement if a customer has neither a token nor an organization to download with
+	ErrNoEntitlement = &Error{"no_entitlement", 403, "No Entitlement", "The user has no token or organization that allows downloads"}
+	// ErrUserDisabled if an admin disabled the user
+	ErrUserDisabled = &Error{"user_disabled", 403, "User Disabled", "The user was disabled"}
 	// ErrCredentials if there are missing / wrong credentials
 	ErrCredentials = &Error{"invalid_credentials", 401, "Invalid credentials", "Invalid username or password"}
 	// ErrNotAcceptable wrong accept header
 	ErrNotAcceptable = &Error{"not_acceptable", 406, "Not Acceptable", "Accept header must be set to 'application/json'."}
 	// ErrUnsupportedMediaType wrong media type
 	ErrUnsupportedMediaType = &Error{"unsupported_media_type", 415, "Unsupported Media Type", "Content-Type header must be set to: 'application/json'."}
+	// ErrPasswordChangeRequired if the user must change the password before doing anything else
+	ErrPasswordChangeRequired = &Error{"password_change_required", 403, "Password Change Required", "Please change your password to continue"}
+	// ErrTOTPRequired if the admin must enroll in two factor authentication before doing anything else
+	ErrTOTPRequired = &Error{"totp_required", 403, "Two Factor Authentication Required", "Please enable two factor authentication to continue"}
+	// ErrInvalidOTP if the one time password or recovery code is wrong
+	ErrInvalidOTP = &Error{"invalid_otp", 401, "Invalid Code", "The code is invalid or was already used"}
+	// ErrTooManyAttempts if the address or account is locked after too many failures
+	ErrTooManyAttempts = &Error{"too_many_attempts", 429, "Too Many Attempts", "Too many failed attempts. Please try again later."}
+	// ErrOTPLocked if there were too many wrong codes
+	ErrOTPLocked = &Error{"otp_locked", 429, "Too Many Attempts", "Too many invalid codes. Please try again later."}
+	// ErrWebAuthn if a WebAuthn ceremony fails
+	ErrWebAuthn = &Error{"webauthn_failed", 401, "Authentication Failed", "The security key or passkey could not be verified"}
+	// ErrAPIKeyScope if the API key is not allowed to access the route
+	ErrAPIKeyScope = &Error{"api_key_scope", 403, "Forbidden", "The API key is not allowed to access this resource"}
 	// ErrCSRF missing CSRF cookie or parameter
 	ErrCSRF = &Error{"forbidden", 403, "Forbidden", "Issue with CSRF code"}
+	// ErrInvalidTokenWindow if the token activation window does not make sense
+	ErrInvalidTokenWindow = &Error{"bad_request", 400, "Invalid Token Window", "Token expiration must be in the future and after the activation time"}
+	// ErrMalformedToken if the token does not match the token format
+	ErrMalformedToken = &Error{"malformed_token", 400, "Malformed Token", "The token is malformed. Please make sure it was copied correctly."}
+	// ErrIdempotencyKeyReused if the idempotency key was used for a different request
+	ErrIdempotencyKeyReused = &Error{"idempotency_key_reused", 422, "Idempotency Key Reused", "The idempotency key was already used for a different request"}
+	// ErrIdempotencyKeyInProgress if the original request with the idempotency key did not complete yet
+	ErrIdempotencyKeyInProgress = &Error{"idempotency_key_in_progress", 409, "Request In Progress", "A request with the same idempotency key is still in progress"}
+	// ErrNotFound if the requested resource does not exist
+	ErrNotFound = &Error{"not_found", 404, "Not Found", "The requested resource does not exist"}
 	// ErrInternalServer if things go wrong on our side
 	ErrInternalServer = &Error{"internal_server_error", 500, "Internal Server Error", "Something went wrong."}
 )
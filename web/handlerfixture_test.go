@@ -6,11 +6,9 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
-	"time"
 
 	"github.com/demisto/download/conf"
 	"github.com/demisto/download/repo"
-	"github.com/demisto/download/util"
 	"github.com/gorilla/context"
 	"github.com/justinas/alice"
 )
@@ -55,7 +53,10 @@ func create(t *testing.T, confFile string) *HandlerFixture {
 	if err != nil {
 		t.Fatal(err)
 	}
-	hf.appcontext = NewContext(hf.r)
+	hf.appcontext, err = NewContext(hf.r)
+	if err != nil {
+		t.Fatal(err)
+	}
 	hf.handlers = alice.New(context.ClearHandler, recoverHandler)
 	hf.router = New(hf.appcontext, filepath.Join(wd, "static"))
 	hf.response = httptest.NewRecorder()
@@ -83,8 +84,7 @@ func (hf *HandlerFixture) sendGeneralRequest(req *http.Request, isSessionCookie
 	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", contentType)
-	pass := conf.Options.Security.SessionKey
-	val, cErr := util.Encrypt(noXSRFAllowed+time.Now().String(), []byte(pass))
+	val, cErr := newCSRFToken()
 	if cErr == nil {
 		req.AddCookie(&http.Cookie{Name: xsrfCookie, Value: val})
 		req.Header.Set(xsrfHeader, val)
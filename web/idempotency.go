@@ -0,0 +1,140 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/domain"
+	"github.com/gorilla/context"
+)
+
+const (
+	// idempotencyKeyHeader is the header clients use to safely retry requests
+	idempotencyKeyHeader = "Idempotency-Key"
+	// maxIdempotencyKey is the max length of an idempotency key
+	maxIdempotencyKey = 255
+)
+
+// recordingResponseWriter keeps a copy of the response so it can be stored
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// requestFingerprint is a digest of the method, path and body of the request
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sealIdempotentBody encrypts the response body with the cookie keyring before it is stored as it can include plain tokens
+func sealIdempotentBody(body []byte) ([]byte, error) {
+	k, err := cookieKeyring()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := k.Seal(body)
+	return []byte(sealed), err
+}
+
+// openIdempotentBody decrypts a response body sealed by sealIdempotentBody
+func openIdempotentBody(sealed []byte) ([]byte, error) {
+	k, err := cookieKeyring()
+	if err != nil {
+		return nil, err
+	}
+	return k.Open(string(sealed))
+}
+
+// idempotencyHandler replays the stored response for requests repeating an Idempotency-Key header of the same user.
+// Requests without the header are handled as usual. Responses of failed requests (5xx) are not stored so they can be retried.
+// The stored body is sealed so plain tokens are never kept in the database.
+// Must come after the auth handler and before the body handler.
+func (ac *AppContext) idempotencyHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid Idempotency Key", Detail: "Idempotency key is too long"})
+			return
+		}
+		u := context.Get(r, "user").(*domain.User)
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.WithError(err).Warn("Unable to read request body")
+			WriteError(w, ErrBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp := &domain.IdempotentResponse{Key: key, Username: u.Username, Request: requestFingerprint(r, body)}
+		existing, err := ac.r.ReserveIdempotencyKey(resp)
+		if err != nil {
+			log.WithError(err).Errorf("Unable to reserve idempotency key %s", key)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+		if existing != nil {
+			switch {
+			case existing.Request != resp.Request:
+				WriteError(w, ErrIdempotencyKeyReused)
+			case !existing.Done():
+				WriteError(w, ErrIdempotencyKeyInProgress)
+			default:
+				body, err := openIdempotentBody(existing.Body)
+				if err != nil {
+					log.WithError(err).Errorf("Unable to open response of idempotency key %s", key)
+					WriteError(w, ErrInternalServer)
+					return
+				}
+				log.Infof("Replaying response for idempotency key %s of %s", key, u.Username)
+				w.Header().Set("Content-Type", existing.ContentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.Status)
+				w.Write(body)
+			}
+			return
+		}
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		defer func() {
+			if rw.status != 0 && rw.status < 500 {
+				if resp.Body, err = sealIdempotentBody(rw.body.Bytes()); err == nil {
+					resp.Status, resp.ContentType = rw.status, rw.Header().Get("Content-Type")
+					if err = ac.r.SetIdempotentResponse(resp); err == nil {
+						return
+					}
+				}
+				log.WithError(err).Errorf("Unable to save response of idempotency key %s", key)
+			}
+			// Release the key so the request can be retried
+			if err = ac.r.DeleteIdempotencyKey(resp.Username, resp.Key); err != nil {
+				log.WithError(err).Errorf("Unable to release idempotency key %s", key)
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
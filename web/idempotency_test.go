@@ -0,0 +1,74 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/demisto/download/domain"
+	"github.com/gorilla/context"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyHandler(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+
+	calls := 0
+	started, release := make(chan struct{}), make(chan struct{})
+	h := context.ClearHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		context.Set(r, "user", &domain.User{Username: "idempotent"})
+		f.appcontext.idempotencyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if r.URL.Query().Get("block") == "true" {
+				started <- struct{}{}
+				<-release
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"token":"plain-secret-%d"}`, calls)
+		})).ServeHTTP(w, r)
+	}))
+	send := func(key, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(body))
+		req.Header.Set(idempotencyKeyHeader, key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	f.r.DeleteIdempotencyKey("idempotent", "replay")
+	f.r.DeleteIdempotencyKey("idempotent", "slow")
+
+	first := send("replay", "http://demisto.com/tokens/generate", `{"count":1}`)
+	assert.Equal(t, http.StatusOK, first.Code)
+	replay := send("replay", "http://demisto.com/tokens/generate", `{"count":1}`)
+	assert.Equal(t, http.StatusOK, replay.Code)
+	assert.Equal(t, "true", replay.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first.Body.String(), replay.Body.String(), "the original response must be replayed")
+	assert.Equal(t, 1, calls, "a replayed request must not be handled again")
+
+	reused := send("replay", "http://demisto.com/tokens/generate", `{"count":2}`)
+	assert.Equal(t, ErrIdempotencyKeyReused.Status, reused.Code)
+	assert.Contains(t, reused.Body.String(), ErrIdempotencyKeyReused.ID)
+
+	// The stored body is sealed so the plain tokens are not kept in the database
+	req, _ := http.NewRequest("POST", "http://demisto.com/tokens/generate", nil)
+	stored, err := f.r.ReserveIdempotencyKey(&domain.IdempotentResponse{Key: "replay", Username: "idempotent", Request: requestFingerprint(req, []byte(`{"count":1}`))})
+	if assert.NoError(t, err) && assert.NotNil(t, stored) {
+		assert.False(t, strings.Contains(string(stored.Body), "plain-secret"))
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- send("slow", "http://demisto.com/tokens/generate?block=true", `{"count":1}`)
+	}()
+	<-started
+	inProgress := send("slow", "http://demisto.com/tokens/generate?block=true", `{"count":1}`)
+	assert.Equal(t, ErrIdempotencyKeyInProgress.Status, inProgress.Code)
+	assert.Contains(t, inProgress.Body.String(), ErrIdempotencyKeyInProgress.ID)
+	close(release)
+	assert.Equal(t, http.StatusOK, (<-done).Code)
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,220 @@
+package web
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+	"github.com/gorilla/context"
+)
+
+const (
+	// loginLinkPath is where emailed sign-in links point to
+	loginLinkPath = "/login/link"
+	// loginLinkConfirmPath is where the sign-in page posts the link to
+	loginLinkConfirmPath = "/login/link/confirm"
+)
+
+var (
+	// linkThrottle limits how many sign-in links are sent to an email so the link cannot be used to spam customers
+	linkThrottle = &domain.Throttle{MaxFailures: 3, Window: 15 * time.Minute, Lockout: 15 * time.Minute, MaxLockout: time.Hour}
+	// linkAddressThrottle limits how many links and reset codes a single address asks for. Every request counts so it
+	// is kept apart from addressThrottle, which would lock the address out of password login.
+	linkAddressThrottle = &domain.Throttle{MaxFailures: 20, Window: 15 * time.Minute, Lockout: 15 * time.Minute, MaxLockout: time.Hour}
+)
+
+// loginLinkPage asks the customer to confirm the sign-in. Mail scanners and browsers prefetch links with GET so the
+// link is only used when the form is posted.
+var loginLinkPage = template.Must(template.New("login-link").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="referrer" content="no-referrer">
+<title>Sign in to Demisto downloads</title>
+<link rel="stylesheet" href="/style.css">
+</head>
+<body>
+<form method="POST" action="{{.Action}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="hidden" name="` + xsrfField + `" value="{{.CSRF}}">
+<p>Sign in to Demisto downloads as {{.Email}}?</p>
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+type loginLinkRequest struct {
+	Email string `json:"email"`
+}
+
+func linkKey(email string) string {
+	return attemptsKey("link", strings.ToLower(email))
+}
+
+func linkAddressKey(r *http.Request) string {
+	return attemptsKey("link-ip", remoteIP(r))
+}
+
+// requestLoginLinkHandler emails a one time sign-in link to the customer with the email. The response is the same
+// whether the customer exists or not so it cannot be used to find customers.
+func (ac *AppContext) requestLoginLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if ac.mailer == nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	body := context.Get(r, "body").(*loginLinkRequest)
+	if body.Email == "" {
+		WriteError(w, ErrMissingPartRequest)
+		return
+	}
+	if ac.throttled(w, linkAddressKey(r), linkKey(body.Email)) {
+		return
+	}
+	// Every request counts, not just failures
+	ac.attemptFailed(linkAddressThrottle, linkAddressKey(r))
+	ac.attemptFailed(linkThrottle, linkKey(body.Email))
+	u, err := ac.r.CustomerByEmail(body.Email)
+	if err == repo.ErrNotFound {
+		log.Infof("Sign-in link requested for unknown email %s", body.Email)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to load customer with email %s", body.Email)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	l := domain.NewLoginLink(u.Username, domain.LoginLinkSignIn)
+	if err = ac.r.DeleteExpiredLoginLinks(l.CreatedAt); err != nil {
+		log.WithError(err).Warn("Unable to delete expired sign-in links")
+	}
+	if err = ac.r.AddLoginLink(l); err != nil {
+		log.WithError(err).Errorf("Unable to save sign-in link of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	// Sending takes a while so it is done in the background to not reveal that the customer exists
+	go ac.sendLoginLink(u, l)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loginLink returns the valid link of the given kind. If the link is unknown, used, expired or of another kind,
+// the error is written and nil is returned.
+func (ac *AppContext) loginLink(w http.ResponseWriter, r *http.Request, token, kind string) *domain.LoginLink {
+	if ac.throttled(w, addressKey(r)) {
+		return nil
+	}
+	l, err := ac.r.LoginLink(domain.TokenDigest(token))
+	if err == repo.ErrNotFound {
+		log.Warnf("Unknown or used %s link", kind)
+		ac.attemptFailed(addressThrottle, addressKey(r))
+		WriteError(w, ErrAuth)
+		return nil
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to load %s link", kind)
+		WriteError(w, ErrInternalServer)
+		return nil
+	}
+	if err = l.Valid(kind, time.Now()); err != nil {
+		log.Warnf("Invalid %s link of %s - %v", kind, l.Username, err)
+		WriteError(w, ErrAuth)
+		return nil
+	}
+	return l
+}
+
+// useLoginLink deletes the link so it cannot be used again. If a concurrent request already used it, ErrAuth is
+// written and false is returned.
+func (ac *AppContext) useLoginLink(w http.ResponseWriter, l *domain.LoginLink) bool {
+	switch err := ac.r.UseLoginLink(l.ID); err {
+	case nil:
+		return true
+	case repo.ErrNotFound:
+		WriteError(w, ErrAuth)
+	default:
+		log.WithError(err).Errorf("Unable to use %s link of %s", l.Kind, l.Username)
+		WriteError(w, ErrInternalServer)
+	}
+	return false
+}
+
+func (ac *AppContext) sendLoginLink(u *domain.User, l *domain.LoginLink) {
+	link := strings.TrimRight(conf.Options.ExternalAddress, "/") + loginLinkPath + "?" + url.Values{"token": {l.Plain}}.Encode()
+	ac.sendEmail(mailSignIn, nil, u, &mailData{Link: link, Minutes: int(domain.LoginLinkTimeout / time.Minute), Organization: u.Organization})
+}
+
+// loginLinkHandler shows the page that confirms the sign-in with the emailed link. The link is not used yet.
+func (ac *AppContext) loginLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if ac.mailer == nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		WriteError(w, ErrMissingPartRequest)
+		return
+	}
+	l := ac.loginLink(w, r, token, domain.LoginLinkSignIn)
+	if l == nil {
+		return
+	}
+	u, err := ac.r.User(l.Username)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to load user %s of sign-in link", l.Username)
+		WriteError(w, ErrAuth)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	err = loginLinkPage.Execute(w, map[string]string{"Action": loginLinkConfirmPath, "Token": token, "CSRF": csrfToken(r), "Email": u.Email})
+	if err != nil {
+		log.WithError(err).Error("Unable to render the sign-in page")
+	}
+}
+
+// confirmLoginLinkHandler signs the customer in with the link posted by the sign-in page and redirects to the
+// landing page. Customers with TOTP get the one time password challenge instead.
+func (ac *AppContext) confirmLoginLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if ac.mailer == nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	token := r.PostFormValue("token")
+	if token == "" {
+		WriteError(w, ErrMissingPartRequest)
+		return
+	}
+	l := ac.loginLink(w, r, token, domain.LoginLinkSignIn)
+	if l == nil || !ac.useLoginLink(w, l) {
+		return
+	}
+	u, err := ac.r.User(l.Username)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to load user %s of sign-in link", l.Username)
+		WriteError(w, ErrAuth)
+		return
+	}
+	// Links are only sent to local customers but the user may have been linked to an IdP since
+	if u.Source != "" {
+		log.Warnf("Sign-in link used by %s who must sign in with %s", u.Username, u.Source)
+		WriteError(w, ErrAuth)
+		return
+	}
+	// The link replaces the password, not the second factor
+	if u.TOTPEnabled {
+		ac.otpChallenge(w, u)
+		return
+	}
+	if e := ac.startSession(w, r, u); e != nil {
+		WriteError(w, e)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
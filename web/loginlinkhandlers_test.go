@@ -0,0 +1,187 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpStandIn is a local SMTP server that accepts any message and passes its decoded body to the test
+type smtpStandIn struct {
+	l      net.Listener
+	bodies chan string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{l: l, bodies: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("220 localhost ESMTP\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case cmd == "DATA":
+			conn.Write([]byte("354 Go ahead\r\n"))
+			data := &bytes.Buffer{}
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			if msg, err := mail.ReadMessage(data); err == nil {
+				body, _ := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+				s.bodies <- string(body)
+			}
+			conn.Write([]byte("250 Queued\r\n"))
+		case cmd == "QUIT":
+			conn.Write([]byte("221 Bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("250 OK\r\n"))
+		}
+	}
+}
+
+// body waits for the next email
+func (s *smtpStandIn) body(t *testing.T) string {
+	select {
+	case b := <-s.bodies:
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatal("No email was sent")
+	}
+	return ""
+}
+
+func TestLoginLink(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+	s := newSMTPStandIn(t)
+	defer s.l.Close()
+	f.appcontext.mailer = &util.Mailer{Address: s.l.Addr().String(), From: "noreply@demisto.com"}
+	f.r.DeleteAttempts(linkKey("link@example.com"))
+	f.r.DeleteAttempts(attemptsKey("ip", ""))
+	f.r.DeleteAttempts(attemptsKey("link-ip", ""))
+	u := &domain.User{Username: "link-customer", Email: "link@example.com", Name: "Link", Type: domain.UserTypeUser}
+	if err := f.r.SetUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "http://demisto.com/login/link", bytes.NewBufferString(`{"email":"nobody@example.com"}`))
+	f.sendRequest(req, false, "")
+	assert.Equal(t, http.StatusNoContent, f.response.Code, "unknown emails must look the same")
+
+	req, _ = http.NewRequest("POST", "http://demisto.com/login/link", bytes.NewBufferString(`{"email":"link@example.com"}`))
+	f.sendRequest(req, false, "")
+	assert.Equal(t, http.StatusNoContent, f.response.Code)
+	m := regexp.MustCompile(`/login/link\?token=([A-Za-z0-9]+)`).FindStringSubmatch(s.body(t))
+	if m == nil {
+		t.Fatal("No sign-in link in the email")
+	}
+
+	// Opening the link only shows the page, so scanners that follow it do not use it up
+	for i := 0; i < 2; i++ {
+		req, _ = http.NewRequest("GET", "http://demisto.com/login/link?token="+m[1], nil)
+		f.sendRequest(req, false, "")
+		assert.Equal(t, http.StatusOK, f.response.Code)
+		assert.Contains(t, f.response.Body.String(), `action="/login/link/confirm"`)
+		assert.Contains(t, f.response.Body.String(), `value="`+m[1]+`"`)
+	}
+
+	form := "token=" + m[1]
+	req, _ = http.NewRequest("POST", "http://demisto.com/login/link/confirm", bytes.NewBufferString(form))
+	f.sendGeneralRequest(req, false, "", "application/x-www-form-urlencoded")
+	assert.Equal(t, http.StatusSeeOther, f.response.Code)
+	var sessionValue string
+	for _, c := range f.response.Result().Cookies() {
+		if c.Name == sessionCookie {
+			sessionValue = c.Value
+		}
+	}
+	req, _ = http.NewRequest("GET", "http://demisto.com/user", nil)
+	f.sendRequest(req, true, sessionValue)
+	assert.Equal(t, http.StatusOK, f.response.Code, "the link must create a session")
+
+	req, _ = http.NewRequest("POST", "http://demisto.com/login/link/confirm", bytes.NewBufferString(form))
+	f.sendGeneralRequest(req, false, "", "application/x-www-form-urlencoded")
+	assert.Equal(t, http.StatusUnauthorized, f.response.Code, "links are single use")
+
+	for i := 0; i < 3; i++ {
+		req, _ = http.NewRequest("POST", "http://demisto.com/login/link", bytes.NewBufferString(`{"email":"link@example.com"}`))
+		f.sendRequest(req, false, "")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, f.response.Code, "links are rate limited")
+	assert.NotEmpty(t, f.response.Header().Get("Retry-After"))
+}
+
+func TestLoginLinkKeepsOtherFactors(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+	f.appcontext.mailer = &recordingMailer{emails: make(chan *util.Email, 1)}
+	f.r.DeleteAttempts(attemptsKey("ip", ""))
+	totp := &domain.User{Username: "link-totp", Email: "totp@example.com", Type: domain.UserTypeUser, TOTPEnabled: true}
+	sso := &domain.User{Username: "acme/link-sso", Email: "sso@example.com", Type: domain.UserTypeUser, Source: domain.UserSourceSAML}
+	for _, u := range []*domain.User{totp, sso} {
+		if err := f.r.SetUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	confirm := func(u *domain.User) {
+		l := domain.NewLoginLink(u.Username, domain.LoginLinkSignIn)
+		if err := f.r.AddLoginLink(l); err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("POST", "http://demisto.com/login/link/confirm", bytes.NewBufferString("token="+l.Plain))
+		f.sendGeneralRequest(req, false, "", "application/x-www-form-urlencoded")
+	}
+
+	confirm(totp)
+	assert.Equal(t, http.StatusOK, f.response.Code)
+	assert.Contains(t, f.response.Body.String(), "otpRequired")
+	cookies := map[string]bool{}
+	for _, c := range f.response.Result().Cookies() {
+		cookies[c.Name] = true
+	}
+	assert.True(t, cookies[otpCookie], "the one time password must still be required")
+	assert.False(t, cookies[sessionCookie], "no session before the one time password")
+
+	confirm(sso)
+	assert.Equal(t, http.StatusUnauthorized, f.response.Code, "IdP users must sign in at the IdP")
+}
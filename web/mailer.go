@@ -0,0 +1,120 @@
+package web
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/util"
+)
+
+const (
+	// maxEmailSubject and maxEmailError are the sizes of the delivery columns
+	maxEmailSubject = 255
+	maxEmailError   = 1024
+	// defaultMailFrom is the sender when SMTP.From is not set
+	defaultMailFrom = "noreply@localhost"
+)
+
+// Mailer sends the emails of the handlers, such as sign-in links, password resets and issued tokens
+type Mailer interface {
+	SendEmail(e *util.Email) error
+}
+
+// newMailer based on the configured driver or nil if emails are not configured
+func newMailer() Mailer {
+	c := conf.Options.SMTP
+	from := c.From
+	if from == "" {
+		from = defaultMailFrom
+	}
+	driver := conf.Options.Mail.Driver
+	if driver == "" && c.Address != "" {
+		driver = "smtp"
+	}
+	switch driver {
+	case "":
+		return nil
+	case "smtp":
+		return &util.Mailer{Address: c.Address, Username: c.Username, Password: c.Password, From: from}
+	case "file":
+		return &util.FileMailer{Dir: conf.Options.Mail.Dir, From: from}
+	case "log":
+		return util.LogMailer{}
+	}
+	log.Errorf("Unknown mail driver %s, emails are disabled", driver)
+	return nil
+}
+
+// sendEmail renders the template for the user and sends it. The delivery is recorded so admins can see whether the
+// email was sent. Sending takes a while so callers run it in the background.
+func (ac *AppContext) sendEmail(name string, variants []string, u *domain.User, data *mailData) {
+	data.Name, data.Email = u.Name, u.Email
+	d := &domain.EmailDelivery{Template: name, Username: u.Username, Recipient: u.Email, Status: domain.EmailQueued, CreatedAt: time.Now()}
+	e, err := renderEmail(name, variants, data)
+	if err == nil {
+		d.Subject = truncate(e.Subject, maxEmailSubject)
+	}
+	if rErr := ac.r.AddEmailDelivery(d); rErr != nil {
+		log.WithError(rErr).Errorf("Unable to record %s email to %s", name, u.Email)
+	}
+	if err == nil {
+		err = ac.mailer.SendEmail(e)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("Unable to send %s email to %s", name, u.Email)
+		d.Status, d.Error = domain.EmailFailed, truncate(err.Error(), maxEmailError)
+	} else {
+		log.Infof("Sent %s email to %s", name, u.Username)
+		now := time.Now()
+		d.Status, d.SentAt = domain.EmailSent, &now
+	}
+	if d.ID == 0 {
+		return
+	}
+	if err = ac.r.SetEmailDeliveryStatus(d); err != nil {
+		log.WithError(err).Errorf("Unable to record the status of %s email to %s", name, u.Email)
+	}
+}
+
+// sendToken emails the download link of a newly issued token to the customer. Templates can be customized for the
+// organization of the customer and for the downloads the token is limited to.
+func (ac *AppContext) sendToken(u *domain.User, t *domain.Token) {
+	var variants, downloads []string
+	if u.Organization != "" {
+		variants = append(variants, "org-"+u.Organization)
+	}
+	for _, s := range t.Scope {
+		if !strings.ContainsAny(s, `*?[\`) {
+			variants = append(variants, "download-"+s)
+			downloads = append(downloads, s)
+		}
+	}
+	q := url.Values{"token": {t.Plain}, "email": {u.Email}}
+	// Tokens limited to a single download can only download that
+	if len(t.Scope) == 1 && len(downloads) == 1 {
+		q.Set("downloadName", downloads[0])
+	}
+	// The link opens a page that confirms the download so mail scanners following it do not use a download
+	link := strings.TrimRight(conf.Options.ExternalAddress, "/") + downloadLinkPath + "?" + q.Encode()
+	ac.sendEmail(mailToken, variants, u, &mailData{Link: link, Token: t, Organization: u.Organization})
+}
+
+// sendTokens emails the tokens of the grants one after the other so large imports do not flood the server
+func (ac *AppContext) sendTokens(grants []domain.TokenGrant) {
+	for _, g := range grants {
+		if g.User.Email != "" {
+			ac.sendToken(g.User, g.Token)
+		}
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,23 @@
+package web
+
+import (
+	"testing"
+
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMailerDefaultSender(t *testing.T) {
+	conf.Default()
+	defer conf.Default()
+	conf.Options.SMTP.Address = "127.0.0.1:25"
+	m, ok := newMailer().(*util.Mailer)
+	if assert.True(t, ok, "SMTP must be the default driver when the address is set") {
+		assert.Equal(t, defaultMailFrom, m.From)
+	}
+	conf.Options.SMTP.From = "downloads@demisto.com"
+	if m, ok = newMailer().(*util.Mailer); assert.True(t, ok) {
+		assert.Equal(t, "downloads@demisto.com", m.From)
+	}
+}
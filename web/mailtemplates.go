@@ -0,0 +1,130 @@
+package web
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/util"
+)
+
+// The email templates
+const (
+	mailSignIn        = "sign-in"
+	mailPasswordReset = "password-reset"
+	mailToken         = "token"
+)
+
+// mailData is what the email templates can use
+type mailData struct {
+	// Name of the recipient, which can be empty
+	Name  string
+	Email string
+	// Link to sign in or download
+	Link string
+	// Code to reset the password
+	Code string
+	// Minutes the link or code can be used
+	Minutes int
+	// Token issued to the recipient with its plain value
+	Token        *domain.Token
+	Organization string
+}
+
+// builtinMailTemplates are used for the parts without a custom template. Emails without an HTML template are
+// sent as plain text.
+var builtinMailTemplates = map[string]map[string]string{
+	mailSignIn: {
+		"subject": "Sign in to Demisto downloads",
+		"txt": "Hello {{.Name}},\n\nUse the following link to sign in to Demisto downloads:\n\n{{.Link}}\n\n" +
+			"The link can be used once within {{.Minutes}} minutes. If you did not ask to sign in, you can ignore this email.\n",
+	},
+	mailPasswordReset: {
+		"subject": "Reset your Demisto downloads password",
+		"txt": "Hello {{.Name}},\n\nUse the following code to reset your Demisto downloads password within {{.Minutes}} minutes:\n\n{{.Code}}\n\n" +
+			"If you did not ask to reset your password, you can ignore this email and your password will not change.\n",
+	},
+	mailToken: {
+		"subject": "Your Demisto download link",
+		"txt": "Hello{{if .Name}} {{.Name}}{{end}},\n\nUse the following link to download Demisto:\n\n{{.Link}}\n\n" +
+			"{{with .Token.ExpiresAt}}The link expires on {{.Format \"2006-01-02\"}}.\n\n{{end}}" +
+			"Anyone with the link can use your downloads, so please do not share it.\n",
+		"html": `<p>Hello{{if .Name}} {{.Name}}{{end}},</p>
+<p>Use the following link to download Demisto:</p>
+<p><a href="{{.Link}}">Download Demisto</a></p>
+{{with .Token.ExpiresAt}}<p>The link expires on {{.Format "2006-01-02"}}.</p>
+{{end}}<p>Anyone with the link can use your downloads, so please do not share it.</p>
+`,
+	},
+}
+
+// mailVariant limits variants to names that are safe in file names
+var mailVariant = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// mailTemplatePart returns the part (subject, txt or html) of the template. Custom templates are files named
+// name.variant.part in the templates directory, tried for each variant in order and then as name.part.
+// The built in part is used if there is no custom one.
+func mailTemplatePart(name string, variants []string, part string) (string, error) {
+	if dir := conf.Options.Mail.Templates; dir != "" {
+		for _, v := range append(variants, "") {
+			base := name
+			if v != "" {
+				if !mailVariant.MatchString(v) {
+					continue
+				}
+				base += "." + v
+			}
+			b, err := ioutil.ReadFile(filepath.Join(dir, base+"."+part))
+			if err == nil {
+				return string(b), nil
+			} else if !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+	}
+	return builtinMailTemplates[name][part], nil
+}
+
+// renderEmail renders the template with the data for the recipient. Templates are read on every email so they can
+// be changed without a restart.
+func renderEmail(name string, variants []string, data *mailData) (*util.Email, error) {
+	e := &util.Email{To: []string{data.Email}}
+	for part, dest := range map[string]*string{"subject": &e.Subject, "txt": &e.Text} {
+		src, err := mailTemplatePart(name, variants, part)
+		if err != nil {
+			return nil, err
+		}
+		t, err := texttemplate.New(name + "." + part).Parse(src)
+		if err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{}
+		if err = t.Execute(buf, data); err != nil {
+			return nil, err
+		}
+		*dest = buf.String()
+	}
+	// Subjects cannot span lines
+	e.Subject = strings.Join(strings.Fields(e.Subject), " ")
+	src, err := mailTemplatePart(name, variants, "html")
+	if err != nil || src == "" {
+		return e, err
+	}
+	t, err := htmltemplate.New(name + ".html").Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err = t.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	e.HTML = buf.String()
+	return e, nil
+}
@@ -1,16 +1,18 @@
 package web
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"reflect"
+	"regexp"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/demisto/download/conf"
 	"github.com/demisto/download/domain"
-	"github.com/demisto/download/util"
 	"github.com/go-errors/errors"
 	"github.com/gorilla/context"
 )
@@ -41,13 +43,38 @@ func (l *loggingResponseWriter) WriteHeader(status int) {
 	l.ResponseWriter.WriteHeader(status)
 }
 
+// requestIDHeader correlates a request with the logs and audit entries. A sane ID from a proxy is kept.
+const requestIDHeader = "X-Request-Id"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID returns the ID of the request set by the logging handler
+func requestID(r *http.Request) string {
+	id, _ := context.Get(r, "requestID").(string)
+	return id
+}
+
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
 func loggingHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
+		id := newRequestID(r)
+		context.Set(r, "requestID", id)
+		w.Header().Set(requestIDHeader, id)
 		lw := &loggingResponseWriter{w, 200}
 		t1 := time.Now()
 		next.ServeHTTP(lw, r)
 		t2 := time.Now()
-		log.Infof("[%s] %q %v %v", r.Method, r.URL.String(), lw.status, t2.Sub(t1))
+		log.Infof("[%s] %q %v %v %s", r.Method, r.URL.String(), lw.status, t2.Sub(t1), id)
 	}
 
 	return http.HandlerFunc(fn)
@@ -90,6 +117,10 @@ func multipartContentTypeHandler(next http.Handler) http.Handler {
 	return contentTypeHandler(next, "multipart/form-data")
 }
 
+func csvContentTypeHandler(next http.Handler) http.Handler {
+	return contentTypeHandler(next, "text/csv")
+}
+
 func bodyHandler(v interface{}) func(http.Handler) http.Handler {
 	t := reflect.TypeOf(v)
 
@@ -121,6 +152,8 @@ const (
 	xsrfCookie = `XSRF-TOKEN`
 	// xsrfHeader is the name of the expected header
 	xsrfHeader = `X-XSRF-TOKEN`
+	// xsrfField is the form field with the token for pages that post forms and cannot set the header
+	xsrfField = `xsrf`
 	// noXsrfAllowed is the error message
 	noXSRFAllowed = `No XSRF Allowed`
 	// xFrameOptionsHeader is the name of the x frame header
@@ -143,7 +176,7 @@ func decryptSession(request *http.Request) (*session, error) {
 		return nil, err
 	}
 	var sess session
-	err = util.DecryptJSON(cookie.Value, conf.Options.Security.SessionKey, &sess)
+	err = openCookie(cookie.Value, &sess)
 	if err != nil {
 		log.WithFields(log.Fields{"cookie": cookie.Value, "error": err}).Warn("Unable to decrypt encrypted session")
 		return nil, err
@@ -156,15 +189,34 @@ func decryptSession(request *http.Request) (*session, error) {
 	return &sess, nil
 }
 
+// csrfToken returns the token of the CSRF cookie the browser will have after this response
+func csrfToken(r *http.Request) string {
+	if val, ok := context.Get(r, "csrf").(string); ok {
+		return val
+	}
+	if c, err := r.Cookie(xsrfCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
 // Handle CSRF protection
 func csrfHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		csrf, err := r.Cookie(xsrfCookie)
 		csrfHeader := r.Header.Get(xsrfHeader)
+		if csrfHeader == "" && r.Method == "POST" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			csrfHeader = r.PostFormValue(xsrfField)
+		}
 		ok := false
 		secure := conf.Options.SSL.Key != ""
-		pass := conf.Options.Security.SessionKey
 
+		// API keys are sent explicitly in the Authorization header which browsers never add on their own,
+		// so there is nothing to forge. The key itself is verified by the auth handler.
+		if bearerToken(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
 		// If it is an idempotent method, set the cookie
 		if r.Method == "GET" || r.Method == "HEAD" || r.RequestURI == "/saml" {
 			// But set it only if there is no XSRF or the session is not valid
@@ -175,19 +227,19 @@ func csrfHandler(next http.Handler) http.Handler {
 				shouldCreate = err != nil
 			}
 			if shouldCreate {
-				val, cErr := util.Encrypt(noXSRFAllowed+time.Now().String(), []byte(pass))
+				val, cErr := newCSRFToken()
 				if cErr == nil {
 					http.SetCookie(w, &http.Cookie{Name: xsrfCookie, Value: val, Path: "/", Expires: time.Now().Add(365 * 24 * time.Hour), MaxAge: 365 * 24 * 60 * 60, Secure: secure, HttpOnly: false})
+					context.Set(r, "csrf", val)
 				} else {
 					log.WithField("error", cErr).Error("Unable to generate CSRF")
 				}
 			}
 			ok = true
 		} else if err == nil && csrf.Value == csrfHeader {
-			val, cErr := util.Decrypt(csrfHeader, []byte(pass))
-			if cErr == nil && strings.HasPrefix(val, noXSRFAllowed) {
+			if cErr := validCSRFToken(csrfHeader); cErr == nil {
 				ok = true
-			} else if cErr != nil {
+			} else {
 				log.WithError(cErr).Errorf("Failed to execute %s method because of csrf", r.Method)
 			}
 		} else {
@@ -208,18 +260,47 @@ const (
 
 func (ac *AppContext) authHandler(next http.Handler) http.Handler {
 	fn := func(writer http.ResponseWriter, request *http.Request) {
+		if plain := bearerToken(request); plain != "" {
+			k, u, err := ac.apiKeyUser(plain)
+			if err == ErrAuth {
+				WriteError(writer, ErrAuth)
+				return
+			} else if err != nil {
+				log.WithError(err).Error("Unable to authenticate API key")
+				WriteError(writer, ErrInternalServer)
+				return
+			}
+			log.Debugf("User %v in request with API key %s", u.Username, k.Hint)
+			context.Set(request, "user", u)
+			context.Set(request, "apiKey", k)
+			next.ServeHTTP(writer, request)
+			return
+		}
 		session, err := decryptSession(request)
 		if err != nil {
 			WriteError(writer, ErrAuth)
 			return
 		}
-		context.Set(request, "session", &session)
+		s, err := ac.serverSession(session)
+		if err == ErrAuth {
+			WriteError(writer, ErrAuth)
+			return
+		} else if err != nil {
+			log.WithError(err).Error("Unable to load session")
+			WriteError(writer, ErrInternalServer)
+			return
+		}
+		context.Set(request, "session", s)
 		log.Debugf("User %v in request", session.User)
 		u, err := ac.r.User(session.User)
 		if err != nil {
 			log.WithFields(log.Fields{"username": session.User, "id": session.User, "error": err}).Warn("Unable to load user from repository")
 			panic(err)
 		}
+		if u.Disabled {
+			WriteError(writer, ErrUserDisabled)
+			return
+		}
 
 		context.Set(request, "user", u)
 
@@ -227,7 +308,7 @@ func (ac *AppContext) authHandler(next http.Handler) http.Handler {
 		session.When = time.Now().Unix() * 1000
 		secure := conf.Options.SSL.Key != ""
 		timeout := conf.Options.Security.Timeout
-		val, _ := util.EncryptJSON(&session, conf.Options.Security.SessionKey)
+		val, _ := sealCookie(&session)
 		http.SetCookie(writer, &http.Cookie{
 			Name:     sessionCookie,
 			Value:    val,
@@ -242,16 +323,42 @@ func (ac *AppContext) authHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+// passwordChangeRoutes are the only routes users that must change their password can access
+var passwordChangeRoutes = map[string]bool{"GET /user": true, "POST /user/password": true, "POST /logout": true}
+
+// totpEnrollmentRoutes are the only routes admins can access until they enroll when TOTP is required
+var totpEnrollmentRoutes = map[string]bool{"GET /user": true, "POST /user/password": true, "POST /logout": true, "POST /user/totp": true, "POST /user/totp/confirm": true}
+
 func (ac *AppContext) permissionsHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		currentUser := context.Get(r, "user").(*domain.User)
-		requires := context.Get(r, "requires")
-		if requires != nil && len(requires.([]domain.UserType)) > 0 {
-			if !util.In(requires, currentUser.Type) {
+		route := r.Method + " " + r.URL.Path
+		if k, ok := context.Get(r, "apiKey").(*domain.APIKey); ok {
+			if scope, ok := apiKeyRoutes[route]; !ok || !k.Allows(scope) {
+				WriteError(w, ErrAPIKeyScope)
+				return
+			}
+		}
+		if currentUser.ForcePasswordChange && !passwordChangeRoutes[route] {
+			WriteError(w, ErrPasswordChangeRequired)
+			return
+		}
+		if totpRequired(currentUser) && !totpEnrollmentRoutes[route] {
+			WriteError(w, ErrTOTPRequired)
+			return
+		}
+		requires, _ := context.Get(r, "requires").([]domain.Permission)
+		for _, p := range requires {
+			if !ac.roles.Allows(currentUser, p) {
 				WriteError(w, ErrPermission)
 				return
 			}
 		}
+		// Changes on routes that require permissions are audited, not what users do with their own account
+		if r.Method != "GET" && r.Method != "HEAD" && len(requires) > 0 {
+			ac.audit(w, r, next)
+			return
+		}
 		next.ServeHTTP(w, r)
 		return
 	}
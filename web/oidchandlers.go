@@ -0,0 +1,185 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+)
+
+const (
+	// oidcCookie holds the state, nonce and PKCE verifier of the sign-in in progress
+	oidcCookie = `SDOIDC`
+	// oidcTimeout is how long the user has to sign in at the IdP
+	oidcTimeout = 10 * time.Minute
+	// oidcCallbackPath is where the IdP redirects back to
+	oidcCallbackPath = "/login/oidc/callback"
+)
+
+// oidcLogin is the encrypted content of the OIDC cookie
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	When     int64  `json:"when"`
+}
+
+// newOIDCProvider based on the configuration or nil if single sign-on is not configured
+func newOIDCProvider() *domain.OIDCProvider {
+	c := conf.Options.OIDC
+	if c.Issuer == "" {
+		return nil
+	}
+	redirect := c.RedirectURL
+	if redirect == "" {
+		redirect = strings.TrimRight(conf.Options.ExternalAddress, "/") + oidcCallbackPath
+	}
+	return &domain.OIDCProvider{
+		Issuer:        c.Issuer,
+		ClientID:      c.ClientID,
+		ClientSecret:  c.ClientSecret,
+		RedirectURL:   redirect,
+		Scopes:        c.Scopes,
+		UsernameClaim: c.UsernameClaim,
+		GroupsClaim:   c.GroupsClaim,
+		AdminGroups:   c.AdminGroups,
+		UserGroups:    c.UserGroups,
+		Client:        &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func clearOIDCCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Value: "", Path: oidcCallbackPath, Expires: time.Now(), MaxAge: -1, Secure: conf.Options.SSL.Key != "", HttpOnly: true})
+}
+
+// oidcLoginHandler redirects the browser to the IdP
+func (ac *AppContext) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if ac.oidc == nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	login := &oidcLogin{State: domain.NewOIDCSecret(), Nonce: domain.NewOIDCSecret(), Verifier: domain.NewOIDCSecret(), When: time.Now().Unix()}
+	authURL, err := ac.oidc.AuthCodeURL(login.State, login.Nonce, login.Verifier)
+	if err != nil {
+		log.WithError(err).Error("Unable to reach the OIDC provider")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	val, err := sealCookie(login)
+	if err != nil {
+		log.WithError(err).Error("Unable to encrypt OIDC login")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    val,
+		Path:     oidcCallbackPath,
+		Expires:  time.Now().Add(oidcTimeout),
+		MaxAge:   int(oidcTimeout.Seconds()),
+		Secure:   conf.Options.SSL.Key != "",
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// errOIDCUserExists is returned when the username of a new OIDC user is already taken
+var errOIDCUserExists = errors.New("User already exists")
+
+// oidcUser returns the user the IdP created for the issuer and subject of the claims, or a new one of the type if this
+// is the first sign-in. Existing accounts with the same username are never linked since the IdP controls the username
+// claim, which is the email by default.
+func (ac *AppContext) oidcUser(claims *domain.OIDCClaims, userType domain.UserType) (*domain.User, error) {
+	externalID := ac.oidc.ExternalID(claims)
+	u, err := ac.r.UserByExternalID(domain.UserSourceOIDC, externalID)
+	if err != repo.ErrNotFound {
+		return u, err
+	}
+	if _, err = ac.r.User(claims.Username); err == nil {
+		return nil, errOIDCUserExists
+	} else if err != repo.ErrNotFound {
+		return nil, err
+	}
+	log.Infof("Provisioning OIDC user %s as %v", claims.Username, userType)
+	return &domain.User{Username: claims.Username, Type: userType, Source: domain.UserSourceOIDC, ExternalID: externalID}, nil
+}
+
+// oidcCallbackHandler completes the sign-in, provisions the user if needed and starts the session
+func (ac *AppContext) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if ac.oidc == nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		WriteError(w, ErrAuth)
+		return
+	}
+	clearOIDCCookie(w)
+	var login oidcLogin
+	if err = openCookie(cookie.Value, &login); err != nil || time.Since(time.Unix(login.When, 0)) > oidcTimeout {
+		WriteError(w, ErrAuth)
+		return
+	}
+	if r.FormValue("state") != login.State {
+		log.Warn("OIDC callback with the wrong state")
+		WriteError(w, ErrAuth)
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		log.Warnf("OIDC sign-in failed - %s %s", e, r.FormValue("error_description"))
+		WriteError(w, ErrAuth)
+		return
+	}
+	claims, err := ac.oidc.Exchange(r.FormValue("code"), login.Verifier, login.Nonce)
+	if err != nil {
+		log.WithError(err).Warn("Unable to complete OIDC sign-in")
+		WriteError(w, ErrAuth)
+		return
+	}
+	userType, err := ac.oidc.UserType(claims)
+	if err != nil {
+		log.WithError(err).Warnf("OIDC user %s with groups %v is not allowed to sign in", claims.Username, claims.Groups)
+		WriteError(w, ErrPermission)
+		return
+	}
+	u, err := ac.oidcUser(claims, userType)
+	if err == errOIDCUserExists {
+		log.Warnf("OIDC user %s of %s matches an existing account that was not created by the IdP", claims.Username, claims.Subject)
+		WriteError(w, ErrAuth)
+		return
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to load OIDC user %s", claims.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	// The type is only set when the user is created. If the groups no longer grant it, an admin has to change it.
+	if u.Type != userType {
+		log.Warnf("OIDC user %s is a %v but the groups %v map to %v", u.Username, u.Type, claims.Groups, userType)
+		WriteError(w, ErrPermission)
+		return
+	}
+	// The IdP is the source of truth for the profile of its users
+	if claims.Email != "" {
+		u.Email = claims.Email
+	}
+	if claims.Name != "" {
+		u.Name = claims.Name
+	}
+	u.ModifyDate = time.Now()
+	if err = ac.r.SetUser(u); err != nil {
+		log.WithError(err).Errorf("Unable to save OIDC user %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if e := ac.startSession(w, r, u); e != nil {
+		WriteError(w, e)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
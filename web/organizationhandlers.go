@@ -0,0 +1,75 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+	"github.com/gorilla/context"
+)
+
+// organizationsHandler returns the list of organizations
+func (ac *AppContext) organizationsHandler(w http.ResponseWriter, r *http.Request) {
+	o, err := ac.r.Organizations()
+	if err != nil {
+		log.WithError(err).Warn("Unable to retrieve organizations")
+		panic(err)
+	}
+	writeJSON(w, o)
+}
+
+// updateOrganizationHandler creates or updates an organization with its pool and entitlements
+func (ac *AppContext) updateOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	o := context.Get(r, "body").(*domain.Organization)
+	o.Name = strings.TrimSpace(o.Name)
+	if o.Name == "" || o.Downloads < 0 {
+		WriteError(w, ErrMissingPartRequest)
+		return
+	}
+	if e := validateScope(o.Scope, o.Versions); e != nil {
+		WriteError(w, e)
+		return
+	}
+	before, err := ac.r.Organization(o.Name)
+	if err != nil && err != repo.ErrNotFound {
+		log.WithError(err).Errorf("Unable to load organization %s", o.Name)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	log.Infof("Updating organization: %#v", o)
+	err = ac.r.SetOrganization(o)
+	if err != nil {
+		log.WithError(err).Warnf("Unable to save organization - %#v", o)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	auditChange(r, o.Name, before, o)
+	writeJSON(w, o)
+}
+
+// organizationsUsageHandler returns the download usage per organization
+func (ac *AppContext) organizationsUsageHandler(w http.ResponseWriter, r *http.Request) {
+	u, err := ac.r.OrganizationsUsage()
+	if err != nil {
+		log.WithError(err).Warn("Unable to retrieve organizations usage")
+		panic(err)
+	}
+	writeJSON(w, u)
+}
+
+// validateOrganization makes sure that the organization users are attached to exists
+func (ac *AppContext) validateOrganization(name string) *Error {
+	if name == "" {
+		return nil
+	}
+	_, err := ac.r.Organization(name)
+	if err == repo.ErrNotFound {
+		return &Error{ID: "bad_request", Status: 400, Title: "Invalid Organization", Detail: "Organization " + name + " does not exist"}
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to load organization %s", name)
+		return ErrInternalServer
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+	"github.com/gorilla/context"
+)
+
+type passwordForgot struct {
+	User string `json:"user"`
+}
+
+type passwordReset struct {
+	// Token is the code from the email
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func resetKey(username string) string {
+	return attemptsKey("reset", strings.ToLower(username))
+}
+
+// forgotPasswordHandler emails a one time code to reset the password of the user. Only enabled users with a local
+// password and an email can reset it. The response is the same whether the user exists or not.
+func (ac *AppContext) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if ac.mailer == nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	body := context.Get(r, "body").(*passwordForgot)
+	if body.User == "" {
+		WriteError(w, ErrMissingPartRequest)
+		return
+	}
+	if ac.throttled(w, linkAddressKey(r), resetKey(body.User)) {
+		return
+	}
+	// Every request counts, not just failures
+	ac.attemptFailed(linkAddressThrottle, linkAddressKey(r))
+	ac.attemptFailed(linkThrottle, resetKey(body.User))
+	u, err := ac.r.User(body.User)
+	if err == repo.ErrNotFound || err == nil && (u.Hash == "" || u.Email == "" || u.Disabled) {
+		log.Infof("Password reset requested for %s that cannot reset it", body.User)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to load user %s", body.User)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	l := domain.NewLoginLink(u.Username, domain.LoginLinkPasswordReset)
+	if err = ac.r.DeleteExpiredLoginLinks(l.CreatedAt); err != nil {
+		log.WithError(err).Warn("Unable to delete expired links")
+	}
+	if err = ac.r.AddLoginLink(l); err != nil {
+		log.WithError(err).Errorf("Unable to save password reset of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	// Sending takes a while so it is done in the background to not reveal that the user exists
+	go ac.sendPasswordReset(u, l)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ac *AppContext) sendPasswordReset(u *domain.User, l *domain.LoginLink) {
+	ac.sendEmail(mailPasswordReset, nil, u, &mailData{Code: l.Plain, Minutes: int(domain.LoginLinkTimeout / time.Minute), Organization: u.Organization})
+}
+
+// resetPasswordHandler sets the password with the emailed code and ends all the sessions of the user
+func (ac *AppContext) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if ac.mailer == nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	body := context.Get(r, "body").(*passwordReset)
+	if body.Token == "" || body.Password == "" {
+		WriteError(w, ErrMissingPartRequest)
+		return
+	}
+	l := ac.loginLink(w, r, body.Token, domain.LoginLinkPasswordReset)
+	if l == nil {
+		return
+	}
+	u, err := ac.r.User(l.Username)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to load user %s of password reset", l.Username)
+		WriteError(w, ErrAuth)
+		return
+	}
+	if u.Disabled {
+		WriteError(w, ErrUserDisabled)
+		return
+	}
+	// The code is only used once the password is accepted so a weak password does not waste it
+	if !ac.validatePassword(w, body.Password, u) || !ac.useLoginLink(w, l) {
+		return
+	}
+	u.SetPassword(body.Password)
+	u.ForcePasswordChange = false
+	u.ModifyDate = time.Now()
+	if err = ac.r.SetUser(u); err != nil {
+		log.WithError(err).Errorf("Unable to save password of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if _, err = ac.r.DeleteUserSessions(u.Username); err != nil {
+		log.WithError(err).Errorf("Unable to end the sessions of %s after password reset", u.Username)
+	}
+	ac.loginSucceeded(u.Username)
+	log.Warnf("User %s reset the password", u.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordReset(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+	s := newSMTPStandIn(t)
+	defer s.l.Close()
+	f.appcontext.mailer = &util.Mailer{Address: s.l.Addr().String(), From: "noreply@demisto.com"}
+	f.r.DeleteAttempts(resetKey("resetter"))
+	f.r.DeleteAttempts(attemptsKey("ip", ""))
+	u := &domain.User{Username: "resetter", Email: "resetter@demisto.com", Name: "Resetter", Type: domain.UserTypeAdmin}
+	u.SetPassword("forgotten password")
+	if err := f.r.SetUser(u); err != nil {
+		t.Fatal(err)
+	}
+	sessionValue := loginWithUserAndPassword(t, f, "resetter", "forgotten password", true)
+
+	req, _ := http.NewRequest("POST", "http://demisto.com/password/forgot", bytes.NewBufferString(`{"user":"nobody"}`))
+	f.sendRequest(req, false, "")
+	assert.Equal(t, http.StatusNoContent, f.response.Code, "unknown users must look the same")
+
+	req, _ = http.NewRequest("POST", "http://demisto.com/password/forgot", bytes.NewBufferString(`{"user":"resetter"}`))
+	f.sendRequest(req, false, "")
+	assert.Equal(t, http.StatusNoContent, f.response.Code)
+	m := regexp.MustCompile(`(?m)^([A-Za-z0-9]{32})\r?$`).FindStringSubmatch(s.body(t))
+	if m == nil {
+		t.Fatal("No reset code in the email")
+	}
+
+	req, _ = http.NewRequest("POST", "http://demisto.com/password/reset", bytes.NewBufferString(`{"token":"`+m[1]+`","password":"short"}`))
+	f.sendRequest(req, false, "")
+	assert.Equal(t, http.StatusBadRequest, f.response.Code, "the password policy applies")
+
+	req, _ = http.NewRequest("POST", "http://demisto.com/password/reset", bytes.NewBufferString(`{"token":"`+m[1]+`","password":"a brand new password"}`))
+	f.sendRequest(req, false, "")
+	assert.Equal(t, http.StatusNoContent, f.response.Code, "a rejected password must not use the code")
+
+	req, _ = http.NewRequest("GET", "http://demisto.com/user", nil)
+	f.sendRequest(req, true, sessionValue)
+	assert.Equal(t, http.StatusUnauthorized, f.response.Code, "sessions must be revoked")
+	loginWithUserAndPassword(t, f, "resetter", "a brand new password", true)
+
+	req, _ = http.NewRequest("POST", "http://demisto.com/password/reset", bytes.NewBufferString(`{"token":"`+m[1]+`","password":"another new password"}`))
+	f.sendRequest(req, false, "")
+	assert.Equal(t, http.StatusUnauthorized, f.response.Code, "codes are single use")
+}
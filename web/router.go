@@ -72,28 +72,30 @@ type Router struct {
 	*httprouter.Router
 	staticHandlers alice.Chain
 	commonHandlers alice.Chain
-	authHandlers   alice.Chain
-	fileHandlers   alice.Chain
-	appContext     *AppContext
+	// scannerHandlers are used by external machines that cannot do the CSRF dance
+	scannerHandlers alice.Chain
+	authHandlers    alice.Chain
+	fileHandlers    alice.Chain
+	appContext      *AppContext
 }
 
 // Get handles GET requests
-func (r *Router) Get(path string, requires []domain.UserType, handler http.Handler) {
+func (r *Router) Get(path string, requires []domain.Permission, handler http.Handler) {
 	r.GET(path, wrapHandler(requires, handler))
 }
 
 // Post handles POST requests
-func (r *Router) Post(path string, requires []domain.UserType, handler http.Handler) {
+func (r *Router) Post(path string, requires []domain.Permission, handler http.Handler) {
 	r.POST(path, wrapHandler(requires, handler))
 }
 
 // Put handles PUT requests
-func (r *Router) Put(path string, requires []domain.UserType, handler http.Handler) {
+func (r *Router) Put(path string, requires []domain.Permission, handler http.Handler) {
 	r.PUT(path, wrapHandler(requires, handler))
 }
 
 // Delete handles DELETE requests
-func (r *Router) Delete(path string, requires []domain.UserType, handler http.Handler) {
+func (r *Router) Delete(path string, requires []domain.Permission, handler http.Handler) {
 	r.DELETE(path, wrapHandler(requires, handler))
 }
 
@@ -119,12 +121,12 @@ func handlePublicPath(pubPath string) {
 
 // New creates a new router
 func New(appC *AppContext, pubPath string) *Router {
-	initBruteForceMap(false)
 	handlePublicPath(pubPath)
 	r := &Router{Router: httprouter.New()}
 	r.appContext = appC
 	r.staticHandlers = alice.New(context.ClearHandler, loggingHandler, csrfHandler, recoverHandler, clickjackingHandler)
 	r.commonHandlers = r.staticHandlers.Append(acceptHandler)
+	r.scannerHandlers = alice.New(context.ClearHandler, loggingHandler, recoverHandler, clickjackingHandler)
 	r.authHandlers = r.commonHandlers.Append(appC.authHandler, appC.permissionsHandler)
 	r.fileHandlers = r.staticHandlers.Append(appC.authHandler, appC.permissionsHandler)
 	r.registerStaticHandlers()
@@ -149,25 +151,74 @@ func (r *Router) registerStaticHandlers() {
 func (r *Router) registerApplicationHandlers() {
 	// Security
 	r.Post("/login", nil, r.commonHandlers.Append(jsonContentTypeHandler, bodyHandler(credentials{})).ThenFunc(r.appContext.loginHandler))
+	r.Post("/login/otp", nil, r.commonHandlers.Append(jsonContentTypeHandler, bodyHandler(otpCredentials{})).ThenFunc(r.appContext.loginOTPHandler))
+	r.Post("/login/webauthn", nil, r.commonHandlers.Append(jsonContentTypeHandler, bodyHandler(credentials{})).ThenFunc(r.appContext.beginWebAuthnLoginHandler))
+	r.Post("/login/webauthn/finish", nil, r.commonHandlers.Append(jsonContentTypeHandler, bodyHandler(webAuthnResponse{})).ThenFunc(r.appContext.finishWebAuthnLoginHandler))
+	r.Post(loginLinkPath, nil, r.commonHandlers.Append(jsonContentTypeHandler, bodyHandler(loginLinkRequest{})).ThenFunc(r.appContext.requestLoginLinkHandler))
+	r.Get(loginLinkPath, nil, r.staticHandlers.ThenFunc(r.appContext.loginLinkHandler))
+	r.Post(loginLinkConfirmPath, nil, r.staticHandlers.ThenFunc(r.appContext.confirmLoginLinkHandler))
+	r.Post("/password/forgot", nil, r.commonHandlers.Append(jsonContentTypeHandler, bodyHandler(passwordForgot{})).ThenFunc(r.appContext.forgotPasswordHandler))
+	r.Post("/password/reset", nil, r.commonHandlers.Append(jsonContentTypeHandler, bodyHandler(passwordReset{})).ThenFunc(r.appContext.resetPasswordHandler))
+	r.Get("/login/oidc", nil, r.staticHandlers.ThenFunc(r.appContext.oidcLoginHandler))
+	r.Get(oidcCallbackPath, nil, r.staticHandlers.ThenFunc(r.appContext.oidcCallbackHandler))
+	r.Get("/saml/metadata", nil, r.staticHandlers.ThenFunc(r.appContext.samlMetadataHandler))
+	r.Get("/saml/login", nil, r.staticHandlers.ThenFunc(r.appContext.samlLoginHandler))
+	// The IdP posts the response cross site so the CSRF handler lets it through and the relay state protects it
+	r.Post("/saml", nil, r.staticHandlers.ThenFunc(r.appContext.samlACSHandler))
 	r.Post("/logout", nil, r.authHandlers.ThenFunc(r.appContext.logoutHandler))
 	r.Get("/user", nil, r.authHandlers.ThenFunc(r.appContext.userCurrHandler))
-	r.Post("/user", []domain.UserType{domain.UserTypeAdmin}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(userDetails{})).ThenFunc(r.appContext.handleUserUpdate))
+	r.Post("/user/totp", nil, r.authHandlers.ThenFunc(r.appContext.enrollTOTPHandler))
+	r.Post("/user/totp/confirm", nil, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(otpCredentials{})).ThenFunc(r.appContext.confirmTOTPHandler))
+	r.Post("/user/totp/recovery", nil, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(otpCredentials{})).ThenFunc(r.appContext.recoveryCodesHandler))
+	r.Post("/user/totp/disable", nil, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(credentials{})).ThenFunc(r.appContext.disableTOTPHandler))
+	r.Get("/user/webauthn", nil, r.authHandlers.ThenFunc(r.appContext.webAuthnCredentialsHandler))
+	r.Post("/user/webauthn/register", nil, r.authHandlers.ThenFunc(r.appContext.beginWebAuthnRegistrationHandler))
+	r.Post("/user/webauthn/register/finish", nil, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(webAuthnResponse{})).ThenFunc(r.appContext.finishWebAuthnRegistrationHandler))
+	r.Post("/user/webauthn/delete", nil, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(domain.WebAuthnCredential{})).ThenFunc(r.appContext.deleteWebAuthnCredentialHandler))
+	r.Post("/user/password", nil, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(passwordChange{})).ThenFunc(r.appContext.changePasswordHandler))
+	r.Get("/user/sessions", nil, r.authHandlers.ThenFunc(r.appContext.sessionsHandler))
+	r.Post("/user/sessions/revoke", nil, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(domain.Session{})).ThenFunc(r.appContext.revokeSessionHandler))
+	r.Post("/sessions/revoke", []domain.Permission{domain.PermissionManageUsers}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(sessionsRevocation{})).ThenFunc(r.appContext.revokeUserSessionsHandler))
+	r.Get("/users", []domain.Permission{domain.PermissionManageUsers}, r.authHandlers.ThenFunc(r.appContext.usersHandler))
+	r.Get("/users/detail", []domain.Permission{domain.PermissionManageUsers}, r.authHandlers.ThenFunc(r.appContext.userDetailsHandler))
+	r.Post("/user", []domain.Permission{domain.PermissionManageUsers}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(userDetails{})).ThenFunc(r.appContext.handleUserUpdate))
+	r.Get("/apikeys", []domain.Permission{domain.PermissionManageUsers}, r.authHandlers.ThenFunc(r.appContext.apiKeysHandler))
+	r.Post("/apikeys", []domain.Permission{domain.PermissionManageUsers}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(newAPIKey{})).ThenFunc(r.appContext.createAPIKeyHandler))
+	r.Post("/apikeys/revoke", []domain.Permission{domain.PermissionManageUsers}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(domain.APIKey{})).ThenFunc(r.appContext.revokeAPIKeyHandler))
 	// Token
-	r.Get("/token", []domain.UserType{domain.UserTypeAdmin}, r.authHandlers.ThenFunc(r.appContext.tokenHandler))
-	r.Post("/tokens/generate", []domain.UserType{domain.UserTypeAdmin}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(newTokens{})).ThenFunc(r.appContext.createTokensHandler))
-	r.Post("/token", []domain.UserType{domain.UserTypeAdmin}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(domain.Token{})).ThenFunc(r.appContext.updateToken))
-	r.Post("/tokens/email", []domain.UserType{domain.UserTypeAdmin}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(newEmailToken{})).ThenFunc(r.appContext.createEmailTokenHandler))
+	r.Get("/token", []domain.Permission{domain.PermissionIssueTokens}, r.authHandlers.ThenFunc(r.appContext.tokenHandler))
+	r.Post("/tokens/generate", []domain.Permission{domain.PermissionIssueTokens}, r.authHandlers.Append(jsonContentTypeHandler, r.appContext.idempotencyHandler, bodyHandler(newTokens{})).ThenFunc(r.appContext.createTokensHandler))
+	r.Post("/token", []domain.Permission{domain.PermissionIssueTokens}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(tokenUpdate{})).ThenFunc(r.appContext.updateToken))
+	r.Post("/token/adjust", []domain.Permission{domain.PermissionIssueTokens}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(tokenAdjustment{})).ThenFunc(r.appContext.adjustTokenHandler))
+	r.Get("/token/history", []domain.Permission{domain.PermissionIssueTokens}, r.authHandlers.ThenFunc(r.appContext.tokenHistoryHandler))
+	r.Post("/tokens/email", []domain.Permission{domain.PermissionIssueTokens}, r.authHandlers.Append(jsonContentTypeHandler, r.appContext.idempotencyHandler, bodyHandler(newEmailToken{})).ThenFunc(r.appContext.createEmailTokenHandler))
+	r.Post("/tokens/import", []domain.Permission{domain.PermissionIssueTokens}, r.authHandlers.Append(csvContentTypeHandler, r.appContext.idempotencyHandler).ThenFunc(r.appContext.importTokensHandler))
+	r.Get("/tokens/export", []domain.Permission{domain.PermissionIssueTokens}, r.authHandlers.ThenFunc(r.appContext.exportTokensHandler))
+	r.Get("/emails", []domain.Permission{domain.PermissionIssueTokens}, r.authHandlers.ThenFunc(r.appContext.emailsHandler))
+	r.Get("/tokens/pattern", nil, r.scannerHandlers.ThenFunc(r.appContext.tokenPatternHandler))
+	r.Post("/tokens/leaked", nil, r.scannerHandlers.Append(jsonContentTypeHandler, bodyHandler([]leakedToken{})).ThenFunc(r.appContext.leakedTokensHandler))
+	// Organizations
+	r.Get("/organizations", []domain.Permission{domain.PermissionIssueTokens}, r.authHandlers.ThenFunc(r.appContext.organizationsHandler))
+	r.Post("/organization", []domain.Permission{domain.PermissionIssueTokens}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(domain.Organization{})).ThenFunc(r.appContext.updateOrganizationHandler))
+	r.Get("/saml/providers", []domain.Permission{domain.PermissionManageUsers}, r.authHandlers.ThenFunc(r.appContext.samlProvidersHandler))
+	r.Post("/saml/providers", []domain.Permission{domain.PermissionManageUsers}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(samlProviderDetails{})).ThenFunc(r.appContext.updateSAMLProviderHandler))
+	r.Post("/saml/providers/delete", []domain.Permission{domain.PermissionManageUsers}, r.authHandlers.Append(jsonContentTypeHandler, bodyHandler(domain.SAMLProvider{})).ThenFunc(r.appContext.deleteSAMLProviderHandler))
+	r.Get("/organizations/usage", []domain.Permission{domain.PermissionReadLog}, r.authHandlers.ThenFunc(r.appContext.organizationsUsageHandler))
 	// Downloads
-	r.Get("/check-download", []domain.UserType{domain.UserTypeUser, domain.UserTypeAdmin}, r.authHandlers.ThenFunc(r.appContext.checkDownloadHandler))
-	r.Get("/download", []domain.UserType{domain.UserTypeUser, domain.UserTypeAdmin}, r.fileHandlers.ThenFunc(r.appContext.downloadHandler))
+	r.Get("/check-download", []domain.Permission{domain.PermissionDownload}, r.authHandlers.ThenFunc(r.appContext.checkDownloadHandler))
+	r.Get("/download", []domain.Permission{domain.PermissionDownload}, r.fileHandlers.ThenFunc(r.appContext.downloadHandler))
 	r.Get("/check-download-params", nil, r.commonHandlers.ThenFunc(r.appContext.checkDownloadParamsHandler))
-	r.Get("/download-params", nil, r.staticHandlers.ThenFunc(r.appContext.downloadParamsHandler))
-	r.Post("/upload", []domain.UserType{domain.UserTypeAdmin}, r.authHandlers.Append(multipartContentTypeHandler).ThenFunc(r.appContext.uploadHandler))
-	r.Get("/log", []domain.UserType{domain.UserTypeAdmin}, r.authHandlers.ThenFunc(r.appContext.downloadLogHandler))
-	r.Get("/list-downloads", []domain.UserType{domain.UserTypeAdmin}, r.authHandlers.ThenFunc(r.appContext.listDownloadsHandler))
+	r.Get(downloadParamsPath, nil, r.staticHandlers.ThenFunc(r.appContext.downloadParamsHandler))
+	r.Post(downloadParamsPath, nil, r.staticHandlers.ThenFunc(r.appContext.downloadParamsHandler))
+	r.Get(downloadLinkPath, nil, r.staticHandlers.ThenFunc(r.appContext.downloadLinkHandler))
+	r.Post("/upload", []domain.Permission{domain.PermissionUpload}, r.authHandlers.Append(multipartContentTypeHandler).ThenFunc(r.appContext.uploadHandler))
+	r.Get("/log", []domain.Permission{domain.PermissionReadLog}, r.authHandlers.ThenFunc(r.appContext.downloadLogHandler))
+	r.Get("/list-downloads", []domain.Permission{domain.PermissionUpload}, r.authHandlers.ThenFunc(r.appContext.listDownloadsHandler))
+	// Audit
+	r.Get("/audit", []domain.Permission{domain.PermissionReadAudit}, r.authHandlers.ThenFunc(r.appContext.auditLogHandler))
 }
 
-func wrapHandler(requires []domain.UserType, h http.Handler) httprouter.Handle {
+func wrapHandler(requires []domain.Permission, h http.Handler) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		context.Set(r, "params", ps)
 		context.Set(r, "requires", requires)
@@ -3,11 +3,15 @@ package web
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"bytes"
 	"strings"
 
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/gorilla/context"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -65,3 +69,45 @@ func loginWithUserAndPassword(t *testing.T, f *HandlerFixture, username, pswd st
 	f.response = httptest.NewRecorder()
 	return res
 }
+
+func TestCSRFFormField(t *testing.T) {
+	conf.Default()
+	h := context.ClearHandler(csrfHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	val, err := newCSRFToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, status := range map[string]int{val: http.StatusNoContent, "forged": http.StatusForbidden} {
+		req, _ := http.NewRequest("POST", "http://demisto.com/login/link/confirm", strings.NewReader(url.Values{xsrfField: {field}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: xsrfCookie, Value: val})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, status, rec.Code)
+	}
+}
+
+func TestReleaseEngineerCannotManageCustomers(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+	u := &domain.User{Username: "releaser", Type: domain.UserTypeAdmin, Roles: domain.StringList{domain.RoleReleaseEngineer}}
+	u.SetPassword("release password")
+	if err := f.r.SetUser(u); err != nil {
+		t.Fatal(err)
+	}
+	sessionValue := loginWithUserAndPassword(t, f, "releaser", "release password", true)
+
+	for _, route := range []struct{ method, path, body string }{
+		{"GET", "/organizations", ""},
+		{"POST", "/organization", `{"name":"acme","downloads":1000}`},
+		{"GET", "/saml/providers", ""},
+		{"POST", "/saml/providers", `{"organization":"acme"}`},
+		{"POST", "/saml/providers/delete", `{"organization":"acme"}`},
+	} {
+		req, _ := http.NewRequest(route.method, "http://demisto.com"+route.path, bytes.NewBufferString(route.body))
+		f.sendRequest(req, true, sessionValue)
+		assert.Equal(t, http.StatusForbidden, f.response.Code, "%s %s", route.method, route.path)
+	}
+}
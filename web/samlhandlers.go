@@ -0,0 +1,224 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+	"github.com/demisto/download/util"
+	"github.com/gorilla/context"
+)
+
+const (
+	// samlTimeout is how long the user has to sign in at the IdP
+	samlTimeout = 10 * time.Minute
+	// samlCookie holds the nonce of the relay state so the response is only accepted by the browser that started
+	// the sign-in
+	samlCookie = `SDSAML`
+	// samlPath is where the IdP posts the response
+	samlPath = "/saml"
+)
+
+// samlRelayState is the encrypted relay state that ties the response to our request
+type samlRelayState struct {
+	Organization string `json:"org"`
+	RequestID    string `json:"id"`
+	Nonce        string `json:"nonce"`
+	When         int64  `json:"when"`
+}
+
+// setSAMLCookie sets the nonce cookie. The IdP posts the response from its own site so the cookie must be sent on
+// cross site requests, which browsers only allow for secure cookies.
+func setSAMLCookie(w http.ResponseWriter, value string, maxAge int) {
+	c := &http.Cookie{Name: samlCookie, Value: value, Path: samlPath, MaxAge: maxAge, Secure: conf.Options.SSL.Key != "", HttpOnly: true}
+	if c.Secure {
+		c.SameSite = http.SameSiteNoneMode
+	}
+	if maxAge > 0 {
+		c.Expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+	} else {
+		c.Expires = time.Now()
+	}
+	http.SetCookie(w, c)
+}
+
+// samlProviderDetails is the provider configuration. If the IdP metadata is given, it fills the entity ID, SSO URL and certificate.
+type samlProviderDetails struct {
+	domain.SAMLProvider
+	Metadata string `json:"metadata"`
+}
+
+// serviceProvider is our SAML side based on the external address
+func serviceProvider() *domain.ServiceProvider {
+	base := strings.TrimRight(conf.Options.ExternalAddress, "/")
+	return &domain.ServiceProvider{EntityID: base + "/saml/metadata", ACSURL: base + samlPath}
+}
+
+// samlMetadataHandler returns the metadata customers configure their IdP with
+func (ac *AppContext) samlMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(serviceProvider().Metadata())
+}
+
+// samlLoginHandler redirects the browser to the IdP of the organization given in the org parameter
+func (ac *AppContext) samlLoginHandler(w http.ResponseWriter, r *http.Request) {
+	org := r.FormValue("org")
+	p, err := ac.r.SAMLProvider(org)
+	if err == repo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to load SAML provider of %s", org)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	state := &samlRelayState{Organization: org, RequestID: domain.NewSAMLRequestID(), Nonce: util.SecureRandomString(32, false), When: time.Now().Unix()}
+	relayState, err := sealCookie(state)
+	if err != nil {
+		log.WithError(err).Error("Unable to encrypt SAML relay state")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	authURL, err := serviceProvider().AuthnRequestURL(p, state.RequestID, relayState, time.Now())
+	if err != nil {
+		log.WithError(err).Errorf("Unable to create SAML request for %s", org)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	setSAMLCookie(w, state.Nonce, int(samlTimeout.Seconds()))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// samlACSHandler is the assertion consumer service. It verifies the response, provisions the organization user and
+// starts the session. Only sign-ins we started are accepted.
+func (ac *AppContext) samlACSHandler(w http.ResponseWriter, r *http.Request) {
+	var state samlRelayState
+	if err := openCookie(r.FormValue("RelayState"), &state); err != nil || time.Since(time.Unix(state.When, 0)) > samlTimeout {
+		log.Warn("SAML response with an invalid relay state")
+		WriteError(w, ErrAuth)
+		return
+	}
+	cookie, err := r.Cookie(samlCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state.Nonce)) != 1 {
+		log.Warnf("SAML response for %s was not started by this browser", state.Organization)
+		WriteError(w, ErrAuth)
+		return
+	}
+	setSAMLCookie(w, "", -1)
+	p, err := ac.r.SAMLProvider(state.Organization)
+	if err != nil {
+		log.WithError(err).Warnf("Unable to load SAML provider of %s", state.Organization)
+		WriteError(w, ErrAuth)
+		return
+	}
+	a, err := serviceProvider().ParseResponse(p, r.FormValue("SAMLResponse"), state.RequestID, time.Now())
+	if err != nil {
+		log.WithError(err).Warnf("Invalid SAML response for %s", state.Organization)
+		WriteError(w, ErrAuth)
+		return
+	}
+	// Used assertions are kept in the database until they expire so they cannot be replayed on another server
+	if err = ac.r.UseSAMLAssertion(state.Organization+"/"+a.ID, a.NotOnOrAfter); err == repo.ErrAlreadyUsed {
+		log.Warnf("Replayed SAML assertion %s for %s", a.ID, state.Organization)
+		WriteError(w, ErrAuth)
+		return
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to record SAML assertion %s for %s", a.ID, state.Organization)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	username := domain.SAMLUsername(state.Organization, a.NameID)
+	u, err := ac.r.User(username)
+	if err == repo.ErrNotFound {
+		log.Infof("Provisioning SAML user %s of %s", a.NameID, state.Organization)
+		u = &domain.User{Username: username, Type: domain.UserTypeUser, Source: domain.UserSourceSAML}
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to load SAML user %s", username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	u.Organization, u.Email = state.Organization, a.Email
+	if a.Name != "" {
+		u.Name = a.Name
+	}
+	u.ModifyDate = time.Now()
+	if err = ac.r.SetUser(u); err != nil {
+		log.WithError(err).Errorf("Unable to save SAML user %s", username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if e := ac.startSession(w, r, u); e != nil {
+		WriteError(w, e)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// samlProvidersHandler returns the SAML IdPs of all the organizations
+func (ac *AppContext) samlProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := ac.r.SAMLProviders()
+	if err != nil {
+		log.WithError(err).Error("Unable to load SAML providers")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	writeJSON(w, p)
+}
+
+// updateSAMLProviderHandler creates or updates the SAML IdP of an organization
+func (ac *AppContext) updateSAMLProviderHandler(w http.ResponseWriter, r *http.Request) {
+	details := context.Get(r, "body").(*samlProviderDetails)
+	p := &details.SAMLProvider
+	if details.Metadata != "" {
+		m, err := domain.ParseSAMLMetadata([]byte(details.Metadata))
+		if err != nil {
+			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid Metadata", Detail: err.Error()})
+			return
+		}
+		p.EntityID, p.SSOURL, p.Certificate = m.EntityID, m.SSOURL, m.Certificate
+	}
+	if err := p.Validate(); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid SAML Provider", Detail: err.Error()})
+		return
+	}
+	if e := ac.validateOrganization(p.Organization); e != nil {
+		WriteError(w, e)
+		return
+	}
+	before, err := ac.r.SAMLProvider(p.Organization)
+	if err != nil && err != repo.ErrNotFound {
+		log.WithError(err).Errorf("Unable to load SAML provider of %s", p.Organization)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if err = ac.r.SetSAMLProvider(p); err != nil {
+		log.WithError(err).Errorf("Unable to save SAML provider of %s", p.Organization)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	auditChange(r, p.Organization, before, p)
+	writeJSON(w, p)
+}
+
+// deleteSAMLProviderHandler removes the SAML IdP of an organization. Its users can no longer sign in with SAML.
+func (ac *AppContext) deleteSAMLProviderHandler(w http.ResponseWriter, r *http.Request) {
+	p := context.Get(r, "body").(*domain.SAMLProvider)
+	before, err := ac.r.SAMLProvider(p.Organization)
+	if err != nil && err != repo.ErrNotFound {
+		log.WithError(err).Errorf("Unable to load SAML provider of %s", p.Organization)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if err = ac.r.DeleteSAMLProvider(p.Organization); err != nil {
+		log.WithError(err).Errorf("Unable to delete SAML provider of %s", p.Organization)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	auditChange(r, p.Organization, before, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
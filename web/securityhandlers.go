@@ -1,7 +1,6 @@
 package web
 
 import (
-	"encoding/base64"
 	"net"
 	"net/http"
 	"time"
@@ -9,14 +8,10 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/demisto/download/conf"
 	"github.com/demisto/download/domain"
-	"github.com/demisto/download/util"
+	"github.com/demisto/download/repo"
 	"github.com/gorilla/context"
-	lru "github.com/hashicorp/golang-lru"
-	"golang.org/x/crypto/bcrypt"
 )
 
-var bruteForceMap *lru.Cache
-
 type credentials struct {
 	User     string `json:"user"`
 	Password string `json:"password"`
@@ -28,99 +23,89 @@ type userPreferences struct {
 	Notify   []string `json:"notify"`
 }
 
-func initBruteForceMap(sleep bool) {
-	tmpBruteForceMap, err := lru.New(100)
-	if err != nil {
-		log.WithError(err).Error("Failed creating brute force lru map sleep:", sleep)
-		if sleep {
-			time.Sleep(time.Second * 10)
-		}
-	} else {
-		bruteForceMap = tmpBruteForceMap
-	}
-}
-
-func (ac *AppContext) preventBruteForce(key string) {
-	var count int
-	//This is just for safety if for some reason we fail to create the map in the initialization phase
-	if bruteForceMap == nil {
-		initBruteForceMap(true)
-	}
-	countInter, exists := bruteForceMap.Get(key)
-	if exists {
-		count, _ = countInter.(int)
-		count++
-	}
-	if count <= 0 {
-		count = 1
-	}
-	if count > 5 {
-		time.Sleep(time.Second * 60 * time.Duration(count-5))
-	} else if count > 2 {
-		time.Sleep(time.Second * 10)
-	}
-	bruteForceMap.Add(key, count)
-}
-
-func (ac *AppContext) resetBruteForce(key string) {
-	bruteForceMap.Remove(key)
-}
-
+// remoteIP returns the address of the client.
 // r.RemoteAddr is in format ip:port, and might contain ipv6 data in format a:a:a:a:a:a:port
-func (ac *AppContext) getBruteforceKey(r *http.Request, username string) string {
+func remoteIP(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		host = r.RemoteAddr
 	}
-	return host + username
+	return host
 }
 
 func (ac *AppContext) handleLoginError(r *http.Request, w http.ResponseWriter, user string) {
-	ac.preventBruteForce(ac.getBruteforceKey(r, user))
+	ac.loginFailed(r, user)
 	WriteError(w, ErrCredentials)
 }
 
 func (ac *AppContext) doLogin(w http.ResponseWriter, r *http.Request, username, password string) (u *domain.User) {
 	body := &credentials{User: username, Password: password}
+	if ac.loginThrottled(w, r, body.User) {
+		return nil
+	}
 	if body.User == "" || body.Password == "" {
 		ac.handleLoginError(r, w, body.User)
 		return nil
 	}
 
-	u, err := ac.r.User(body.User)
-	if err == nil {
-		hash, err := base64.StdEncoding.DecodeString(u.Hash)
-		if err != nil {
-			ac.handleLoginError(r, w, body.User)
-			return nil
+	for _, a := range ac.authenticators {
+		var err error
+		if u, err = a.Authenticate(body.User, body.Password); err == nil {
+			break
+		} else if err != errInvalidCredentials {
+			log.WithError(err).Warnf("Unable to authenticate %s", body.User)
 		}
-		if bcrypt.CompareHashAndPassword(hash, []byte(body.Password)) != nil {
-			ac.handleLoginError(r, w, body.User)
-			return nil
-		}
-	} else {
+	}
+	if u == nil {
 		ac.handleLoginError(r, w, body.User)
 		return nil
 	}
-	// successful login need to reset login cookie
-	ac.resetBruteForce(ac.getBruteforceKey(r, u.Username))
+	if u.Disabled {
+		log.Warnf("Disabled user %s tried to log in", u.Username)
+		WriteError(w, ErrUserDisabled)
+		return nil
+	}
+	ac.loginSucceeded(u.Username)
 	return
 }
 
 func (ac *AppContext) loginResponse(w http.ResponseWriter, r *http.Request, u *domain.User) {
-	log.Infof("User %s logged in\n", u.Username)
-	loginTime := time.Now()
+	if e := ac.startSession(w, r, u); e != nil {
+		WriteError(w, e)
+		return
+	}
+	writeWithFilter(w, u, domain.UserFilterFields...)
+}
 
+// startSession records the login, stores the session and sets the session cookie. Disabled users are rejected
+// here as well since single sign-on does not go through the login handler.
+func (ac *AppContext) startSession(w http.ResponseWriter, r *http.Request, u *domain.User) *Error {
+	if u.Disabled {
+		log.Warnf("Disabled user %s tried to log in", u.Username)
+		return ErrUserDisabled
+	}
+	log.Infof("User %s logged in\n", u.Username)
+	timeout := conf.Options.Security.Timeout
+	s := domain.NewSession(u.Username, remoteIP(r), r.UserAgent())
+	if err := ac.r.DeleteExpiredSessions(s.CreatedAt.Add(-time.Duration(timeout) * time.Minute)); err != nil {
+		log.WithError(err).Warn("Unable to delete expired sessions")
+	}
+	if err := ac.r.AddSession(s); err != nil {
+		log.WithError(err).Errorf("Unable to save session of %s", u.Username)
+		return ErrInternalServer
+	}
 	sess := session{
+		ID:   s.Plain,
 		User: u.Username,
-		When: loginTime.Unix() * 1000,
+		When: s.CreatedAt.Unix() * 1000,
 	}
 	secure := conf.Options.SSL.Key != ""
-	timeout := conf.Options.Security.Timeout
-	val, _ := util.EncryptJSON(&sess, conf.Options.Security.SessionKey)
+	val, _ := sealCookie(&sess)
 
-	u.LastLogin = loginTime
-	ac.r.SetUser(u)
+	u.LastLogin = s.CreatedAt
+	if err := ac.r.SetLastLogin(u.Username, u.LastLogin); err != nil {
+		log.WithError(err).Warnf("Unable to save the last login of %s", u.Username)
+	}
 
 	// Set the cookie for the user
 	http.SetCookie(w, &http.Cookie{
@@ -132,48 +117,196 @@ func (ac *AppContext) loginResponse(w http.ResponseWriter, r *http.Request, u *d
 		Secure:   secure,
 		HttpOnly: true,
 	})
-	writeWithFilter(w, u, domain.UserFilterFields...)
+	return nil
 }
+
 func (ac *AppContext) loginHandler(w http.ResponseWriter, r *http.Request) {
 	body := context.Get(r, "body").(*credentials)
 	u := ac.doLogin(w, r, body.User, body.Password)
-	if u != nil {
-		ac.loginResponse(w, r, u)
+	if u == nil {
+		return
 	}
+	if u.TOTPEnabled {
+		ac.otpChallenge(w, u)
+		return
+	}
+	ac.loginResponse(w, r, u)
 }
 
 func (ac *AppContext) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if s, ok := context.Get(r, "session").(*domain.Session); ok {
+		if err := ac.r.DeleteSession(s.ID); err != nil && err != repo.ErrNotFound {
+			log.WithError(err).Errorf("Unable to delete session of %s", s.Username)
+		}
+	}
 	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", Expires: time.Now(), MaxAge: -1, Secure: conf.Options.SSL.Key != "", HttpOnly: true})
 	w.WriteHeader(http.StatusNoContent)
 	w.Write([]byte("\n"))
 }
 
+// userDetails are the fields of a user admins can set. Only the given fields are changed when updating
+// an existing user and the password is only changed if it is provided.
 type userDetails struct {
-	Username string          `json:"username"`
-	Password string          `json:"password"`
-	Email    string          `json:"email"`
-	Name     string          `json:"name"`
-	Type     domain.UserType `json:"type"`
-	Token    string          `json:"token"`
+	Username            string           `json:"username"`
+	Password            string           `json:"password"`
+	Email               *string          `json:"email"`
+	Name                *string          `json:"name"`
+	Type                *domain.UserType `json:"type"`
+	Token               string           `json:"token"`
+	Organization        *string          `json:"organization"`
+	ForcePasswordChange *bool            `json:"forcePasswordChange"`
+	// DisableTOTP removes the two factor authentication of a user that lost access to the authenticator
+	DisableTOTP bool `json:"disableTotp"`
+	// Roles replace the roles of the user. An empty list restores the default role of the type.
+	Roles *[]string `json:"roles"`
+	// Disabled users cannot log in or download. Disabling a user also ends all its sessions.
+	Disabled *bool `json:"disabled"`
+}
+
+// validatePassword checks the password against the policy and writes the error if it is not allowed
+func (ac *AppContext) validatePassword(w http.ResponseWriter, password string, u *domain.User) bool {
+	if err := ac.passwords.Validate(password, u); err != nil {
+		WriteError(w, &Error{ID: "weak_password", Status: 400, Title: "Password Not Allowed", Detail: err.Error()})
+		return false
+	}
+	return true
 }
 
 // handleUserUpdate creates or updates any user in the system. Permissions are checked by middleware.
 func (ac *AppContext) handleUserUpdate(w http.ResponseWriter, r *http.Request) {
 	details := context.Get(r, "body").(*userDetails)
-	// Skip validation checks for now
-	u := &domain.User{
-		Username:   details.Username,
-		Hash:       domain.GetHashFromPassword(details.Password),
-		Email:      details.Email,
-		Name:       details.Name,
-		Type:       details.Type,
-		Token:      details.Token,
-		ModifyDate: time.Now(),
-	}
-	ac.r.SetUser(u)
+	username := details.Username
+	// Customer users are named after the token digest so we never keep the plain token
+	if details.Token != "" {
+		if details.Email == nil || details.Type == nil || *details.Type != domain.UserTypeUser {
+			WriteError(w, ErrMissingPartRequest)
+			return
+		}
+		if !domain.IsTokenDigest(details.Token) {
+			details.Token = domain.TokenDigest(details.Token)
+		}
+		username = domain.TokenUsername(details.Token, *details.Email)
+	}
+	if username == "" {
+		WriteError(w, ErrMissingPartRequest)
+		return
+	}
+	u, err := ac.r.User(username)
+	var before *domain.User
+	if err == nil {
+		loaded := *u
+		before = &loaded
+	}
+	if err == repo.ErrNotFound {
+		if details.Type == nil {
+			WriteError(w, ErrMissingPartRequest)
+			return
+		}
+		u = &domain.User{Username: username, Type: *details.Type, Token: details.Token}
+		// Admins must have a password while customers usually download with their token
+		if u.Type == domain.UserTypeAdmin && details.Password == "" {
+			WriteError(w, ErrMissingPartRequest)
+			return
+		}
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to load user %s", username)
+		WriteError(w, ErrInternalServer)
+		return
+	} else if details.Type != nil {
+		u.Type = *details.Type
+	}
+	if details.Email != nil {
+		u.Email = *details.Email
+	}
+	if details.Name != nil {
+		u.Name = *details.Name
+	}
+	if details.Organization != nil {
+		if e := ac.validateOrganization(*details.Organization); e != nil {
+			WriteError(w, e)
+			return
+		}
+		u.Organization = *details.Organization
+	}
+	if details.Password != "" {
+		if !ac.validatePassword(w, details.Password, u) {
+			return
+		}
+		u.SetPassword(details.Password)
+	}
+	if details.ForcePasswordChange != nil {
+		u.ForcePasswordChange = *details.ForcePasswordChange
+	}
+	if details.Roles != nil {
+		if err = ac.roles.Validate(*details.Roles); err != nil {
+			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid Roles", Detail: err.Error()})
+			return
+		}
+		u.Roles = *details.Roles
+	}
+	if details.Disabled != nil {
+		if *details.Disabled && u.Username == context.Get(r, "user").(*domain.User).Username {
+			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid User", Detail: "You cannot disable yourself"})
+			return
+		}
+		u.Disabled = *details.Disabled
+	}
+	if details.DisableTOTP {
+		log.Warnf("Disabling two factor authentication of %s", u.Username)
+		u.DisableTOTP()
+	}
+	u.ModifyDate = time.Now()
+	if err = ac.r.SetUser(u); err != nil {
+		log.WithError(err).Errorf("Unable to save user %s", username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	auditChange(r, u.Username, before, u, domain.UserFilterFields...)
+	if u.Disabled {
+		if _, err = ac.r.DeleteUserSessions(u.Username); err != nil {
+			log.WithError(err).Errorf("Unable to end the sessions of disabled user %s", username)
+		}
+	}
 	writeWithFilter(w, u, domain.UserFilterFields...)
 }
 
+type passwordChange struct {
+	Current  string `json:"current"`
+	Password string `json:"password"`
+}
+
+// changePasswordHandler lets the logged in user change the password. The current password is required.
+func (ac *AppContext) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	change := context.Get(r, "body").(*passwordChange)
+	u := context.Get(r, "user").(*domain.User)
+	if ac.loginThrottled(w, r, u.Username) {
+		return
+	}
+	if !u.CheckPassword(change.Current) {
+		ac.loginFailed(r, u.Username)
+		WriteError(w, ErrCredentials)
+		return
+	}
+	ac.loginSucceeded(u.Username)
+	if change.Password == change.Current {
+		WriteError(w, &Error{ID: "weak_password", Status: 400, Title: "Password Not Allowed", Detail: "New password must be different from the current one"})
+		return
+	}
+	if !ac.validatePassword(w, change.Password, u) {
+		return
+	}
+	u.SetPassword(change.Password)
+	u.ForcePasswordChange = false
+	u.ModifyDate = time.Now()
+	if err := ac.r.SetUser(u); err != nil {
+		log.WithError(err).Errorf("Unable to save password of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	log.Infof("User %s changed the password", u.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (ac *AppContext) userCurrHandler(w http.ResponseWriter, r *http.Request) {
 	u := context.Get(r, "user").(*domain.User)
 	writeWithFilter(w, u, domain.UserFilterFields...)
@@ -1,9 +1,12 @@
 package web
 
 import (
+	"bytes"
 	"net/http"
 	"testing"
 
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,8 +28,68 @@ func TestLoginAndOut(t *testing.T) {
 func TestBruteForce(t *testing.T) {
 	f := newHandlerFixture(t)
 	defer f.Close()
+	f.r.DeleteAttempts(accountKey("slavik"))
 	loginWithUserAndPassword(t, f, "slavik", "wrong", false)
-	assert.EqualValues(t, 1, bruteForceMap.Len(), "brute force map not updated")
+	a, err := f.r.Attempts(accountKey("slavik"))
+	assert.NoError(t, err, "failed login not recorded")
+	assert.EqualValues(t, 1, a.Failures, "failed login not recorded")
 	loginWithUserAndPassword(t, f, "slavik", "password", true)
-	assert.EqualValues(t, 0, bruteForceMap.Len(), "brute force map not updated")
+	_, err = f.r.Attempts(accountKey("slavik"))
+	assert.Equal(t, repo.ErrNotFound, err, "failed logins not reset")
+}
+
+func TestChangePassword(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+	u := &domain.User{Username: "forced", Type: domain.UserTypeAdmin, ForcePasswordChange: true}
+	u.SetPassword("temporary password")
+	if err := f.r.SetUser(u); err != nil {
+		t.Fatal(err)
+	}
+	sessionValue := loginWithUserAndPassword(t, f, "forced", "temporary password", true)
+
+	req, _ := http.NewRequest("GET", "http://demisto.com/token", nil)
+	f.sendRequest(req, true, sessionValue)
+	assert.Equal(t, http.StatusForbidden, f.response.Code, "user must change the password first")
+
+	req, _ = http.NewRequest("POST", "http://demisto.com/user/password", bytes.NewBufferString(`{"current":"wrong","password":"a much better password"}`))
+	f.sendRequest(req, true, sessionValue)
+	assert.Equal(t, http.StatusUnauthorized, f.response.Code)
+
+	req, _ = http.NewRequest("POST", "http://demisto.com/user/password", bytes.NewBufferString(`{"current":"temporary password","password":"short"}`))
+	f.sendRequest(req, true, sessionValue)
+	assert.Equal(t, http.StatusBadRequest, f.response.Code)
+
+	req, _ = http.NewRequest("POST", "http://demisto.com/user/password", bytes.NewBufferString(`{"current":"temporary password","password":"a much better password"}`))
+	f.sendRequest(req, true, sessionValue)
+	assert.Equal(t, http.StatusNoContent, f.response.Code)
+
+	req, _ = http.NewRequest("GET", "http://demisto.com/token", nil)
+	f.sendRequest(req, true, sessionValue)
+	assert.Equal(t, http.StatusOK, f.response.Code)
+	loginWithUserAndPassword(t, f, "forced", "a much better password", true)
+}
+
+func TestConfirmTOTPLockout(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+	u := &domain.User{Username: "otpguess", Type: domain.UserTypeUser}
+	u.SetPassword("otp guessing password")
+	if err := f.r.SetUser(u); err != nil {
+		t.Fatal(err)
+	}
+	f.r.DeleteAttempts(otpKey("otpguess"))
+	sessionValue := loginWithUserAndPassword(t, f, "otpguess", "otp guessing password", true)
+
+	req, _ := http.NewRequest("POST", "http://demisto.com/user/totp", nil)
+	f.sendRequest(req, true, sessionValue)
+	assert.Equal(t, http.StatusOK, f.response.Code)
+	for i := 0; i < maxOTPAttempts; i++ {
+		req, _ = http.NewRequest("POST", "http://demisto.com/user/totp/confirm", bytes.NewBufferString(`{"code":"wrong"}`))
+		f.sendRequest(req, true, sessionValue)
+		assert.Equal(t, http.StatusUnauthorized, f.response.Code)
+	}
+	req, _ = http.NewRequest("POST", "http://demisto.com/user/totp/confirm", bytes.NewBufferString(`{"code":"wrong"}`))
+	f.sendRequest(req, true, sessionValue)
+	assert.Equal(t, http.StatusTooManyRequests, f.response.Code, "wrong codes must lock the user out")
 }
@@ -0,0 +1,100 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+	"github.com/gorilla/context"
+)
+
+// sessionSeenInterval limits how often the last request of a session is written
+const sessionSeenInterval = time.Minute
+
+// sessionsRevocation revokes all the sessions of a user
+type sessionsRevocation struct {
+	Username string `json:"username"`
+}
+
+// serverSession returns the stored session of the cookie. Returns ErrAuth if the session was revoked or expired.
+func (ac *AppContext) serverSession(cookie *session) (*domain.Session, error) {
+	if cookie.ID == "" {
+		return nil, ErrAuth
+	}
+	s, err := ac.r.Session(domain.TokenDigest(cookie.ID))
+	if err == repo.ErrNotFound {
+		log.Debugf("Revoked session of %s", cookie.User)
+		return nil, ErrAuth
+	} else if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if s.Username != cookie.User || s.Valid(now, time.Duration(conf.Options.Security.Timeout)*time.Minute) != nil {
+		return nil, ErrAuth
+	}
+	if now.Sub(s.LastSeen) > sessionSeenInterval {
+		s.LastSeen = now
+		if err = ac.r.SetSessionSeen(s.ID, now); err != nil {
+			log.WithError(err).Warnf("Unable to record use of session of %s", s.Username)
+		}
+	}
+	return s, nil
+}
+
+// sessionsHandler returns the sessions of the current user
+func (ac *AppContext) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	u := context.Get(r, "user").(*domain.User)
+	sessions, err := ac.r.Sessions(u.Username)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to load sessions of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if current, ok := context.Get(r, "session").(*domain.Session); ok {
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current.ID
+		}
+	}
+	writeJSON(w, sessions)
+}
+
+// revokeSessionHandler revokes one of the sessions of the current user
+func (ac *AppContext) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*domain.Session)
+	u := context.Get(r, "user").(*domain.User)
+	s, err := ac.r.Session(body.ID)
+	if err == repo.ErrNotFound || err == nil && s.Username != u.Username {
+		WriteError(w, ErrNotFound)
+		return
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to load session of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	switch err = ac.r.DeleteSession(s.ID); err {
+	case nil, repo.ErrNotFound:
+		log.Infof("User %s revoked a session from %s", u.Username, s.IP)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		log.WithError(err).Errorf("Unable to revoke session of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+	}
+}
+
+// revokeUserSessionsHandler revokes all the sessions of any user so they are logged out on their next request
+func (ac *AppContext) revokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*sessionsRevocation)
+	u := context.Get(r, "user").(*domain.User)
+	n, err := ac.r.DeleteUserSessions(body.Username)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to revoke sessions of %s", body.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	log.Infof("User %s revoked %d sessions of %s", u.Username, n, body.Username)
+	auditChange(r, body.Username, nil, map[string]int64{"revoked": n})
+	writeJSON(w, map[string]int64{"revoked": n})
+}
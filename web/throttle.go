@@ -0,0 +1,142 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+)
+
+var (
+	// accountThrottle protects each account from password guessing, even when spread over many addresses
+	accountThrottle = &domain.Throttle{MaxFailures: 5, Window: 15 * time.Minute, Lockout: time.Minute, MaxLockout: time.Hour}
+	// addressThrottle limits a single address trying many accounts or download tokens
+	addressThrottle = &domain.Throttle{MaxFailures: 20, Window: 15 * time.Minute, Lockout: 5 * time.Minute, MaxLockout: time.Hour}
+	// otpThrottle locks the user out after a few wrong codes as six digit codes are easy to guess
+	otpThrottle = &domain.Throttle{MaxFailures: maxOTPAttempts, Window: otpLockout, Lockout: otpLockout, MaxLockout: otpLockout}
+)
+
+// maxAttemptsKey is the size of the key column
+const maxAttemptsKey = 255
+
+func attemptsKey(kind, value string) string {
+	key := kind + ":" + value
+	if len(key) > maxAttemptsKey {
+		key = key[:maxAttemptsKey]
+	}
+	return key
+}
+
+func accountKey(username string) string {
+	return attemptsKey("account", strings.ToLower(username))
+}
+
+func addressKey(r *http.Request) string {
+	return attemptsKey("ip", remoteIP(r))
+}
+
+func otpKey(username string) string {
+	return attemptsKey("otp", strings.ToLower(username))
+}
+
+// retryAfter returns how long until all the keys are unlocked. Throttling fails open if the repository is down
+// since logins fail anyway in that case.
+func (ac *AppContext) retryAfter(keys ...string) time.Duration {
+	var res time.Duration
+	now := time.Now()
+	for _, key := range keys {
+		a, err := ac.r.Attempts(key)
+		if err == repo.ErrNotFound {
+			continue
+		} else if err != nil {
+			log.WithError(err).Errorf("Unable to load attempts of %s", key)
+			continue
+		}
+		if d := a.RetryAfter(now); d > res {
+			res = d
+		}
+	}
+	return res
+}
+
+// writeTooManyAttempts writes the error with the Retry-After header in seconds
+func writeTooManyAttempts(w http.ResponseWriter, e *Error, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+	WriteError(w, e)
+}
+
+// throttled writes ErrTooManyAttempts and returns true if any of the keys is locked. It never blocks.
+func (ac *AppContext) throttled(w http.ResponseWriter, keys ...string) bool {
+	d := ac.retryAfter(keys...)
+	if d == 0 {
+		return false
+	}
+	log.Warnf("Rejecting attempt of locked %s", strings.Join(keys, ", "))
+	writeTooManyAttempts(w, ErrTooManyAttempts, d)
+	return true
+}
+
+// attemptFailed records a failure of the key. Old attempts are cleaned whenever a new window starts.
+func (ac *AppContext) attemptFailed(t *domain.Throttle, key string) {
+	now := time.Now()
+	a, err := ac.r.FailAttempt(key, t, now)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to record failed attempt of %s", key)
+		return
+	}
+	if a.LockedUntil != nil && a.Failures == t.MaxFailures {
+		log.Warnf("Locked %s after %d failed attempts", key, a.Failures)
+	}
+	if a.Failures == 1 {
+		if err = ac.r.DeleteExpiredAttempts(now.Add(-time.Hour), now); err != nil {
+			log.WithError(err).Warn("Unable to delete expired attempts")
+		}
+	}
+}
+
+// loginThrottled checks the address and the account of a login
+func (ac *AppContext) loginThrottled(w http.ResponseWriter, r *http.Request, username string) bool {
+	if username == "" {
+		return ac.throttled(w, addressKey(r))
+	}
+	return ac.throttled(w, addressKey(r), accountKey(username))
+}
+
+// loginFailed counts a failed login against the address and the account
+func (ac *AppContext) loginFailed(r *http.Request, username string) {
+	ac.attemptFailed(addressThrottle, addressKey(r))
+	if username != "" {
+		ac.attemptFailed(accountThrottle, accountKey(username))
+	}
+}
+
+// loginSucceeded clears the failures of the account. Failures of the address are kept so an attacker cannot reset
+// them by logging in to an account of their own.
+func (ac *AppContext) loginSucceeded(username string) {
+	if err := ac.r.DeleteAttempts(accountKey(username)); err != nil {
+		log.WithError(err).Warnf("Unable to reset failed attempts of %s", username)
+	}
+}
+
+// otpThrottled writes ErrOTPLocked and returns true if the user is locked out after too many wrong codes.
+// The same lockout applies to every endpoint that checks a code.
+func (ac *AppContext) otpThrottled(w http.ResponseWriter, username string) bool {
+	d := ac.retryAfter(otpKey(username))
+	if d == 0 {
+		return false
+	}
+	log.Warnf("User %s is locked out after too many wrong codes", username)
+	writeTooManyAttempts(w, ErrOTPLocked, d)
+	return true
+}
+
+// otpSucceeded clears the wrong codes of the user
+func (ac *AppContext) otpSucceeded(username string) {
+	if err := ac.r.DeleteAttempts(otpKey(username)); err != nil {
+		log.WithError(err).Warnf("Unable to reset wrong codes of %s", username)
+	}
+}
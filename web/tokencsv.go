@@ -0,0 +1,246 @@
+package web
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/asaskevich/govalidator"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+	"github.com/demisto/download/util"
+	"github.com/gorilla/context"
+)
+
+// maxImportRows is the max number of tokens a single import can create
+const maxImportRows = 1000
+
+// importColumns are the columns an import CSV can have. Only email and downloads are mandatory.
+var importColumns = []string{"email", "downloads", "expires", "scope", "versions", "organization", "customer", "notes", "labels"}
+
+// importResultColumns are the columns of the import results CSV
+var importResultColumns = []string{"row", "email", "token", "downloads", "expires", "organization", "result", "error"}
+
+// importRow is a single line of the import CSV along with its validation result
+type importRow struct {
+	line   int
+	email  string
+	grant  domain.TokenGrant
+	result string
+	err    string
+}
+
+// importRecord returns the value of the given column or empty if the CSV does not have it
+func importRecord(record []string, header map[string]int, column string) string {
+	i, ok := header[column]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+// parseImportTime parses an expiration date (2006-01-02) or RFC3339 time
+func parseImportTime(val string) (*time.Time, error) {
+	if val == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, val, time.Local); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid expiration %s - use 2006-01-02 or RFC3339", val)
+}
+
+// parseImportRow validates the record and builds the token and user for it
+func (ac *AppContext) parseImportRow(record []string, header map[string]int, admin *domain.User, orgs map[string]bool) (*domain.TokenGrant, error) {
+	email := importRecord(record, header, "email")
+	if !govalidator.IsEmail(email) {
+		return nil, fmt.Errorf("Invalid email")
+	}
+	downloads, err := strconv.Atoi(importRecord(record, header, "downloads"))
+	if err != nil || downloads < 0 {
+		return nil, fmt.Errorf("Downloads must be a non negative number")
+	}
+	opts := &tokenOptions{
+		Scope:    util.SplitAndTrim(importRecord(record, header, "scope")),
+		Versions: importRecord(record, header, "versions"),
+		Customer: importRecord(record, header, "customer"),
+		Notes:    importRecord(record, header, "notes"),
+		Labels:   util.SplitAndTrim(importRecord(record, header, "labels")),
+	}
+	if opts.ExpiresAt, err = parseImportTime(importRecord(record, header, "expires")); err != nil {
+		return nil, err
+	}
+	if e := opts.validate(); e != nil {
+		return nil, fmt.Errorf("%s", e.Detail)
+	}
+	org := importRecord(record, header, "organization")
+	if org != "" {
+		if _, ok := orgs[org]; !ok {
+			_, err = ac.r.Organization(org)
+			if err != nil && err != repo.ErrNotFound {
+				return nil, err
+			}
+			orgs[org] = err == nil
+		}
+		if !orgs[org] {
+			return nil, fmt.Errorf("Organization %s does not exist", org)
+		}
+	}
+	token := domain.NewToken(downloads)
+	opts.apply(token, admin)
+	u := &domain.User{Username: domain.TokenUsername(token.Name, email), Email: email, Token: token.Name, Organization: org, Type: domain.UserTypeUser, LastLogin: time.Now()}
+	return &domain.TokenGrant{Token: token, User: u}, nil
+}
+
+// writeImportResults writes the results CSV with the generated tokens or the errors
+func writeImportResults(w http.ResponseWriter, status int, rows []importRow) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(status)
+	cw := csv.NewWriter(w)
+	cw.Write(importResultColumns)
+	for _, row := range rows {
+		rec := []string{strconv.Itoa(row.line), row.email, "", "", "", "", row.result, row.err}
+		if t := row.grant.Token; t != nil {
+			rec[3] = strconv.Itoa(t.Downloads)
+			if t.ExpiresAt != nil {
+				rec[4] = t.ExpiresAt.UTC().Format(time.RFC3339)
+			}
+			rec[5] = row.grant.User.Organization
+			if row.result == "created" {
+				rec[2] = t.Plain
+			}
+		}
+		writeCSVRow(cw, rec)
+	}
+	cw.Flush()
+}
+
+// importTokensHandler creates tokens and users for every row of the CSV body. All the rows are validated first
+// and if any of them is invalid nothing is created. Either way, the response is a CSV with the result of each row.
+func (ac *AppContext) importTokensHandler(w http.ResponseWriter, r *http.Request) {
+	admin := context.Get(r, "user").(*domain.User)
+	cr := csv.NewReader(r.Body)
+	cr.FieldsPerRecord = -1
+	first, err := cr.Read()
+	if err != nil {
+		log.WithError(err).Warn("Unable to read import header")
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid CSV", Detail: "The CSV must start with a header row"})
+		return
+	}
+	header := make(map[string]int)
+	for i, column := range first {
+		header[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	for column := range header {
+		if !util.In(importColumns, column) {
+			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid CSV", Detail: "Unknown column " + column})
+			return
+		}
+	}
+	if _, ok := header["email"]; !ok {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid CSV", Detail: "Missing email column"})
+		return
+	}
+	if _, ok := header["downloads"]; !ok {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid CSV", Detail: "Missing downloads column"})
+		return
+	}
+	var rows []importRow
+	valid := true
+	orgs := make(map[string]bool)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.WithError(err).Warn("Unable to read import CSV")
+			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid CSV", Detail: err.Error()})
+			return
+		}
+		if len(rows) == maxImportRows {
+			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid CSV", Detail: fmt.Sprintf("Import is limited to %d rows", maxImportRows)})
+			return
+		}
+		line, _ := cr.FieldPos(0)
+		row := importRow{line: line, email: importRecord(record, header, "email"), result: "valid"}
+		grant, err := ac.parseImportRow(record, header, admin, orgs)
+		if err != nil {
+			row.result, row.err, valid = "invalid", err.Error(), false
+		} else {
+			row.grant = *grant
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid CSV", Detail: "No tokens to import"})
+		return
+	}
+	if !valid {
+		writeImportResults(w, http.StatusBadRequest, rows)
+		return
+	}
+	grants := make([]domain.TokenGrant, len(rows))
+	for i := range rows {
+		grants[i] = rows[i].grant
+	}
+	log.Infof("Importing %d tokens", len(grants))
+	if err = ac.r.ImportTokens(grants, r.FormValue("reason")); err != nil {
+		log.WithError(err).Error("Unable to import tokens")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	for i := range rows {
+		rows[i].result = "created"
+	}
+	auditChange(r, "", nil, grants, "Token.token", "User.hash")
+	if ac.mailer != nil {
+		go ac.sendTokens(grants)
+	}
+	writeImportResults(w, http.StatusOK, rows)
+}
+
+// exportTokensHandler returns all the tokens with their users and usage as CSV
+func (ac *AppContext) exportTokensHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := ac.r.TokensUsage()
+	if err != nil {
+		log.WithError(err).Error("Unable to retrieve tokens usage")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=tokens.csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "hint", "email", "organization", "customer", "downloads", "used", "expires", "expired", "revoked",
+		"scope", "versions", "labels", "notes", "created_by", "created_at", "last_used"})
+	for _, u := range usage {
+		writeCSVRow(cw, []string{u.Name, u.Hint, u.Email, u.Organization, u.Customer, strconv.Itoa(u.Downloads), strconv.Itoa(u.Used),
+			formatTime(u.ExpiresAt), strconv.FormatBool(u.Expired), formatTime(u.RevokedAt), strings.Join(u.Scope, ","), u.Versions,
+			strings.Join(u.Labels, ","), u.Notes, u.CreatedBy, formatTime(&u.CreatedAt), formatTime(u.LastUsed)})
+	}
+	cw.Flush()
+}
+
+// writeCSVRow writes the row with cells that spreadsheets would run as formulas prefixed with a quote so they are
+// shown as text
+func writeCSVRow(cw *csv.Writer, row []string) error {
+	for i, cell := range row {
+		if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+			row[i] = "'" + cell
+		}
+	}
+	return cw.Write(row)
+}
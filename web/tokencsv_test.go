@@ -0,0 +1,17 @@
+package web
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteCSVRowEscapesFormulas(t *testing.T) {
+	buf := &bytes.Buffer{}
+	cw := csv.NewWriter(buf)
+	writeCSVRow(cw, []string{"=HYPERLINK(\"http://evil\")", "+1", "-2", "@SUM(A1)", "jane@demisto.com", "", "5"})
+	cw.Flush()
+	assert.Equal(t, "\"'=HYPERLINK(\"\"http://evil\"\")\",'+1,'-2,'@SUM(A1),jane@demisto.com,,5\n", buf.String())
+}
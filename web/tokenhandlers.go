@@ -1,41 +1,115 @@
 package web
 
 import (
+	"encoding/json"
 	"net/http"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+	"github.com/demisto/download/util"
 	"github.com/gorilla/context"
 	"github.com/asaskevich/govalidator"
 	"time"
 )
 
-// tokenHandler handles get retrieve tokens requests
+// tokenHandler handles get retrieve tokens requests. By default only open tokens are returned.
+// The tokens can be filtered by label (can be repeated), customer and createdBy parameters
+// and all=true returns also the used up and expired tokens.
 func (ac *AppContext) tokenHandler(w http.ResponseWriter, r *http.Request) {
-	tokens, err := ac.r.OpenTokens()
+	q := r.URL.Query()
+	f := &domain.TokenFilter{Customer: q.Get("customer"), CreatedBy: q.Get("createdBy"), All: q.Get("all") == "true"}
+	for _, l := range q["label"] {
+		f.Labels = append(f.Labels, util.SplitAndTrim(l)...)
+	}
+	tokens, err := ac.r.SearchTokens(f)
 	if err != nil {
 		log.WithError(err).Warn("Unable to retrieve tokens")
 	}
 	writeJSON(w, tokens)
 }
 
+// tokenOptions are the optional restrictions that can be set when generating tokens
+type tokenOptions struct {
+	NotBefore *time.Time   `json:"notBefore"`
+	ExpiresAt *time.Time   `json:"expiresAt"`
+	Scope     domain.Scope `json:"scope"`
+	Versions  string       `json:"versions"`
+	Customer  string       `json:"customer"`
+	Notes     string       `json:"notes"`
+	Labels    []string     `json:"labels"`
+	// Reason is recorded in the ledger of the generated tokens
+	Reason string `json:"reason"`
+}
+
+// validate the options and return the relevant error if they do not make sense
+func (to *tokenOptions) validate() *Error {
+	if to.ExpiresAt != nil {
+		if !to.ExpiresAt.After(time.Now()) || to.NotBefore != nil && !to.ExpiresAt.After(*to.NotBefore) {
+			return ErrInvalidTokenWindow
+		}
+	}
+	if e := validateScope(to.Scope, to.Versions); e != nil {
+		return e
+	}
+	return validateLabels(to.Labels)
+}
+
+// validateLabels makes sure the labels can be searched
+func validateLabels(labels []string) *Error {
+	if err := domain.ValidateLabels(labels); err != nil {
+		return &Error{ID: "bad_request", Status: 400, Title: "Invalid Token Labels", Detail: err.Error()}
+	}
+	return nil
+}
+
+// validateScope checks the download patterns and the versions constraint
+func validateScope(scope domain.Scope, versions string) *Error {
+	if err := scope.Validate(); err != nil {
+		return &Error{ID: "bad_request", Status: 400, Title: "Invalid Token Scope", Detail: err.Error()}
+	}
+	if err := domain.ValidateVersions(versions); err != nil {
+		return &Error{ID: "bad_request", Status: 400, Title: "Invalid Token Versions", Detail: err.Error()}
+	}
+	return nil
+}
+
+// apply the options to the given token created by the given admin
+func (to *tokenOptions) apply(t *domain.Token, creator *domain.User) {
+	t.NotBefore = to.NotBefore
+	t.ExpiresAt = to.ExpiresAt
+	t.Scope = to.Scope
+	t.Versions = to.Versions
+	t.Customer = to.Customer
+	t.Notes = to.Notes
+	t.Labels = to.Labels
+	t.CreatedBy = creator.Username
+}
+
 type newTokens struct {
 	Count     int `json:"count"`
 	Downloads int `json:"downloads"`
+	tokenOptions
 }
 
 // createTokensHandler handles creation of new tokens
 func (ac *AppContext) createTokensHandler(w http.ResponseWriter, r *http.Request) {
 	nt := context.Get(r, "body").(*newTokens)
+	u := context.Get(r, "user").(*domain.User)
 	log.Infof("Generating tokens: %#v", nt)
 	if nt.Count > 50 || nt.Count < 1 {
 		WriteError(w, ErrBadRequest)
 		return
 	}
+	if e := nt.validate(); e != nil {
+		WriteError(w, e)
+		return
+	}
 	tokens := make([]domain.Token, 0, nt.Count)
 	for i := 0; i < nt.Count; i++ {
 		token := domain.NewToken(nt.Downloads)
-		err := ac.r.SetToken(token)
+		nt.apply(token, u)
+		err := ac.r.SetTokenWithEvent(token, &domain.TokenEvent{Type: domain.TokenEventIssued, Delta: token.Downloads, Actor: u.Username, Reason: nt.Reason})
 		if err != nil {
 			log.WithError(err).Warnf("Unable to generate token - %#v", token)
 			WriteError(w, ErrBadRequest)
@@ -43,48 +117,266 @@ func (ac *AppContext) createTokensHandler(w http.ResponseWriter, r *http.Request
 		}
 		tokens = append(tokens, *token)
 	}
+	auditChange(r, "", nil, tokens, "token")
 	writeJSON(w, tokens)
 }
 
-// updateToken updates a single token
+// optionalTime distinguishes a time that was not given from one that was explicitly set to null
+type optionalTime struct {
+	Set  bool
+	Time *time.Time
+}
+
+// UnmarshalJSON implements json.Unmarshaler and is also called for null values
+func (o *optionalTime) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	return json.Unmarshal(data, &o.Time)
+}
+
+// tokenUpdate are the fields of a token admins can change. Only the given fields are changed and
+// null clears the activation or expiration time.
+type tokenUpdate struct {
+	Name      string        `json:"name"`
+	Downloads *int          `json:"downloads"`
+	NotBefore optionalTime  `json:"notBefore"`
+	ExpiresAt optionalTime  `json:"expiresAt"`
+	Scope     *domain.Scope `json:"scope"`
+	Versions  *string       `json:"versions"`
+	Customer  *string       `json:"customer"`
+	Notes     *string       `json:"notes"`
+	Labels    *[]string     `json:"labels"`
+}
+
+// apply the given fields to the token and return the relevant error if the result does not make sense
+func (tu *tokenUpdate) apply(t *domain.Token) error {
+	if tu.Downloads != nil {
+		if *tu.Downloads < 0 {
+			return ErrBadRequest
+		}
+		t.Downloads = *tu.Downloads
+	}
+	if tu.NotBefore.Set {
+		t.NotBefore = tu.NotBefore.Time
+	}
+	if tu.ExpiresAt.Set {
+		t.ExpiresAt = tu.ExpiresAt.Time
+	}
+	if t.ExpiresAt != nil && t.NotBefore != nil && !t.ExpiresAt.After(*t.NotBefore) {
+		return ErrInvalidTokenWindow
+	}
+	if tu.Scope != nil {
+		t.Scope = *tu.Scope
+	}
+	if tu.Versions != nil {
+		t.Versions = *tu.Versions
+	}
+	if e := validateScope(t.Scope, t.Versions); e != nil {
+		return e
+	}
+	if tu.Labels != nil {
+		if e := validateLabels(*tu.Labels); e != nil {
+			return e
+		}
+		t.Labels = *tu.Labels
+	}
+	if tu.Customer != nil {
+		t.Customer = *tu.Customer
+	}
+	if tu.Notes != nil {
+		t.Notes = *tu.Notes
+	}
+	// The expiration job will mark it again if needed so we allow extending expired tokens
+	t.Expired = t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now())
+	return nil
+}
+
+// updateToken updates the given fields of a single token. If the downloads change, the difference is recorded
+// in the ledger with the reason given in the reason parameter.
 func (ac *AppContext) updateToken(w http.ResponseWriter, r *http.Request) {
-	t := context.Get(r, "body").(*domain.Token)
-	log.Infof("Updating token: %#v", t)
-	err := ac.r.SetToken(t)
-	if err != nil {
-		log.WithError(err).Warnf("Unable to save token - %#v", t)
+	tu := context.Get(r, "body").(*tokenUpdate)
+	u := context.Get(r, "user").(*domain.User)
+	log.Infof("Updating token: %#v", tu)
+	if tu.Name == "" {
+		WriteError(w, ErrMissingPartRequest)
+		return
+	}
+	old, t, err := ac.r.UpdateToken(tu.Name, tu.apply, u.Username, r.FormValue("reason"))
+	if e, ok := err.(*Error); ok {
+		WriteError(w, e)
+		return
+	} else if err == repo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	} else if err != nil {
+		log.WithError(err).Warnf("Unable to save token - %s", tu.Name)
 		WriteError(w, ErrBadRequest)
 		return
 	}
+	auditChange(r, tu.Name, old, t, "token")
 	writeJSON(w, t)
 }
 
+// tokenAdjustment adds (or with a negative delta removes) downloads from a token
+type tokenAdjustment struct {
+	Name  string `json:"name"`
+	Delta int    `json:"delta"`
+	// Type is either topped_up (default) or refunded
+	Type   domain.TokenEventType `json:"type"`
+	Reason string                `json:"reason"`
+}
+
+// adjustTokenHandler tops up or refunds downloads to a token through the ledger
+func (ac *AppContext) adjustTokenHandler(w http.ResponseWriter, r *http.Request) {
+	adj := context.Get(r, "body").(*tokenAdjustment)
+	u := context.Get(r, "user").(*domain.User)
+	if adj.Type == "" {
+		adj.Type = domain.TokenEventToppedUp
+	}
+	if adj.Name == "" || adj.Delta == 0 || adj.Type != domain.TokenEventToppedUp && adj.Type != domain.TokenEventRefunded {
+		WriteError(w, ErrBadRequest)
+		return
+	}
+	log.Infof("Adjusting token %s by %d (%s)", adj.Name, adj.Delta, adj.Type)
+	t, err := ac.r.AdjustToken(&domain.TokenEvent{Token: adj.Name, Type: adj.Type, Delta: adj.Delta, Actor: u.Username, Reason: adj.Reason})
+	switch err {
+	case nil:
+		auditChange(r, adj.Name, nil, adj)
+		writeJSON(w, t)
+	case repo.ErrNotFound:
+		WriteError(w, ErrNotFound)
+	case domain.ErrTokenUsed:
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid Adjustment", Detail: "Token downloads cannot go below zero"})
+	default:
+		log.WithError(err).Warnf("Unable to adjust token - %s", adj.Name)
+		WriteError(w, ErrInternalServer)
+	}
+}
+
+// tokenHistoryHandler returns the ledger of the token given in the name parameter and checks it against the token downloads
+func (ac *AppContext) tokenHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	t, err := ac.r.Token(name)
+	if err == repo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	} else if err != nil {
+		log.WithError(err).Warnf("Unable to load token - %s", name)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	events, err := ac.r.TokenEvents(name)
+	if err != nil {
+		log.WithError(err).Warnf("Unable to load token events - %s", name)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	h := &domain.TokenHistory{Token: t, Events: events}
+	for _, e := range events {
+		h.LedgerBalance += e.Delta
+	}
+	h.Consistent = h.LedgerBalance == t.Downloads
+	if !h.Consistent {
+		log.Warnf("Token %s has %d downloads but its ledger balance is %d", name, t.Downloads, h.LedgerBalance)
+	}
+	writeJSON(w, h)
+}
+
 type newEmailToken struct {
 	Email     string `json:"email"`
-	Downloads int `json:"downloads"`
+	Downloads int    `json:"downloads"`
+	// Organization to attach the user to. The downloads are then drawn from the organization pool.
+	Organization string `json:"organization"`
+	tokenOptions
 }
 
-// createEmailTokenHandler handles creation of new tokens
+// createEmailTokenHandler creates a token for the email and emails the download link if emails are configured
 func (ac *AppContext) createEmailTokenHandler(w http.ResponseWriter, r *http.Request) {
 	nt := context.Get(r, "body").(*newEmailToken)
+	admin := context.Get(r, "user").(*domain.User)
 	if !govalidator.IsEmail(nt.Email) {
 		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Invalid Email", Detail: "Invalid email provided"})
 		return
 	}
+	if e := nt.validate(); e != nil {
+		WriteError(w, e)
+		return
+	}
+	if e := ac.validateOrganization(nt.Organization); e != nil {
+		WriteError(w, e)
+		return
+	}
 	log.Infof("Generating token for : %s with %d downloads", nt.Email, nt.Downloads)
 	token := domain.NewToken(nt.Downloads)
-	err := ac.r.SetToken(token)
+	nt.apply(token, admin)
+	err := ac.r.SetTokenWithEvent(token, &domain.TokenEvent{Type: domain.TokenEventIssued, Delta: token.Downloads, Actor: admin.Username, Reason: nt.Reason})
 	if err != nil {
 		log.WithError(err).Warnf("Unable to generate token - %#v", token)
 		WriteError(w, ErrBadRequest)
 		return
 	}
-	u := &domain.User{Username: token.Name + "*-*" + nt.Email, Email: nt.Email, Token: token.Name, Type: domain.UserTypeUser, LastLogin: time.Now()}
+	u := &domain.User{Username: domain.TokenUsername(token.Name, nt.Email), Email: nt.Email, Token: token.Name, Organization: nt.Organization, Type: domain.UserTypeUser, LastLogin: time.Now()}
 	err = ac.r.SetUser(u)
 	if err != nil {
 		log.WithError(err).Warnf("Error saving token user - %#v", u)
 		WriteError(w, ErrInternalServer)
 		return
 	}
+	auditChange(r, u.Username, nil, token, "token")
+	if ac.mailer != nil {
+		go ac.sendToken(u, token)
+	}
 	writeJSON(w, token)
 }
+
+// leakedToken is a report of a secret scanner about a token found in a public place
+type leakedToken struct {
+	Token  string `json:"token"`
+	URL    string `json:"url"`
+	Source string `json:"source"`
+}
+
+// leakedTokenResult is the result for each reported token
+type leakedTokenResult struct {
+	Hint   string `json:"hint"`
+	Result string `json:"result"`
+}
+
+// maxLeakedTokens is the max number of tokens a single report can include
+const maxLeakedTokens = 100
+
+// leakedTokensHandler receives tokens found by secret scanners and revokes them.
+// Anyone holding a token can revoke it so there is no authentication. Tokens that do not match
+// the format are rejected without touching the DB.
+func (ac *AppContext) leakedTokensHandler(w http.ResponseWriter, r *http.Request) {
+	reports := *context.Get(r, "body").(*[]leakedToken)
+	if len(reports) == 0 || len(reports) > maxLeakedTokens {
+		WriteError(w, ErrBadRequest)
+		return
+	}
+	res := make([]leakedTokenResult, 0, len(reports))
+	now := time.Now()
+	for _, report := range reports {
+		result := leakedTokenResult{Hint: domain.TokenHint(report.Token), Result: "malformed"}
+		if domain.ValidTokenFormat(report.Token) {
+			err := ac.r.RevokeToken(domain.TokenDigest(report.Token), "scanner:"+report.Source, "Leaked at "+report.URL, now)
+			switch err {
+			case nil:
+				log.Warnf("Revoked leaked token %s found at [%s] by [%s]", result.Hint, report.URL, report.Source)
+				result.Result = "revoked"
+			case repo.ErrNotFound:
+				result.Result = "unknown"
+			default:
+				log.WithError(err).Errorf("Unable to revoke leaked token %s", result.Hint)
+				WriteError(w, ErrInternalServer)
+				return
+			}
+		}
+		res = append(res, result)
+	}
+	writeJSON(w, res)
+}
+
+// tokenPatternHandler publishes the token format for secret scanners
+func (ac *AppContext) tokenPatternHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"prefix": domain.TokenPrefix, "pattern": domain.TokenPattern, "report": "/tokens/leaked"})
+}
@@ -0,0 +1,171 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeakedTokens(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+
+	token := domain.NewToken(3)
+	if err := f.r.SetToken(token); err != nil {
+		t.Fatal(err)
+	}
+	unknown := domain.NewPlainToken()
+	b, _ := json.Marshal([]leakedToken{{Token: token.Plain, URL: "https://github.com/acme/leak"}, {Token: unknown}, {Token: token.Plain + "x"}})
+	req, err := http.NewRequest("POST", "http://demisto.com/tokens/leaked", bytes.NewBuffer(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.sendRequest(req, false, "")
+	if f.response.Code != http.StatusOK {
+		t.Fatalf("Did not receive the correct status - %v %v", f.response.Code, f.response.Body)
+	}
+	var res []leakedTokenResult
+	if err = json.NewDecoder(f.response.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, res, 3) {
+		assert.Equal(t, "revoked", res[0].Result)
+		assert.Equal(t, "unknown", res[1].Result)
+		assert.Equal(t, "malformed", res[2].Result)
+	}
+	revoked, err := f.r.Token(token.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, domain.ErrTokenRevoked, revoked.Valid(revoked.CreatedAt))
+}
+
+// recordingMailer passes the emails to the test instead of sending them
+type recordingMailer struct {
+	emails chan *util.Email
+}
+
+func (m *recordingMailer) SendEmail(e *util.Email) error {
+	m.emails <- e
+	return nil
+}
+
+func TestEmailToken(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+	m := &recordingMailer{emails: make(chan *util.Email, 1)}
+	f.appcontext.mailer = m
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf.Options.Mail.Templates = dir
+	defer func() { conf.Options.Mail.Templates = "" }()
+	ioutil.WriteFile(filepath.Join(dir, "token.org-acme.subject"), []byte("Your {{.Organization}} download"), 0600)
+	if err = f.r.SetOrganization(&domain.Organization{Name: "acme", Downloads: 10}); err != nil {
+		t.Fatal(err)
+	}
+	sessionValue := loginWithUserAndPassword(t, f, "slavik", "password", true)
+
+	req, _ := http.NewRequest("POST", "http://demisto.com/tokens/email", bytes.NewBufferString(`{"email":"mailed@example.com","downloads":2,"organization":"acme"}`))
+	f.sendRequest(req, true, sessionValue)
+	if f.response.Code != http.StatusOK {
+		t.Fatalf("Unable to issue token - %v %v", f.response.Code, f.response.Body)
+	}
+	var token domain.Token
+	if err = json.NewDecoder(f.response.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+	var e *util.Email
+	select {
+	case e = <-m.emails:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No email was sent")
+	}
+	assert.Equal(t, []string{"mailed@example.com"}, e.To)
+	assert.Equal(t, "Your acme download", e.Subject, "the organization template must be used")
+	assert.Contains(t, e.Text, "/download-link?")
+	assert.Contains(t, e.Text, "token="+token.Plain)
+	assert.Contains(t, e.HTML, `<a href="`)
+
+	// Opening the link only shows the page, so scanners that follow it do not take a download
+	req, _ = http.NewRequest("GET", "http://demisto.com/download-link?"+url.Values{"token": {token.Plain}, "email": {"mailed@example.com"}}.Encode(), nil)
+	f.sendRequest(req, false, "")
+	assert.Equal(t, http.StatusOK, f.response.Code)
+	assert.Contains(t, f.response.Body.String(), `action="/download-params"`)
+	opened, err := f.r.Token(token.Name)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, opened.Downloads)
+		assert.Nil(t, opened.LastUsed)
+	}
+
+	// The delivery status is stored after sending
+	var emails []domain.EmailDelivery
+	for i := 0; i < 50; i++ {
+		emails, err = f.r.EmailDeliveries(&domain.EmailFilter{Recipient: "mailed@example.com", Limit: 1})
+		if err != nil || len(emails) == 1 && emails[0].Status == domain.EmailSent {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if assert.NoError(t, err) && assert.Len(t, emails, 1) {
+		assert.Equal(t, domain.EmailSent, emails[0].Status)
+		assert.Equal(t, mailToken, emails[0].Template)
+	}
+}
+
+func TestUpdateTokenKeepsOmittedFields(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+
+	expires := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	token := domain.NewToken(3)
+	token.Scope = domain.Scope{"demisto-*"}
+	token.ExpiresAt = &expires
+	token.Customer = "acme"
+	if err := f.r.SetToken(token); err != nil {
+		t.Fatal(err)
+	}
+	sessionValue := loginWithUserAndPassword(t, f, "slavik", "password", true)
+
+	req, _ := http.NewRequest("POST", "http://demisto.com/token", bytes.NewBufferString(`{"name":"`+token.Name+`","downloads":7}`))
+	f.sendRequest(req, true, sessionValue)
+	if f.response.Code != http.StatusOK {
+		t.Fatalf("Unable to update token - %v %v", f.response.Code, f.response.Body)
+	}
+	updated, err := f.r.Token(token.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 7, updated.Downloads)
+	assert.Equal(t, token.Scope, updated.Scope, "the scope was not given and must not change")
+	assert.Equal(t, "acme", updated.Customer)
+	if assert.NotNil(t, updated.ExpiresAt, "the expiration was not given and must not change") {
+		assert.True(t, expires.Equal(*updated.ExpiresAt))
+	}
+
+	// An explicit null removes the expiration
+	req, _ = http.NewRequest("POST", "http://demisto.com/token", bytes.NewBufferString(`{"name":"`+token.Name+`","expiresAt":null}`))
+	f.sendRequest(req, true, sessionValue)
+	if f.response.Code != http.StatusOK {
+		t.Fatalf("Unable to update token - %v %v", f.response.Code, f.response.Body)
+	}
+	updated, err = f.r.Token(token.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, updated.ExpiresAt)
+	assert.Equal(t, 7, updated.Downloads)
+}
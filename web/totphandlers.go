@@ -0,0 +1,228 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+	"github.com/gorilla/context"
+)
+
+const (
+	// otpCookie holds the pending login of a user that still needs to provide the one time password
+	otpCookie = `SDOTP`
+	// otpTimeout is how long the user has to provide the one time password after the password
+	otpTimeout = 5 * time.Minute
+	// maxOTPAttempts is how many wrong codes a user can try before being locked out
+	maxOTPAttempts = 5
+	// otpLockout is how long a user is locked out after too many wrong codes
+	otpLockout = 15 * time.Minute
+)
+
+// pendingLogin is the encrypted content of the OTP cookie
+type pendingLogin struct {
+	User string `json:"user"`
+	When int64  `json:"when"`
+}
+
+type otpCredentials struct {
+	// Code from the authenticator app
+	Code string `json:"code"`
+	// RecoveryCode can be used instead of the code
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// otpChallenge is the response to a valid password of a user with TOTP. The session is only created
+// once the one time password is provided to /login/otp.
+func (ac *AppContext) otpChallenge(w http.ResponseWriter, u *domain.User) {
+	val, err := sealCookie(&pendingLogin{User: u.Username, When: time.Now().Unix()})
+	if err != nil {
+		log.WithError(err).Error("Unable to encrypt pending login")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     otpCookie,
+		Value:    val,
+		Path:     "/login/otp",
+		Expires:  time.Now().Add(otpTimeout),
+		MaxAge:   int(otpTimeout.Seconds()),
+		Secure:   conf.Options.SSL.Key != "",
+		HttpOnly: true,
+	})
+	writeJSON(w, map[string]bool{"otpRequired": true})
+}
+
+// loginOTPHandler is the second login step for users with TOTP
+func (ac *AppContext) loginOTPHandler(w http.ResponseWriter, r *http.Request) {
+	creds := context.Get(r, "body").(*otpCredentials)
+	cookie, err := r.Cookie(otpCookie)
+	if err != nil {
+		WriteError(w, ErrAuth)
+		return
+	}
+	var pending pendingLogin
+	if err = openCookie(cookie.Value, &pending); err != nil || time.Since(time.Unix(pending.When, 0)) > otpTimeout {
+		WriteError(w, ErrAuth)
+		return
+	}
+	if ac.otpThrottled(w, pending.User) {
+		return
+	}
+	u, err := ac.r.User(pending.User)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to load user %s with pending login", pending.User)
+		WriteError(w, ErrAuth)
+		return
+	}
+	if creds.RecoveryCode != "" {
+		err = ac.useRecoveryCode(u, creds.RecoveryCode)
+		if err == nil {
+			log.Warnf("User %s used a recovery code, %d left", u.Username, len(u.RecoveryCodes))
+		}
+	} else {
+		err = ac.useTOTP(u, creds.Code)
+	}
+	if !ac.otpChecked(w, u, err) {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: otpCookie, Value: "", Path: "/login/otp", Expires: time.Now(), MaxAge: -1, Secure: conf.Options.SSL.Key != "", HttpOnly: true})
+	ac.loginResponse(w, r, u)
+}
+
+// useTOTP checks the code of the user and records its step in the database before it is accepted so the same code
+// cannot be used again, even by a concurrent request
+func (ac *AppContext) useTOTP(u *domain.User, code string) error {
+	if err := u.CheckTOTP(code, time.Now()); err != nil {
+		return err
+	}
+	return ac.r.UseTOTPStep(u.Username, u.TOTPLastStep)
+}
+
+// useRecoveryCode removes the recovery code of the user in the database before it is accepted so the same code
+// cannot be used again, even by a concurrent request
+func (ac *AppContext) useRecoveryCode(u *domain.User, code string) error {
+	loaded := u.RecoveryCodes
+	if err := u.UseRecoveryCode(code); err != nil {
+		return err
+	}
+	return ac.r.UseRecoveryCode(u.Username, loaded, u.RecoveryCodes)
+}
+
+// otpChecked handles the result of using a code. Wrong or already used codes count as failed attempts and any other
+// error fails the request. Returns true if the code was accepted.
+func (ac *AppContext) otpChecked(w http.ResponseWriter, u *domain.User, err error) bool {
+	switch err {
+	case nil:
+		ac.otpSucceeded(u.Username)
+		return true
+	case domain.ErrInvalidOTP, repo.ErrAlreadyUsed:
+		ac.attemptFailed(otpThrottle, otpKey(u.Username))
+		WriteError(w, ErrInvalidOTP)
+	default:
+		log.WithError(err).Errorf("Unable to check the one time password of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+	}
+	return false
+}
+
+// enrollTOTPHandler generates a new secret for the current user. TOTP is enabled once a code is confirmed.
+func (ac *AppContext) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	u := context.Get(r, "user").(*domain.User)
+	if u.TOTPEnabled {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "TOTP Enabled", Detail: "Two factor authentication is already enabled. Disable it first to enroll again."})
+		return
+	}
+	secret, err := u.NewTOTPSecret()
+	if err != nil {
+		log.WithError(err).Error("Unable to generate TOTP secret")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if err = ac.r.SetUser(u); err != nil {
+		log.WithError(err).Errorf("Unable to save TOTP secret of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	writeJSON(w, map[string]string{"secret": secret, "uri": u.TOTPURI(secret)})
+}
+
+// confirmTOTPHandler enables TOTP for the current user after validating a code and returns the recovery codes
+func (ac *AppContext) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	creds := context.Get(r, "body").(*otpCredentials)
+	u := context.Get(r, "user").(*domain.User)
+	if u.TOTPEnabled {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "TOTP Enabled", Detail: "Two factor authentication is already enabled"})
+		return
+	}
+	if ac.otpThrottled(w, u.Username) {
+		return
+	}
+	if !ac.otpChecked(w, u, ac.useTOTP(u, creds.Code)) {
+		return
+	}
+	u.TOTPEnabled = true
+	codes := u.NewRecoveryCodes()
+	if err := ac.r.SetUser(u); err != nil {
+		log.WithError(err).Errorf("Unable to enable TOTP for %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	log.Infof("User %s enabled two factor authentication", u.Username)
+	writeJSON(w, map[string][]string{"recoveryCodes": codes})
+}
+
+// recoveryCodesHandler replaces the recovery codes of the current user after validating a code
+func (ac *AppContext) recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	creds := context.Get(r, "body").(*otpCredentials)
+	u := context.Get(r, "user").(*domain.User)
+	if !u.TOTPEnabled {
+		WriteError(w, ErrInvalidOTP)
+		return
+	}
+	if ac.otpThrottled(w, u.Username) {
+		return
+	}
+	if !ac.otpChecked(w, u, ac.useTOTP(u, creds.Code)) {
+		return
+	}
+	codes := u.NewRecoveryCodes()
+	if err := ac.r.SetUser(u); err != nil {
+		log.WithError(err).Errorf("Unable to save recovery codes of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	writeJSON(w, map[string][]string{"recoveryCodes": codes})
+}
+
+// disableTOTPHandler disables TOTP for the current user after validating the password
+func (ac *AppContext) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	creds := context.Get(r, "body").(*credentials)
+	u := context.Get(r, "user").(*domain.User)
+	if ac.loginThrottled(w, r, u.Username) {
+		return
+	}
+	if !u.CheckPassword(creds.Password) {
+		ac.loginFailed(r, u.Username)
+		WriteError(w, ErrCredentials)
+		return
+	}
+	ac.loginSucceeded(u.Username)
+	u.DisableTOTP()
+	if err := ac.r.SetUser(u); err != nil {
+		log.WithError(err).Errorf("Unable to disable TOTP for %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	log.Warnf("User %s disabled two factor authentication", u.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// totpRequired checks if the user must enroll in TOTP before doing anything else. Single sign-on users are exempt
+// since the IdP is responsible for their second factor.
+func totpRequired(u *domain.User) bool {
+	return conf.Options.Security.RequireTOTP && u.Type == domain.UserTypeAdmin && !u.TOTPEnabled && !u.SingleSignOn()
+}
@@ -0,0 +1,22 @@
+package web
+
+import (
+	"testing"
+
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPRequired(t *testing.T) {
+	conf.Options.Security.RequireTOTP = true
+	defer func() { conf.Options.Security.RequireTOTP = false }()
+	local := &domain.User{Username: "admin", Type: domain.UserTypeAdmin}
+	local.SetPassword("password")
+	assert.True(t, totpRequired(local))
+	// Directory users have no local password but still sign in with one
+	assert.True(t, totpRequired(&domain.User{Username: "ldap-admin", Type: domain.UserTypeAdmin, Source: domain.UserSourceLDAP}))
+	assert.False(t, totpRequired(&domain.User{Username: "sso-admin", Type: domain.UserTypeAdmin, Source: domain.UserSourceOIDC}))
+	assert.False(t, totpRequired(&domain.User{Username: "enrolled", Type: domain.UserTypeAdmin, TOTPEnabled: true}))
+	assert.False(t, totpRequired(&domain.User{Username: "customer", Type: domain.UserTypeUser}))
+}
@@ -0,0 +1,131 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+)
+
+const (
+	// defaultUserPageSize is the page size when the limit parameter is not given
+	defaultUserPageSize = 50
+	// userDetailsDownloads is how many recent downloads are shown in the user details
+	userDetailsDownloads = 20
+	// userDetailsEmails is how many recent emails are shown in the user details
+	userDetailsEmails = 20
+	// defaultEmailPageSize is the page size of email deliveries when the limit parameter is not given
+	defaultEmailPageSize = 100
+)
+
+// usersHandler returns a page of the users matching the username, email, type and organization parameters.
+// The total number of matches is returned in the X-Total-Count header.
+func (ac *AppContext) usersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := &domain.UserFilter{Username: q.Get("username"), Email: q.Get("email"), Organization: q.Get("organization"), Limit: defaultUserPageSize}
+	if t := q.Get("type"); t != "" {
+		userType, err := strconv.Atoi(t)
+		if err != nil {
+			WriteError(w, ErrBadRequest)
+			return
+		}
+		f.Type = (*domain.UserType)(&userType)
+	}
+	var err error
+	if v := q.Get("offset"); v != "" {
+		if f.Offset, err = strconv.Atoi(v); err != nil || f.Offset < 0 {
+			WriteError(w, ErrBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > domain.MaxUserPageSize {
+			WriteError(w, ErrBadRequest)
+			return
+		}
+	}
+	users, total, err := ac.r.SearchUsers(f)
+	if err != nil {
+		log.WithError(err).Error("Unable to search users")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if users == nil {
+		users = []domain.User{}
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeWithFilter(w, users, domain.UserFilterFields...)
+}
+
+// userDetailsHandler returns the user given in the username parameter with its tokens, recent downloads, sessions
+// and emails
+func (ac *AppContext) userDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	u, err := ac.r.User(username)
+	if err == repo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to load user %s", username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	details := &domain.UserDetails{User: u}
+	if u.Token != "" {
+		if details.Token, err = ac.r.Token(u.Token); err != nil && err != repo.ErrNotFound {
+			log.WithError(err).Errorf("Unable to load token of %s", username)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+	}
+	if details.IssuedTokens, err = ac.r.SearchTokens(&domain.TokenFilter{CreatedBy: username, All: true}); err != nil {
+		log.WithError(err).Errorf("Unable to load tokens issued by %s", username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if details.Downloads, err = ac.r.UserDownloadLog(username, userDetailsDownloads); err != nil {
+		log.WithError(err).Errorf("Unable to load downloads of %s", username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if details.Sessions, err = ac.r.Sessions(username); err != nil {
+		log.WithError(err).Errorf("Unable to load sessions of %s", username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if details.Emails, err = ac.r.EmailDeliveries(&domain.EmailFilter{Username: username, Limit: userDetailsEmails}); err != nil {
+		log.WithError(err).Errorf("Unable to load emails of %s", username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	filters := make([]string, len(domain.UserFilterFields))
+	for i, f := range domain.UserFilterFields {
+		filters[i] = "user." + f
+	}
+	writeWithFilter(w, details, filters...)
+}
+
+// emailsHandler returns the most recent email deliveries matching the username, recipient and status parameters
+func (ac *AppContext) emailsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := &domain.EmailFilter{Username: q.Get("username"), Recipient: q.Get("recipient"), Status: q.Get("status"), Limit: defaultEmailPageSize}
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > domain.MaxEmailPageSize {
+			WriteError(w, ErrBadRequest)
+			return
+		}
+	}
+	emails, err := ac.r.EmailDeliveries(f)
+	if err != nil {
+		log.WithError(err).Error("Unable to load email deliveries")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if emails == nil {
+		emails = []domain.EmailDelivery{}
+	}
+	writeJSON(w, emails)
+}
@@ -0,0 +1,317 @@
+package web
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/repo"
+	"github.com/gorilla/context"
+)
+
+const (
+	// webAuthnCookie holds the encrypted ID of the ceremony in progress
+	webAuthnCookie = `SDWA`
+	// webAuthnTimeout is how long the user has to complete a ceremony
+	webAuthnTimeout = 5 * time.Minute
+)
+
+// webAuthnResponse is the PublicKeyCredential returned by the browser with base64url encoded buffers
+type webAuthnResponse struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	} `json:"response"`
+}
+
+type webAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// decodeBuffer decodes base64url with or without padding
+func decodeBuffer(val string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(val, "="))
+}
+
+// relyingParty based on the configured origin
+func relyingParty() (*domain.RelyingParty, error) {
+	origin := conf.Options.Security.WebAuthnOrigin
+	if origin == "" {
+		origin = conf.Options.ExternalAddress
+	}
+	u, err := url.Parse(strings.TrimRight(origin, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("WebAuthn origin is not configured")
+	}
+	return &domain.RelyingParty{ID: u.Hostname(), Origin: u.Scheme + "://" + u.Host, Name: domain.TOTPIssuer}, nil
+}
+
+// startCeremony stores a new ceremony with its challenge, sets its ID in the cookie and returns the challenge
+func (ac *AppContext) startCeremony(w http.ResponseWriter, username, ceremonyType string) (string, error) {
+	c := domain.NewWebAuthnCeremony(username, ceremonyType, webAuthnTimeout)
+	val, err := sealCookie(c.ID)
+	if err != nil {
+		return "", err
+	}
+	if err = ac.r.AddWebAuthnCeremony(c); err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     webAuthnCookie,
+		Value:    val,
+		Path:     "/",
+		Expires:  c.ExpiresAt,
+		MaxAge:   int(webAuthnTimeout.Seconds()),
+		Secure:   conf.Options.SSL.Key != "",
+		HttpOnly: true,
+	})
+	return c.Challenge, nil
+}
+
+// finishCeremony returns the ceremony in progress of the given type and deletes it from the database so the challenge
+// cannot be used again, even with a copy of the cookie
+func (ac *AppContext) finishCeremony(w http.ResponseWriter, r *http.Request, ceremonyType string) (*domain.WebAuthnCeremony, *Error) {
+	cookie, err := r.Cookie(webAuthnCookie)
+	if err != nil {
+		return nil, ErrWebAuthn
+	}
+	http.SetCookie(w, &http.Cookie{Name: webAuthnCookie, Value: "", Path: "/", Expires: time.Now(), MaxAge: -1, Secure: conf.Options.SSL.Key != "", HttpOnly: true})
+	var id string
+	if err = openCookie(cookie.Value, &id); err != nil {
+		return nil, ErrWebAuthn
+	}
+	c, err := ac.r.UseWebAuthnCeremony(id)
+	if err == repo.ErrNotFound {
+		log.Warnf("WebAuthn ceremony %s was already used or does not exist", ceremonyType)
+		return nil, ErrWebAuthn
+	} else if err != nil {
+		log.WithError(err).Error("Unable to load WebAuthn ceremony")
+		return nil, ErrInternalServer
+	}
+	if c.Type != ceremonyType || !time.Now().Before(c.ExpiresAt) {
+		return nil, ErrWebAuthn
+	}
+	return c, nil
+}
+
+// credentialDescriptors of the user credentials for the options
+func (ac *AppContext) credentialDescriptors(username string) ([]webAuthnCredentialDescriptor, error) {
+	creds, err := ac.r.WebAuthnCredentials(username)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]webAuthnCredentialDescriptor, 0, len(creds))
+	for _, c := range creds {
+		res = append(res, webAuthnCredentialDescriptor{Type: "public-key", ID: c.ID})
+	}
+	return res, nil
+}
+
+// beginWebAuthnRegistrationHandler returns the options for navigator.credentials.create()
+func (ac *AppContext) beginWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	u := context.Get(r, "user").(*domain.User)
+	rp, err := relyingParty()
+	if err != nil {
+		log.WithError(err).Error("Unable to start WebAuthn ceremony")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	exclude, err := ac.credentialDescriptors(u.Username)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to load WebAuthn credentials of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	challenge, err := ac.startCeremony(w, u.Username, "webauthn.create")
+	if err != nil {
+		log.WithError(err).Error("Unable to start WebAuthn registration")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	params := make([]map[string]interface{}, 0, len(domain.WebAuthnAlgorithms))
+	for _, alg := range domain.WebAuthnAlgorithms {
+		params = append(params, map[string]interface{}{"type": "public-key", "alg": alg})
+	}
+	writeJSON(w, map[string]interface{}{
+		"rp":                     map[string]string{"id": rp.ID, "name": rp.Name},
+		"user":                   map[string]string{"id": base64.RawURLEncoding.EncodeToString([]byte(u.Username)), "name": u.Username, "displayName": u.Name},
+		"challenge":              base64.RawURLEncoding.EncodeToString([]byte(challenge)),
+		"pubKeyCredParams":       params,
+		"timeout":                webAuthnTimeout / time.Millisecond,
+		"attestation":            "none",
+		"excludeCredentials":     exclude,
+		"authenticatorSelection": map[string]string{"residentKey": "preferred", "userVerification": "required"},
+	})
+}
+
+// finishWebAuthnRegistrationHandler verifies the new credential and stores it for the user
+func (ac *AppContext) finishWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	resp := context.Get(r, "body").(*webAuthnResponse)
+	u := context.Get(r, "user").(*domain.User)
+	c, e := ac.finishCeremony(w, r, "webauthn.create")
+	if e != nil {
+		WriteError(w, e)
+		return
+	}
+	if c.Username != u.Username {
+		WriteError(w, ErrWebAuthn)
+		return
+	}
+	rp, err := relyingParty()
+	if err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	clientDataJSON, err1 := decodeBuffer(resp.Response.ClientDataJSON)
+	attestationObject, err2 := decodeBuffer(resp.Response.AttestationObject)
+	if err1 != nil || err2 != nil {
+		WriteError(w, ErrBadRequest)
+		return
+	}
+	cred, err := rp.VerifyRegistration(c.Challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		log.WithError(err).Warnf("Invalid WebAuthn registration for %s", u.Username)
+		WriteError(w, ErrWebAuthn)
+		return
+	}
+	cred.Username, cred.Name = u.Username, resp.Name
+	if err = ac.r.AddWebAuthnCredential(cred); err != nil {
+		log.WithError(err).Errorf("Unable to save WebAuthn credential of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	log.Infof("User %s registered WebAuthn credential [%s]", u.Username, cred.Name)
+	writeJSON(w, cred)
+}
+
+// webAuthnCredentialsHandler lists the credentials of the current user
+func (ac *AppContext) webAuthnCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	u := context.Get(r, "user").(*domain.User)
+	creds, err := ac.r.WebAuthnCredentials(u.Username)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to load WebAuthn credentials of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	writeJSON(w, creds)
+}
+
+// deleteWebAuthnCredentialHandler removes a credential of the current user
+func (ac *AppContext) deleteWebAuthnCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	cred := context.Get(r, "body").(*domain.WebAuthnCredential)
+	u := context.Get(r, "user").(*domain.User)
+	if err := ac.r.DeleteWebAuthnCredential(u.Username, cred.ID); err != nil {
+		log.WithError(err).Errorf("Unable to delete WebAuthn credential of %s", u.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// beginWebAuthnLoginHandler returns the options for navigator.credentials.get(). Without a username,
+// the authenticator offers its discoverable credentials (passkeys).
+func (ac *AppContext) beginWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	creds := context.Get(r, "body").(*credentials)
+	rp, err := relyingParty()
+	if err != nil {
+		log.WithError(err).Error("Unable to start WebAuthn ceremony")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	allow := []webAuthnCredentialDescriptor{}
+	if creds.User != "" {
+		if allow, err = ac.credentialDescriptors(creds.User); err != nil {
+			log.WithError(err).Errorf("Unable to load WebAuthn credentials of %s", creds.User)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+	}
+	challenge, err := ac.startCeremony(w, creds.User, "webauthn.get")
+	if err != nil {
+		log.WithError(err).Error("Unable to start WebAuthn login")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"rpId":             rp.ID,
+		"challenge":        base64.RawURLEncoding.EncodeToString([]byte(challenge)),
+		"timeout":          webAuthnTimeout / time.Millisecond,
+		"allowCredentials": allow,
+		"userVerification": "required",
+	})
+}
+
+// finishWebAuthnLoginHandler verifies the assertion and logs the credential owner in
+func (ac *AppContext) finishWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	resp := context.Get(r, "body").(*webAuthnResponse)
+	c, e := ac.finishCeremony(w, r, "webauthn.get")
+	if e != nil {
+		WriteError(w, e)
+		return
+	}
+	rp, err := relyingParty()
+	if err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if ac.loginThrottled(w, r, c.Username) {
+		return
+	}
+	cred, err := ac.r.WebAuthnCredential(resp.ID)
+	if err == repo.ErrNotFound || err == nil && c.Username != "" && c.Username != cred.Username {
+		ac.loginFailed(r, c.Username)
+		WriteError(w, ErrWebAuthn)
+		return
+	} else if err != nil {
+		log.WithError(err).Error("Unable to load WebAuthn credential")
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	clientDataJSON, err1 := decodeBuffer(resp.Response.ClientDataJSON)
+	authData, err2 := decodeBuffer(resp.Response.AuthenticatorData)
+	signature, err3 := decodeBuffer(resp.Response.Signature)
+	if err1 != nil || err2 != nil || err3 != nil {
+		WriteError(w, ErrBadRequest)
+		return
+	}
+	if err = rp.VerifyAssertion(cred, c.Challenge, clientDataJSON, authData, signature); err != nil {
+		log.WithError(err).Warnf("Invalid WebAuthn login for %s", cred.Username)
+		ac.loginFailed(r, cred.Username)
+		WriteError(w, ErrWebAuthn)
+		return
+	}
+	// The counter is only saved if it is still higher than the stored one so racing replays cannot both succeed
+	if err = ac.r.UpdateWebAuthnCredential(cred); err == domain.ErrWebAuthnCloned {
+		log.Warnf("Replayed WebAuthn login for %s", cred.Username)
+		ac.loginFailed(r, cred.Username)
+		WriteError(w, ErrWebAuthn)
+		return
+	} else if err != nil {
+		log.WithError(err).Errorf("Unable to update WebAuthn credential of %s", cred.Username)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	u, err := ac.r.User(cred.Username)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to load user %s of WebAuthn credential", cred.Username)
+		WriteError(w, ErrAuth)
+		return
+	}
+	ac.loginSucceeded(cred.Username)
+	// A passkey is already a second factor so TOTP is not required
+	ac.loginResponse(w, r, u)
+}
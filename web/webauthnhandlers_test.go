@@ -0,0 +1,84 @@
+package web
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/demisto/download/conf"
+	"github.com/demisto/download/domain"
+	"github.com/demisto/download/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebAuthnChallengeReplay(t *testing.T) {
+	f := newHandlerFixture(t)
+	defer f.Close()
+	conf.Options.Security.WebAuthnOrigin = "https://download.demisto.com"
+	defer func() { conf.Options.Security.WebAuthnOrigin = "" }()
+
+	// A passkey without a signature counter so only the challenge prevents replays
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cose, err := util.MarshalCBOR(util.CBORMap{{1, 2}, {3, -7}, {-1, 1}, {-2, key.X.FillBytes(make([]byte, 32))}, {-3, key.Y.FillBytes(make([]byte, 32))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred := &domain.WebAuthnCredential{ID: "replayed-passkey", Username: "slavik", PublicKey: cose}
+	f.r.DeleteWebAuthnCredential(cred.Username, cred.ID)
+	if err = f.r.AddWebAuthnCredential(cred); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "http://demisto.com/login/webauthn", bytes.NewBufferString(`{"user":"slavik"}`))
+	f.sendRequest(req, false, "")
+	if f.response.Code != http.StatusOK {
+		t.Fatalf("Unable to start WebAuthn login - %v %v", f.response.Code, f.response.Body)
+	}
+	var cookie *http.Cookie
+	for _, c := range f.response.Result().Cookies() {
+		if c.Name == webAuthnCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("No WebAuthn cookie was set")
+	}
+	var options struct {
+		Challenge string `json:"challenge"`
+	}
+	if err = json.NewDecoder(f.response.Body).Decode(&options); err != nil {
+		t.Fatal(err)
+	}
+
+	clientDataJSON, _ := json.Marshal(map[string]string{"type": "webauthn.get", "challenge": options.Challenge, "origin": "https://download.demisto.com"})
+	rpIDHash := sha256.Sum256([]byte("download.demisto.com"))
+	// User present and verified with a zero counter
+	authData := append(rpIDHash[:], 0x05, 0, 0, 0, 0)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &webAuthnResponse{ID: cred.ID}
+	resp.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientDataJSON)
+	resp.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	resp.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	body, _ := json.Marshal(resp)
+
+	for i, status := range []int{http.StatusOK, ErrWebAuthn.Status} {
+		req, _ = http.NewRequest("POST", "http://demisto.com/login/webauthn/finish", bytes.NewBuffer(body))
+		req.AddCookie(cookie)
+		f.sendRequest(req, false, "")
+		assert.Equal(t, status, f.response.Code, "attempt %d - %v", i+1, f.response.Body)
+	}
+}